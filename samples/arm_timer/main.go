@@ -21,7 +21,7 @@ func main() {
 	machine.MiniUART.Configure(&machine.UARTConfig{RXInterrupt: true})
 	writer = &machine.MiniUARTWriter{}
 	c.Logf("offset of IRQPending1 %x", unsafe.Offsetof(machine.IC.Pending1))
-	machine.IC.Enable1.SetAux()
+	machine.IRQAux.Enable()
 	machine.QA7.LocalInterrupt.SetCore0IRQ()
 
 	//arm64.QuadA7.LocalInterruptRouting.Set(0)
@@ -3,6 +3,7 @@ package main
 import (
 	"machine"
 
+	"lib/mmu"
 	"lib/trust"
 	"lib/upbeat"
 
@@ -120,23 +121,9 @@ func main() {
 		(MemoryNoCacheValue << (MemoryNoCache * 8)) |
 		(MemoryNormalValue << (MemoryNormal * 8))))
 
-	// zero on these fields
-	// TBI - no tag bits
-	// IPS - 32 bit (4GB)
-	// EPD1 - enable walks in kernel
-	// EPD0 - enable walks in userspc
+	// 64K granules and 42 bit address spaces, see memoryLayout
 	//TCR REG https://developer.arm.com/docs/ddi0595/b/aarch64-system-registers/tcr_el1
-
-	TCREL1Val := uint64(((0b11 << 30) | // granule size in kernel
-		(0b11 << 28) | // inner shareable
-		(0b01 << 26) | // write back (outer)
-		(0b01 << 24) | // write back (inner)
-		(22 << 16) | //22 is T1SZ, 42bit addr space (same as example https://developer.arm.com/docs/den0024/latest/the-memory-management-unit/translating-a-virtual-address-to-a-physical-address)
-		(0b1 << 14) | // granule size in user
-		(0b11 << 12) | //inner shareable
-		(0b01 << 10) | //write back (outer)
-		(0b01 << 8) | //write back (inner)
-		(22 << 0))) //22 is T0SZ, 42 bit addr space
+	TCREL1Val := memoryLayout.TCR()
 
 	// Undocumented TTBRCNP from BZT's tutorial....
 	//TTBR0Val := uint64((0x100000 << 7) | UndocumentedTTBRCNP) //base addr 0x10_0000, no other shenanigans
@@ -150,55 +137,14 @@ func main() {
 		(1 << 1) | //  Alignment check enable
 		(1 << 0)) // MMU ENABLED!! THE BIG DOG
 
-	//we don't use level 1 because we have 42 bit address and 64k granules
-	sizeOfLevel2 := uintptr(0x1_0000) //8192 entries (only 4 in use, the lowest 4)
-	sizeOfLevel3 := uintptr(0x1_0000) //8192 entries
-
-	//level 2 table has 8192 entries selected by bits 41:29 but we are only interested in bits
-	//29 and 30 because the rest are always the same... so we need to point to 4 different level
-	//3 tables in the lowest positions
-	root := uintptr(0x1_0000)
-
-	logger.Infof("Setting up level 2 table (8192 entries) @ 0x%016x", root)
-	level2Ptr := root
-	level3PtrsBase := root + sizeOfLevel2
-	logger.Infof("level 3 tables begin at 0x%016x", level3PtrsBase)
-	for i := uintptr(0); i < 8192; i++ { //fill in entries to cause a fault
-		//entries are bad other than first 4
-		asUint64 := (*uint64)(unsafe.Pointer(level2Ptr + (i * 8))) //8 bytes entry
-		if i < 4 {                                                 //4 entries means we have 4x32bits or 4x4GB or 64GB addr space
-			target := level3PtrsBase + (i * sizeOfLevel3)
-			*asUint64 = makeTableEntry(target)
-			logger.Infof("level 2, entry %d (@ 0x%016x) is 0x%016x (0x%016x)", i, asUint64, target, *asUint64)
-			continue
-		}
-		*asUint64 = makeBadEntry()
+	if err := memoryLayout.AddDevices(machine.MemoryMap, machineAttrs); err != nil {
+		panic("unable to map devices: " + err.Error())
 	}
-
-	for i := uintptr(0); i < 4; i++ {
-		level3Ptr := level3PtrsBase + (i * sizeOfLevel3)
-		logger.Infof("Setting up level 3 table %d (8192 entries) @ 0x%016x", i, level3Ptr)
-		for j := uintptr(0); j < 8192; j++ { //12 bits
-			asUint64 := ((*uint64)(unsafe.Pointer(level3Ptr + (j * 8)))) //8 bytes entry
-			target := (i << 29) | (j << 16)                              //j only has 12 bits, so these don't overlap
-			memType := uint64(MemoryNormal)
-			if target >= 0x3C00_0000 && target < 0x3F00_0000 { //framebuffer
-				memType = MemoryNoCache
-			}
-			if target >= 0x3F00_0000 && target < 0x4_0000_0000 { //peripherals
-				memType = MemoryDeviceNoGatherNoReorderNoEarlyWriteAck
-			}
-			if target >= 0x4_0000_0000 && target < 0x4_0000_0100 { //local peripherals, qa7
-				memType = MemoryDeviceNoGatherNoReorderNoEarlyWriteAck
-			}
-			if target >= 0x4_0000_0100 { // bad mojo
-				*asUint64 = makeBadEntry()
-				continue
-			}
-			//make the physical block entry
-			*asUint64 = makePhysicalBlockEntry(target, memType)
-		}
+	root, end, err := memoryLayout.Build(mmu.Physical{}, TTBR0Val)
+	if err != nil {
+		panic("unable to build page tables: " + err.Error())
 	}
+	logger.Infof("page tables from 0x%016x to 0x%016x", root, end)
 
 	//go live!
 	logger.Infof("going live!")
@@ -218,9 +164,10 @@ func main() {
 	logger.Debugf("self test start of vc4ram 0x3C000000 = 0x%16x", selfTest(0x3C000000))
 	logger.Debugf("self test end of vc4ram   0x3EFFFFFF = 0x%16x", selfTest(0x3EFFFFFF))
 	logger.Debugf("self test start of perpih 0x3F000000 = 0x%16x", selfTest(0x3F000000))
+	logger.Debugf("self test emmc            0x3F300000 = 0x%16x", selfTest(0x3F300000))
 	logger.Debugf("self test end of periph   0x3FFFFFFF = 0x%16x", selfTest(0x3FFFFFFF))
 	logger.Debugf("self test start of mbox   0x40000000 = 0x%16x", selfTest(0x40000000))
-	logger.Debugf("self test end of mbox     0x401FFFFF = 0x%16x", selfTest(0x401FFFFF))
+	logger.Debugf("self test end of qa7      0x4000FFFF = 0x%16x", selfTest(0x4000FFFF))
 	kernelBase := uintptr(0x3000_0000 | isKernelAddrMask)
 	logger.Debugf("self test kbase   0x%016x = 0x%16x", kernelBase, selfTest(kernelBase))
 
@@ -243,94 +190,40 @@ func main() {
 	}
 }
 
-// bits 41:29 are the index area of VA in L2
-const l2IndexArea = 0x3FF_E000_0000
-
-// bits 28:16 are the index area of VA in L3
-const l3IndexArea = 0x1FFF_0000
-
-// bits 15:0 are the index area into real block
-const physIndexArea = 0xFFFF
-
-// bits 47:16 are the PTR area of L3
-const ptrArea = 0xFFFF_FFFF_0000
+//the same tables are used for both halves of the address space, so the
+//kernel half (isKernelAddrMask) sees the same thing.  main adds the devices
+//from the machine package's MemoryMap (which comes from the sysdec
+//descriptions)
+var memoryLayout = mmu.Layout{
+	Granule: mmu.Granule64K,
+	VABits:  42,
+	Regions: []mmu.Region{
+		{Name: "ram", VA: 0, PA: 0, Size: 0x3C00_0000, Attr: MemoryNormal},
+	},
+}
 
-const noLower16 = ^uint64(0xffff)
+//machineAttrs is the MAIR index for each of machine's MemoryAttrs
+var machineAttrs = []uint64{
+	machine.MemoryDevice:  MemoryDeviceNoGatherNoReorderNoEarlyWriteAck,
+	machine.MemoryNoCache: MemoryNoCache,
+	machine.MemoryNormal:  MemoryNormal,
+}
 
+// selfTest walks the tables, like the MMU will, to see where va ends up
 func selfTest(va uintptr) uint64 {
-	ttbr := uintptr(TTBR0Val)
+	ttbr := TTBR0Val
 	if va&isKernelAddrMask != 0 {
-		ttbr = uintptr(TTBR1Val)
-	}
-	//logger.Debugf("entering self test with va %x", va)
-	index := (va & l2IndexArea) >> 29 //bits 41:29
-	asUint64 := ((*uint64)(unsafe.Pointer(ttbr + (index * 8))))
-	if uintptr(*asUint64)&uintptr(1) == 0 {
-		logger.Errorf("!!!!!hit a TBL entry that doesn't point to anything 0x%016x", asUint64)
+		ttbr = TTBR1Val
 	}
-	level3Ptr := uintptr((*asUint64)) & ptrArea //points to BASE of next table
-	index = (va & l3IndexArea) >> 16            //pull out the index in this table
-	asUint64 = ((*uint64)(unsafe.Pointer(level3Ptr + (index * 8))))
-	if uintptr(*asUint64)&uintptr(1) == 0 {
-		logger.Errorf("!!!!!hit a PHYS entry that doesn't point to anything 0x%016x", asUint64)
+	pa, _, _, ok := memoryLayout.Walk(mmu.Physical{}, ttbr, uint64(va))
+	if !ok {
+		logger.Errorf("!!!!!0x%016x isn't mapped", va)
 	}
-	maskedEntry := (*asUint64 & noLower16)
-	//logger.Debugf("table ptr %x table value %x (masked %x) and lower 16 %x\n", asUint64, *asUint64, maskedEntry, va&physIndexArea)
-	return maskedEntry | uint64(va&physIndexArea) //could do + here but these don't overlap
+	return pa
 }
 
-const noLast16 = 0xffff_ffff_ffff_0000
-
 const isKernelAddrMask = 0xffff_fc00_0000_0000
 
-func makeTableEntry(destination uintptr) uint64 {
-
-	//low 2 bits as 0b11
-	//bits 5:2 are index into mair table (4 bits to ref which one)
-	//bits 7:6 el0 no read, no write (no read 0b01, no write 0b10)
-	//bits 9:8 inner and outer shareable (inner 0b11, outer 0b10)
-	//bit 10 AF flag, lets OS know if page is first accessed if 0
-	//bits 47:16 address (32 bits, because we are 64K granules)
-	result := uint64(
-		uint64(1<<63) | //secure state?!? why is it needed?
-			uint64(destination&noLast16) | //address of the _BASE_ of next table, just a mask because >>16 and then <<16
-			uint64(3<<0)) //last two bits indicate page tbl
-	return result
-}
-
-func makeBadEntry() uint64 {
-	//*ANY* entry in a page table must have the last bit high, so 0 is always bad (easy!)
-	return 0
-}
-
-var ok = false
-
-// mair index == MemoryNormal
-// mair index == MemoryNoCache for video ram
-// mair index == MemoryDeviceNoGatherNoReorderNoEarlyWriteAckValue for device memory
-// destination is top 32 bits of final memory location
-func makePhysicalBlockEntry(destination uintptr, mairIndex uint64) uint64 {
-
-	//https://armv8-ref.codingbelief.com/en/chapter_d4/d44_1_memory_access_control.html
-	//we have SCTLR_EL1.WXN =0
-	//we have AP set to 0b00
-	//we have UXN set to 0
-	//we have PXN set to 0
-	//this implies: RWX from EL1, X only from EL0
-
-	result := uint64(
-		uint64(destination&noLast16) | //address of the PAGE, without low order
-			//no use of bit 11, this controls if access in per process id
-			(0b1 << 10) | //we are not yet using the ACCESS flag
-			(0b1 << 5) | //non-secure
-			(mairIndex&0x7)<<2 | // index in the MAIR register
-			uint64(0b11<<0)) //last two bits are 0b11 to indicate block entry
-	//note: last two bits are 0b01 *IF* you are not at level 3 of translation
-	//note: at level3, there is this special encoding and we are at level 3
-	//https://armv8-ref.codingbelief.com/en/chapter_d4/d43_2_armv8_translation_table_level_3_descriptor_formats.html
-	return result
-}
-
 // func main() {
 // 	rt.MiniUART = rt.NewUART()
 // 	_ = rt.MiniUART.Configure(rt.UARTConfig{ /*no interrupt*/ })
@@ -21,7 +21,7 @@ func main() {
 	machine.MiniUART.Configure(&machine.UARTConfig{RXInterrupt: true})
 
 	//tell the Interrupt controlller what's going on
-	machine.IC.Enable1.SetAux()
+	machine.IRQAux.Enable()
 
 	//Configure the local timer
 	//On qemu, you have to be sure set the timer enable AFTER the
@@ -30,12 +30,14 @@ func main() {
 	// function bcm2836_control_local_timer_set_next,
 	// file /Users/iansmith/rpi3/src/qemu-5.0.0/hw/intc/bcm2836_control.c, line 201.
 
-	machine.QA7.LocalTimerControl.SetInterruptEnable()
-	machine.QA7.LocalTimerControl.SetReloadValue(period)
-	machine.QA7.LocalTimerControl.SetTimerEnable()
+	machine.QA7.LocalTimerControl.Modify(func(v *machine.LocalTimerControlValue) {
+		v.SetInterruptEnable()
+		v.SetReloadValue(period)
+		v.SetTimerEnable()
+	})
 
 	//route BOTH local timer and GPU to core 0 on IRQ
-	machine.QA7.GPUInterruptRouting.IRQToCore0()
+	machine.QA7.GPUInterruptRouting.SetIRQToCore0()
 	machine.QA7.LocalInterrupt.SetCore0IRQ()
 
 	//Tell Core0 which interrupts to consume
@@ -0,0 +1,208 @@
+package anticipation
+
+//
+// Binary framing is an alternative to the ascii intel hex encoding that
+// roughly halves the number of bytes on the wire.  The records carried
+// are exactly the same as the converted form of a hex line (length, 16 bit
+// address, line type, payload) so ProcessLine works on them unchanged.
+// Only the wrapping is different:
+//
+//   FrameDelimiter | escaped(length addrHi addrLo type payload... crc32) | FrameDelimiter
+//
+// The crc32 is the IEEE one, big-endian, computed over everything before it.
+// Any FrameDelimiter, FrameEscape or newline in the body is sent as FrameEscape
+// followed by the byte XOR'd with FrameEscapeXor.  Escaping the newline means
+// a frame can never be mistaken for the end of a hex line.
+//
+// In windowed mode (see ExtensionWindow) the body of each frame starts with
+// an extra byte, the sequence number, and the crc covers it too.
+//
+// The sender asks for binary framing by sending an ExtensionBinaryFraming
+// hex line carrying FramingVersion.  A device that understands it acks the
+// line and expects frames from then on; one that doesn't will nak the line
+// and the sender sticks with hex.
+//
+
+const (
+	FrameDelimiter = 0x7e
+	FrameEscape    = 0x7d
+	FrameEscapeXor = 0x20
+)
+
+// the version of the framing we speak, sent in the ExtensionBinaryFraming line
+const FramingVersion = 1
+
+// largest frame body: 4 bytes of header, 255 of payload, 4 of crc
+const FrameMaxSize = 4 + 0xff + 4
+
+const crc32IEEE = 0xedb88320
+
+// crc32Update is the bitwise (table-free) version of the IEEE crc32, we
+// don't want to bother with hash/crc32 on the device
+func crc32Update(crc uint32, data []byte) uint32 {
+	crc = ^crc
+	for _, b := range data {
+		crc ^= uint32(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 == 1 {
+				crc = (crc >> 1) ^ crc32IEEE
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return ^crc
+}
+
+func needsEscape(b byte) bool {
+	return b == FrameDelimiter || b == FrameEscape || b == 10
+}
+
+// EncodeFrame wraps a converted record (length, address, type, payload) in a
+// binary frame ready to be put on the wire.  Anything past the payload (like
+// the hex checksum) is ignored.
+func EncodeFrame(converted []byte) []byte {
+	return encodeFrame(converted[:4+int(converted[0])])
+}
+
+// EncodeSequencedFrame is EncodeFrame for windowed mode
+func EncodeSequencedFrame(seq uint8, converted []byte) []byte {
+	body := make([]byte, 0, 5+int(converted[0]))
+	body = append(body, seq)
+	body = append(body, converted[:4+int(converted[0])]...)
+	return encodeFrame(body)
+}
+
+func encodeFrame(body []byte) []byte {
+	crc := crc32Update(0, body)
+	result := make([]byte, 0, 2+2*(len(body)+4))
+	result = append(result, FrameDelimiter)
+	for _, b := range body {
+		result = appendEscaped(result, b)
+	}
+	for p := 3; p >= 0; p-- {
+		result = appendEscaped(result, byte(crc>>(8*p)))
+	}
+	result = append(result, FrameDelimiter)
+	return result
+}
+
+func appendEscaped(buf []byte, b byte) []byte {
+	if needsEscape(b) {
+		return append(buf, FrameEscape, b^FrameEscapeXor)
+	}
+	return append(buf, b)
+}
+
+// HexLineToFrame converts one hex line into the equivalent binary frame
+func HexLineToFrame(s string) ([]byte, error) {
+	converted, _, _, err := DecodeAndCheckStringToBytes(s)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeFrame(converted), nil
+}
+
+// HexLineToSequencedFrame is HexLineToFrame for windowed mode
+func HexLineToSequencedFrame(seq uint8, s string) ([]byte, error) {
+	converted, _, _, err := DecodeAndCheckStringToBytes(s)
+	if err != nil {
+		return nil, err
+	}
+	return EncodeSequencedFrame(seq, converted), nil
+}
+
+// FrameDecoder pulls frames out of a stream of bytes, one byte at a time.
+// This is intended to be fed from an interrupt handler so it does not
+// allocate once created.
+type FrameDecoder struct {
+	buffer    []byte
+	count     int
+	inFrame   bool
+	escaped   bool
+	dropped   bool
+	sequenced bool
+	seq       uint8
+}
+
+func NewFrameDecoder() *FrameDecoder {
+	return &FrameDecoder{buffer: make([]byte, FrameMaxSize+1)}
+}
+
+// SetSequenced tells the decoder that frames carry a sequence number
+func (f *FrameDecoder) SetSequenced(b bool) {
+	f.sequenced = b
+}
+
+// Sequence is the sequence number of the last good frame, if sequenced
+func (f *FrameDecoder) Sequence() uint8 {
+	return f.seq
+}
+
+// Feed adds the byte b to the frame in progress.  When b finishes a frame
+// the converted record is returned along with true.  The returned slice is
+// only valid until the next call to Feed.  If the frame was bad (too long,
+// bad length, or bad crc) the error is returned with true.
+func (f *FrameDecoder) Feed(b byte) ([]byte, bool, error) {
+	if b == FrameDelimiter {
+		if !f.inFrame || f.count == 0 {
+			//start of frame (or back to back delimiters, which are harmless)
+			f.inFrame = true
+			f.count = 0
+			f.escaped = false
+			f.dropped = false
+			return nil, false, nil
+		}
+		f.inFrame = false
+		converted, err := f.check()
+		return converted, true, err
+	}
+	if !f.inFrame {
+		return nil, false, nil //noise between frames
+	}
+	if b == FrameEscape {
+		f.escaped = true
+		return nil, false, nil
+	}
+	if f.escaped {
+		b ^= FrameEscapeXor
+		f.escaped = false
+	}
+	if f.count == len(f.buffer) {
+		f.dropped = true
+		return nil, false, nil
+	}
+	f.buffer[f.count] = b
+	f.count++
+	return nil, false, nil
+}
+
+func (f *FrameDecoder) check() ([]byte, error) {
+	if f.dropped {
+		return nil, NewEncodeDecodeError("frame too large")
+	}
+	header := 0
+	if f.sequenced {
+		header = 1
+	}
+	if f.count < 8+header {
+		return nil, NewEncodeDecodeError("frame too short")
+	}
+	covered := f.buffer[:f.count-4]
+	body := covered[header:]
+	if len(body) != 4+int(body[0]) {
+		return nil, NewEncodeDecodeError("frame length does not match its contents")
+	}
+	crcBytes := f.buffer[f.count-4 : f.count]
+	crc := uint32(crcBytes[0])<<24 | uint32(crcBytes[1])<<16 | uint32(crcBytes[2])<<8 | uint32(crcBytes[3])
+	if crc32Update(0, covered) != crc {
+		return nil, NewEncodeDecodeError("bad frame crc")
+	}
+	if f.sequenced {
+		f.seq = covered[0]
+	}
+	if _, ok := ExtractLineType(body); !ok {
+		return nil, NewEncodeDecodeError("bad frame line type")
+	}
+	return body, nil
+}
@@ -0,0 +1,168 @@
+package anticipation
+
+import (
+	"bytes"
+	"hash/crc32"
+	"testing"
+)
+
+func TestCRCMatchesLibrary(t *testing.T) {
+	data := []byte("feelings from scratch, anticipation bootloader")
+	if crc32Update(0, data) != crc32.ChecksumIEEE(data) {
+		t.Errorf("crc32 mismatch: expected %08x but got %08x", crc32.ChecksumIEEE(data), crc32Update(0, data))
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	lines := []string{
+		":0B0010006164647265737320676170A7",
+		":020000021200EA",
+		":04000005000000CD2A",
+		":02000004FC0AF4",
+		":04000082DEADBEEF42",
+		":200000800001020304050607101112131415161720212223242526273031323334353637F0",
+		EncodeDataBytes([]byte{FrameDelimiter, FrameEscape, 10, 0, FrameDelimiter}, 0x7e7d),
+		EncodeBinaryFraming(FramingVersion),
+	}
+	dec := NewFrameDecoder()
+	for _, l := range lines {
+		expected, lt, _, err := DecodeAndCheckStringToBytes(l)
+		if err != nil {
+			t.Fatalf("unable to decode test line %s: %v", l, err)
+		}
+		frame, err := HexLineToFrame(l)
+		if err != nil {
+			t.Fatalf("unable to convert %s to a frame: %v", l, err)
+		}
+		if bytes.IndexByte(frame[1:len(frame)-1], FrameDelimiter) != -1 || bytes.IndexByte(frame, 10) != -1 {
+			t.Errorf("frame for %s has an unescaped delimiter or newline", l)
+		}
+		got := feedAll(t, dec, frame)
+		if !bytes.Equal(got, expected[:len(expected)-1]) {
+			t.Errorf("frame for %s decoded to %x", l, got)
+		}
+		gotLt, ok := ExtractLineType(got)
+		if !ok || gotLt != lt {
+			t.Errorf("frame for %s has wrong line type %s", l, gotLt)
+		}
+	}
+}
+
+func TestFrameIsSmaller(t *testing.T) {
+	data := make([]byte, 0x30)
+	for i := range data {
+		data[i] = byte(i * 3)
+	}
+	l := EncodeDataBytes(data, 0x100)
+	frame, err := HexLineToFrame(l)
+	if err != nil {
+		t.Fatalf("unable to convert line to frame: %v", err)
+	}
+	if len(frame) >= len(l)*2/3 {
+		t.Errorf("expected frame (%d bytes) to be much smaller than hex line (%d bytes)", len(frame), len(l))
+	}
+}
+
+func TestFrameIntoByteBuster(t *testing.T) {
+	values := []byte{97, 100, 100, 114, 101, 115, 115, 32, 103, 97, 112}
+	bb := newFakeByteBuster(values, 0x10)
+	dec := NewFrameDecoder()
+	for _, l := range []string{":020000021200EA", ":0B0010006164647265737320676170A7"} {
+		frame, _ := HexLineToFrame(l)
+		converted := feedAll(t, dec, frame)
+		lt, _ := ExtractLineType(converted)
+		hadError, _ := ProcessLine(lt, converted, bb)
+		if hadError {
+			t.Errorf("unexpected error processing frame for %s", l)
+		}
+	}
+	if !bb.FinishedOk() {
+		t.Errorf("wrong number of bytes written from frames")
+	}
+}
+
+func TestFrameCorruption(t *testing.T) {
+	frame, _ := HexLineToFrame(":0B0010006164647265737320676170A7")
+	bad := append([]byte{}, frame...)
+	bad[6] ^= 0x01
+	dec := NewFrameDecoder()
+	var err error
+	for _, b := range bad {
+		_, done, e := dec.Feed(b)
+		if done {
+			err = e
+		}
+	}
+	if err == nil {
+		t.Errorf("expected corrupted frame to fail crc check")
+	}
+	//decoder must recover and accept a good frame right after
+	if got := feedAll(t, dec, frame); got == nil {
+		t.Errorf("decoder did not recover after a bad frame")
+	}
+}
+
+func TestFrameNoise(t *testing.T) {
+	frame, _ := HexLineToFrame(":04000005000000CD2A")
+	stream := append([]byte("junk between frames"), frame...)
+	dec := NewFrameDecoder()
+	if got := feedAll(t, dec, stream); got == nil {
+		t.Errorf("expected to find a frame after noise")
+	}
+}
+
+func TestBinaryFramingVersion(t *testing.T) {
+	converted, lt, _, err := DecodeAndCheckStringToBytes(EncodeBinaryFraming(FramingVersion))
+	if err != nil || lt != ExtensionBinaryFraming {
+		t.Fatalf("unable to decode binary framing line: %v %s", err, lt)
+	}
+	if hadError, _ := ProcessLine(lt, converted, NewNullByteBuster()); hadError {
+		t.Errorf("expected our own framing version to be accepted")
+	}
+	converted, lt, _, _ = DecodeAndCheckStringToBytes(EncodeBinaryFraming(FramingVersion + 1))
+	if hadError, _ := ProcessLine(lt, converted, NewNullByteBuster()); !hadError {
+		t.Errorf("expected an unknown framing version to be rejected")
+	}
+}
+
+func TestSequencedFrame(t *testing.T) {
+	l := ":0B0010006164647265737320676170A7"
+	expected, _, _, _ := DecodeAndCheckStringToBytes(l)
+	frame, err := HexLineToSequencedFrame(0x7e, l) //seq needs escaping too
+	if err != nil {
+		t.Fatalf("unable to build sequenced frame: %v", err)
+	}
+	dec := NewFrameDecoder()
+	dec.SetSequenced(true)
+	got := feedAll(t, dec, frame)
+	if !bytes.Equal(got, expected[:len(expected)-1]) {
+		t.Errorf("sequenced frame decoded to %x", got)
+	}
+	if dec.Sequence() != 0x7e {
+		t.Errorf("expected sequence 0x7e but got %x", dec.Sequence())
+	}
+	//an unsequenced decoder must not accept it
+	plain := NewFrameDecoder()
+	for _, b := range frame {
+		if _, done, err := plain.Feed(b); done && err == nil {
+			t.Errorf("unsequenced decoder accepted a sequenced frame")
+		}
+	}
+}
+
+func feedAll(t *testing.T, dec *FrameDecoder, stream []byte) []byte {
+	t.Helper()
+	for _, b := range stream {
+		converted, done, err := dec.Feed(b)
+		if !done {
+			continue
+		}
+		if err != nil {
+			t.Errorf("unexpected frame error: %v", err)
+			return nil
+		}
+		return append([]byte{}, converted...)
+	}
+	t.Errorf("stream ended without a complete frame")
+	return nil
+}
@@ -1,9 +1,8 @@
 package anticipation
 
 import (
-	"log"
+	"crypto/ed25519"
 	"testing"
-	"unsafe"
 )
 
 //
@@ -12,6 +11,7 @@ import (
 //
 type byteBuster interface {
 	Write(addr uint64, value uint8) bool
+	Read(addr uint64) uint8 //what is in memory now, for differential reload
 	SetBaseAddr(addr uint32)
 	SetEntryPoint(addr uint32)
 	BaseAddress() uint64
@@ -21,6 +21,7 @@ type byteBuster interface {
 	SetBigBaseAddr(addr uint32)
 	SetParameter(i int, value uint64)
 	GetParameter(i int) uint64
+	SetImageDigest(sum []byte, sig []byte) //sig is nil if not signed
 }
 
 const entryPointSentinal = 0x22222
@@ -40,6 +41,8 @@ type fakeByteBuster struct {
 	entryPoint uint64
 	t          *testing.T
 	param      [4]uint64
+	digest     []byte
+	signature  []byte
 }
 
 func (f *fakeByteBuster) SetEntryPoint(addr uint32) {
@@ -54,6 +57,11 @@ func (f *fakeByteBuster) GetParameter(i int) uint64 {
 	return f.param[i]
 }
 
+func (f *fakeByteBuster) SetImageDigest(sum []byte, sig []byte) {
+	f.digest = sum
+	f.signature = sig
+}
+
 func (f *fakeByteBuster) SetBaseAddr(addr uint32) {
 	prev := f.baseAdd & 0xffff_ffff_0000_0000
 	f.baseAdd = prev | uint64(addr)
@@ -68,6 +76,15 @@ func (f *fakeByteBuster) SetBigBaseAddr(addr uint32) {
 	f.baseAdd = prev | (uint64(addr) << 32)
 }
 
+// the fake one only knows what it has been told to expect
+func (f *fakeByteBuster) Read(addr uint64) uint8 {
+	i := addr - (f.BaseAddress() + f.lineOffset)
+	if i >= uint64(len(f.values)) {
+		return 0
+	}
+	return f.values[i]
+}
+
 func (f *fakeByteBuster) FinishedOk() bool {
 	return f.written == len(f.values)
 }
@@ -118,6 +135,10 @@ type MetalByteBuster struct {
 	entryPoint uint64
 	written    uint32
 	param      [4]uint64
+	digest     *ImageDigest
+	expected   []byte //digest the sender claims, nil if it never sent one
+	signature  []byte
+	section    sectionMark
 }
 
 //set entry point affects the LOWER 32 bits of the entry point
@@ -132,11 +153,12 @@ func (m *MetalByteBuster) SetBigEntryPoint(addr uint32) {
 	m.entryPoint = prev | (uint64(addr) << 32)
 }
 
-// SetBigBaseAddr sets the HIGH order 32 bits of the base address
+// SetBigBaseAddr sets the HIGH order 32 bits of the base address, the
+// line that does this starts a section (see watchdog.go)
 func (m *MetalByteBuster) SetBigBaseAddr(addr uint32) {
 	prev := m.baseAdd & 0xffff_ffff
 	m.baseAdd = prev | (uint64(addr) << 32)
-
+	m.section.start(m.digest)
 }
 
 // SetBaseAddr sets the LOW order 32 bits of the base address
@@ -148,7 +170,7 @@ func (m *MetalByteBuster) SetBaseAddr(addr uint32) {
 
 // the fake one can only process one line of data
 func NewMetalByteBuster() *MetalByteBuster {
-	bb := &MetalByteBuster{}
+	bb := &MetalByteBuster{digest: NewImageDigest()}
 	bb.entryPoint = entryPointSentinal
 	return bb
 }
@@ -161,18 +183,6 @@ func (m *MetalByteBuster) EntryPoint() uint64 {
 	return m.entryPoint
 }
 
-var tmp = uint64(0xf)
-
-func (m *MetalByteBuster) Write(addr uint64, value uint8) bool {
-	a := (*uint8)(unsafe.Pointer(uintptr(addr)))
-	*a = value
-
-	if (addr & ^(tmp)) == 0xfffffc0030000000 {
-		log.Printf("xxx at place: %x, value %x", addr, value)
-	}
-	m.written++
-	return true
-}
 func (m *MetalByteBuster) EntryPointIsSet() bool {
 	return m.entryPoint != entryPointSentinal
 }
@@ -182,6 +192,31 @@ func (m *MetalByteBuster) SetParameter(i int, v uint64) {
 func (m *MetalByteBuster) GetParameter(i int) uint64 {
 	return m.param[i]
 }
+func (m *MetalByteBuster) SetImageDigest(sum []byte, sig []byte) {
+	m.expected = append([]byte{}, sum...)
+	m.signature = nil
+	if sig != nil {
+		m.signature = append([]byte{}, sig...)
+	}
+}
+
+// VerifyImage checks that everything written matches the digest the sender
+// gave us, and that it was signed by key (if key is not nil).  This must be
+// called before jumping to the kernel.
+func (m *MetalByteBuster) VerifyImage(key ed25519.PublicKey) error {
+	return CheckImage(m.digest.Sum(), m.expected, m.signature, key)
+}
+
+// Digest is the digest of everything written so far, for the LoadRecord
+func (m *MetalByteBuster) Digest() []byte {
+	return m.digest.Sum()
+}
+
+// Resync forgets what was written in the current section and returns the
+// number of sections, for the resync request
+func (m *MetalByteBuster) Resync() int {
+	return m.section.resync(m.digest)
+}
 
 /////////////////////////////////////////////////////////////////////////
 // NullByteBuster
@@ -231,6 +266,10 @@ func (n *nullByteBuster) Write(addr uint64, value uint8) bool {
 	return true
 }
 
+func (n *nullByteBuster) Read(addr uint64) uint8 {
+	return 0
+}
+
 func (n *nullByteBuster) SetBigEntryPoint(addr uint32) {
 }
 
@@ -241,3 +280,101 @@ func (n *nullByteBuster) SetParameter(i int, v uint64) {
 func (n *nullByteBuster) GetParameter(i int) uint64 {
 	return 0
 }
+func (n *nullByteBuster) SetImageDigest(sum []byte, sig []byte) {
+}
+
+/////////////////////////////////////////////////////////////////////////
+// SparseByteBuster
+////////////////////////////////////////////////////////////////////////
+//
+// SparseByteBuster keeps everything that is written in a map, so code on
+// the host can pretend to be the device and look at the results.
+//
+type SparseByteBuster struct {
+	Memory     map[uint64]uint8
+	baseAdd    uint64
+	entryPoint uint64
+	param      [4]uint64
+	digest     *ImageDigest
+	expected   []byte
+	signature  []byte
+	section    sectionMark
+}
+
+func NewSparseByteBuster() *SparseByteBuster {
+	return &SparseByteBuster{
+		Memory:     make(map[uint64]uint8),
+		entryPoint: entryPointSentinal,
+		digest:     NewImageDigest(),
+	}
+}
+
+func (s *SparseByteBuster) Write(addr uint64, value uint8) bool {
+	s.Memory[addr] = value
+	s.digest.Add(value)
+	return true
+}
+func (s *SparseByteBuster) Read(addr uint64) uint8 {
+	return s.Memory[addr]
+}
+func (s *SparseByteBuster) SetEntryPoint(addr uint32) {
+	prev := s.entryPoint & 0xffff_ffff_0000_0000
+	s.entryPoint = prev | uint64(addr)
+}
+func (s *SparseByteBuster) SetBigEntryPoint(addr uint32) {
+	prev := s.entryPoint & 0xffff_ffff
+	s.entryPoint = prev | (uint64(addr) << 32)
+}
+func (s *SparseByteBuster) SetBaseAddr(addr uint32) {
+	prev := s.baseAdd & 0xffff_ffff_0000_0000
+	s.baseAdd = prev | uint64(addr)
+}
+func (s *SparseByteBuster) SetBigBaseAddr(addr uint32) {
+	prev := s.baseAdd & 0xffff_ffff
+	s.baseAdd = prev | (uint64(addr) << 32)
+	s.section.start(s.digest)
+}
+func (s *SparseByteBuster) BaseAddress() uint64 {
+	return s.baseAdd
+}
+func (s *SparseByteBuster) EntryPoint() uint64 {
+	return s.entryPoint
+}
+func (s *SparseByteBuster) EntryPointIsSet() bool {
+	return s.entryPoint != entryPointSentinal
+}
+func (s *SparseByteBuster) SetParameter(i int, v uint64) {
+	s.param[i] = v
+}
+func (s *SparseByteBuster) GetParameter(i int) uint64 {
+	return s.param[i]
+}
+func (s *SparseByteBuster) SetImageDigest(sum []byte, sig []byte) {
+	s.expected = append([]byte{}, sum...)
+	s.signature = nil
+	if sig != nil {
+		s.signature = append([]byte{}, sig...)
+	}
+}
+
+// VerifyImage is the same check the MetalByteBuster does before booting
+func (s *SparseByteBuster) VerifyImage(key ed25519.PublicKey) error {
+	return CheckImage(s.digest.Sum(), s.expected, s.signature, key)
+}
+
+// Digest is the digest of everything written so far
+func (s *SparseByteBuster) Digest() []byte {
+	return s.digest.Sum()
+}
+
+// Resync is the same as the MetalByteBuster's
+func (s *SparseByteBuster) Resync() int {
+	return s.section.resync(s.digest)
+}
+
+// Restart is a new load into the same memory, like antc after a reset
+func (s *SparseByteBuster) Restart() *SparseByteBuster {
+	n := NewSparseByteBuster()
+	n.Memory = s.Memory
+	return n
+}
@@ -0,0 +1,16 @@
+// +build !tinygo
+
+package anticipation
+
+// On the host there is no memory for the MetalByteBuster to write to, these
+// are only here so it is still a byteBuster.  Use a SparseByteBuster.
+
+// Read is not possible on the host
+func (m *MetalByteBuster) Read(addr uint64) uint8 {
+	panic("MetalByteBuster can only read memory on the device")
+}
+
+// Write is not possible on the host
+func (m *MetalByteBuster) Write(addr uint64, value uint8) bool {
+	panic("MetalByteBuster can only write memory on the device")
+}
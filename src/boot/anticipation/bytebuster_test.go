@@ -0,0 +1,38 @@
+package anticipation
+
+import (
+	"testing"
+)
+
+func TestSparseByteBuster(t *testing.T) {
+	data := []byte("sparse")
+	bb := NewSparseByteBuster()
+	lines := []string{
+		EncodeBigAddr(0xfffffc00),
+		EncodeELA(0x3001),
+		EncodeDataBytes(data, 0x10),
+	}
+	d := NewImageDigest()
+	d.Write(data)
+	lines = append(lines, EncodeImageDigest(d.Sum(), nil))
+	for _, l := range lines {
+		converted, lt, _, err := DecodeAndCheckStringToBytes(l)
+		if err != nil {
+			t.Fatalf("unable to decode %s: %v", l, err)
+		}
+		if hadError, _ := ProcessLine(lt, converted, bb); hadError {
+			t.Fatalf("unable to process %s", l)
+		}
+	}
+	if len(bb.Memory) != len(data) {
+		t.Errorf("expected %d bytes written but got %d", len(data), len(bb.Memory))
+	}
+	for i, b := range data {
+		if got := bb.Memory[0xfffffc0030010010+uint64(i)]; got != b {
+			t.Errorf("byte %d: expected %02x but got %02x", i, b, got)
+		}
+	}
+	if err := bb.VerifyImage(nil); err != nil {
+		t.Errorf("expected image to verify: %v", err)
+	}
+}
@@ -3,54 +3,48 @@ package main
 import (
 	"boot/anticipation"
 	"lib/upbeat"
+	"machine"
 )
 
-type oneLine []uint8
-
-const ringMax = 0xf //all 1s at the end
-
+// lineRing is the anticipation.LineRing with the parts only antc can do:
+// waiting for the uart interrupt to bring a line, and sending the responses
+// to lines that go in the window.
 type lineRing struct {
-	allLines []oneLine
-	lineHead int
-	lineTail int
+	*anticipation.LineRing
 }
 
 func newLineRing() *lineRing {
-	result := &lineRing{
-		allLines: make([]oneLine, ringMax+1),
-	}
-	for i := 0; i < len(result.allLines); i++ {
-		result.allLines[i] = make([]uint8, anticipation.FileXFerDataLineSize)
-	}
-	return result
+	return &lineRing{anticipation.NewLineRing()}
 }
 
+// next blocks until there is a line in the fifo and returns it.
 // should only be called with interrupts masked!
-func (l *lineRing) addLineToRing(s string) {
-	l.allLines[l.lineHead] = []byte(s)
-	l.lineHead++
-	l.lineHead &= ringMax
+func (l *lineRing) next(buffer []uint8) string {
+	for l.Empty() {
+		upbeat.UnmaskDAIF()
+		wait()
+		upbeat.MaskDAIF()
+	}
+	return l.Next()
 }
 
+// addToWindow puts a line in its slot and tells the host if it is a
+// duplicate, outside the window or past a missing line.
 // should only be called with interrupts masked!
-func (l *lineRing) empty() bool {
-	return l.lineHead == l.lineTail
+func (l *lineRing) addToWindow(seq uint8, s string) {
+	if response := l.AddToWindow(seq, s); response != "" {
+		machine.MiniUART.WriteString(response + "\n")
+	}
 }
 
+// nextInWindow blocks until the expected line is here and returns it, the
+// caller must call Advance() or Drop() when done with it.
 // should only be called with interrupts masked!
-func (l *lineRing) next(buffer []uint8) string {
-	for {
-		if l.empty() {
-			upbeat.UnmaskDAIF()
-			wait()
-			upbeat.MaskDAIF()
-		} else {
-			break // can only get here with interrupts masked
-		}
+func (l *lineRing) nextInWindow() (uint8, string) {
+	for !l.Ready() {
+		upbeat.UnmaskDAIF()
+		wait()
+		upbeat.MaskDAIF()
 	}
-	//byte by byte looking for the LF
-	line := l.allLines[l.lineTail]
-	l.lineTail++
-	l.lineTail &= ringMax
-	return string(line)
+	return l.NextInWindow()
 }
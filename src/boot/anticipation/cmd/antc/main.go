@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"errors"
 	"fmt"
 	"log"
@@ -10,6 +11,8 @@ import (
 	"machine"
 
 	"boot/anticipation"
+	"lib/bootparams"
+	"lib/mmu"
 	"lib/trust"
 	"lib/upbeat"
 )
@@ -24,9 +27,6 @@ const MemoryDeviceNoGatherNoReorderNoEarlyWriteAckValue = 0x00 //it's hardware r
 const MemoryNoCacheValue = 0x44                                //not inner or outer cacheable
 const MemoryNormalValue = 0xFF                                 //cache all you want, including using TLB
 
-//drop bottom 64k
-const noLast16 = 0xffffffffffff0000
-
 //export _enable_mmu_tables
 func enableMMUTables(mairVal uint64, tcrVal uint64, sctrlVal uint64, ttbr0 uint64, ttbr1 uint64)
 
@@ -34,19 +34,100 @@ const isKernelAddrMask = 0xfffffc0000000000
 
 const kernelBase = uintptr(0x3000_104C | isKernelAddrMask)
 
+//the ram we can use, the videocore has the rest
+const ramTop = 0x3C00_0000
+
+//what setupVM maps, the same tables are used for both halves of the address
+//space so the kernel (at isKernelAddrMask) sees the same thing.  setupVM
+//adds whatever sysdec says the devices (and the videocore's memory) are, in
+//the machine package's MemoryMap.  touching anything else faults.
+var memoryLayout = mmu.Layout{
+	Granule: mmu.Granule64K,
+	VABits:  42,
+	Regions: []mmu.Region{
+		{Name: "ram", VA: 0, PA: 0, Size: ramTop, Attr: MemoryNormal},
+	},
+}
+
+//machineAttrs is the MAIR index for each of machine's MemoryAttrs
+var machineAttrs = []uint64{
+	machine.MemoryDevice:  MemoryDeviceNoGatherNoReorderNoEarlyWriteAck,
+	machine.MemoryNoCache: MemoryNoCache,
+	machine.MemoryNormal:  MemoryNormal,
+}
+
 const TTBR0Val = uint64(0x10000) //this is where we START our page tables, must be 64K aligned
 const TTBR1Val = uint64(0x10000) //this is where we START our page tables, must be 64K aligned
 
+//secondaryBootDef is secondary_boot_info in set_regs.S, what cores 1-3 need
+//to turn on the MMU the way setupVM did, and the params of the kernel we
+//are sending them to
+type secondaryBootDef struct {
+	MAIR   uint64
+	TCR    uint64
+	SCTLR  uint64
+	TTBR0  uint64
+	TTBR1  uint64
+	Params uint64
+}
+
+//go:extern secondary_boot_info
+var secondaryBoot secondaryBootDef
+
+//export _release_core
+func releaseCore(core uint64)
+
 var logger *trust.Logger
 
 var buffer oneLine
 var lr *lineRing
 var started = false
 
+// irqs has our handlers, interruptReceive looks after both the uart and the
+// local timer (our watchdog)
+var irqs machine.IRQTable
+
 var metal *anticipation.MetalByteBuster
 
+//once the host asks for binary framing (and we say ok) every byte received
+//goes through the frame decoder instead of the line buffer
+var binaryMode = false
+var frames *anticipation.FrameDecoder
+
+//in windowed mode this is the sequence number (as hex) of the line being
+//processed, it goes after the . or ! of our response
+var currentTag = ""
+
+//if processLine sets this, it is what we ack with instead of the summary,
+//it's the answer to lines that ask us something
+var answer = ""
+
+//where we keep the anticipation.LoadRecord, below the page tables at
+//TTBR0Val.  nothing else touches this page, so it survives a reset.
+const loadRecordAddr = uintptr(0xf000)
+
+func loadRecord() *anticipation.LoadRecord {
+	return (*anticipation.LoadRecord)(unsafe.Pointer(loadRecordAddr))
+}
+
+//if this is set, we only boot kernels signed with the matching private key
+//(release -key).  it is set by trustedkey.go, which the Makefile writes with
+//release -trust when KEY is set.  without it any kernel boots.
+var trustedKey ed25519.PublicKey
+
 const interval = 0x4000000
 
+//what the watchdog (the local timer) does when the host goes quiet during a
+//transfer, counted in intervals: ask the host to resync the section we are
+//in, and then give up and reset the board.  zero turns either one off.
+var watchdog = anticipation.WatchdogPolicy{Resync: 3, Reboot: 10}
+
+//writes to the PM registers are ignored without this in the top byte
+const pmPassword = 0x5a00_0000
+
+//ticks (about 16us) from setting up the PM watchdog to the reset
+const rebootTicks = 10
+
 func wait() {
 	amount := 1500000000
 	if started {
@@ -65,6 +146,7 @@ func main() {
 	buffer = make([]uint8, anticipation.FileXFerDataLineSize)
 	lr = newLineRing() //probably overkill since never need more than 1 line
 	metal = anticipation.NewMetalByteBuster()
+	frames = anticipation.NewFrameDecoder()
 
 	info := upbeat.SetFramebufferRes1024x768()
 	if info == nil {
@@ -86,14 +168,18 @@ func main() {
 	machine.MiniUART = machine.NewUART()
 	machine.MiniUART.Configure(&machine.UARTConfig{RXInterrupt: true})
 	//tell the Interrupt controlller what's going on
-	machine.IC.Enable1.SetAux()
+	irqs.Register("Aux", func(machine.IRQ) { interruptReceive() })
+	irqs.Register("LocalTimer", func(machine.IRQ) { interruptReceive() })
+	machine.IRQAux.Enable()
 
-	machine.QA7.LocalTimerControl.SetInterruptEnable()
-	machine.QA7.LocalTimerControl.SetReloadValue(interval)
-	machine.QA7.LocalTimerControl.SetTimerEnable()
+	machine.QA7.LocalTimerControl.Modify(func(v *machine.LocalTimerControlValue) {
+		v.SetInterruptEnable()
+		v.SetReloadValue(interval)
+		v.SetTimerEnable()
+	})
 
 	//route BOTH local timer and GPU to core 0 on IRQ
-	machine.QA7.GPUInterruptRouting.IRQToCore0()
+	machine.QA7.GPUInterruptRouting.SetIRQToCore0()
 	machine.QA7.LocalInterrupt.SetCore0IRQ()
 
 	//Tell Core0 which interrupts to consume
@@ -111,21 +197,51 @@ func main() {
 		wait()
 		upbeat.MaskDAIF()
 	}
-	machine.QA7.LocalTimerControl.ClearTimerEnable()
+	//the timer keeps going during the transfer, it is our watchdog
+	waitCount = 0
+
+	if monitorRequested {
+		//the user can be as slow as they like
+		machine.QA7.LocalTimerControl.ClearTimerEnable()
+		monitor() //until the user asks for a load
+		waitCount = 0
+		machine.QA7.LocalTimerClearReload.SetReload()
+		machine.QA7.LocalTimerControl.SetTimerEnable()
+	}
 
 	//nothing to do but wait for interrupts, we use lr.next() to block
 	//until we get a line, and lr.next implies interrupts are off
 	for {
-		s := lr.next(buffer)
-
-		if len(s) == 0 {
-			continue
+		var s string
+		currentTag = ""
+		answer = ""
+		if lr.Windowed() {
+			var seq uint8
+			seq, s = lr.nextInWindow()
+			currentTag = anticipation.SequenceTag(seq)
+		} else {
+			s = lr.next(buffer)
+			if len(s) == 0 {
+				continue
+			}
 		}
+		sum := summary(s) //before processing, the line may change binaryMode
+		windowed := lr.Windowed()
 		done, err := processLine(s)
 		if err != nil {
-			machine.MiniUART.WriteString("! processing error:" + err.Error() + " " + s[0:16] + "\n")
+			if windowed {
+				lr.Drop()
+			}
+			machine.MiniUART.WriteString("!" + currentTag + " processing error:" + err.Error() + " " + sum + "\n")
 		} else {
-			machine.MiniUART.WriteString(". accept: " + s[0:16] + "\n")
+			if windowed {
+				lr.Advance()
+			}
+			if answer != "" {
+				machine.MiniUART.WriteString("." + currentTag + " " + answer + "\n")
+			} else {
+				machine.MiniUART.WriteString("." + currentTag + " accept: " + sum + "\n")
+			}
 		}
 		if done {
 			break
@@ -134,18 +250,32 @@ func main() {
 }
 
 //export raw_exception_handler
-func rawExceptionHandler(t uint64, esr uint64, addr uint64, el uint64, procId uint64) {
+func rawExceptionHandler(t uint64, esr uint64, addr uint64, el uint64, procId uint64, far uint64, fp uint64) {
 	if t != 5 {
 		// this is in case we get some OTHER kind of exception
-		logger.Errorf("raw exception handler:exception type %d and "+
-			"esr %x with addr %x and EL=%d, ProcID=%x\n",
+		crashf("raw exception handler:exception type %d and "+
+			"esr %x with addr %x and EL=%d, ProcID=%x",
 			t, esr, addr, el, procId)
-		logger.Errorf("DEADLOOP\n")
+		crashf("fault address %x", far)
+		var pcs [upbeat.MaxBacktrace]uint64
+		n := upbeat.Backtrace(fp, 0, ramTop, pcs[:])
+		for i := 0; i < n; i++ {
+			crashf("frame %d: %x", i, pcs[i])
+		}
+		crashf("DEADLOOP")
 		for {
 			arm.Asm("nop")
 		}
 	}
-	interruptReceive()
+	irqs.Dispatch()
+}
+
+// crashf puts a line of a crash report on the screen and sends it to
+// release, which decodes it.  It goes as a comment so it can't be taken
+// for a nak in the middle of a transfer.
+func crashf(format string, args ...interface{}) {
+	logger.Errorf(format, args...)
+	machine.MiniUART.WriteString("#" + fmt.Sprintf(format, args...) + "\n")
 }
 
 //go:noinline
@@ -161,21 +291,53 @@ func interruptReceive() {
 				if !machine.Aux.MULSR.DataReadyIsSet() {
 					break
 				}
+				//pull the character into the internal buffer
+				ch := byte(machine.Aux.MUData.Receive())
 				//this is slightly dodgy, but since interrupts are off, it's ok
 				if !started {
+					if ch == anticipation.MonitorBreak[breakCount] {
+						breakCount++
+						if breakCount == len(anticipation.MonitorBreak) {
+							monitorRequested = true
+							started = true
+						}
+						continue
+					}
+					breakCount = 0
 					started = true
 				} else {
 					//reset watchdog timer
 					machine.QA7.LocalTimerClearReload.SetReload()
 					machine.QA7.LocalTimerClearReload.SetClear() //sad nomenclature
 				}
-				//pull the character into the internal buffer
-				ch := byte(machine.Aux.MUData.Receive())
+				if binaryMode {
+					converted, done, err := frames.Feed(ch)
+					if done {
+						switch {
+						case err != nil:
+							machine.MiniUART.WriteString("! frame error:" + err.Error() + "\n")
+						case lr.Windowed():
+							lr.addToWindow(frames.Sequence(), string(converted))
+						default:
+							lr.Add(string(converted))
+						}
+					}
+					continue
+				}
 				switch {
 				case ch == 10:
 					machine.MiniUART.LoadRx(10)
 					moved := machine.MiniUART.CopyRxBuffer(buffer)
-					lr.addLineToRing(string(buffer[:moved]))
+					if lr.Windowed() {
+						seq, rest, ok := anticipation.DecodeSequenced(buffer[:moved])
+						if !ok {
+							machine.MiniUART.WriteString("! bad sequenced line\n")
+							continue
+						}
+						lr.addToWindow(seq, string(rest))
+						continue
+					}
+					lr.Add(string(buffer[:moved]))
 				case ch < 32 || ch > 127:
 					//nothing
 				default:
@@ -190,7 +352,17 @@ func interruptReceive() {
 			atLeastOne = true
 			if started {
 				logger.Debugf("___________WATCHDOG! __________\n")
-				//machine.MiniUART.WriteString(". watchdog timeout during transfer\n")
+				switch watchdog.Action(waitCount) {
+				case anticipation.WatchdogReboot:
+					reboot()
+				case anticipation.WatchdogResync:
+					resync()
+				default:
+					if lr.Windowed() {
+						//we are waiting on this one, ask for it again
+						machine.MiniUART.WriteString("!" + anticipation.SequenceTag(lr.Expected()) + " timeout\n")
+					}
+				}
 			} else {
 				logger.Debugf("anticipation: local timer interrupt: #%03d", waitCount)
 				machine.MiniUART.WriteString(fmt.Sprintf(". local timer interrupt: #%03d\n", waitCount))
@@ -203,76 +375,179 @@ func interruptReceive() {
 
 var waitCount = 0
 
+// resync throws away whatever we have that isn't processed yet and asks
+// the host to start the current section again.  interrupts are off.
+func resync() {
+	machine.MiniUART.CopyRxBuffer(buffer) //a partial line, if any
+	tag := ""
+	if lr.Windowed() {
+		tag = anticipation.SequenceTag(lr.Expected())
+	}
+	lr.Resync()
+	logger.Debugf("anticipation: asking for a resync after %d intervals", waitCount)
+	machine.MiniUART.WriteString(anticipation.EncodeResync(tag, metal.Resync()) + "\n")
+}
+
+// reboot has the PM watchdog reset the board, it doesn't come back.  memory
+// survives, but the load record was cleared when the transfer started.
+func reboot() {
+	logger.Errorf("anticipation: no lines for %d intervals, rebooting", waitCount)
+	machine.PM.WDOG.Set(pmPassword | rebootTicks)
+	machine.PM.RSTC.Modify(func(v *machine.RSTCValue) {
+		v.SetPasswd(pmPassword >> 24)
+		v.SetFullReset()
+	})
+	for {
+		arm.Asm("nop")
+	}
+}
+
 func processLine(line string) (bool, error) {
 	//really should do a lock here, but on baremetal will be ok
 	waitCount = 0
 
-	//clip off the LF that came from server
-	end := len(line)
-	if end > 0 && line[end-1] == 10 {
-		end--
-	}
-	// just do what the line says
-	converted, lt, addr, err := anticipation.DecodeAndCheckStringToBytes(line[:end])
-	if addr == 0x0 && metal.BaseAddress() == 0xfffffc0030000000 && lt == anticipation.DataLine {
-		log.Printf("line is %s", line[:end])
+	var converted []byte
+	var lt anticipation.HexLineType
+	if binaryMode {
+		//frames were checked by the decoder, so this is already converted
+		converted = []byte(line)
+		lt, _ = anticipation.ExtractLineType(converted)
+	} else {
+		//clip off the LF that came from server
+		end := len(line)
+		if end > 0 && line[end-1] == 10 {
+			end--
+		}
+		// just do what the line says
+		var addr uint32
+		var err error
+		converted, lt, addr, err = anticipation.DecodeAndCheckStringToBytes(line[:end])
+		if addr == 0x0 && metal.BaseAddress() == 0xfffffc0030000000 && lt == anticipation.DataLine {
+			log.Printf("line is %s", line[:end])
+		}
+		if err != nil {
+			return false, err
+		}
 	}
-	if err != nil {
-		return false, err
+	query := lt == anticipation.ExtensionDeviceInfo ||
+		(lt == anticipation.ExtensionWindowHash && converted[4] == anticipation.WindowHashQuery)
+	if !query {
+		loadRecord().Clear() //memory is about to change
 	}
 	wasError, done := anticipation.ProcessLine(lt, converted, metal)
 	if wasError {
-		return false, errors.New("unable to execute line " + line)
+		return false, errors.New("unable to execute line " + summary(line))
+	}
+	switch {
+	case lt == anticipation.ExtensionDeviceInfo:
+		answer = anticipation.DeviceInfoResponse(deviceID(), loadRecord())
+	case query:
+		answer = anticipation.WindowHashAnswer(converted, metal)
+	}
+	if lt == anticipation.ExtensionBinaryFraming {
+		//our caller acks this line, and the host sends frames after that
+		binaryMode = true
+	}
+	if lt == anticipation.ExtensionWindow {
+		//ProcessLine checked it against WindowMax, the size of the ring
+		//our caller acks this line, and the host sends sequence numbers after that
+		lr.SetWindow(converted[4])
+		frames.SetSequenced(true)
 	}
 	if done {
 		if !metal.EntryPointIsSet() {
 			return false, errors.New("no entry point has been set")
 		}
+		if err := metal.VerifyImage(trustedKey); err != nil {
+			return false, errors.New("refusing to boot: " + err.Error())
+		}
+		loadRecord().Set(metal.Digest()) //for the next load, after a reset
 		// normally our CALLER does the confirm, but we are never going to
 		// reach there
-		machine.MiniUART.WriteString(".\n") //signal the sender everything is ok
+		machine.MiniUART.WriteString("." + currentTag + "\n") //signal the sender everything is ok
 		logger.Infof(" === jumping to kernel at address %x ===\n", metal.EntryPoint())
-		upbeat.MaskDAIF() //turn off interrupts while we boot up the kernel
-		//turn off the interrupts so we don't get them in kernel until we are ready
-		machine.IC.Disable1.SetAux() //sadly, you *set* things in the DISable reg to turn off
-		machine.QA7.LocalTimerControl.ClearTimerEnable()
-		jumpToKernel(metal.EntryPoint(), metal.GetParameter(0), metal.GetParameter(1),
+		jump(metal.EntryPoint(), metal.GetParameter(0), metal.GetParameter(1),
 			metal.GetParameter(2), metal.GetParameter(3))
 	}
 	//keep going
 	return false, nil
 }
 
+// deviceID is how release knows which board this is, so it can find what
+// it sent us last time
+func deviceID() uint64 {
+	if id, ok := upbeat.BoardID(); ok {
+		return id
+	}
+	if mac, ok := upbeat.MACAddress(); ok {
+		return mac
+	}
+	return 0
+}
+
+// summary is the bit of a line we echo back to the host
+func summary(s string) string {
+	if binaryMode {
+		if len(s) < 4 {
+			return "short frame"
+		}
+		return "frame " + anticipation.HexLineType(s[3]).String()
+	}
+	if len(s) < 16 {
+		return s
+	}
+	return s[0:16]
+}
+
 //export jump_to_kernel
 func jumpToKernel(ep uint64, blockPtr uint64, _ uint64, _ uint64, _ uint64)
 
+// jump turns off our interrupts and goes to ep, it doesn't come back
+func jump(ep uint64, blockPtr uint64, p1 uint64, p2 uint64, p3 uint64) {
+	upbeat.MaskDAIF() //turn off interrupts while we boot up the kernel
+	//turn off the interrupts so we don't get them in kernel until we are ready
+	machine.IRQAux.Disable()
+	machine.QA7.LocalTimerControl.ClearTimerEnable()
+	startSecondaries(blockPtr)
+	jumpToKernel(ep, blockPtr, p1, p2, p3)
+}
+
+// startSecondaries sends cores 1-3 to the kernel, if the params have an
+// entry point for them.  They are in the spin loop of the boot code, and go
+// through secondary_boot (set_regs.S) to get our MMU setup first.  All the
+// interrupts stay routed to core 0.
+func startSecondaries(blockPtr uint64) {
+	if blockPtr == 0 {
+		return //monitor's jump
+	}
+	p := (*bootparams.BootloaderParamsDef)(unsafe.Pointer(uintptr(blockPtr)))
+	if p.Check() != nil {
+		return //older kernel, it only knows about core 0
+	}
+	secondaryBoot.Params = blockPtr
+	for core := uint64(1); core < bootparams.MaxCores; core++ {
+		if p.Cores[core].EntryPoint == 0 {
+			continue
+		}
+		logger.Debugf("starting core %d at %x", core, p.Cores[core].EntryPoint)
+		releaseCore(core)
+	}
+}
+
 func setupVM() {
 	//setup memory types and attributes
 	MAIRVal := uint64(((MemoryDeviceNoGatherNoReorderNoEarlyWriteAckValue << (MemoryDeviceNoGatherNoReorderNoEarlyWriteAck * 8)) |
 		(MemoryNoCacheValue << (MemoryNoCache * 8)) |
 		(MemoryNormalValue << (MemoryNormal * 8))))
 
-	// zero on these fields
+	// 64K granules and a 42 bit address space for both halves, see
+	// memoryLayout.  zero on the rest of the fields
 	// TBI - no tag bits
 	// IPS - 32 bit (4GB)
 	// EPD1 - enable walks in kernel
 	// EPD0 - enable walks in userspc
 	//TCR REG https://developer.arm.com/docs/ddi0595/b/aarch64-system-registers/tcr_el1
-
-	TCREL1Val := uint64(((0b11 << 30) | // granule size in kernel
-		(0b11 << 28) | // inner shareable
-		(0b01 << 26) | // write back (outer)
-		(0b01 << 24) | // write back (inner)
-		(22 << 16) | //22 is T1SZ, 42bit addr space (same as example https://developer.arm.com/docs/den0024/latest/the-memory-management-unit/translating-a-virtual-address-to-a-physical-address)
-		(0b1 << 14) | // granule size in user
-		(0b11 << 12) | //inner shareable
-		(0b01 << 10) | //write back (outer)
-		(0b01 << 8) | //write back (inner)
-		(22 << 0))) //22 is T0SZ, 42 bit addr space
-
-	// Undocumented TTBRCNP from BZT's tutorial....
-	//TTBR0Val := uint64((0x100000 << 7) | UndocumentedTTBRCNP) //base addr 0x10_0000, no other shenanigans
-	//TTBR1Val := uint64((0x100000 << 7) | UndocumentedTTBRCNP) //base addr 0x10_0000, no other shenanigans
+	TCREL1Val := memoryLayout.TCR()
 
 	SCTRLEL1Val := uint64((0xC00800) | //mandatory reserved 1 bits
 		(1 << 12) | // I Cache for both el1 and el0
@@ -282,58 +557,19 @@ func setupVM() {
 		(1 << 1) | //  Alignment check enable
 		(1 << 0)) // MMU ENABLED!! THE BIG DOG
 
-	//we don't use level 1 because we have 42 bit address and 64k granules
-	sizeOfLevel2 := uintptr(0x1_0000) //8192 entries (only 4 in use, the lowest 4)
-	sizeOfLevel3 := uintptr(0x1_0000) //8192 entries
-
-	//level 2 table has 8192 entries selected by bits 41:29 but we are only interested in bits
-	//29 and 30 because the rest are always the same... so we need to point to 4 different level
-	//3 tables in the lowest positions
-	root := uintptr(0x1_0000)
 	logger.Infof("=== Bringing up the MMU and virtual memory === ")
-
-	logger.Infof("Setting up level 2 table (8192 entries) @ 0x%016x\n", root)
-	level2Ptr := root
-	level3PtrsBase := root + sizeOfLevel2
-	logger.Infof("Level 3 tables begin at 0x%016x", level3PtrsBase)
-	for i := uintptr(0); i < 8192; i++ { //fill in entries to cause a fault
-		//entries are bad other than first 4
-		asUint64 := (*uint64)(unsafe.Pointer(level2Ptr + (i * 8))) //8 bytes entry
-		if i < 4 {                                                 //4 entries means we have 4x32bits or 4x4GB or 64GB addr space
-			target := level3PtrsBase + (i * sizeOfLevel3)
-			*asUint64 = makeTableEntry(target)
-			logger.Infof("level 2, entry %d (@ 0x%016x) is 0x%016x (0x%016x)", i, asUint64, target, *asUint64)
-			continue
-		}
-		*asUint64 = makeBadEntry()
+	if err := memoryLayout.AddDevices(machine.MemoryMap, machineAttrs); err != nil {
+		panic("unable to map devices: " + err.Error())
 	}
-
-	for i := uintptr(0); i < 4; i++ {
-		level3Ptr := level3PtrsBase + (i * sizeOfLevel3)
-		logger.Infof("Setting up level 3 table %d (8192 entries) @ 0x%016x\n", i, level3Ptr)
-		for j := uintptr(0); j < 8192; j++ { //12 bits
-			asUint64 := ((*uint64)(unsafe.Pointer(level3Ptr + (j * 8)))) //8 bytes entry
-			target := (i << 29) | (j << 16)                              //j only has 12 bits, so these don't overlap
-			memType := uint64(MemoryNormal)
-			if target >= 0x3C00_0000 && target < 0x3F00_0000 { //framebuffer
-				memType = MemoryNoCache
-			}
-			if target >= 0x3F00_0000 && target < 0x4_0000_0000 { //peripherals
-				memType = MemoryDeviceNoGatherNoReorderNoEarlyWriteAck
-			}
-			if target >= 0x4_0000_0000 && target < 0x4_0000_0100 { //local peripherals, qa7
-				memType = MemoryDeviceNoGatherNoReorderNoEarlyWriteAck
-			}
-			if target >= 0x4_0000_0100 { // bad mojo
-				*asUint64 = makeBadEntry()
-				continue
-			}
-			//make the physical block entry
-			*asUint64 = makePhysicalBlockEntry(target, memType)
-		}
+	root, end, err := memoryLayout.Build(mmu.Physical{}, TTBR0Val)
+	if err != nil {
+		panic("unable to build page tables: " + err.Error())
 	}
+	logger.Infof("page tables from 0x%016x to 0x%016x", root, end)
 
 	enableMMUTables(MAIRVal, TCREL1Val, SCTRLEL1Val, TTBR0Val, TTBR1Val)
+	secondaryBoot = secondaryBootDef{MAIR: MAIRVal, TCR: TCREL1Val, SCTLR: SCTRLEL1Val,
+		TTBR0: TTBR0Val, TTBR1: TTBR1Val}
 	logger.Infof("=== MMUenabled ===")
 	ptr := ((*uint64)(unsafe.Pointer(uintptr(kernelBase))))
 	*ptr = 0x0123456776543210
@@ -341,51 +577,3 @@ func setupVM() {
 	x := ((*uint64)(unsafe.Pointer(kernelBase)))
 	logger.Debugf("Self test readback from kernel space 0x%016x\n", *x)
 }
-
-func makeTableEntry(destination uintptr) uint64 {
-
-	//low 2 bits as 0b11
-	//bits 5:2 are index into mair table (4 bits to ref which one)
-	//bits 7:6 el0 no read, no write (no read 0b01, no write 0b10)
-	//bits 9:8 inner and outer shareable (inner 0b11, outer 0b10)
-	//bit 10 AF flag, lets OS know if page is first accessed if 0
-	//bits 47:16 address (32 bits, because we are 64K granules)
-	result := uint64(
-		uint64(1<<63) | //secure state?!? why is it needed?
-			uint64(destination&noLast16) | //address of the _BASE_ of next table, just a mask because >>16 and then <<16
-			uint64(3<<0)) //last two bits indicate page tbl
-	return result
-}
-
-func makeBadEntry() uint64 {
-	//*ANY* entry in a page table must have the last bit high, so 0 is always bad (easy!)
-	return 0
-}
-
-var ok = false
-
-// mair index == MemoryNormal
-// mair index == MemoryNoCache for video ram
-// mair index == MemoryDeviceNoGatherNoReorderNoEarlyWriteAckValue for device memory
-// destination is top 32 bits of final memory location
-func makePhysicalBlockEntry(destination uintptr, mairIndex uint64) uint64 {
-
-	//https://armv8-ref.codingbelief.com/en/chapter_d4/d44_1_memory_access_control.html
-	//we have SCTLR_EL1.WXN =0
-	//we have AP set to 0b00
-	//we have UXN set to 0
-	//we have PXN set to 0
-	//this implies: RWX from EL1, X only from EL0
-
-	result := uint64(
-		uint64(destination&noLast16) | //address of the PAGE, without low order
-			//no use of bit 11, this controls if access in per process id
-			(0b1 << 10) | //we are not yet using the ACCESS flag
-			(0b1 << 5) | //non-secure
-			(mairIndex&0x7)<<2 | // index in the MAIR register
-			uint64(0b11<<0)) //last two bits are 0b11 to indicate block entry
-	//note: last two bits are 0b01 *IF* you are not at level 3 of translation
-	//note: at level3, there is this special encoding and we are at level 3
-	//https://armv8-ref.codingbelief.com/en/chapter_d4/d43_2_armv8_translation_table_level_3_descriptor_formats.html
-	return result
-}
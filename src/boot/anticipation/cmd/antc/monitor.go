@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"machine"
+
+	"boot/anticipation"
+	"lib/upbeat"
+)
+
+//set by interruptReceive when it sees the break during the countdown
+var monitorRequested = false
+
+//how much of anticipation.MonitorBreak we have seen so far
+var breakCount = 0
+
+// sysRegs is filled in by _read_sys_regs in set_regs.S, in this order
+type sysRegs struct {
+	CurrentEL uint64
+	SCTLR     uint64
+	TCR       uint64
+	MAIR      uint64
+	TTBR0     uint64
+	TTBR1     uint64
+	VBAR      uint64
+	MPIDR     uint64
+	DAIF      uint64
+	SP        uint64
+}
+
+//export _read_sys_regs
+func readSysRegs(r *sysRegs)
+
+func reply(s string) {
+	machine.MiniUART.WriteString(s + "\n")
+}
+
+// monitor runs commands until one of them is load (or jump). like the
+// line loop in main, this must be called with interrupts off.
+func monitor() {
+	logger.Infof("=== monitor ===")
+	reply(". monitor: type help for commands")
+	for {
+		s := strings.TrimSpace(lr.next(buffer))
+		if len(s) == 0 {
+			continue
+		}
+		req, err := anticipation.ParseMonitorLine(s)
+		if err != nil {
+			reply("! " + err.Error())
+			continue
+		}
+		switch req.Command {
+		case anticipation.MonitorHelp:
+			for _, h := range anticipation.MonitorHelpText {
+				reply(". " + h)
+			}
+		case anticipation.MonitorPeek:
+			for i := uint64(0); i < req.Value; i++ {
+				a := req.Addr + (i * 8)
+				if !mapped(a) {
+					reply(fmt.Sprintf("! %016x is not mapped", a))
+					break
+				}
+				reply(fmt.Sprintf(". %016x: %016x", a, *(*uint64)(unsafe.Pointer(uintptr(a)))))
+			}
+		case anticipation.MonitorPoke:
+			if !mapped(req.Addr) {
+				reply(fmt.Sprintf("! %016x is not mapped", req.Addr))
+				continue
+			}
+			loadRecord().Clear() //whatever we loaded last, this isn't it anymore
+			*(*uint64)(unsafe.Pointer(uintptr(req.Addr))) = req.Value
+			reply(fmt.Sprintf(". %016x: %016x", req.Addr, req.Value))
+		case anticipation.MonitorRegs:
+			var r sysRegs
+			readSysRegs(&r)
+			reply(fmt.Sprintf(". CurrentEL %d  DAIF  %016x  SP    %016x", (r.CurrentEL>>2)&0x3, r.DAIF, r.SP))
+			reply(fmt.Sprintf(". SCTLR %016x  TCR   %016x  MAIR  %016x", r.SCTLR, r.TCR, r.MAIR))
+			reply(fmt.Sprintf(". TTBR0 %016x  TTBR1 %016x  VBAR  %016x", r.TTBR0, r.TTBR1, r.VBAR))
+			reply(fmt.Sprintf(". MPIDR %016x", r.MPIDR))
+		case anticipation.MonitorInfo:
+			boardInfo()
+		case anticipation.MonitorLoad:
+			metal = anticipation.NewMetalByteBuster() //in case we poked at it
+			reply(anticipation.MonitorLoadResponse)
+			return
+		case anticipation.MonitorJump:
+			if !mapped(req.Addr) {
+				reply(fmt.Sprintf("! %016x is not mapped", req.Addr))
+				continue
+			}
+			reply(fmt.Sprintf(". jumping to %016x", req.Addr))
+			jump(req.Addr, 0, 0, 0, 0)
+		}
+	}
+}
+
+// mapped is true if addr is in memoryLayout, touching anything else
+// faults (and we don't come back from that).  The kernel half of the
+// address space uses the same tables as the bottom half.
+func mapped(addr uint64) bool {
+	if addr&isKernelAddrMask == isKernelAddrMask {
+		addr &^= isKernelAddrMask
+	}
+	_, ok := memoryLayout.Find(addr)
+	return ok
+}
+
+func boardInfo() {
+	if v, ok := upbeat.FirmwareVersion(); ok {
+		reply(fmt.Sprintf(". firmware version %08x", v))
+	}
+	if m, ok := upbeat.BoardModel(); ok {
+		reply(fmt.Sprintf(". board model      %08x", m))
+	}
+	if rev, ok := upbeat.BoardRevision(); ok {
+		reply(fmt.Sprintf(". board revision   %08x %s", rev, upbeat.BoardRevisionDecode(fmt.Sprintf("%x", rev))))
+	}
+	if id, ok := upbeat.BoardID(); ok {
+		reply(fmt.Sprintf(". serial number    %016x", id))
+	}
+	if mac, ok := upbeat.MACAddress(); ok {
+		reply(fmt.Sprintf(". mac address      %012x", mac))
+	}
+	if base, size, ok := upbeat.GetARMMemoryAndBase(); ok {
+		reply(fmt.Sprintf(". arm memory       %08x, %08x bytes", base, size))
+	}
+	if base, size, ok := upbeat.GetVCMemoryAndBase(); ok {
+		reply(fmt.Sprintf(". vc memory        %08x, %08x bytes", base, size))
+	}
+	if cr, ok := upbeat.GetClockRate(); ok {
+		reply(fmt.Sprintf(". arm clock rate   %d hz", cr))
+	}
+}
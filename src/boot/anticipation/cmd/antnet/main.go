@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"time"
+
+	"boot/anticipation"
+)
+
+//
+// antnet is the device side of release's -net option, running on the host.
+// It speaks the same line protocol as antc (it's a SimDevice) but the
+// lines come in datagrams.  This is for testing the network transport on
+// loopback or with QEMU's user networking, before there is an antc that
+// can drive a NIC.  The work is done by anticipation.NetDevice.
+//
+
+// how long we keep answering after the transfer is done
+const netLinger = 2 * time.Second
+
+var listenFlag = flag.String("l", ":7777", "udp address to listen on")
+var dropFlag = flag.Int("drop", 0, "percentage of datagrams to drop (both ways), to test retransmits")
+var verbose = flag.Int("v", 0, "verbosity level: 0 terse (default), 1 debug info, 2 show everything ")
+
+func main() {
+	flag.Parse()
+	addr, err := net.ResolveUDPAddr("udp", *listenFlag)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	log.Printf("antnet: listening on %s", conn.LocalAddr())
+	d := anticipation.NewNetDevice(conn)
+	d.Drop = dropped
+	d.Verbose = *verbose
+	if err := d.Serve(netLinger); err != nil {
+		log.Fatalf("failed to read from network: %v", err)
+	}
+	log.Printf("antnet: received %d bytes, entry point %x, params %x",
+		len(d.Memory.Memory), d.Memory.EntryPoint(), d.Memory.GetParameter(0))
+	os.Exit(0)
+}
+
+func dropped() bool {
+	return *dropFlag > 0 && rand.Intn(100) < *dropFlag
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+///////////////////////////////////////////////////////////////////////
+// The console is what we do with the lines that come back after the
+// kernel is running.  Each line becomes a logRecord, using the prefixes
+// the trust logger (and antc) put on the front.  Records that get past
+// the filters are printed and, with -log, written to a file one JSON
+// object per line with the time we read them.
+///////////////////////////////////////////////////////////////////////
+
+// exit status when -failfast sees the kernel die
+const kernelFailedExit = 2
+
+type logLevel int
+
+// in order, -level shows that level and everything after it
+const (
+	levelTrace logLevel = 0 // * lines, antc being chatty
+	levelDebug logLevel = 1
+	levelInfo  logLevel = 2 // also STATS and lines without a prefix
+	levelWarn  logLevel = 3
+	levelError logLevel = 4
+	levelFatal logLevel = 5 // also panics
+)
+
+var levelNames = map[string]logLevel{
+	"trace": levelTrace,
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+	"fatal": levelFatal,
+}
+
+// trust's prefixes, after the line has been trimmed (so " WARN:" is "WARN:")
+var trustPrefixes = []struct {
+	prefix string
+	level  logLevel
+	name   string
+}{
+	{"FATAL:", levelFatal, "fatal"},
+	{"ERROR:", levelError, "error"},
+	{"WARN:", levelWarn, "warn"},
+	{"INFO:", levelInfo, "info"},
+	{"DEBUG:", levelDebug, "debug"},
+	{"panic:", levelFatal, "panic"},
+}
+
+// logRecord is one line of the kernel log.  Level is the name of the
+// level, except that panics are "panic", STATS are "stats" and lines with
+// no prefix at all are "print".
+type logRecord struct {
+	Time     time.Time `json:"time"`
+	Level    string    `json:"level"`
+	Category string    `json:"category,omitempty"`
+	Message  string    `json:"message"`
+	level    logLevel
+	display  string //what we print, the way we always have
+}
+
+// parseLogLine turns a (trimmed) line from the device into a record,
+// without the time
+func parseLogLine(l string) logRecord {
+	switch l[0] {
+	case '*':
+		return logRecord{Level: "trace", Message: l[1:], level: levelTrace, display: l[1:]}
+	case '@':
+		return logRecord{Level: "debug", Message: l[1:], level: levelDebug, display: "@@@ " + l[1:]}
+	case '!':
+		return logRecord{Level: "error", Message: l[1:], level: levelError, display: "!!! " + l[1:]}
+	case '#':
+		return logRecord{Level: "info", Message: l[1:], level: levelInfo, display: "### " + l[1:]}
+	}
+	for _, p := range trustPrefixes {
+		if strings.HasPrefix(l, p.prefix) {
+			return logRecord{Level: p.name, Message: strings.TrimSpace(l[len(p.prefix):]), level: p.level, display: l}
+		}
+	}
+	if strings.HasPrefix(l, "STATS[") {
+		if end := strings.Index(l, "]:"); end > 0 {
+			return logRecord{Level: "stats", Category: l[len("STATS["):end],
+				Message: strings.TrimSpace(l[end+2:]), level: levelInfo, display: l}
+		}
+	}
+	return logRecord{Level: "print", Message: l, level: levelInfo, display: l}
+}
+
+// failed is true for the records that mean the kernel is done for
+func (r *logRecord) failed() bool {
+	return r.level == levelFatal
+}
+
+type console struct {
+	out        io.Writer
+	records    *bufio.Writer //nil without -log
+	fp         *os.File
+	minLevel   logLevel
+	categories map[string]bool //nil means all of them
+	verbose    int
+	now        func() time.Time
+	symbols    *symbolizer  //for crash reports
+	crash      *crashReport //nil unless we are in the middle of one
+}
+
+// newConsole makes a console that prints to out.  level is one of the
+// names in levelNames, categories is a comma separated list of STATS
+// categories to show (empty is all of them).
+func newConsole(out io.Writer, level string, categories string) (*console, error) {
+	min, ok := levelNames[strings.ToLower(level)]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %s, expected trace, debug, info, warn, error or fatal", level)
+	}
+	c := &console{out: out, minLevel: min, verbose: *verbose, now: time.Now,
+		symbols: kernelSymbols}
+	if categories != "" {
+		c.categories = make(map[string]bool)
+		for _, cat := range strings.Split(categories, ",") {
+			c.categories[strings.TrimSpace(cat)] = true
+		}
+	}
+	return c, nil
+}
+
+// capture writes every record that gets past the filters to path
+func (c *console) capture(path string) error {
+	fp, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	c.fp = fp
+	c.records = bufio.NewWriter(fp)
+	return nil
+}
+
+// show is true if the filters let r through.  Failures are always shown.
+func (c *console) show(r *logRecord) bool {
+	if r.failed() {
+		return true
+	}
+	if r.level < c.minLevel {
+		return false
+	}
+	if r.Category != "" && c.categories != nil && !c.categories[r.Category] {
+		return false
+	}
+	return true
+}
+
+// line handles one line from the device and returns the record for it,
+// or the crash report if the line finished one.  The caller decides what
+// to do about failures.
+func (c *console) line(l string) (logRecord, error) {
+	r := parseLogLine(l)
+	r.Time = c.now()
+	var report *logRecord
+	switch {
+	case c.crash == nil:
+		c.crash = parseCrashStart(r.Message)
+	case c.crash.add(r.Message), strings.HasPrefix(r.Message, crashEnd):
+		//still part of the report, the end is handled after we show the line
+	default: //the report is over, even if we didn't see the end
+		crash, err := c.emitCrash()
+		if err != nil {
+			return r, err
+		}
+		report = &crash
+		c.crash = parseCrashStart(r.Message)
+	}
+	//antc's chatter is still controlled by -v, like before there was a console
+	quiet := (l[0] == '*' && c.verbose < 2) || (l[0] == '@' && c.verbose == 0)
+	if err := c.emit(&r, quiet); err != nil {
+		return r, err
+	}
+	if c.crash != nil && strings.HasPrefix(r.Message, crashEnd) {
+		return c.emitCrash()
+	}
+	if report != nil {
+		return *report, nil
+	}
+	return r, nil
+}
+
+// emitCrash emits the report in progress and forgets about it
+func (c *console) emitCrash() (logRecord, error) {
+	r := c.crash.record(c.symbols)
+	r.Time = c.now()
+	c.crash = nil
+	return r, c.emit(&r, false)
+}
+
+// emit prints r and writes it to the capture file, if it gets past the filters
+func (c *console) emit(r *logRecord, quiet bool) error {
+	if !c.show(r) {
+		return nil
+	}
+	if !quiet {
+		fmt.Fprintf(c.out, "%s\n", r.display)
+	}
+	if c.records == nil {
+		return nil
+	}
+	buf, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := c.records.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	if r.failed() {
+		return c.records.Flush() //we are probably about to exit
+	}
+	return nil
+}
+
+// Close prints any crash report still waiting for its end and flushes
+// the captured records
+func (c *console) Close() error {
+	if c.crash != nil {
+		if _, err := c.emitCrash(); err != nil {
+			return err
+		}
+	}
+	if c.records == nil {
+		return nil
+	}
+	if err := c.records.Flush(); err != nil {
+		c.fp.Close()
+		return err
+	}
+	return c.fp.Close()
+}
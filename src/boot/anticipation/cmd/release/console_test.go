@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	cases := []struct {
+		line     string
+		level    string
+		category string
+		message  string
+		failed   bool
+	}{
+		{"ERROR: no sd card", "error", "", "no sd card", false},
+		{"WARN: slow clock", "warn", "", "slow clock", false},
+		{"INFO: kmem init5", "info", "", "kmem init5", false},
+		{"DEBUG:x=1", "debug", "", "x=1", false},
+		{"STATS[gc]: 12 collections", "stats", "gc", "12 collections", false},
+		{"STATS[]: nothing", "stats", "", "nothing", false},
+		{"FATAL:out of memory", "fatal", "", "out of memory", true},
+		{"panic: runtime error: index out of range", "panic", "", "runtime error: index out of range", true},
+		{"hello, world", "print", "", "hello, world", false},
+		{"STATS[broken", "print", "", "STATS[broken", false},
+		{"@entry point 30000000", "debug", "", "entry point 30000000", false},
+		{"!bad checksum", "error", "", "bad checksum", false},
+		{"#comment", "info", "", "comment", false},
+		{"*chatter", "trace", "", "chatter", false},
+	}
+	for _, c := range cases {
+		r := parseLogLine(c.line)
+		if r.Level != c.level || r.Category != c.category || r.Message != c.message || r.failed() != c.failed {
+			t.Errorf("%q: got %+v", c.line, r)
+		}
+	}
+}
+
+func TestConsoleFilters(t *testing.T) {
+	var out bytes.Buffer
+	c, err := newConsole(&out, "warn", "gc, sched")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	c.verbose = 0
+	for _, l := range []string{"DEBUG:no", "INFO:no", "WARN:yes", "hello", "STATS[gc]:no",
+		"ERROR:yes", "@no", "panic: yes"} {
+		if _, err := c.line(l); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if got, want := out.String(), "WARN:yes\nERROR:yes\npanic: yes\n"; got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+
+	out.Reset()
+	c, _ = newConsole(&out, "TRACE", "gc")
+	c.verbose = 0
+	for _, l := range []string{"STATS[gc]:yes", "STATS[net]:no", "*no", "@no", "#yes"} {
+		c.line(l)
+	}
+	if got, want := out.String(), "STATS[gc]:yes\n### yes\n"; got != want {
+		t.Errorf("got %q, expected %q", got, want)
+	}
+
+	if _, err := newConsole(&out, "loud", ""); err == nil {
+		t.Errorf("expected an error for a bad level")
+	}
+}
+
+func TestConsoleCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kernel.jsonl")
+	var out bytes.Buffer
+	c, _ := newConsole(&out, "info", "")
+	start := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tick := 0
+	c.now = func() time.Time {
+		tick++
+		return start.Add(time.Duration(tick) * time.Millisecond)
+	}
+	if err := c.capture(path); err != nil {
+		t.Fatalf("unable to capture: %v", err)
+	}
+	for _, l := range []string{"DEBUG:filtered", "INFO:booted", "STATS[gc]: 3", "FATAL:done"} {
+		if _, err := c.line(l); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("unable to close: %v", err)
+	}
+
+	fp, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open capture: %v", err)
+	}
+	defer fp.Close()
+	var records []logRecord
+	s := bufio.NewScanner(fp)
+	for s.Scan() {
+		if !strings.HasPrefix(s.Text(), "{") {
+			t.Fatalf("not a JSON object: %s", s.Text())
+		}
+		var r logRecord
+		if err := json.Unmarshal(s.Bytes(), &r); err != nil {
+			t.Fatalf("bad record %s: %v", s.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %+v", records)
+	}
+	if records[0].Level != "info" || records[0].Message != "booted" || !records[0].Time.Equal(start.Add(2*time.Millisecond)) {
+		t.Errorf("unexpected first record %+v", records[0])
+	}
+	if records[1].Level != "stats" || records[1].Category != "gc" || records[1].Message != "3" {
+		t.Errorf("unexpected stats record %+v", records[1])
+	}
+	if records[2].Level != "fatal" || records[2].Message != "done" {
+		t.Errorf("unexpected last record %+v", records[2])
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Crash reports.  When joy or antc take an exception they can't handle,
+// rawExceptionHandler prints the exception line, the fault address, any
+// frames it could find by following the frame pointers and then DEADLOOP.
+// We collect those lines and, since we still have the ELF we sent, print
+// the report again with the exception class decoded and the addresses
+// turned into function+offset (and file:line if there is DWARF).  antc
+// sends its report as # comments during the transfer, and the ELF we have
+// isn't antc's, so its addresses are left as they are.
+///////////////////////////////////////////////////////////////////////
+
+// these must match what rawExceptionHandler prints
+const (
+	crashExceptionFormat = "raw exception handler:exception type %d and esr %x with addr %x and EL=%d, ProcID=%x"
+	crashFaultFormat     = "fault address %x"
+	crashFrameFormat     = "frame %d: %x"
+	crashEnd             = "DEADLOOP"
+)
+
+// the kernel being watched, set by main, nil when we don't have one
+var kernelSymbols *symbolizer
+
+// this mirrors upbeat.PrintoutException, indexed by the exception class
+// (the top 6 bits of the ESR).  Classes not here are unused.
+var exceptionClasses = map[uint64]string{
+	0:  "unknown exception",
+	1:  "trapped WFE or WFI instruction",
+	3:  "trapped MRRC or MCRR access",
+	4:  "trapped MRRC or MCRR access",
+	5:  "trapped MRC or MCR access",
+	6:  "trapped LDC or STC access",
+	7:  "access to SVE, advanced SIMD or FP functionality",
+	12: "trapped to MRRC access",
+	13: "branch target exception",
+	14: "illegal execution state",
+	17: "SVC instruction in AARCH32",
+	21: "SVC instruction in AARCH64",
+	24: "trapped MRS, MSR or System instruction in AARCH64",
+	25: "access to SVE functionality",
+	32: "instruction abort from lower exception level",
+	33: "instruction abort from same exception level",
+	34: "PC alignment fault",
+	36: "data abort from lower exception level",
+	37: "data abort from same exception level",
+	40: "trapped floating point exception from AARCH32",
+	44: "trapped floating point exception from AARCH64",
+	47: "SError exception",
+	48: "Breakpoint from lower exception level",
+	49: "Breakpoint from same exception level",
+	50: "Software step from lower exception level",
+	51: "Software step from same exception level",
+	52: "Watchpoint from lower exception level",
+	53: "Watchpoint from same exception level",
+	56: "BKPT from AARCH32",
+	60: "BRK from AARCH64",
+}
+
+// describeESR is the exception class in words, with the immediate for SVCs
+func describeESR(esr uint64) string {
+	class := esr >> 26
+	s, ok := exceptionClasses[class]
+	if !ok {
+		return fmt.Sprintf("unused exception code, should never happen (%d)", class)
+	}
+	if class == 17 || class == 21 {
+		s += fmt.Sprintf(" [%x]", esr&0xffff)
+	}
+	return s
+}
+
+// faultAddressValid is true for the classes where the FAR means something
+func faultAddressValid(esr uint64) bool {
+	switch esr >> 26 {
+	case 32, 33, 34, 36, 37, 52, 53:
+		return true
+	}
+	return false
+}
+
+type symbolizer struct {
+	funcs []elf.Symbol //sorted by address
+	dw    *dwarf.Data  //nil if the kernel has no debug info
+}
+
+// newSymbolizer uses fp's function symbols and, if it has them, line
+// numbers.  It returns nil if there are no symbols at all.
+func newSymbolizer(fp *elf.File) *symbolizer {
+	syms, err := fp.Symbols()
+	if err != nil {
+		return nil
+	}
+	s := &symbolizer{}
+	for _, sym := range syms {
+		if elf.ST_TYPE(sym.Info) == elf.STT_FUNC && sym.Value != 0 {
+			s.funcs = append(s.funcs, sym)
+		}
+	}
+	if len(s.funcs) == 0 {
+		return nil
+	}
+	sort.Slice(s.funcs, func(i, j int) bool { return s.funcs[i].Value < s.funcs[j].Value })
+	if dw, err := fp.DWARF(); err == nil {
+		s.dw = dw
+	}
+	return s
+}
+
+// describe is addr as function+offset (file:line), or just the address
+// if it isn't in any function we know about
+func (s *symbolizer) describe(addr uint64) string {
+	result := fmt.Sprintf("%016x", addr)
+	if s == nil {
+		return result
+	}
+	i := sort.Search(len(s.funcs), func(i int) bool { return s.funcs[i].Value > addr }) - 1
+	if i < 0 {
+		return result
+	}
+	f := s.funcs[i]
+	if f.Size != 0 && addr >= f.Value+f.Size {
+		return result
+	}
+	result += fmt.Sprintf(" %s+0x%x", f.Name, addr-f.Value)
+	if file, line, ok := s.line(addr); ok {
+		result += fmt.Sprintf(" (%s:%d)", file, line)
+	}
+	return result
+}
+
+func (s *symbolizer) line(addr uint64) (string, int, bool) {
+	if s.dw == nil {
+		return "", 0, false
+	}
+	cu, err := s.dw.Reader().SeekPC(addr)
+	if err != nil {
+		return "", 0, false
+	}
+	lr, err := s.dw.LineReader(cu)
+	if err != nil || lr == nil {
+		return "", 0, false
+	}
+	var entry dwarf.LineEntry
+	if err := lr.SeekPC(addr, &entry); err != nil || entry.File == nil {
+		return "", 0, false
+	}
+	return entry.File.Name, entry.Line, true
+}
+
+// crashReport is the pieces of one crash, as they arrive
+type crashReport struct {
+	kind, esr, elr, el, core uint64
+	far                      uint64
+	haveFar                  bool
+	frames                   []uint64
+}
+
+// parseCrashStart returns a new report if msg is the exception line
+func parseCrashStart(msg string) *crashReport {
+	c := &crashReport{}
+	if _, err := fmt.Sscanf(msg, crashExceptionFormat, &c.kind, &c.esr, &c.elr, &c.el, &c.core); err != nil {
+		return nil
+	}
+	return c
+}
+
+// add takes the fault address and frame lines, false means msg isn't
+// part of a crash report
+func (c *crashReport) add(msg string) bool {
+	var a uint64
+	var n int
+	if _, err := fmt.Sscanf(msg, crashFaultFormat, &a); err == nil {
+		c.far, c.haveFar = a, true
+		return true
+	}
+	if _, err := fmt.Sscanf(msg, crashFrameFormat, &n, &a); err == nil {
+		c.frames = append(c.frames, a)
+		return true
+	}
+	return false
+}
+
+// text is the report to print, one line per element
+func (c *crashReport) text(s *symbolizer) []string {
+	lines := []string{
+		fmt.Sprintf("=== crash: exception type %d on core %d at EL%d ===", c.kind, c.core, c.el),
+		fmt.Sprintf("    %s (esr %x)", describeESR(c.esr), c.esr),
+		fmt.Sprintf("    pc  %s", s.describe(c.elr)),
+	}
+	if c.haveFar && faultAddressValid(c.esr) {
+		lines = append(lines, fmt.Sprintf("    far %s", s.describe(c.far)))
+	}
+	if len(c.frames) > 0 {
+		lines = append(lines, "    called from:")
+		for i, f := range c.frames {
+			//the return address is the instruction after the call
+			lines = append(lines, fmt.Sprintf("    #%-2d %s", i, s.describe(f-4)))
+		}
+	}
+	return lines
+}
+
+// record is the report as a log record, which always counts as a failure
+func (c *crashReport) record(s *symbolizer) logRecord {
+	lines := c.text(s)
+	return logRecord{Level: "crash", Message: strings.Join(lines, "\n"), level: levelFatal,
+		display: strings.Join(lines, "\n")}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"debug/elf"
+	"strings"
+	"testing"
+)
+
+func testSymbolizer() *symbolizer {
+	return &symbolizer{funcs: []elf.Symbol{
+		{Name: "joy.KernelMain", Value: 0x1000, Size: 0x100},
+		{Name: "main.run", Value: 0x2000},
+	}}
+}
+
+func TestDescribeESR(t *testing.T) {
+	cases := map[uint64]string{
+		0x96000045: "data abort from same exception level",
+		0x56000010: "SVC instruction in AARCH64 [10]",
+		0xf2000000: "BRK from AARCH64",
+		0x08000000: "unused exception code, should never happen (2)",
+	}
+	for esr, want := range cases {
+		if got := describeESR(esr); got != want {
+			t.Errorf("%x: got %q, expected %q", esr, got, want)
+		}
+	}
+}
+
+func TestSymbolizer(t *testing.T) {
+	s := testSymbolizer()
+	cases := map[uint64]string{
+		0x1010: "0000000000001010 joy.KernelMain+0x10",
+		0x1100: "0000000000001100",
+		0x2050: "0000000000002050 main.run+0x50",
+		0x0500: "0000000000000500",
+	}
+	for addr, want := range cases {
+		if got := s.describe(addr); got != want {
+			t.Errorf("%x: got %q, expected %q", addr, got, want)
+		}
+	}
+	var none *symbolizer
+	if got := none.describe(0x1010); got != "0000000000001010" {
+		t.Errorf("no symbols: got %q", got)
+	}
+}
+
+func TestConsoleCrash(t *testing.T) {
+	var out bytes.Buffer
+	c, _ := newConsole(&out, "trace", "")
+	c.symbols = testSymbolizer()
+	lines := []string{
+		"INFO:kmem init5",
+		"INFO:raw exception handler:exception type 4 and esr 96000045 with addr 1010 and EL=1, ProcID=2",
+		"ERROR:fault address 8",
+		"ERROR:frame 0: 2054",
+		"ERROR:DEADLOOP!",
+	}
+	var last logRecord
+	for i, l := range lines {
+		r, err := c.line(l)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if i < len(lines)-1 && r.failed() {
+			t.Fatalf("%q should not be a failure", l)
+		}
+		last = r
+	}
+	if !last.failed() || last.Level != "crash" {
+		t.Fatalf("expected a crash report, got %+v", last)
+	}
+	for _, want := range []string{
+		"exception type 4 on core 2 at EL1",
+		"data abort from same exception level (esr 96000045)",
+		"pc  0000000000001010 joy.KernelMain+0x10",
+		"far 0000000000000008",
+		"#0  0000000000002050 main.run+0x50",
+	} {
+		if !strings.Contains(last.Message, want) || !strings.Contains(out.String(), want) {
+			t.Errorf("report is missing %q:\n%s", want, out.String())
+		}
+	}
+
+	//a report with no end is finished by the next line that isn't part of it
+	out.Reset()
+	c.line("ERROR:raw exception handler:exception type 0 and esr 56000001 with addr 2000 and EL=1, ProcID=0")
+	r, _ := c.line("hello")
+	if !r.failed() || !strings.Contains(r.Message, "SVC instruction in AARCH64 [1]") || strings.Contains(r.Message, "far") {
+		t.Errorf("unexpected report %+v", r)
+	}
+	if !strings.HasSuffix(out.String(), "hello\n") {
+		t.Errorf("expected the report before the line that ended it:\n%s", out.String())
+	}
+
+	//or by the end of the log
+	out.Reset()
+	c.line("ERROR:raw exception handler:exception type 0 and esr 96000045 with addr 2000 and EL=1, ProcID=0")
+	c.Close()
+	if !strings.Contains(out.String(), "=== crash") {
+		t.Errorf("expected a report when closing:\n%s", out.String())
+	}
+}
+
+// antc sends its report as comments, and we have no symbols for it
+func TestConsoleAntcCrash(t *testing.T) {
+	var out bytes.Buffer
+	c, _ := newConsole(&out, "trace", "")
+	c.symbols = nil
+	var r logRecord
+	for _, l := range []string{
+		"#raw exception handler:exception type 4 and esr 96000045 with addr 80120 and EL=1, ProcID=0",
+		"#fault address 3f300000",
+		"#frame 0: 80444",
+		"#DEADLOOP",
+	} {
+		r, _ = c.line(l)
+	}
+	if !r.failed() {
+		t.Fatalf("expected a crash report, got %+v", r)
+	}
+	for _, want := range []string{
+		"data abort from same exception level (esr 96000045)",
+		"pc  0000000000080120\n",
+		"far 000000003f300000",
+		"#0  0000000000080440",
+	} {
+		if !strings.Contains(r.Message+"\n", want) {
+			t.Errorf("report is missing %q:\n%s", want, r.Message)
+		}
+	}
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
-	"boot/anticipation"
-	"debug/elf"
+	"bytes"
 	"io"
 	"log"
 	"unsafe"
+
+	"boot/anticipation"
+	"lib/bootparams"
 )
 
 const resetIncrement = 0xff00 //a little less than 64K
 
+// most bytes we try to squeeze into a single compressed line
+const compressedReadSize = 0x4000
+
+// bytes of the bootloader params in each data line, same as a segment
+const paramsLineSize = 0x30
+
 ///////////////////////////////////////////////////////////////////////////////
 // emitter can take a blob of data and emit the necessary commands to transmit
 // that memory to the other side. It uses a ioProto to do the actual IO work
@@ -18,18 +26,21 @@ const resetIncrement = 0xff00 //a little less than 64K
 type emitter interface {
 	line() (string, error)
 	next() bool //true if no more lines
-	reset()     //return to beginning of sect
+	reset()     //return to beginning of segment
 	name() string
+	segment() *loadableSegment //what the device ends up with
 	read([]uint8) (string, error)
 	receiver() ioProto
 	currentAddr() uint32
+	position() uint32 //offset of the next line in the segment
+	seek(uint32)      //go back to position, starting with the base address
 }
 
-// loadableSectionEmitter works from the blob of data in a loadable section of
+// loadableSegmentEmitter works from the blob of data in a loadable segment of
 // an elf format binary
-type loadableSectionEmitter struct {
-	sect              *elf.Section
-	loadable          *loadableSect
+type loadableSegmentEmitter struct {
+	loadable          *loadableSegment
+	base              uint64 //base address on the device, moves up 64K at a time
 	state             emitterState
 	current           uint32
 	resetPoint        uint32
@@ -37,6 +48,8 @@ type loadableSectionEmitter struct {
 	buffer            []uint8
 	seeker            io.ReadSeeker
 	pendingLineLength uint16
+	compressBuffer    []uint8
+	plan              *reloadPlan //windows the device already has, can be nil
 }
 
 type emitterState int
@@ -48,6 +61,7 @@ const (
 	swData          emitterState = 3
 	swBigEntryPoint emitterState = 4
 	swBigAddr       emitterState = 5
+	swKeep          emitterState = 6 //device already has this window
 )
 
 type constantWriterState int
@@ -59,47 +73,49 @@ const (
 	cwData    constantWriterState = 3
 )
 
-func newSectionEmitter(s *elf.Section, l *loadableSect, oh ioProto) emitter {
-	if s.Size > 0xffff {
-		log.Fatalf("unable to encode inflating sect (.bss) because size is greater than 0xffff (16 bits): %x", s.Size)
+func newSegmentEmitter(l *loadableSegment, oh ioProto) emitter {
+	if l.inflate && l.size > 0xffff {
+		log.Fatalf("unable to encode inflating %s because size is greater than 0xffff (16 bits): %x", l.name, l.size)
 	}
-	if l.vaddr&0xffff_ffff_0000_000 == 0 && l.vaddr&0xffff != 0 {
-		if l.vaddr&0xf != 0 {
-			log.Fatalf("unable to create base addr for sect %s, %x has neither lower 16 or lower 4 bits clear", l.name, l.vaddr)
+	if l.addr&0xffff_ffff_0000_000 == 0 && l.addr&0xffff != 0 {
+		if l.addr&0xf != 0 {
+			log.Fatalf("unable to create base addr for %s, %x has neither lower 16 or lower 4 bits clear", l.name, l.addr)
 		}
-		if l.vaddr&0xfff00000 != 0 {
-			log.Fatalf("unable to create base addr for sect %s, %x has width > 16bits that will not fit in ESA", l.name, l.vaddr)
+		if l.addr&0xfff00000 != 0 {
+			log.Fatalf("unable to create base addr for %s, %x has width > 16bits that will not fit in ESA", l.name, l.addr)
 		}
 		l.addressType = anticipation.ExtendedSegmentAddress
 	} else {
 		l.addressType = anticipation.ExtensionBigEntryPoint
 	}
-	return &loadableSectionEmitter{sect: s,
-		loadable:   l,
-		state:      swStart,
-		oh:         oh,
-		buffer:     make([]uint8, anticipation.FileXFerDataLineSize+1),
-		current:    0,
-		resetPoint: resetIncrement, //16 bits in a data line means we need a reset before rollover
-		seeker:     nil,
+	return &loadableSegmentEmitter{
+		loadable:       l,
+		base:           l.addr,
+		state:          swStart,
+		oh:             oh,
+		buffer:         make([]uint8, anticipation.FileXFerDataLineSize+1),
+		compressBuffer: make([]uint8, compressedReadSize),
+		current:        0,
+		resetPoint:     resetIncrement, //16 bits in a data line means we need a reset before rollover
+		seeker:         nil,
 	}
 }
 
-func (s *loadableSectionEmitter) receiver() ioProto {
+func (s *loadableSegmentEmitter) receiver() ioProto {
 	return s.oh
 }
 
-func (s *loadableSectionEmitter) name() string {
-	return s.sect.Name
+func (s *loadableSegmentEmitter) name() string {
+	return s.loadable.name
 }
-func (s *loadableSectionEmitter) section() *elf.Section {
-	return s.sect
+func (s *loadableSegmentEmitter) segment() *loadableSegment {
+	return s.loadable
 }
-func (s *loadableSectionEmitter) currentAddr() uint32 {
+func (s *loadableSegmentEmitter) currentAddr() uint32 {
 	return s.current
 }
 
-func (s *loadableSectionEmitter) next() bool {
+func (s *loadableSegmentEmitter) next() bool {
 	switch s.state {
 	case swStart:
 		if s.loadable.entrypoint != uint64signal {
@@ -109,7 +125,7 @@ func (s *loadableSectionEmitter) next() bool {
 		}
 		return true
 	case swEntryPoint:
-		s.state = swAddr
+		s.state = swBigAddr //the entry point doesn't tell the device the top of base
 		return true
 	case swBigEntryPoint:
 		s.state = swEntryPoint
@@ -118,9 +134,13 @@ func (s *loadableSectionEmitter) next() bool {
 		s.state = swAddr
 		return true
 	case swAddr:
+		if _, ok := s.plan.kept(s.loadable.addr + uint64(s.current)); ok {
+			s.state = swKeep
+			return true
+		}
 		s.state = swData
 		if !s.loadable.inflate {
-			s.seeker = s.sect.Open()
+			s.seeker = s.loadable.open()
 			//at start s.current==0 but later we may pass a 64K boundary
 			//and in that case it will not be ==0
 			s.seeker.Seek(int64(s.current), io.SeekStart)
@@ -128,10 +148,19 @@ func (s *loadableSectionEmitter) next() bool {
 		return true
 	case swData:
 		s.current += uint32(s.pendingLineLength)
-		if uint64(s.current) == s.sect.Size {
+		if uint64(s.current) == s.loadable.size {
 			return false
 		}
 		return true
+	case swKeep:
+		s.current = uint32(windowEnd(s.loadable, uint64(s.current)))
+		if uint64(s.current) == s.loadable.size {
+			return false
+		}
+		//same as the end of a trimmed line, on to the next 64K
+		s.base += 0x10000
+		s.state = swStart
+		return s.next()
 	}
 	panic("unexpected emitter state")
 }
@@ -139,7 +168,7 @@ func (s *loadableSectionEmitter) next() bool {
 var rollover = ^uint64(0xffff)
 
 //string return value here is of limited value, it's already been transmitted
-func (s *loadableSectionEmitter) line() (string, error) {
+func (s *loadableSegmentEmitter) line() (string, error) {
 	switch s.state {
 	case swStart:
 		panic("should never request a line in start state")
@@ -162,7 +191,7 @@ func (s *loadableSectionEmitter) line() (string, error) {
 		}
 		return result, nil
 	case swBigAddr:
-		top := uint32(s.loadable.vaddr >> 32)
+		top := uint32(s.base >> 32)
 		result := anticipation.EncodeBigAddr(top)
 		s.pendingLineLength = uint16(len(result))
 		err := s.oh.BigBaseAddr(result, top)
@@ -171,7 +200,7 @@ func (s *loadableSectionEmitter) line() (string, error) {
 		}
 		return result, nil
 	case swAddr:
-		bottom := uint32(s.loadable.vaddr & 0xffff_ffff)
+		bottom := uint32(s.base & 0xffff_ffff)
 		if s.loadable.addressType == anticipation.ExtendedSegmentAddress {
 			result := anticipation.EncodeESA(uint16(bottom >> 4))
 			s.pendingLineLength = uint16(len(result))
@@ -190,21 +219,32 @@ func (s *loadableSectionEmitter) line() (string, error) {
 			}
 			return result, nil
 		}
+	case swKeep:
+		w, _ := s.plan.kept(s.loadable.addr + uint64(s.current))
+		result := anticipation.EncodeWindowHash(anticipation.WindowHashKeep, w.Addr, w.Size, w.Sum)
+		s.pendingLineLength = 0
+		err := s.oh.(reloader).WindowHash(result, anticipation.WindowHashKeep, w.Addr)
+		if err != nil {
+			return "", err
+		}
+		return result, nil
 	case swData:
+		if *compressFlag {
+			return s.compressedLine()
+		}
 		payloadSize := uint32(0x30)
-		if uint32(s.sect.Size)-s.current < payloadSize {
-			payloadSize = uint32(s.sect.Size) - s.current
+		if uint32(s.loadable.size)-s.current < payloadSize {
+			payloadSize = uint32(s.loadable.size) - s.current
 		}
 		trimmed := false
-		currentLowest16ForProtocol := uint16(s.current&0xffff) + uint16(s.sect.Addr&0xffff)
+		currentLowest16ForProtocol := uint16(s.current&0xffff) + uint16(s.loadable.addr&0xffff)
 		lowest16As32 := uint32(currentLowest16ForProtocol)
 		if lowest16As32+payloadSize > 0xffff {
-			diff := (0x10000 - (lowest16As32 + payloadSize))
-			if diff > 0 { //may have already been aligned perfectly
-				//too big, gotta trim
-				payloadSize -= diff //subtract difference, possibly zero
+			//too big, gotta trim (may have already been aligned perfectly)
+			payloadSize = 0x10000 - lowest16As32
+			if *verbose > 1 {
+				log.Printf("trimmed at 64K boundary: %d", payloadSize)
 			}
-			log.Printf("trimmed: %d", diff)
 			trimmed = true
 		}
 		var result string
@@ -227,7 +267,7 @@ func (s *loadableSectionEmitter) line() (string, error) {
 			return "", err
 		}
 		if trimmed { //we succeceded with the last line of this 64k bunch
-			s.loadable.vaddr += 0x10000
+			s.base += 0x10000
 			s.state = swStart //force resend starting next packet
 			//tricky: this means that we will not add pending count on next
 			//packet, so we better do it ourselves
@@ -240,12 +280,64 @@ func (s *loadableSectionEmitter) line() (string, error) {
 	panic("unexpected emitter state!")
 }
 
+// compressedLine sends as much of the segment as will fit in one compressed
+// line, stopping at the 64K boundary just like a data line does
+func (s *loadableSegmentEmitter) compressedLine() (string, error) {
+	currentLowest16ForProtocol := uint16(s.current&0xffff) + uint16(s.loadable.addr&0xffff)
+	span := uint32(s.loadable.size) - s.current
+	if span > compressedReadSize {
+		span = compressedReadSize
+	}
+	toBoundary := 0x10000 - uint32(currentLowest16ForProtocol)
+	if span > toBoundary {
+		span = toBoundary
+	}
+	raw := s.compressBuffer[:span]
+	if !s.loadable.inflate { //inflate just leaves the buffer as zeros
+		_, err := s.seeker.Seek(int64(s.current), io.SeekStart)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.ReadFull(s.seeker, raw)
+		if err != nil {
+			return "", err
+		}
+	}
+	result, consumed := anticipation.EncodeCompressedData(raw, currentLowest16ForProtocol)
+	s.pendingLineLength = uint16(consumed)
+	err := s.oh.CompressedData(result, raw[:consumed])
+	if err != nil {
+		return "", err
+	}
+	if uint32(currentLowest16ForProtocol)+uint32(consumed) == 0x10000 {
+		//same dance as the trimmed case of a data line
+		s.base += 0x10000
+		s.state = swStart
+		s.current += uint32(s.pendingLineLength)
+		s.pendingLineLength = 0
+	}
+	return result, nil
+}
+
 // normally, you want to call next() immediately after this
-func (s *loadableSectionEmitter) reset() {
+func (s *loadableSegmentEmitter) reset() {
+	s.state = swStart
+}
+
+func (s *loadableSegmentEmitter) position() uint32 {
+	return s.current
+}
+
+// seek is like reset, but to the 64K that holds offset
+func (s *loadableSegmentEmitter) seek(offset uint32) {
+	chunks := ((s.loadable.addr + uint64(offset)) >> 16) - (s.loadable.addr >> 16)
+	s.base = s.loadable.addr + chunks<<16
+	s.current = offset
+	s.pendingLineLength = 0
 	s.state = swStart
 }
 
-func (s *loadableSectionEmitter) read(buffer []uint8) (string, error) {
+func (s *loadableSegmentEmitter) read(buffer []uint8) (string, error) {
 	return s.oh.Read(buffer)
 }
 
@@ -254,14 +346,14 @@ func (s *loadableSectionEmitter) read(buffer []uint8) (string, error) {
 //
 type constantParamsEmitter struct {
 	addr              uint64
-	params            *BootloaderParamsDef
+	params            *bootparams.BootloaderParamsDef
 	state             constantWriterState
 	io                ioProto
-	done              bool
+	offset            uint64 //how much of the params have been sent
 	pendingLineLength uint16
 }
 
-func newContstantParamsEmitter(addr uint64, params *BootloaderParamsDef, io ioProto) emitter {
+func newContstantParamsEmitter(addr uint64, params *bootparams.BootloaderParamsDef, io ioProto) emitter {
 	return &constantParamsEmitter{addr: addr, params: params, io: io, state: cwStart}
 }
 func (c *constantParamsEmitter) line() (string, error) {
@@ -269,7 +361,7 @@ func (c *constantParamsEmitter) line() (string, error) {
 	case cwStart:
 		panic("should never request a line in start state")
 	case cwBigAddr:
-		top := uint32(uintptr(c.addr) >> 32)
+		top := uint32(uintptr(c.addr+c.offset) >> 32)
 		result := anticipation.EncodeBigAddr(top)
 		c.pendingLineLength = uint16(len(result))
 		err := c.io.BigBaseAddr(result, top)
@@ -278,7 +370,7 @@ func (c *constantParamsEmitter) line() (string, error) {
 		}
 		return result, nil
 	case cwAddr:
-		bottom := uint32(uintptr(c.addr) & 0xffffffff)
+		bottom := uint32(uintptr(c.addr+c.offset) & 0xffffffff)
 		result := anticipation.EncodeELA(uint16(bottom >> 16))
 		c.pendingLineLength = uint16(len(result))
 		err := c.io.BaseAddrELA(result, bottom)
@@ -288,14 +380,16 @@ func (c *constantParamsEmitter) line() (string, error) {
 		return result, nil
 
 	case cwData:
-		//6 uint64s
-		currentLowest16ForProtocol := uint16(uintptr(c.addr) & 0xffff)
-		payloadSize := uint32(unsafe.Sizeof(BootloaderParamsDef{}))
-		rawData := make([]byte, payloadSize)
-		for i := 0; i < int(payloadSize); i++ {
-			ptr := (*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(&bootloaderParamsCopy)) + uintptr(i)))
-			rawData[i] = *ptr
+		//too big for one line, so in pieces like a segment
+		currentLowest16ForProtocol := uint16(uintptr(c.addr+c.offset) & 0xffff)
+		rawData := paramsBytes(c.params)[c.offset:]
+		if len(rawData) > paramsLineSize {
+			rawData = rawData[:paramsLineSize]
 		}
+		if uint32(currentLowest16ForProtocol)+uint32(len(rawData)) > 0x10000 {
+			rawData = rawData[:0x10000-uint32(currentLowest16ForProtocol)]
+		}
+		c.pendingLineLength = uint16(len(rawData))
 		result := anticipation.EncodeDataBytes(rawData, currentLowest16ForProtocol)
 		err := c.io.Data(result, rawData)
 		if err != nil {
@@ -306,6 +400,17 @@ func (c *constantParamsEmitter) line() (string, error) {
 	panic("unexpected emitter state!")
 
 }
+// paramsBytes is the in-memory form of the params, what ends up in the kernel
+func paramsBytes(p *bootparams.BootloaderParamsDef) []byte {
+	payloadSize := uint32(unsafe.Sizeof(*p))
+	rawData := make([]byte, payloadSize)
+	for i := 0; i < int(payloadSize); i++ {
+		ptr := (*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(p)) + uintptr(i)))
+		rawData[i] = *ptr
+	}
+	return rawData
+}
+
 func (c *constantParamsEmitter) next() bool {
 	switch c.state {
 	case cwStart:
@@ -318,17 +423,29 @@ func (c *constantParamsEmitter) next() bool {
 		c.state = cwData
 		return true
 	case cwData:
-		//only one line
-		if c.done {
-			return true
+		c.offset += uint64(c.pendingLineLength)
+		c.pendingLineLength = 0
+		if c.offset == uint64(len(paramsBytes(c.params))) {
+			return false
 		}
-		c.done = true
-		return false
+		if (c.addr+c.offset)&0xffff == 0 { //crossed into the next 64K
+			c.state = cwBigAddr
+		}
+		return true
 	}
 	panic("bad state of constantParamsEmitter")
 }
 func (c *constantParamsEmitter) reset() {
-	c.done = false
+	c.offset = 0
+	c.state = cwStart
+}
+func (c *constantParamsEmitter) position() uint32 {
+	return uint32(c.offset)
+}
+func (c *constantParamsEmitter) seek(offset uint32) {
+	c.offset = uint64(offset)
+	c.pendingLineLength = 0
+	c.state = cwStart
 }
 func (c *constantParamsEmitter) name() string {
 	return "bootloader parameters"
@@ -336,9 +453,14 @@ func (c *constantParamsEmitter) name() string {
 func (c *constantParamsEmitter) read(buffer []uint8) (string, error) {
 	return c.io.Read(buffer)
 }
+// the params block looks like a tiny segment to the receiver
+func (c *constantParamsEmitter) segment() *loadableSegment {
+	raw := paramsBytes(c.params)
+	return newLoadableSegment(c.name(), c.addr, c.addr, uint64(len(raw)), bytes.NewReader(raw))
+}
 func (c *constantParamsEmitter) receiver() ioProto {
 	return c.io
 }
 func (c *constantParamsEmitter) currentAddr() uint32 {
-	return uint32(uintptr(c.addr) & 0xffffffff)
+	return uint32(uintptr(c.addr+c.offset) & 0xffffffff)
 }
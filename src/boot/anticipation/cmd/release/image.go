@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Images on disk.  hexFileIOProto writes the same lines we would send to
+// the device into a file, with nothing to negotiate since nobody is on
+// the other end.  The raw image is the kernel as it sits in memory, with
+// the bootloader params already in it, for kernel8.img or qemu -kernel.
+///////////////////////////////////////////////////////////////////////
+
+// the biggest raw image we will write, segments spread out further than
+// this are probably a mistake in the linker script
+const maxRawImage = 0x1000_0000
+
+// hexFileIOProto is not a windower (or a framer), there is no one to ask
+type hexFileIOProto struct {
+	fp   *os.File
+	w    *bufio.Writer
+	last string
+}
+
+func newHexFileIOProto(path string) *hexFileIOProto { //returns nil when it can't create the file
+	fp, err := os.Create(path)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil
+	}
+	return &hexFileIOProto{fp: fp, w: bufio.NewWriter(fp)}
+}
+
+func (h *hexFileIOProto) NewSegment(_ *loadableSegment) error {
+	return nil //nothing to do for us
+}
+func (h *hexFileIOProto) Data(s string, _ []uint8) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) CompressedData(s string, _ []uint8) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) DataInflate(s string, _ uint16) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) EntryPoint(s string, _ uint32) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) BigEntryPoint(s string, _ uint32) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) BaseAddrESA(s string, _ uint32) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) BigBaseAddr(s string, _ uint32) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) BaseAddrELA(s string, _ uint32) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) ExtensionSetParams(s string, _ [4]uint64) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) BinaryFraming(s string, _ uint8) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) Window(s string, _ uint8) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) ImageDigest(s string, _ []byte) error {
+	return h.sendString(s)
+}
+func (h *hexFileIOProto) EOF() (string, error) {
+	return EOFLine, h.sendString(EOFLine)
+}
+
+func (h *hexFileIOProto) sendString(s string) error {
+	h.last = s
+	_, err := h.w.WriteString(s + "\n")
+	return err
+}
+
+func (h *hexFileIOProto) Sent() (uint8, string) {
+	return 0, h.last
+}
+
+func (h *hexFileIOProto) Resend(_ uint8, _ string) error {
+	return nil //we never nak, so this can't happen
+}
+
+// Read is the "device" accepting every line
+func (h *hexFileIOProto) Read(_ []uint8) (string, error) {
+	return ".", nil
+}
+
+// Close flushes the lines to the file
+func (h *hexFileIOProto) Close() error {
+	if err := h.w.Flush(); err != nil {
+		h.fp.Close()
+		return err
+	}
+	return h.fp.Close()
+}
+
+// writeRawImage writes memory as the kernel expects it, from the lowest
+// physical address of any segment to the end of the highest.  Gaps and zero
+// fill are zeros.  The firmware jumps to the first byte, so the entry point
+// better be there.
+func writeRawImage(path string, segs []*loadableSegment) {
+	setBootloaderParams()
+	low, high := ^uint64(0), uint64(0)
+	for _, l := range segs {
+		if l.addr < low {
+			low = l.addr
+		}
+		if l.addr+l.size > high {
+			high = l.addr + l.size
+		}
+	}
+	if high-low > maxRawImage {
+		log.Fatalf("segments span %x bytes (%x to %x), too big for a raw image", high-low, low, high)
+	}
+	image := make([]byte, high-low)
+	for _, l := range segs {
+		if l.inflate {
+			continue //already zero
+		}
+		if _, err := io.ReadFull(l.open(), image[l.addr-low:l.addr-low+l.size]); err != nil {
+			log.Fatalf("unable to read %s: %v", l.name, err)
+		}
+	}
+	if bootloaderParamsLocation == 0 {
+		log.Printf("no bootloader_params symbol, the image has no boot parameters")
+	} else {
+		params := paramsBytes(&bootloaderParamsCopy)
+		p := physicalAddress(segs, bootloaderParamsLocation)
+		if p < low || p+uint64(len(params)) > high {
+			log.Fatalf("bootloader params at %x are outside the image (%x to %x)", p, low, high)
+		}
+		copy(image[p-low:], params)
+	}
+	entry := physicalAddress(segs, bootloaderParamsCopy.EntryPoint)
+	if entry != low {
+		log.Printf("warning: entry point %x is not at the start of the image (%x), the firmware jumps to the first byte", entry, low)
+	}
+	if err := ioutil.WriteFile(path, image, 0644); err != nil {
+		log.Fatalf("unable to write %s: %v", path, err)
+	}
+	log.Printf("wrote %s: %d bytes to be loaded at %x", path, len(image), low)
+}
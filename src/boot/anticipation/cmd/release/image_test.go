@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"boot/anticipation"
+)
+
+func TestHexFileReplays(t *testing.T) {
+	fp, text, data := testKernel(t)
+	for _, compress := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compressed %v", compress), func(t *testing.T) {
+			defer setFlags(16, compress, "")()
+			path := filepath.Join(t.TempDir(), "kernel.hex")
+			oh := newHexFileIOProto(path)
+			if oh == nil {
+				t.Fatalf("unable to create %s", path)
+			}
+			protocol("test kernel", loadKernel(fp), oh)
+
+			//play the file back the way antc would
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("unable to open %s: %v", path, err)
+			}
+			defer f.Close()
+			bb := anticipation.NewSparseByteBuster()
+			done := false
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				if done {
+					t.Fatalf("line after the EOF: %s", scanner.Text())
+				}
+				converted, lt, _, err := anticipation.DecodeAndCheckStringToBytes(scanner.Text())
+				if err != nil {
+					t.Fatalf("bad line %s: %v", scanner.Text(), err)
+				}
+				if lt == anticipation.ExtensionWindow || lt == anticipation.ExtensionBinaryFraming {
+					t.Fatalf("negotiation in a hex file: %s", scanner.Text())
+				}
+				var failed bool
+				failed, done = anticipation.ProcessLine(lt, converted, bb)
+				if failed {
+					t.Fatalf("unable to process %s", scanner.Text())
+				}
+			}
+			if !done {
+				t.Fatalf("no EOF in the hex file")
+			}
+			if err := bb.VerifyImage(nil); err != nil {
+				t.Errorf("digest: %v", err)
+			}
+			checkMemory(t, bb, text, data)
+		})
+	}
+}
+
+func TestRawImage(t *testing.T) {
+	fp, text, data := testKernel(t)
+	path := filepath.Join(t.TempDir(), "kernel8.img")
+	writeRawImage(path, loadKernel(fp))
+	image, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("unable to read image: %v", err)
+	}
+	expected := make([]byte, testData-testText+testDataSize+testBssSize)
+	copy(expected, text)
+	copy(expected[testData-testText:], data)
+	copy(expected[testParams-testText:], paramsBytes(&bootloaderParamsCopy))
+	if !bytes.Equal(image, expected) {
+		t.Errorf("image is not right (%d bytes, expected %d)", len(image), len(expected))
+	}
+}
@@ -1,9 +1,10 @@
 package main
 
 import (
-	"debug/elf"
+	"bytes"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 
 	"boot/anticipation"
@@ -18,6 +19,7 @@ import (
 ////////////////////////////////////////////////////////////////////////////////
 type ioProto interface {
 	Data(s string, data []uint8) error              //data is the original data (for cross check)
+	CompressedData(s string, data []uint8) error    //data is the original, uncompressed data (for cross check)
 	DataInflate(s string, data uint16) error        // data is number of inflated bytes
 	EntryPoint(s string, addr uint32) error         // addr is the lower 32bits of entry point
 	BigEntryPoint(s string, addr uint32) error      // addr is the upper 32bits of entry point
@@ -25,17 +27,70 @@ type ioProto interface {
 	BigBaseAddr(s string, addr uint32) error        //addr is upper 32 bits of  base addr
 	BaseAddrELA(s string, addr uint32) error        //addr is lower 32 bits of  base addr
 	ExtensionSetParams(s string, p [4]uint64) error //for kernel info
+	BinaryFraming(s string, version uint8) error    //ask the other side for binary frames
+	Window(s string, size uint8) error              //ask the other side for a window of lines
+	ImageDigest(s string, sum []byte) error         //sum is the digest of everything sent (for cross check)
+	Sent() (uint8, string)                          //sequence number and line of the last line sent
+	Resend(seq uint8, s string) error               //send a line again, with its original sequence number
 	Read([]uint8) (string, error)                   //read the next thing from the other side
-	NewSection(*elf.Section) error                  //just a notification
+	NewSegment(*loadableSegment) error              //just a notification
 	EOF() (string, error)                           //just a notification
 }
 
+// framer is implemented by ioProtos that can switch from sending hex lines to
+// sending binary frames (see anticipation/binframe.go) once the device agrees
+type framer interface {
+	SetFramed(bool)
+}
+
+// windower is implemented by ioProtos that can put sequence numbers on lines
+// once the device agrees to a window
+type windower interface {
+	SetWindowed(bool)
+	Renumber(seq uint8) //the next line sent is seq, after a resync
+}
+
+// sequencer hands out sequence numbers to lines as they are sent (when
+// windowed) and remembers the last one so it can be sent again later
+type sequencer struct {
+	windowed bool
+	nextSeq  uint8
+	lastSeq  uint8
+	last     string
+}
+
+func (q *sequencer) SetWindowed(b bool) {
+	q.windowed = b
+}
+
+func (q *sequencer) Renumber(seq uint8) {
+	q.nextSeq = seq
+}
+
+func (q *sequencer) Sent() (uint8, string) {
+	return q.lastSeq, q.last
+}
+
+// number is called with each line as it is sent and returns its sequence number
+func (q *sequencer) number(s string) uint8 {
+	seq := q.nextSeq
+	if q.windowed {
+		q.nextSeq++
+	}
+	q.lastSeq = seq
+	q.last = s
+	return seq
+}
+
 ///////////////////////////////////////////////////////////////////////
 // ttyIOProto is the model
 ///////////////////////////////////////////////////////////////////////
 
 type ttyIOProto struct {
-	io *tty.TTY
+	sequencer
+	io     *tty.TTY
+	framed bool
+	unread []string //lines Read returns before reading the tty
 }
 
 func newTTYIOProto(devTTYPath string) *ttyIOProto { //returns null when it can't open
@@ -51,7 +106,7 @@ func newTTYIOProto(devTTYPath string) *ttyIOProto { //returns null when it can't
 	}
 	return &ttyIOProto{io: ttyObj}
 }
-func (t *ttyIOProto) NewSection(_ *elf.Section) error {
+func (t *ttyIOProto) NewSegment(_ *loadableSegment) error {
 	return nil //nothing to do for us
 }
 
@@ -79,12 +134,46 @@ func (t *ttyIOProto) Data(s string, _ []uint8) error {
 	t.sendString(s)
 	return nil
 }
+func (t *ttyIOProto) CompressedData(s string, _ []uint8) error {
+	t.sendString(s)
+	return nil
+}
 func (t *ttyIOProto) DataInflate(s string, _ uint16) error {
 	t.sendString(s)
 	return nil
 }
 
+func (t *ttyIOProto) SetFramed(b bool) {
+	t.framed = b
+}
+
 func (t *ttyIOProto) sendString(s string) {
+	t.write(t.number(s), s)
+}
+
+func (t *ttyIOProto) Resend(seq uint8, s string) error {
+	t.write(seq, s)
+	return nil
+}
+
+func (t *ttyIOProto) write(seq uint8, s string) {
+	if t.framed {
+		var frame []byte
+		var err error
+		if t.windowed {
+			frame, err = anticipation.HexLineToSequencedFrame(seq, s)
+		} else {
+			frame, err = anticipation.HexLineToFrame(s)
+		}
+		if err != nil {
+			log.Fatalf("unable to convert line to a frame (%s): %v", s, err)
+		}
+		t.io.Output().Write(frame)
+		return
+	}
+	if t.windowed {
+		s = anticipation.EncodeSequenced(seq, s)
+	}
 	t.io.Output().WriteString(s)
 	t.io.Output().WriteString("\n")
 }
@@ -94,6 +183,11 @@ func (t *ttyIOProto) EOF() (string, error) {
 }
 
 func (t *ttyIOProto) Read(data []uint8) (string, error) {
+	if len(t.unread) > 0 {
+		l := t.unread[0]
+		t.unread = t.unread[1:]
+		return l, nil
+	}
 	count := uint16(0)
 	dropped := 0
 	for {
@@ -128,60 +222,157 @@ func (t *ttyIOProto) ExtensionSetParams(l string, _ [4]uint64) error {
 	return nil
 }
 
+func (t *ttyIOProto) BinaryFraming(l string, _ uint8) error {
+	t.sendString(l)
+	return nil
+}
+
+func (t *ttyIOProto) Window(l string, _ uint8) error {
+	t.sendString(l)
+	return nil
+}
+
+func (t *ttyIOProto) ImageDigest(l string, _ []byte) error {
+	t.sendString(l)
+	return nil
+}
+
+func (t *ttyIOProto) DeviceInfo(l string) error {
+	t.sendString(l)
+	return nil
+}
+
+func (t *ttyIOProto) WindowHash(l string, _ uint8, _ uint64) error {
+	t.sendString(l)
+	return nil
+}
+
 ///////////////////////////////////////////////////////////////////////
 // verifyIOProto checks that the loader is putting the code in the
 // right place. It also verifies the bytes against the disk version.
 // Used in tests (the -t option)
 ///////////////////////////////////////////////////////////////////////
 type verifyIOProto struct {
-	section *elf.Section
+	sequencer
+	acks    []uint8 //sequence numbers the "device" hasn't acked yet
+	segment *loadableSegment
 	data    []uint8
 	current uint64
+	framed  bool
+	frames  *anticipation.FrameDecoder
+	digest  *anticipation.ImageDigest //of the data as decoded, like the device does it
 }
 
 func newAddrCheckReceiver() ioProto {
-	return &verifyIOProto{} //assumes they will call new sect in a sec
+	return &verifyIOProto{ //assumes they will call new sect in a sec
+		frames: anticipation.NewFrameDecoder(),
+		digest: anticipation.NewImageDigest(),
+	}
+}
+
+func (v *verifyIOProto) SetFramed(b bool) {
+	v.framed = b
+}
+
+// when framed, check that the line survives the trip through a binary frame
+func (v *verifyIOProto) checkFrame(s string) error {
+	if !v.framed {
+		return nil
+	}
+	expected, _, _, err := anticipation.DecodeAndCheckStringToBytes(s)
+	if err != nil {
+		return err
+	}
+	frame, err := anticipation.HexLineToFrame(s)
+	if err != nil {
+		return err
+	}
+	for _, b := range frame {
+		converted, done, err := v.frames.Feed(b)
+		if !done {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(converted, expected[:len(expected)-1]) {
+			return errors.New(fmt.Sprintf("frame for line %s decodes to %x", s, converted))
+		}
+		return nil
+	}
+	return errors.New(fmt.Sprintf("frame for line %s never completed", s))
 }
 
 func (v *verifyIOProto) BigEntryPoint(s string, addr uint32) error {
+	v.sent(s)
 	return nil
 }
 
 func (v *verifyIOProto) BigBaseAddr(s string, addr uint32) error {
+	v.sent(s)
 	prev := v.current & 0xffff_ffff
 	v.current = prev | (uint64(addr) << 32)
 	return nil
 }
 
-func (v *verifyIOProto) NewSection(s *elf.Section) error {
-	d, err := s.Data()
-	if err != nil {
-		return err
+func (v *verifyIOProto) NewSegment(s *loadableSegment) error {
+	v.data = make([]uint8, s.size)
+	v.segment = s
+	if s.inflate {
+		return nil //bss segment, so it's just zero
 	}
-	v.data = d
-	v.section = s
-	return nil
+	_, err := io.ReadFull(s.open(), v.data)
+	return err
 }
 
 func (a *verifyIOProto) Data(s string, xcheck []uint8) error {
+	a.sent(s)
 	decoded, _, addr, err := anticipation.DecodeAndCheckStringToBytes(s)
 	if err != nil {
 		return err
 	}
-	trueAddress := int(a.current+uint64(addr)) - int(a.section.Addr)
+	if err := a.checkFrame(s); err != nil {
+		return err
+	}
+	a.digest.Write(decoded[4 : len(decoded)-1])
+	return a.checkBlob(addr, decoded[4:len(decoded)-1], xcheck)
+}
+
+func (a *verifyIOProto) CompressedData(s string, xcheck []uint8) error {
+	a.sent(s)
+	decoded, lt, addr, err := anticipation.DecodeAndCheckStringToBytes(s)
+	if err != nil {
+		return err
+	}
+	if lt != anticipation.ExtensionCompressedData {
+		return errors.New(fmt.Sprintf("expected compressed data line but got %s", lt))
+	}
+	if err := a.checkFrame(s); err != nil {
+		return err
+	}
+	dataBlob, err := anticipation.DecompressRecord(decoded)
+	if err != nil {
+		return err
+	}
+	if len(dataBlob) != len(xcheck) {
+		return errors.New(fmt.Sprintf("compressed line expands to %d bytes but should be %d",
+			len(dataBlob), len(xcheck)))
+	}
+	a.digest.Write(dataBlob)
+	return a.checkBlob(addr, dataBlob, xcheck)
+}
+
+// checkBlob compares the decoded bytes at addr to the elf data and the cross
+// check data supplied by the emitter
+func (a *verifyIOProto) checkBlob(addr uint32, dataBlob []uint8, xcheck []uint8) error {
+	trueAddress := int(a.current+uint64(addr)) - int(a.segment.addr)
 
-	dataBlob := decoded[4 : len(decoded)-1]
 	if trueAddress+len(dataBlob) > len(a.data) {
-		return errors.New(fmt.Sprintf("impossible address %08x for sect %s since data is only %08x long",
-			trueAddress+len(dataBlob), a.section.Name, len(a.data)))
+		return errors.New(fmt.Sprintf("impossible address %08x for %s since data is only %08x long",
+			trueAddress+len(dataBlob), a.segment.name, len(a.data)))
 	}
 	for i := 0; i < len(dataBlob); i++ {
-		var reference byte
-		if a.section.Type&elf.SHT_NOBITS > 0 {
-			reference = 0 //bss segment, so it's just zero
-		} else {
-			reference = a.data[trueAddress+i] //from disk
-		}
+		reference := a.data[trueAddress+i] //from disk, or zeros for bss
 		if reference != dataBlob[i] { //from decode?{
 			return errors.New(fmt.Sprintf("byte number 0x%08x differs between elf data (%02x) and decoded data from string(%02x)",
 				trueAddress+i, reference, dataBlob[i]))
@@ -195,31 +386,75 @@ func (a *verifyIOProto) Data(s string, xcheck []uint8) error {
 }
 
 func (a *verifyIOProto) DataInflate(s string, size uint16) error {
+	a.sent(s)
 	return nil
 }
 func (a *verifyIOProto) EntryPoint(s string, size uint32) error {
+	a.sent(s)
 	return nil
 }
 func (v *verifyIOProto) BaseAddrESA(s string, addr uint32) error {
+	v.sent(s)
 	v.current = uint64(addr)
 	return nil
 }
 func (v *verifyIOProto) BaseAddrELA(s string, addr uint32) error {
+	v.sent(s)
 	prev := v.current & 0xffff_ffff_0000_0000
-	v.current = prev | uint64(addr)
+	v.current = prev | uint64(addr&0xffff_0000) //ELA only carries the top 16 bits
 	return nil
 }
 func (v *verifyIOProto) ExtensionUnixTime(s string, size uint32) error {
 	return nil
 }
 func (v *verifyIOProto) Read(buffer []byte) (string, error) { //just update to next
+	if v.windowed && len(v.acks) > 0 {
+		seq := v.acks[0]
+		v.acks = v.acks[1:]
+		return fmt.Sprintf(".%02X", seq), nil
+	}
 	buffer[0] = '.'
 	return string(buffer[0:1]), nil
 
 }
 func (v *verifyIOProto) EOF() (string, error) {
+	v.sent(EOFLine)
 	return EOFLine, nil
 }
-func (v *verifyIOProto) ExtensionSetParams(_ string, _ [4]uint64) error {
+func (v *verifyIOProto) ExtensionSetParams(s string, _ [4]uint64) error {
+	v.sent(s)
+	return nil
+}
+func (v *verifyIOProto) BinaryFraming(s string, _ uint8) error {
+	v.sent(s)
 	return nil
 }
+func (v *verifyIOProto) Window(s string, _ uint8) error {
+	v.sent(s)
+	return nil
+}
+func (v *verifyIOProto) ImageDigest(s string, sum []byte) error {
+	v.sent(s)
+	if err := v.checkFrame(s); err != nil {
+		return err
+	}
+	if actual := v.digest.Sum(); !bytes.Equal(actual, sum) {
+		return errors.New(fmt.Sprintf("image digest from the elf file (%x) does not match the data sent (%x)",
+			sum, actual))
+	}
+	return nil
+}
+func (v *verifyIOProto) Resend(seq uint8, _ string) error {
+	if v.windowed {
+		v.acks = append(v.acks, seq)
+	}
+	return nil
+}
+
+// sent numbers the line and queues up the ack the device would send
+func (v *verifyIOProto) sent(s string) {
+	seq := v.number(s)
+	if v.windowed {
+		v.acks = append(v.acks, seq)
+	}
+}
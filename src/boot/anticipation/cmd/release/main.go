@@ -4,70 +4,54 @@ import (
 	"time"
 
 	"boot/anticipation"
+	"lib/bootparams"
 
+	"crypto/ed25519"
+	"crypto/x509"
 	"debug/elf"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 )
 
 const uint64signal = uint64(0x1234567887654321)
-const KernelLoadPoint = 0xfffffc0000000000
-const PageSize = 0x10000
 
 // this is the place in the KERNEL where we are going to place a copy of
 // the structure BootloaderParamsDef... the bootloaderParamsCopy is just to
 // make it easier to set the fields
 var bootloaderParamsLocation uint64 //ptr
-var bootloaderParamsCopy BootloaderParamsDef
+var bootloaderParamsCopy bootparams.BootloaderParamsDef
 
 type transmitState int
 
 var helpFlag = flag.Bool("h", false, "get usage info")
 var testFlag = flag.Bool("t", false, "encode a file and decode each data line to see if they match")
 var ptyFlag = flag.String("p", "", "supply a pseudo TTY to output to")
+var netFlag = flag.String("net", "", "send over UDP to host:port instead of a TTY")
+var hexFlag = flag.String("hex", "", "write the lines we would send to this file instead of a device")
+var monitorFlag = flag.Bool("monitor", false, "break into antc's monitor on the -p tty, and load the kernel (if given) when you type load")
+var imgFlag = flag.String("img", "", "write a raw image (like kernel8.img) with the boot parameters in it to this file")
+var binaryFlag = flag.Bool("b", false, "ask the device for binary framing, falls back to hex if refused")
+var windowFlag = flag.Int("w", 16, "lines in flight before waiting for an ack, 1 is stop-and-wait")
+var compressFlag = flag.Bool("z", false, "send data as compressed records (antc must understand them)")
+var keyFlag = flag.String("key", "", "sign the image with this ed25519 private key (PEM, PKCS8)")
+var trustFlag = flag.String("trust", "", "write a go file for antc that only boots kernels signed with -key's key, and exit")
+var logFlag = flag.String("log", "", "write the kernel log to this file as JSON lines, with the time each line arrived")
+var levelFlag = flag.String("level", "trace", "only show kernel log lines at this level or above: trace, debug, info, warn, error or fatal")
+var categoryFlag = flag.String("category", "", "only show STATS lines in these categories (comma separated)")
+var failfastFlag = flag.Bool("failfast", false, "exit with status 2 as soon as the kernel logs a fatal error or panics")
+var diffFlag = flag.Bool("diff", false, "only send the 64K windows that changed since the last kernel sent to this device (needs a warm device)")
+var cacheFlag = flag.String("cache", "", "where -diff remembers what was sent to each device (default is release in the user cache directory)")
 var verbose = flag.Int("v", 0, "verbosity level: 0 terse (default), 1 debug info, 2 show everything ")
+var modulesFlag moduleList
 
-// sadly, we had to COPY this here from upbeat.BootLoaderParamsDef because the
-// hostgo will refuse to link due to other things in lib upbeat
-type BootloaderParamsDef struct {
-	EntryPoint   uint64
-	KernelLast   uint64
-	UnixTime     uint64
-	StackPointer uint64
-	HeapStart    uint64
-	HeapEnd      uint64
-}
-
-///////////////////////////////////////////////////////////////////////
-// loadableSect is how we match up program headers to sections
-///////////////////////////////////////////////////////////////////////
-type loadableSect struct {
-	name        string
-	vaddr       uint64
-	entrypoint  uint64
-	inflate     bool
-	addressType anticipation.HexLineType
-}
-
-func newLoadableSect(name string, v uint64, inflate bool, flg elf.SectionFlag, size uint64) *loadableSect {
-	if flg&elf.SHF_ALLOC == 0 {
-		log.Fatalf("unable to process sect %s: it does not have the SHF_ALLOC flag", name)
-	}
-	if size > 0xffffffff {
-		log.Fatalf("unable to process sect %s, it is larger than 0xffffffff (32 bits): %x", name, size)
-	}
-	return &loadableSect{
-		name:       name,
-		vaddr:      v,
-		inflate:    inflate,
-		entrypoint: uint64signal,
-	}
-}
-func (l *loadableSect) setEntryPoint(a uint64) {
-	//no restriction on the size anymore, this was previously used to trap > 32 bit size values
+func init() {
+	flag.Var(&modulesFlag, "m", "load a file after the kernel's heap as kind:path, kind is ramdisk, config, font or blob (can be repeated)")
 }
 
 ///////////////////////////////////////////////////////////////////////
@@ -75,10 +59,32 @@ func (l *loadableSect) setEntryPoint(a uint64) {
 ///////////////////////////////////////////////////////////////////////
 func main() {
 	flag.Parse()
-	if flag.NArg() == 0 {
+	if *helpFlag {
 		usage()
 	}
-	if *helpFlag {
+	if *trustFlag != "" {
+		if *keyFlag == "" {
+			log.Fatalf("-trust needs a key (-key)")
+		}
+		writeTrustedKey(*trustFlag, loadSigningKey(*keyFlag))
+		os.Exit(0)
+	}
+	var monitorTTY *ttyIOProto
+	if *monitorFlag {
+		if *ptyFlag == "" {
+			log.Fatalf("-monitor needs a tty (-p)")
+		}
+		monitorTTY = newTTYIOProto(*ptyFlag)
+		if monitorTTY == nil {
+			log.Fatalf("unable to connect to %s", *ptyFlag)
+		}
+		monitor(monitorTTY)
+		if flag.NArg() == 0 {
+			log.Printf("no kernel to load, antc is waiting for one")
+			os.Exit(0)
+		}
+	}
+	if flag.NArg() == 0 {
 		usage()
 	}
 	fp, err := elf.Open(flag.Arg(0))
@@ -90,34 +96,72 @@ func main() {
 	}
 	defer fp.Close()
 
-	//get a list of loadable sections
-	lsect := []*loadableSect{}
-	for _, section := range fp.Sections {
-		switch section.Name {
-		case ".text", ".rodata", ".data", ".exc":
-			lsect = append(lsect, newLoadableSect(section.Name, section.Addr, false, section.Flags, section.Size))
-		case ".bss":
-			lsect = append(lsect, newLoadableSect(section.Name, section.Addr, true, section.Flags, section.Size))
+	segs := loadKernel(fp)
+	segs = loadModules(segs, modulesFlag)
+
+	//
+	// Where is the output going?
+	//
+
+	if *testFlag {
+		selfTest(flag.Arg(0), segs)
+	}
+	if *ptyFlag != "" {
+		oh := monitorTTY
+		if oh == nil {
+			oh = newTTYIOProto(*ptyFlag)
+		}
+		if oh == nil {
+			log.Fatalf("unable to connect to %s", *ptyFlag)
 		}
+		protocol(flag.Arg(0), segs, oh)
+	}
+	if *netFlag != "" {
+		oh := newUDPIOProto(*netFlag)
+		if oh == nil {
+			log.Fatalf("unable to connect to %s", *netFlag)
+		}
+		protocol(flag.Arg(0), segs, oh)
+	}
+	if *hexFlag != "" {
+		oh := newHexFileIOProto(*hexFlag)
+		if oh == nil {
+			log.Fatalf("unable to create %s", *hexFlag)
+		}
+		protocol(flag.Arg(0), segs, oh)
+	}
+	if *imgFlag != "" {
+		writeRawImage(*imgFlag, segs)
+	}
+	if !*testFlag && *ptyFlag == "" && *netFlag == "" && *hexFlag == "" && *imgFlag == "" {
+		log.Printf("no test, pty, net, hex or img flag/parameter supplied, not doing anything")
 	}
 
+}
+
+// loadKernel finds the segments to send and fills in what we know about
+// the kernel from its elf file: the entry point, the end of the kernel and
+// where the bootloader params go
+func loadKernel(fp *elf.File) []*loadableSegment {
+	bootloaderParamsCopy = bootparams.New()
+	bootloaderParamsLocation = 0
+
+	//get a list of loadable segments, from the program headers
+	segs := loadableSegments(fp)
+	warnUncovered(fp)
+
 	//no need to check entry point for 32 bits anymore
 	entryPoint := fp.Entry
 
-	//walk program headers, marking the sections as needed in terms of where and when to load
-	for _, prog := range fp.Progs {
-		if prog.ProgHeader.Type&elf.PT_LOAD == 0 {
-			continue
+	//mark the segment with the entry point, and find the end of the kernel
+	for _, ls := range segs {
+		if ls.contains(entryPoint) {
+			ls.entrypoint = entryPoint
+			bootloaderParamsCopy.EntryPoint = ls.entrypoint
+			bootloaderParamsCopy.Cores[0].EntryPoint = ls.entrypoint
 		}
-		for _, ls := range lsect {
-			s := fp.Section(ls.name)
-			if entryPoint >= ls.vaddr && entryPoint < ls.vaddr+s.Size {
-				ls.entrypoint = entryPoint
-				bootloaderParamsCopy.EntryPoint = ls.entrypoint
-			}
-			if ls.vaddr+s.Size > bootloaderParamsCopy.KernelLast {
-				bootloaderParamsCopy.KernelLast = ls.vaddr + s.Size
-			}
+		if ls.vaddr+ls.size > bootloaderParamsCopy.KernelLast {
+			bootloaderParamsCopy.KernelLast = ls.vaddr + ls.size
 		}
 	}
 
@@ -126,80 +170,72 @@ func main() {
 		log.Fatalf("unable to load symbols: %v", err)
 	}
 	for _, sym := range symbols {
-		if sym.Name == "bootloader_params" {
+		switch sym.Name {
+		case "bootloader_params":
+			if sym.Size != bootparams.Size {
+				log.Fatalf("bootloader_params in the kernel is %d bytes, but should be %d (kernel and release are out of sync?)",
+					sym.Size, bootparams.Size)
+			}
 			bootloaderParamsLocation = uint64(uintptr(sym.Value))
-			break
+		case "secondary_start":
+			//the other cores only start if the kernel has somewhere for them to go
+			for i := 1; i < bootparams.MaxCores; i++ {
+				bootloaderParamsCopy.Cores[i].EntryPoint = sym.Value
+			}
 		}
 	}
+	kernelSymbols = newSymbolizer(fp) //for crash reports in the kernel log
 
 	//check that we have an entry point
 	ok := false
-	for _, l := range lsect {
+	for _, l := range segs {
 		if l.entrypoint != uint64signal {
 			ok = true
 			break
 		}
 	}
 	if !ok {
-		log.Fatalf("unable to match entry point %x with any sect!", entryPoint)
-	}
-
-	//
-	// Where is the output going?
-	//
-
-	if *testFlag {
-		selfTest(flag.Arg(0), fp, lsect)
-	}
-	if *ptyFlag != "" {
-		oh := newTTYIOProto(*ptyFlag)
-		if oh == nil {
-			log.Fatalf("unable to connect to %s", *ptyFlag)
-		}
-		protocol(flag.Arg(0), fp, lsect, oh)
-	}
-	if !*testFlag && *ptyFlag == "" {
-		log.Printf("neither testflag nor pty flag/parameter supplied, not doing anything")
+		log.Fatalf("unable to match entry point %x with any segment!", entryPoint)
 	}
+	return segs
 
 }
 
-func selfTest(filename string, fp *elf.File, lsect []*loadableSect) {
+func selfTest(filename string, segs []*loadableSegment) {
 
-	encodeAndDecode(filename, fp, lsect)
-	protocol(filename, fp, lsect, newAddrCheckReceiver())
+	encodeAndDecode(filename, segs)
+	protocol(filename, segs, newAddrCheckReceiver())
 }
 
-func encodeAndDecode(filename string, fp *elf.File, lsect []*loadableSect) {
-	for _, l := range lsect {
-		log.Printf("encoding test: test encoding of file %s, sect %s", filename, l.name)
+func encodeAndDecode(filename string, segs []*loadableSegment) {
+	for _, l := range segs {
+		log.Printf("encoding test: test encoding of file %s, %s", filename, l.name)
 		if l.inflate {
 			continue //bss
 		}
-		s := fp.Section(l.name)
-		if s.Size == 0 {
-			continue // empty
-		}
 		buffer := make([]byte, anticipation.FileXFerDataLineSize)
 		bb := anticipation.NewNullByteBuster()
 		offset := uint64(0)
 		for {
-			if offset == s.Size {
+			if offset == l.size {
 				break
 			}
-			r, err := s.ReadAt(buffer, int64(offset))
-			if err == io.EOF {
+			if l.size-offset < uint64(len(buffer)) {
+				buffer = buffer[:l.size-offset]
+			}
+			r, err := l.data.ReadAt(buffer, int64(offset))
+			if err == io.EOF && r == 0 {
 				break
 			}
-			if err != nil {
-				log.Fatalf("failed trying to read sect of binary: %v", err)
+			if err != nil && err != io.EOF {
+				log.Fatalf("failed trying to read segment of binary: %v", err)
 			}
 			line := anticipation.EncodeDataBytes(buffer[:r], uint16(offset))
 			converted, lt, addr, err := anticipation.DecodeAndCheckStringToBytes(line)
 			if lt != anticipation.DataLine {
 				log.Fatalf("unexpected line type: %s", lt)
 			}
-			if addr != uint32(offset) {
+			if addr != uint32(uint16(offset)) { //only 16 bits of offset in a line
 				log.Fatalf("unexpected offset (expected 0x%04x but got 0x%04x)", offset, addr)
 			}
 			if err != nil {
@@ -209,7 +245,7 @@ func encodeAndDecode(filename string, fp *elf.File, lsect []*loadableSect) {
 			for i := 0; i < len(buffer[:r]); i++ {
 				c := converted[4+i]
 				if buffer[i] != c {
-					log.Fatalf("bad encoding on byte %d from line %s", line)
+					log.Fatalf("bad encoding on byte %d from line %s", i, line)
 				}
 			}
 			offset += uint64(len(buffer))
@@ -218,39 +254,42 @@ func encodeAndDecode(filename string, fp *elf.File, lsect []*loadableSect) {
 	log.Printf("encoding test: everything seems to be ok")
 }
 
-func protocol(filename string, fp *elf.File, lsect []*loadableSect, oh ioProto) {
+func protocol(filename string, segs []*loadableSegment, oh ioProto) {
+	con, err := newConsole(os.Stdout, *levelFlag, *categoryFlag)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
 	//
 	//build a list of what we need
 	//
-	emitterList := make([]emitter, len(lsect)+1) //+1 for kernel params emitter
-	for i, l := range lsect {
-		s := fp.Section(l.name)
-		se := newSectionEmitter(s, l, oh)
-		emitterList[i] = se
-	}
-	//last emmitter does the boot parameter copying magic
-	emitterList[len(lsect)] = newContstantParamsEmitter(bootloaderParamsLocation,
+	var plan *reloadPlan
+	if _, ok := oh.(reloader); ok && *diffFlag {
+		plan = newReloadPlan(*cacheFlag, segs)
+	}
+	emitterList := make([]emitter, len(segs)+1) //+1 for kernel params emitter
+	for i, l := range segs {
+		emitterList[i] = newSegmentEmitter(l, oh)
+		emitterList[i].(*loadableSegmentEmitter).plan = plan
+	}
+	//last emmitter does the boot parameter copying magic, the kernel
+	//gets the virtual address but we write it at the physical one
+	emitterList[len(segs)] = newContstantParamsEmitter(physicalAddress(segs, bootloaderParamsLocation),
 		&bootloaderParamsCopy, oh)
-	//we need to set the bootloader params
-	bootloaderParamsCopy.UnixTime = uint64(time.Now().Unix())
-	page := uint64(KernelLoadPoint)
-	//does this page cover the kernel's loaded size
-	for page+(PageSize-1) < bootloaderParamsCopy.KernelLast {
-		page += PageSize
-	}
-	// kernel code takes N pages
-	// kernel stack takes 2 page (N+1, N+2
-	// kernel heap takes 8 pages (N+3...N+10)
-	page += (2 * PageSize)
-	//this is the "wrong" end of the stack page (if stack reaches here, we are hosed)
-	bootloaderParamsCopy.StackPointer = page + (PageSize - 0x10) //16 byte alignment required
-	page += PageSize
-	bootloaderParamsCopy.HeapStart = page
-	page += (7 * PageSize)
-	bootloaderParamsCopy.HeapEnd = page + (PageSize - 8) //END of N+10th page
-	log.Printf("kernel boot parameters: %#v and address %x", bootloaderParamsCopy, bootloaderParamsLocation)
+	setBootloaderParams()
 	if len(emitterList) < 2 {
-		log.Fatalf("unable to find any data to release! No sections for transmission!")
+		log.Fatalf("unable to find any data to release! No segments for transmission!")
+	}
+	digest := imageDigest(segs)
+	var signature []byte
+	if *keyFlag != "" {
+		key := loadSigningKey(*keyFlag)
+		signature = ed25519.Sign(key, digest)
+		if *verbose > 0 {
+			log.Printf("@@@ signing with key %s, public key is %#v", *keyFlag, key.Public())
+		}
+	}
+	if *verbose > 0 {
+		log.Printf("@@@ image digest %x", digest)
 	}
 
 	//
@@ -258,8 +297,16 @@ func protocol(filename string, fp *elf.File, lsect []*loadableSect, oh ioProto)
 	//
 
 	tx := newTransmitLooper(emitterList, oh)
+	tx.filename = filename
+	tx.digest = digest
+	tx.signature = signature
+	tx.plan = plan
+	if *windowFlag < 1 || *windowFlag > anticipation.WindowMax {
+		log.Fatalf("window must be between 1 and %d", anticipation.WindowMax)
+	}
+	tx.startNegotiation(*binaryFlag, *windowFlag)
 	if *verbose > 0 {
-		log.Printf("@@@ file %s, sect %s", filename, tx.current.name())
+		log.Printf("@@@ file %s, %s", filename, tx.current.name())
 	}
 
 	//right now, we only use the first of 4 params
@@ -268,9 +315,13 @@ func protocol(filename string, fp *elf.File, lsect []*loadableSect, oh ioProto)
 	tx.param[2] = 0
 	tx.param[3] = 0
 
-	name := tx.current.name()
-	copyOfSect := fp.Section(name)
-	tx.current.receiver().NewSection(copyOfSect)
+	tx.current.receiver().NewSegment(tx.current.segment())
+	//antc's comments, the symbols are the kernel's so they'd be wrong
+	boot, err := newConsole(os.Stdout, *levelFlag, *categoryFlag)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	boot.symbols = nil
 outer:
 	for {
 		l, err := tx.read()
@@ -287,8 +338,14 @@ outer:
 		}
 
 		switch l[0] {
-		case '#': //comment
-			log.Print("### ", l[1:])
+		case '#': //comment, or a line of antc's crash report
+			r, err := boot.line(l)
+			if err != nil {
+				log.Fatalf("unable to write %s: %v", *logFlag, err)
+			}
+			if r.failed() {
+				log.Fatalf("aborting, antc crashed")
+			}
 		case '@': //debug info
 			if *verbose > 0 {
 				log.Print("@@@ ", l[1:])
@@ -297,37 +354,39 @@ outer:
 			if *verbose < 2 { //verbose user has already seen this, no sense repeating
 				log.Printf("!!! %s", l[1:])
 			}
-			log.Printf("RETRY offset addr 0x%08x in %s\n", tx.current.currentAddr(), tx.current.name())
-			tx.errorCount++
-			switch {
-			case tx.errorCount > 5:
-				log.Fatalf("aborting, too many errors in a row")
-			case tx.errorCount > 2:
-				tx.current.reset()
-				b := tx.current.next()
-				if !b {
-					log.Fatalf("bad state, should never reset an empty emitter!")
+			if n, ok := anticipation.ParseResync(l); ok {
+				if err := tx.resync(n, l); err != nil {
+					log.Fatalf("aborting, %v", err)
 				}
+				proceed(tx)
+				continue
+			}
+			if tx.negotiating() {
+				if tx.asked {
+					log.Printf("device refused request, continuing without it")
+					tx.negotiated(false, l)
+					proceed(tx)
+				}
+				continue
+			}
+			if err := tx.nak(l); err != nil {
+				log.Fatalf("aborting, %v", err)
 			}
 		case '.':
-			tx.errorCount = 0 //no more consecutive errors
-			switch tx.state {
-			case tsParams:
-				tx.next() //called for effect
-				sendLineToDevice(tx)
-			case tsData:
-				if !tx.current.next() { //done with sect?
-					if tx.next() {
-						if *verbose > 0 {
-							log.Printf("@@@ file %s, sect %s", filename, tx.current.name())
-						}
+			if tx.negotiating() {
+				if tx.asked {
+					if *verbose > 0 {
+						log.Printf("@@@ device accepted request")
 					}
-					tx.current.receiver().NewSection(fp.Section(tx.current.name()))
+					tx.negotiated(true, l)
 				}
-				sendLineToDevice(tx)
-			case tsEnd:
+			} else {
+				tx.ack(l)
+			}
+			if tx.finished() {
 				break outer
 			}
+			proceed(tx)
 		default:
 			log.Printf("ignoring unexpected response: %s", l)
 		}
@@ -336,8 +395,21 @@ outer:
 		log.Printf("verified all the data bytes and the address of loading them.")
 		os.Exit(0)
 	}
+	if h, ok := oh.(*hexFileIOProto); ok {
+		if err := h.Close(); err != nil {
+			log.Fatalf("unable to write %s: %v", *hexFlag, err)
+		}
+		log.Printf("wrote %s", *hexFlag)
+		return
+	}
 
 	log.Printf("transmission successful: %s", flag.Arg(0))
+	plan.save(digest)
+	if *logFlag != "" {
+		if err := con.capture(*logFlag); err != nil {
+			log.Fatalf("unable to capture the kernel log: %v", err)
+		}
+	}
 	log.Printf("--- kernel log ---")
 	for {
 		l, err := tx.read()
@@ -345,31 +417,99 @@ outer:
 			break
 		}
 		if err != nil {
+			con.Close()
 			log.Fatalf("failed to read from client: %v", err)
 		}
 		if len(l) == 0 {
 			if *verbose > 0 {
 				log.Printf("@@@ ignoring empty line")
-				continue
 			}
+			continue
 		}
-		switch l[0] {
-		case '*':
-			if *verbose == 2 {
-				fmt.Printf("%s\n", l[1:])
-			}
-		case '@':
-			if *verbose > 0 {
-				fmt.Printf("@@@ %s\n", l[1:])
-			}
-		case '!':
-			fmt.Printf("!!! %s\n", l[1:])
-		case '#':
-			fmt.Printf("### %s\n", l[1:])
-		default:
-			fmt.Printf("%s\n", l)
+		r, err := con.line(l)
+		if err != nil {
+			log.Fatalf("unable to write %s: %v", *logFlag, err)
+		}
+		if r.failed() && *failfastFlag {
+			con.Close()
+			log.Printf("kernel failed (%s): %s", r.Level, r.Message)
+			os.Exit(kernelFailedExit)
 		}
 	}
+	if err := con.Close(); err != nil {
+		log.Fatalf("unable to write %s: %v", *logFlag, err)
+	}
+}
+
+// setBootloaderParams fills in the rest of the params, the parts that
+// come from where the kernel ends
+func setBootloaderParams() {
+	bootloaderParamsCopy.UnixTime = uint64(time.Now().Unix())
+	bootloaderParamsCopy.SetLayout()
+	log.Printf("kernel boot parameters: %#v and address %x", bootloaderParamsCopy, bootloaderParamsLocation)
+}
+
+// imageDigest is the digest of every byte the device will write, in the
+// order the emitters send them: the segments, then the bootloader params.
+// This must be called after the params are filled in.
+func imageDigest(segs []*loadableSegment) []byte {
+	d := anticipation.NewImageDigest()
+	for _, l := range segs {
+		if l.inflate {
+			d.Write(make([]byte, l.size))
+			continue
+		}
+		if _, err := io.Copy(d, l.open()); err != nil {
+			log.Fatalf("unable to read %s: %v", l.name, err)
+		}
+	}
+	d.Write(paramsBytes(&bootloaderParamsCopy))
+	return d.Sum()
+}
+
+func loadSigningKey(path string) ed25519.PrivateKey {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("unable to read key: %v", err)
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		log.Fatalf("unable to find a PEM block in %s", path)
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		log.Fatalf("unable to parse key in %s: %v", path, err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		log.Fatalf("key in %s is a %T, not an ed25519 key", path, k)
+	}
+	return key
+}
+
+// writeTrustedKey writes the public half of key as a go file for antc,
+// see trustedKey in antc's main.go
+func writeTrustedKey(path string, key ed25519.PrivateKey) {
+	pub := key.Public().(ed25519.PublicKey)
+	var b strings.Builder
+	fmt.Fprintf(&b, "// Code generated by release -trust; DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package main\n\nimport \"crypto/ed25519\"\n\n")
+	fmt.Fprintf(&b, "func init() {\n\ttrustedKey = ed25519.PublicKey{")
+	for i, v := range pub {
+		if i%8 == 0 {
+			b.WriteString("\n\t\t")
+		} else {
+			b.WriteString(" ")
+		}
+		fmt.Fprintf(&b, "0x%02x,", v)
+	}
+	b.WriteString("\n\t}\n}\n")
+	if err := ioutil.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		log.Fatalf("unable to write %s: %v", path, err)
+	}
+	if *verbose > 0 {
+		log.Printf("@@@ wrote %s, antc trusts public key %x", path, pub)
+	}
 }
 
 func usage() {
@@ -378,6 +518,16 @@ func usage() {
 	os.Exit(1)
 }
 
+// proceed sends the next negotiation request or as much data as fits in
+// the window
+func proceed(tx *transmitLooper) {
+	if tx.negotiating() {
+		sendLineToDevice(tx)
+		return
+	}
+	tx.fill()
+}
+
 func sendLineToDevice(tx *transmitLooper) {
 	// we get the line as a courtesy, but it's already been sent
 	l, err := tx.line()
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"lib/bootparams"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Modules are other files (a ramdisk, a font) that go along with the
+// kernel.  Each one starts on a page after the kernel's heap and is sent
+// like any other segment.  The kernel finds them in the module table at
+// the end of the bootloader params.
+///////////////////////////////////////////////////////////////////////
+
+var moduleKinds = map[string]uint64{
+	"blob":    bootparams.ModuleBlob,
+	"ramdisk": bootparams.ModuleRamdisk,
+	"initrd":  bootparams.ModuleRamdisk,
+	"config":  bootparams.ModuleConfig,
+	"font":    bootparams.ModuleFont,
+}
+
+type bootModule struct {
+	kind uint64
+	path string
+}
+
+// moduleList is a flag.Value for -m, which can be given more than once
+type moduleList []bootModule
+
+func (m *moduleList) String() string {
+	parts := []string{}
+	for _, mod := range *m {
+		parts = append(parts, fmt.Sprintf("%d:%s", mod.kind, mod.path))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m *moduleList) Set(s string) error {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return fmt.Errorf("expected kind:path but got %s", s)
+	}
+	kind, ok := moduleKinds[s[:i]]
+	if !ok {
+		return fmt.Errorf("unknown module kind %s", s[:i])
+	}
+	*m = append(*m, bootModule{kind: kind, path: s[i+1:]})
+	return nil
+}
+
+// loadModules places each module on the next page after the heap (or the
+// previous module) and adds it to the module table.  The returned segments
+// are the kernel's followed by one for each module.
+func loadModules(segs []*loadableSegment, mods moduleList) []*loadableSegment {
+	if len(mods) == 0 {
+		return segs
+	}
+	if len(mods) > bootparams.MaxModules {
+		log.Fatalf("too many modules, at most %d fit in the bootloader params", bootparams.MaxModules)
+	}
+	setBootloaderParams() //for HeapEnd
+	addr := bootloaderParamsCopy.ModuleBase()
+	for i, mod := range mods {
+		fp, err := os.Open(mod.path)
+		if err != nil {
+			log.Fatalf("unable to open module: %v", err)
+		}
+		info, err := fp.Stat()
+		if err != nil {
+			log.Fatalf("unable to read module: %v", err)
+		}
+		size := uint64(info.Size())
+		if size == 0 {
+			log.Fatalf("module %s is empty", mod.path)
+		}
+		name := fmt.Sprintf("module %d (%s)", i, mod.path)
+		segs = append(segs, newLoadableSegment(name, kernelPhysical(segs, addr), addr, size, fp))
+		bootloaderParamsCopy.Modules[i] = bootparams.ModuleDef{Kind: mod.kind, Addr: addr, Length: size}
+		if *verbose > 0 {
+			log.Printf("@@@ %s at %x, %d bytes", name, addr, size)
+		}
+		addr = bootparams.PageAlign(addr + size)
+	}
+	bootloaderParamsCopy.ModuleCount = uint64(len(mods))
+	return segs
+}
+
+// kernelPhysical is where a kernel address that isn't in any segment ends
+// up, assuming it's offset like the segment with the entry point
+func kernelPhysical(segs []*loadableSegment, a uint64) uint64 {
+	for _, l := range segs {
+		if l.entrypoint != uint64signal {
+			return a - (l.vaddr - l.addr)
+		}
+	}
+	return a
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"lib/bootparams"
+)
+
+func TestModuleFlag(t *testing.T) {
+	var m moduleList
+	if err := m.Set("initrd:/tmp/root.img"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := m.Set("font:x:y.psf"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m) != 2 || m[0].kind != bootparams.ModuleRamdisk || m[1].kind != bootparams.ModuleFont || m[1].path != "x:y.psf" {
+		t.Errorf("unexpected modules %+v", m)
+	}
+	for _, bad := range []string{"ramdisk", "floppy:a.img"} {
+		if err := m.Set(bad); err == nil {
+			t.Errorf("expected an error for %s", bad)
+		}
+	}
+}
+
+func TestProtocolWithModules(t *testing.T) {
+	fp, text, data := testKernel(t)
+	dir := t.TempDir()
+	contents := [][]byte{bytes.Repeat([]byte("ramdisk!"), 0x2001), []byte("font")}
+	mods := moduleList{}
+	for i, kind := range []uint64{bootparams.ModuleRamdisk, bootparams.ModuleFont} {
+		path := filepath.Join(dir, filepath.Base(t.Name())+string(rune('a'+i)))
+		if err := ioutil.WriteFile(path, contents[i], 0644); err != nil {
+			t.Fatalf("unable to write module: %v", err)
+		}
+		mods = append(mods, bootModule{kind: kind, path: path})
+	}
+	defer setFlags(16, false, "")()
+	oh := newSimIOProto(1)
+	protocol("test kernel", loadModules(loadKernel(fp), mods), oh)
+	if !oh.device.Done() {
+		t.Fatalf("device never got to the end")
+	}
+
+	p := bootloaderParamsCopy
+	if p.Check() != nil || p.ModuleCount != 2 {
+		t.Fatalf("bad module table: %+v", p)
+	}
+	prevEnd := p.HeapEnd
+	for i, m := range p.Modules[:2] {
+		if m.Addr%bootparams.PageSize != 0 || m.Addr <= prevEnd {
+			t.Errorf("module %d at %x, should be on a page after %x", i, m.Addr, prevEnd)
+		}
+		if m.Length != uint64(len(contents[i])) {
+			t.Errorf("module %d is %d bytes, expected %d", i, m.Length, len(contents[i]))
+		}
+		for j, b := range contents[i] {
+			if got := oh.device.Memory.Memory[m.Addr+uint64(j)]; got != b {
+				t.Fatalf("module %d byte %d: expected %02x but got %02x", i, j, b, got)
+			}
+			delete(oh.device.Memory.Memory, m.Addr+uint64(j))
+		}
+		prevEnd = m.Addr + m.Length
+	}
+	//what's left is the kernel, with the table in the params
+	checkMemory(t, oh.device.Memory, text, data)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+
+	"boot/anticipation"
+)
+
+// monitor breaks into antc's monitor during its countdown and then passes
+// lines between the terminal and antc.  It returns when the user asks for
+// a load, with antc waiting for a kernel on t.  When stdin runs out, we
+// exit.
+func monitor(t *ttyIOProto) {
+	buffer := make([]uint8, anticipation.FileXFerDataLineSize)
+	//antc says something each tick of its countdown, and only listens for
+	//the break then
+	for {
+		l, err := t.Read(buffer)
+		if err != nil {
+			log.Fatalf("!!! error reading from tty: %v", err)
+		}
+		if *verbose == 2 {
+			log.Printf("<-- %s", l)
+		}
+		if len(l) > 0 && l[0] == '.' {
+			break
+		}
+	}
+	t.io.Output().WriteString(anticipation.MonitorBreak)
+
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			t.io.Output().WriteString(scanner.Text() + "\n")
+			req, err := anticipation.ParseMonitorLine(scanner.Text())
+			if err == nil && req.Command == anticipation.MonitorLoad {
+				return //the line protocol takes over the tty
+			}
+		}
+		os.Exit(0)
+	}()
+
+	for {
+		l, err := t.Read(buffer)
+		if err != nil {
+			log.Fatalf("!!! error reading from tty: %v", err)
+		}
+		if l == anticipation.MonitorLoadResponse {
+			//protocol starts by waiting for antc to say something
+			t.unread = append(t.unread, l)
+			return
+		}
+		fmt.Println(l)
+	}
+}
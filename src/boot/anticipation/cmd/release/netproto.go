@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"boot/anticipation"
+)
+
+///////////////////////////////////////////////////////////////////////
+// udpIOProto sends each line as one datagram and reads each response
+// as one datagram.  Unlike a serial line, datagrams just vanish so this
+// keeps the lines that haven't been acked and sends the oldest one again
+// when nothing has come back in a while.  The device side of this is
+// antnet (or some day, antc with a NIC).
+///////////////////////////////////////////////////////////////////////
+
+// how long we wait for a response before sending the oldest line again,
+// tests on loopback don't need to wait as long
+var netRetransmit = 500 * time.Millisecond
+
+// how many times in a row we time out before giving up
+const netMaxTimeouts = 10
+
+type udpIOProto struct {
+	sequencer
+	conn     *net.UDPConn
+	unacked  []*sentLine //oldest first
+	heard    bool        //has the other side said anything yet?
+	timeouts int
+}
+
+func newUDPIOProto(hostport string) *udpIOProto { //returns nil when it can't connect
+	addr, err := net.ResolveUDPAddr("udp", hostport)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil
+	}
+	result := &udpIOProto{conn: conn}
+	result.hello()
+	return result
+}
+
+// the protocol starts with the device talking, but the device has no idea
+// where we are until we send it something. an empty datagram is "hello".
+func (u *udpIOProto) hello() {
+	u.conn.Write([]byte{})
+}
+
+func (u *udpIOProto) NewSegment(_ *loadableSegment) error {
+	return nil //nothing to do for us
+}
+func (u *udpIOProto) Data(s string, _ []uint8) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) CompressedData(s string, _ []uint8) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) DataInflate(s string, _ uint16) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) EntryPoint(s string, _ uint32) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) BigEntryPoint(s string, _ uint32) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) BaseAddrESA(s string, _ uint32) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) BigBaseAddr(s string, _ uint32) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) BaseAddrELA(s string, _ uint32) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) ExtensionSetParams(s string, _ [4]uint64) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) BinaryFraming(s string, _ uint8) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) Window(s string, _ uint8) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) ImageDigest(s string, _ []byte) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) DeviceInfo(s string) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) WindowHash(s string, _ uint8, _ uint64) error {
+	return u.sendString(s)
+}
+func (u *udpIOProto) EOF() (string, error) {
+	return EOFLine, u.sendString(EOFLine)
+}
+
+// Renumber is for a resync, the device has thrown away everything unacked
+func (u *udpIOProto) Renumber(seq uint8) {
+	u.unacked = nil
+	u.sequencer.Renumber(seq)
+}
+
+func (u *udpIOProto) sendString(s string) error {
+	seq := u.number(s)
+	u.unacked = append(u.unacked, &sentLine{seq: seq, line: s})
+	return u.write(seq, s)
+}
+
+func (u *udpIOProto) Resend(seq uint8, s string) error {
+	return u.write(seq, s)
+}
+
+func (u *udpIOProto) write(seq uint8, s string) error {
+	if u.windowed {
+		s = anticipation.EncodeSequenced(seq, s)
+	}
+	_, err := u.conn.Write([]byte(s))
+	return err
+}
+
+// Read waits for the next datagram, sending things again if it takes too
+// long.  Before the device has said anything, the thing we send again is
+// the hello.
+func (u *udpIOProto) Read(data []uint8) (string, error) {
+	for {
+		waiting := !u.heard || len(u.unacked) > 0
+		if waiting {
+			u.conn.SetReadDeadline(time.Now().Add(netRetransmit))
+		} else {
+			u.conn.SetReadDeadline(time.Time{}) //kernel log, wait forever
+		}
+		n, err := u.conn.Read(data)
+		if err != nil {
+			var ne net.Error
+			if !waiting || !errors.As(err, &ne) || !ne.Timeout() {
+				return "", err
+			}
+			u.timeouts++
+			if u.timeouts > netMaxTimeouts {
+				return "", errors.New(fmt.Sprintf("no response after %d retransmits", netMaxTimeouts))
+			}
+			if !u.heard {
+				u.hello()
+				continue
+			}
+			oldest := u.unacked[0]
+			if *verbose > 0 {
+				log.Printf("@@@ timeout, sending seq %02x again: %s", oldest.seq, oldest.line)
+			}
+			if err := u.write(oldest.seq, oldest.line); err != nil {
+				return "", err
+			}
+			continue
+		}
+		u.heard = true
+		u.timeouts = 0
+		l := strings.TrimSpace(string(data[:n]))
+		u.acked(l)
+		return l, nil
+	}
+}
+
+// acked drops lines the response covers from the unacked list, with a
+// window an ack covers everything up to its sequence number
+func (u *udpIOProto) acked(response string) {
+	if len(response) == 0 || response[0] != '.' || len(u.unacked) == 0 {
+		return
+	}
+	if !u.windowed {
+		u.unacked = u.unacked[1:]
+		return
+	}
+	seq, ok := responseSequence(response)
+	if !ok {
+		return
+	}
+	for i, s := range u.unacked {
+		if s.seq == seq {
+			u.unacked = u.unacked[i+1:]
+			return
+		}
+	}
+}
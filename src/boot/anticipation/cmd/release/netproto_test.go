@@ -0,0 +1,186 @@
+package main
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"boot/anticipation"
+)
+
+//
+// These run protocol() over loopback UDP against a NetDevice (antnet) in
+// another goroutine, so the datagrams, the retransmit timer and the
+// timeouts are all real.
+//
+
+// loopbackIOProto is a udpIOProto that stops when the EOF is acked,
+// antnet doesn't have a kernel log to send
+type loopbackIOProto struct {
+	*udpIOProto
+}
+
+func (l *loopbackIOProto) Read(data []uint8) (string, error) {
+	if _, last := l.Sent(); last == EOFLine && len(l.unacked) == 0 {
+		return "", io.EOF
+	}
+	return l.udpIOProto.Read(data)
+}
+
+// listen starts a NetDevice on loopback, the error from Serve comes out of
+// the channel when it's done
+func listen(t *testing.T, drop int, seed int64) (*anticipation.NetDevice, string, chan error) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen on loopback: %v", err)
+	}
+	d := anticipation.NewNetDevice(conn)
+	rnd := rand.New(rand.NewSource(seed))
+	d.Drop = func() bool { return rnd.Intn(100) < drop }
+	served := make(chan error, 1)
+	go func() {
+		defer conn.Close()
+		served <- d.Serve(100 * time.Millisecond)
+	}()
+	return d, conn.LocalAddr().String(), served
+}
+
+// shortRetransmit makes the timer quick enough for lots of drops
+func shortRetransmit() func() {
+	r := netRetransmit
+	netRetransmit = 10 * time.Millisecond
+	return func() {
+		netRetransmit = r
+	}
+}
+
+func TestProtocolOverUDP(t *testing.T) {
+	defer shortRetransmit()()
+	fp, text, data := testKernel(t)
+	for _, c := range []struct {
+		name     string
+		window   int
+		compress bool
+		drop     int
+	}{
+		{"stop and wait", 1, false, 0},
+		{"window", 16, false, 0},
+		{"stop and wait drop", 1, false, 10},
+		{"window drop", 16, false, 10},
+		{"compressed window drop", 8, true, 20},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer setFlags(c.window, c.compress, "")()
+			d, addr, served := listen(t, c.drop, int64(c.window+c.drop))
+			u := newUDPIOProto(addr)
+			if u == nil {
+				t.Fatalf("unable to connect to %s", addr)
+			}
+			defer u.conn.Close()
+			protocol("test kernel", loadKernel(fp), &loopbackIOProto{u})
+			if err := <-served; err != nil {
+				t.Fatalf("device failed: %v", err)
+			}
+			checkDevice(t, d.SimDevice, text, data)
+		})
+	}
+}
+
+func TestUDPTimeout(t *testing.T) {
+	defer shortRetransmit()()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen on loopback: %v", err)
+	}
+	defer conn.Close()
+	hellos := make(chan int, 1)
+	go func() {
+		//count what comes in, but never answer
+		n := 0
+		buffer := make([]byte, 2*anticipation.FileXFerDataLineSize)
+		for {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if _, _, err := conn.ReadFromUDP(buffer); err != nil {
+				hellos <- n
+				return
+			}
+			n++
+		}
+	}()
+	u := newUDPIOProto(conn.LocalAddr().String())
+	if u == nil {
+		t.Fatalf("unable to connect to %s", conn.LocalAddr())
+	}
+	defer u.conn.Close()
+	start := time.Now()
+	_, err = u.Read(make([]byte, anticipation.FileXFerDataLineSize))
+	if err == nil || !strings.Contains(err.Error(), "no response") {
+		t.Fatalf("expected to give up waiting but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < netMaxTimeouts*netRetransmit {
+		t.Errorf("gave up after %v, expected at least %v", elapsed, netMaxTimeouts*netRetransmit)
+	}
+	//the first hello and one more each time the timer went off
+	if n := <-hellos; n != netMaxTimeouts+1 {
+		t.Errorf("expected %d hellos but the device got %d", netMaxTimeouts+1, n)
+	}
+}
+
+// once the device has answered, a timeout sends the oldest unacked line
+func TestUDPRetransmit(t *testing.T) {
+	defer shortRetransmit()()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen on loopback: %v", err)
+	}
+	defer conn.Close()
+	got := make(chan []string, 1)
+	go func() {
+		//answer the hello, then ack the third copy of the line
+		lines := []string{}
+		buffer := make([]byte, 2*anticipation.FileXFerDataLineSize)
+		for len(lines) < 3 {
+			conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, from, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				break
+			}
+			switch l := string(buffer[:n]); {
+			case l == "":
+				conn.WriteToUDP([]byte(". ready\n"), from)
+			default:
+				lines = append(lines, l)
+				if len(lines) == 3 {
+					conn.WriteToUDP([]byte(".\n"), from)
+				}
+			}
+		}
+		got <- lines
+	}()
+	u := newUDPIOProto(conn.LocalAddr().String())
+	if u == nil {
+		t.Fatalf("unable to connect to %s", conn.LocalAddr())
+	}
+	defer u.conn.Close()
+	buffer := make([]byte, anticipation.FileXFerDataLineSize)
+	if l, err := u.Read(buffer); err != nil || l != ". ready" {
+		t.Fatalf("expected the device to say it's ready but got %q, %v", l, err)
+	}
+	if err := u.EntryPoint(EOFLine, 0); err != nil {
+		t.Fatalf("unable to send: %v", err)
+	}
+	if l, err := u.Read(buffer); err != nil || l != "." {
+		t.Fatalf("expected an ack but got %q, %v", l, err)
+	}
+	if len(u.unacked) != 0 {
+		t.Errorf("expected the ack to clear the line but %d are unacked", len(u.unacked))
+	}
+	lines := <-got
+	if len(lines) != 3 || lines[0] != EOFLine || lines[2] != EOFLine {
+		t.Errorf("expected the line three times but the device got %v", lines)
+	}
+}
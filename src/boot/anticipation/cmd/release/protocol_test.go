@@ -0,0 +1,504 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"boot/anticipation"
+	"lib/bootparams"
+)
+
+//
+// These tests run protocol() against a SimDevice, which answers the way
+// antc does, with a sparse memory behind it.  The simIOProto in between
+// can corrupt or drop data lines (or frames) to exercise the retry paths.  At the end
+// the device's memory must be exactly what the elf file says.
+//
+
+const (
+	testText     = 0xfffffc0030000000
+	testTextSize = 0x10400 //crosses a 64K boundary
+	testData     = 0xfffffc0030020000
+	testDataSize = 0x100
+	testBssSize  = 0x700
+	testParams   = testData + testDataSize + 0x10 //in the bss
+	testCores    = testText + 0x40                //secondary_start
+)
+
+// watchdog intervals without a response before we decide antc is stuck
+const maxSilent = 10
+
+type simIOProto struct {
+	sequencer
+	device    *anticipation.SimDevice
+	responses []string
+	rnd       *rand.Rand
+	corrupt   int          //percentage of data lines corrupted
+	drop      int          //percentage of data lines lost, without a window the device must resync
+	lose      map[int]bool //data lines (counting from 1) that are lost
+	dataLines int          //data lines sent, including resends
+	framed    bool
+	frames    int //frames sent
+	badFrames int //frames the device said were bad
+}
+
+func newSimIOProto(seed int64) *simIOProto {
+	return &simIOProto{
+		device:    anticipation.NewSimDevice(),
+		rnd:       rand.New(rand.NewSource(seed)),
+		responses: []string{". local timer interrupt: #001"}, //antc talks first
+	}
+}
+
+func (s *simIOProto) NewSegment(_ *loadableSegment) error            { return nil }
+func (s *simIOProto) Data(l string, _ []uint8) error                 { return s.sendString(l) }
+func (s *simIOProto) CompressedData(l string, _ []uint8) error       { return s.sendString(l) }
+func (s *simIOProto) DataInflate(l string, _ uint16) error           { return s.sendString(l) }
+func (s *simIOProto) EntryPoint(l string, _ uint32) error            { return s.sendString(l) }
+func (s *simIOProto) BigEntryPoint(l string, _ uint32) error         { return s.sendString(l) }
+func (s *simIOProto) BaseAddrESA(l string, _ uint32) error           { return s.sendString(l) }
+func (s *simIOProto) BigBaseAddr(l string, _ uint32) error           { return s.sendString(l) }
+func (s *simIOProto) BaseAddrELA(l string, _ uint32) error           { return s.sendString(l) }
+func (s *simIOProto) ExtensionSetParams(l string, _ [4]uint64) error { return s.sendString(l) }
+func (s *simIOProto) BinaryFraming(l string, _ uint8) error          { return s.sendString(l) }
+func (s *simIOProto) Window(l string, _ uint8) error                 { return s.sendString(l) }
+func (s *simIOProto) ImageDigest(l string, _ []byte) error           { return s.sendString(l) }
+func (s *simIOProto) DeviceInfo(l string) error                      { return s.sendString(l) }
+func (s *simIOProto) WindowHash(l string, _ uint8, _ uint64) error   { return s.sendString(l) }
+func (s *simIOProto) EOF() (string, error)                           { return EOFLine, s.sendString(EOFLine) }
+
+func (s *simIOProto) SetFramed(b bool) {
+	s.framed = b
+}
+
+func (s *simIOProto) sendString(l string) error {
+	s.deliver(s.number(l), l)
+	return nil
+}
+
+func (s *simIOProto) Resend(seq uint8, l string) error {
+	s.deliver(seq, l)
+	return nil
+}
+
+func (s *simIOProto) deliver(seq uint8, l string) {
+	if s.framed {
+		s.deliverFrame(seq, l)
+		return
+	}
+	wire := l
+	if s.windowed {
+		wire = anticipation.EncodeSequenced(seq, l)
+	}
+	if s.lost(l) {
+		return
+	}
+	if s.corrupted(l) {
+		wire = s.corruptLine(wire)
+	}
+	s.responses = append(s.responses, s.device.Receive(wire)...)
+}
+
+func (s *simIOProto) deliverFrame(seq uint8, l string) {
+	var frame []byte
+	var err error
+	if s.windowed {
+		frame, err = anticipation.HexLineToSequencedFrame(seq, l)
+	} else {
+		frame, err = anticipation.HexLineToFrame(l)
+	}
+	if err != nil {
+		panic("unable to convert line to a frame: " + err.Error())
+	}
+	s.frames++
+	if s.lost(l) {
+		return
+	}
+	if s.corrupted(l) {
+		frame = s.corruptFrame(frame)
+	}
+	for _, r := range s.device.ReceiveFrames(frame) {
+		if strings.HasPrefix(r, "! frame error") {
+			s.badFrames++
+		}
+		s.responses = append(s.responses, r)
+	}
+}
+
+// lost and corrupted decide what happens to a data line, the others always
+// get there
+func (s *simIOProto) lost(l string) bool {
+	_, lt, _, _ := anticipation.DecodeAndCheckStringToBytes(l)
+	if lt != anticipation.DataLine && lt != anticipation.ExtensionCompressedData {
+		return false
+	}
+	s.dataLines++
+	return s.lose[s.dataLines] || s.rnd.Intn(100) < s.drop
+}
+
+func (s *simIOProto) corrupted(l string) bool {
+	_, lt, _, _ := anticipation.DecodeAndCheckStringToBytes(l)
+	if lt != anticipation.DataLine && lt != anticipation.ExtensionCompressedData {
+		return false
+	}
+	return s.rnd.Intn(100) < s.corrupt
+}
+
+// corruptLine changes one hex digit, which can be in the sequence number
+func (s *simIOProto) corruptLine(l string) string {
+	i := s.rnd.Intn(len(l))
+	if l[i] == ':' {
+		i++
+	}
+	c := byte('0')
+	if l[i] == '0' {
+		c = '1'
+	}
+	return l[:i] + string(c) + l[i+1:]
+}
+
+// corruptFrame changes one byte between the delimiters, half the time it
+// is part of an escape if there is one.  It never makes a delimiter, that
+// would be two bad frames and two naks for one line.
+func (s *simIOProto) corruptFrame(frame []byte) []byte {
+	result := append([]byte{}, frame...)
+	i := 1 + s.rnd.Intn(len(frame)-2)
+	escapes := []int{}
+	for j, b := range frame {
+		if b == anticipation.FrameEscape {
+			escapes = append(escapes, j, j+1) //the escape or the byte after it
+		}
+	}
+	if len(escapes) > 0 && s.rnd.Intn(2) == 0 {
+		i = escapes[s.rnd.Intn(len(escapes))]
+	}
+	result[i] ^= 0x01
+	if result[i] == anticipation.FrameDelimiter {
+		result[i] ^= 0x03
+	}
+	return result
+}
+
+// Read gives back what the device said.  If it has nothing to say, the
+// watchdog on the device goes off.
+func (s *simIOProto) Read(_ []uint8) (string, error) {
+	if len(s.responses) == 0 {
+		if s.device.Done() {
+			return "", io.EOF //no kernel log
+		}
+		//each Timeout is another interval of the watchdog
+		for i := 0; len(s.responses) == 0; i++ {
+			if i == maxSilent {
+				return "", errors.New("device has nothing to say, antc would hang")
+			}
+			s.responses = s.device.Timeout()
+		}
+	}
+	r := s.responses[0]
+	s.responses = s.responses[1:]
+	return r, nil
+}
+
+func TestProtocolAgainstDevice(t *testing.T) {
+	fp, text, data := testKernel(t)
+	for _, c := range []struct {
+		name     string
+		window   int
+		compress bool
+		corrupt  int
+		drop     int
+	}{
+		{"stop and wait", 1, false, 0, 0},
+		{"window", 16, false, 0, 0},
+		{"compressed", 16, true, 0, 0},
+		{"stop and wait corrupt", 1, false, 10, 0},
+		{"window corrupt", 16, false, 10, 0},
+		{"window corrupt and drop", 16, false, 5, 10},
+		{"compressed corrupt and drop", 8, true, 10, 10},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer setFlags(c.window, c.compress, "")()
+			oh := newSimIOProto(int64(c.window + c.corrupt + c.drop))
+			oh.corrupt = c.corrupt
+			oh.drop = c.drop
+			protocol("test kernel", loadKernel(fp), oh)
+			checkDevice(t, oh.device, text, data)
+		})
+	}
+}
+
+func TestProtocolFramed(t *testing.T) {
+	fp, text, data := testKernel(t)
+	for _, c := range []struct {
+		name     string
+		window   int
+		compress bool
+		corrupt  int
+		drop     int
+		refuse   bool
+	}{
+		{"stop and wait", 1, false, 0, 0, false},
+		{"window", 16, false, 0, 0, false},
+		{"compressed", 16, true, 0, 0, false},
+		{"stop and wait corrupt", 1, false, 10, 0, false},
+		{"window corrupt and drop", 16, false, 10, 10, false},
+		{"compressed corrupt and drop", 8, true, 10, 10, false},
+		{"refused", 1, false, 0, 0, true},
+		{"refused window corrupt", 16, false, 10, 0, true},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer setFlags(c.window, c.compress, "")()
+			*binaryFlag = true
+			oh := newSimIOProto(int64(c.window + c.corrupt + c.drop))
+			oh.corrupt = c.corrupt
+			oh.drop = c.drop
+			oh.device.RefuseFraming = c.refuse
+			protocol("test kernel", loadKernel(fp), oh)
+			checkDevice(t, oh.device, text, data)
+			if c.refuse {
+				if oh.device.Framed() || oh.frames != 0 {
+					t.Errorf("device refused framing but %d frames were sent", oh.frames)
+				}
+				return
+			}
+			if !oh.device.Framed() || oh.frames < oh.dataLines {
+				t.Errorf("expected every data line to be framed but sent %d frames for %d data lines",
+					oh.frames, oh.dataLines)
+			}
+			if (c.corrupt > 0) != (oh.badFrames > 0) {
+				t.Errorf("corrupted %d%% of the frames but the device found %d bad ones", c.corrupt, oh.badFrames)
+			}
+		})
+	}
+}
+
+func TestProtocolResync(t *testing.T) {
+	fp, text, data := testKernel(t)
+	for _, c := range []struct {
+		name   string
+		window int
+		policy anticipation.WatchdogPolicy
+		lose   map[int]bool
+		drop   int
+	}{
+		//both sections of .text, then the bss
+		{"stop and wait", 1, anticipation.WatchdogPolicy{Resync: 2}, map[int]bool{100: true, 1480: true, 1520: true}, 0},
+		{"window", 16, anticipation.WatchdogPolicy{Resync: 1}, lostWindow(200, 16), 0},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer setFlags(c.window, false, "")()
+			oh := newSimIOProto(3)
+			oh.lose = c.lose
+			oh.drop = c.drop
+			oh.device.Watchdog = c.policy
+			protocol("test kernel", loadKernel(fp), oh)
+			checkDevice(t, oh.device, text, data)
+		})
+	}
+}
+
+// lostWindow is n data lines in a row, starting at first, that are lost
+func lostWindow(first int, n int) map[int]bool {
+	result := map[int]bool{}
+	for i := first; i < first+n; i++ {
+		result[i] = true
+	}
+	return result
+}
+
+func TestProtocolSigned(t *testing.T) {
+	fp, text, data := testKernel(t)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		t.Fatalf("unable to marshal key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatalf("unable to write key: %v", err)
+	}
+	defer setFlags(16, false, path)()
+	oh := newSimIOProto(1)
+	oh.device.Key = pub
+	protocol("test kernel", loadKernel(fp), oh)
+	checkDevice(t, oh.device, text, data)
+}
+
+// TestTrustedKey checks that the file for antc is go, with the public key
+// in it
+func TestTrustedKey(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "trustedkey.go")
+	writeTrustedKey(path, priv)
+	f, err := parser.ParseFile(token.NewFileSet(), path, nil, 0)
+	if err != nil {
+		t.Fatalf("unable to parse %s: %v", path, err)
+	}
+	var found []byte
+	ast.Inspect(f, func(n ast.Node) bool {
+		if lit, ok := n.(*ast.BasicLit); ok && lit.Kind == token.INT {
+			v, err := strconv.ParseUint(lit.Value, 0, 8)
+			if err != nil {
+				t.Fatalf("bad byte %s: %v", lit.Value, err)
+			}
+			found = append(found, byte(v))
+		}
+		return true
+	})
+	if !bytes.Equal(found, pub) {
+		t.Errorf("expected key %x but got %x", []byte(pub), found)
+	}
+}
+
+// setFlags sets the flags protocol() looks at and returns a func to put
+// them back
+func setFlags(window int, compress bool, key string) func() {
+	w, z, b, k := *windowFlag, *compressFlag, *binaryFlag, *keyFlag
+	*windowFlag, *compressFlag, *binaryFlag, *keyFlag = window, compress, false, key
+	return func() {
+		*windowFlag, *compressFlag, *binaryFlag, *keyFlag = w, z, b, k
+	}
+}
+
+// checkDevice makes sure the device finished with the right memory
+func checkDevice(t *testing.T, d *anticipation.SimDevice, text []byte, data []byte) {
+	t.Helper()
+	if !d.Done() {
+		t.Fatalf("device never got to the end")
+	}
+	checkMemory(t, d.Memory, text, data)
+}
+
+// checkMemory compares memory to the test kernel, with the bootloader
+// params patched in
+func checkMemory(t *testing.T, m *anticipation.SparseByteBuster, text []byte, data []byte) {
+	t.Helper()
+	if m.EntryPoint() != testText {
+		t.Errorf("expected entry point %x but got %x", uint64(testText), m.EntryPoint())
+	}
+	for i, c := range bootloaderParamsCopy.Cores {
+		if (i == 0 && c.EntryPoint != testText) || (i > 0 && c.EntryPoint != testCores) || c.StackPointer == 0 {
+			t.Errorf("core %d has entry point %x and stack %x", i, c.EntryPoint, c.StackPointer)
+		}
+	}
+	expected := map[uint64]byte{}
+	for i, b := range text {
+		expected[testText+uint64(i)] = b
+	}
+	for i, b := range data {
+		expected[testData+uint64(i)] = b
+	}
+	for i := 0; i < testBssSize; i++ {
+		expected[testData+testDataSize+uint64(i)] = 0
+	}
+	for i, b := range paramsBytes(&bootloaderParamsCopy) {
+		expected[testParams+uint64(i)] = b
+	}
+	if len(m.Memory) != len(expected) {
+		t.Errorf("expected %d bytes written but got %d", len(expected), len(m.Memory))
+	}
+	bad := 0
+	for addr, b := range expected {
+		got, ok := m.Memory[addr]
+		if !ok || got != b {
+			bad++
+			if bad < 5 {
+				t.Errorf("byte at %x: expected %02x but got %02x (written? %v)", addr, b, got, ok)
+			}
+		}
+	}
+	if bad > 0 {
+		t.Errorf("%d bytes differ", bad)
+	}
+}
+
+// testKernel builds a small elf file in memory that looks like one of ours:
+// text (that crosses a 64K boundary) in one segment, data and bss in
+// another, a bootloader_params symbol in the bss and a secondary_start
+// in the text
+func testKernel(t *testing.T) (*elf.File, []byte, []byte) {
+	t.Helper()
+	rnd := rand.New(rand.NewSource(0))
+	text := make([]byte, testTextSize)
+	rnd.Read(text)
+	for i := 0x100; i < 0x1100; i++ {
+		text[i] = 0 //something for the compressor
+	}
+	data := make([]byte, testDataSize)
+	rnd.Read(data)
+
+	const textOff = 0x1000
+	dataOff := uint64(textOff + testTextSize)
+	strtab := []byte("\x00bootloader_params\x00secondary_start\x00")
+	shstrtab := []byte("\x00.text\x00.data\x00.bss\x00.symtab\x00.strtab\x00.shstrtab\x00")
+	name := func(s string) uint32 { return uint32(bytes.Index(shstrtab, []byte("\x00"+s+"\x00")) + 1) }
+
+	symtab := &bytes.Buffer{}
+	binary.Write(symtab, binary.LittleEndian, elf.Sym64{})
+	binary.Write(symtab, binary.LittleEndian, elf.Sym64{Name: 1, Info: byte(elf.STB_GLOBAL)<<4 | byte(elf.STT_OBJECT),
+		Shndx: 3, Value: testParams, Size: bootparams.Size})
+	binary.Write(symtab, binary.LittleEndian, elf.Sym64{Name: 19, Info: byte(elf.STB_GLOBAL)<<4 | byte(elf.STT_FUNC),
+		Shndx: 1, Value: testCores})
+	symOff := dataOff + testDataSize
+	strOff := symOff + uint64(symtab.Len())
+	shstrOff := strOff + uint64(len(strtab))
+	shOff := (shstrOff + uint64(len(shstrtab)) + 7) &^ 7
+
+	out := &bytes.Buffer{}
+	hdr := elf.Header64{Type: uint16(elf.ET_EXEC), Machine: uint16(elf.EM_AARCH64), Version: uint32(elf.EV_CURRENT),
+		Entry: testText, Phoff: 64, Shoff: shOff, Ehsize: 64, Phentsize: 56, Phnum: 2, Shentsize: 64, Shnum: 7, Shstrndx: 6}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	binary.Write(out, binary.LittleEndian, hdr)
+	binary.Write(out, binary.LittleEndian, elf.Prog64{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_X),
+		Off: textOff, Vaddr: testText, Paddr: testText, Filesz: testTextSize, Memsz: testTextSize, Align: 0x1000})
+	binary.Write(out, binary.LittleEndian, elf.Prog64{Type: uint32(elf.PT_LOAD), Flags: uint32(elf.PF_R | elf.PF_W),
+		Off: dataOff, Vaddr: testData, Paddr: testData, Filesz: testDataSize, Memsz: testDataSize + testBssSize, Align: 0x10})
+	out.Write(make([]byte, textOff-out.Len()))
+	out.Write(text)
+	out.Write(data)
+	out.Write(symtab.Bytes())
+	out.Write(strtab)
+	out.Write(shstrtab)
+	out.Write(make([]byte, int(shOff)-out.Len()))
+	alloc := uint64(elf.SHF_ALLOC)
+	for _, s := range []elf.Section64{
+		{},
+		{Name: name(".text"), Type: uint32(elf.SHT_PROGBITS), Flags: alloc | uint64(elf.SHF_EXECINSTR), Addr: testText, Off: textOff, Size: testTextSize},
+		{Name: name(".data"), Type: uint32(elf.SHT_PROGBITS), Flags: alloc | uint64(elf.SHF_WRITE), Addr: testData, Off: dataOff, Size: testDataSize},
+		{Name: name(".bss"), Type: uint32(elf.SHT_NOBITS), Flags: alloc | uint64(elf.SHF_WRITE), Addr: testData + testDataSize, Off: symOff, Size: testBssSize},
+		{Name: name(".symtab"), Type: uint32(elf.SHT_SYMTAB), Off: symOff, Size: uint64(symtab.Len()), Link: 5, Info: 1, Entsize: 24, Addralign: 8},
+		{Name: name(".strtab"), Type: uint32(elf.SHT_STRTAB), Off: strOff, Size: uint64(len(strtab))},
+		{Name: name(".shstrtab"), Type: uint32(elf.SHT_STRTAB), Off: shstrOff, Size: uint64(len(shstrtab))},
+	} {
+		binary.Write(out, binary.LittleEndian, s)
+	}
+	fp, err := elf.NewFile(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("unable to read test kernel: %v", err)
+	}
+	return fp, text, data
+}
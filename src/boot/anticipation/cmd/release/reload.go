@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"boot/anticipation"
+)
+
+///////////////////////////////////////////////////////////////////////
+// Differential reload (see anticipation/reload.go for the protocol).  We
+// remember the 64K windows of the last image we sent to each device.  If
+// the device is warm and still has that image, we ask it about each
+// window that hasn't changed since, and the ones it still has aren't sent
+// again.  Windows are the same ones the segment emitter uses: a segment
+// split at every 64K boundary of the device's address.
+///////////////////////////////////////////////////////////////////////
+
+// reloader is implemented by ioProtos that talk to a device that might
+// still have the last image we sent it
+type reloader interface {
+	DeviceInfo(s string) error
+	WindowHash(s string, mode uint8, addr uint64) error
+}
+
+// imageWindow is the part of a segment in one 64K page of the device
+type imageWindow struct {
+	Addr uint64
+	Size uint32
+	Sum  []byte
+}
+
+// cachedImage is what we remember about what we sent to a device
+type cachedImage struct {
+	Device  uint64
+	Digest  []byte //of the whole image, what the device tells us it has
+	Windows []imageWindow
+}
+
+// reloadPlan is what we know about the device, and what it has
+type reloadPlan struct {
+	dir     string
+	windows []imageWindow
+	device  uint64
+	known   bool //device answered the device info request
+	query   []imageWindow
+	next    int //index in query of the window we are asking about
+	same    map[uint64]imageWindow
+}
+
+// windowEnd is the offset in l where the window holding offset ends
+func windowEnd(l *loadableSegment, offset uint64) uint64 {
+	end := ((l.addr + offset) | 0xffff) + 1 - l.addr
+	if end > l.size {
+		end = l.size
+	}
+	return end
+}
+
+// imageWindows splits the segments with data in them into windows, zero
+// fill isn't worth asking about
+func imageWindows(segs []*loadableSegment) []imageWindow {
+	result := []imageWindow{}
+	for _, l := range segs {
+		if l.inflate {
+			continue
+		}
+		r := l.open()
+		for offset := uint64(0); offset < l.size; {
+			end := windowEnd(l, offset)
+			buf := make([]byte, end-offset)
+			if _, err := io.ReadFull(r, buf); err != nil {
+				log.Fatalf("unable to read %s: %v", l.name, err)
+			}
+			sum := sha256.Sum256(buf)
+			result = append(result, imageWindow{Addr: l.addr + offset, Size: uint32(len(buf)), Sum: sum[:]})
+			offset = end
+		}
+	}
+	return result
+}
+
+func newReloadPlan(dir string, segs []*loadableSegment) *reloadPlan {
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			log.Printf("no cache directory, sending everything: %v", err)
+			return nil
+		}
+		dir = filepath.Join(base, "release")
+	}
+	return &reloadPlan{dir: dir, windows: imageWindows(segs), same: make(map[uint64]imageWindow)}
+}
+
+func (p *reloadPlan) cachePath() string {
+	return filepath.Join(p.dir, fmt.Sprintf("%016x.json", p.device))
+}
+
+// deviceInfo takes the device's answer and decides what to ask about
+func (p *reloadPlan) deviceInfo(response string) {
+	id, last, ok := anticipation.ParseDeviceInfo(response)
+	if !ok {
+		log.Printf("device did not understand the device info request, sending everything")
+		return
+	}
+	p.device, p.known = id, true
+	if last == nil {
+		log.Printf("device %016x was power cycled, sending everything", id)
+		return
+	}
+	raw, err := ioutil.ReadFile(p.cachePath())
+	if err != nil {
+		log.Printf("nothing cached for device %016x, sending everything", id)
+		return
+	}
+	var cached cachedImage
+	if err := json.Unmarshal(raw, &cached); err != nil {
+		log.Printf("ignoring bad cache %s: %v", p.cachePath(), err)
+		return
+	}
+	if !bytes.Equal(cached.Digest, last) {
+		log.Printf("device %016x has an image we didn't send it, sending everything", id)
+		return
+	}
+	before := make(map[uint64]imageWindow)
+	for _, w := range cached.Windows {
+		before[w.Addr] = w
+	}
+	for _, w := range p.windows {
+		if b, ok := before[w.Addr]; ok && b.Size == w.Size && bytes.Equal(b.Sum, w.Sum) {
+			p.query = append(p.query, w)
+		}
+	}
+	if *verbose > 0 {
+		log.Printf("@@@ %d of %d windows are the same as last time, asking device %016x about them",
+			len(p.query), len(p.windows), id)
+	}
+}
+
+// asking is true while there are windows to ask about
+func (p *reloadPlan) asking() bool {
+	return p.next < len(p.query)
+}
+
+// answer takes the device's answer about the window we asked about
+func (p *reloadPlan) answer(accepted bool, response string) {
+	w := p.query[p.next]
+	p.next++
+	if accepted && bytes.Contains([]byte(response), []byte(anticipation.WindowSame)) {
+		p.same[w.Addr] = w
+	}
+	if !p.asking() {
+		log.Printf("device %016x already has %d of %d windows, sending the rest", p.device, len(p.same), len(p.windows))
+	}
+}
+
+// kept returns the window starting at addr, if the device already has it
+func (p *reloadPlan) kept(addr uint64) (imageWindow, bool) {
+	if p == nil {
+		return imageWindow{}, false
+	}
+	w, ok := p.same[addr]
+	return w, ok
+}
+
+// save remembers what we sent, once the device has accepted all of it
+func (p *reloadPlan) save(digest []byte) {
+	if p == nil || !p.known {
+		return
+	}
+	raw, err := json.Marshal(&cachedImage{Device: p.device, Digest: digest, Windows: p.windows})
+	if err == nil {
+		err = os.MkdirAll(p.dir, 0755)
+	}
+	if err == nil {
+		err = ioutil.WriteFile(p.cachePath(), raw, 0644)
+	}
+	if err != nil {
+		log.Printf("unable to cache the image for device %016x: %v", p.device, err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"boot/anticipation"
+)
+
+func TestDifferentialReload(t *testing.T) {
+	fp, text, data := testKernel(t)
+	defer setFlags(16, false, "")()
+	d, c := *diffFlag, *cacheFlag
+	*diffFlag, *cacheFlag = true, t.TempDir()
+	defer func() { *diffFlag, *cacheFlag = d, c }()
+
+	load := func(device *anticipation.SimDevice) *simIOProto {
+		oh := newSimIOProto(1)
+		oh.device = device
+		protocol("test kernel", loadKernel(fp), oh)
+		checkDevice(t, device, text, data)
+		return oh
+	}
+	device := anticipation.NewSimDevice()
+	device.ID = 0xb0a4d
+	full := load(device).dataLines
+
+	//after a reset the device has all of it, only the bss and params are sent
+	device.Reset()
+	if n := load(device).dataLines; n*4 > full {
+		t.Errorf("warm reload sent %d data lines, a full load is %d", n, full)
+	}
+
+	//something scribbled on the text, that window has to be sent again
+	device.Reset()
+	device.Memory.Memory[testText+0x10010]++
+	if n := load(device).dataLines; n*4 > full || n <= 0x400/0x30 {
+		t.Errorf("reload of a changed window sent %d data lines, a full load is %d", n, full)
+	}
+
+	//after a power cycle the cache is no use
+	device.PowerCycle()
+	if n := load(device).dataLines; n != full {
+		t.Errorf("reload after a power cycle sent %d data lines but expected %d", n, full)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"boot/anticipation"
+	"debug/elf"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+// loadableSegment is a piece of memory we have to fill in on the device.
+// It comes from a PT_LOAD program header.  A segment with a memsz bigger
+// than its filesz (.data followed by .bss, say) turns into two of these,
+// one with the bytes from the file and one that is inflated (zeros).
+///////////////////////////////////////////////////////////////////////
+type loadableSegment struct {
+	name        string      //for messages, it's the sections inside
+	addr        uint64      //where it goes on the device, from p_paddr
+	vaddr       uint64      //where the kernel thinks it is, from p_vaddr
+	size        uint64      //bytes to put on the device
+	data        io.ReaderAt //nil when inflate
+	entrypoint  uint64
+	inflate     bool
+	addressType anticipation.HexLineType
+}
+
+func newLoadableSegment(name string, addr uint64, vaddr uint64, size uint64, data io.ReaderAt) *loadableSegment {
+	if size > 0xffffffff {
+		log.Fatalf("unable to process %s, it is larger than 0xffffffff (32 bits): %x", name, size)
+	}
+	return &loadableSegment{
+		name:       name,
+		addr:       addr,
+		vaddr:      vaddr,
+		size:       size,
+		data:       data,
+		inflate:    data == nil,
+		entrypoint: uint64signal,
+	}
+}
+
+// open gives a fresh reader for the bytes of the segment (not for inflate)
+func (l *loadableSegment) open() io.ReadSeeker {
+	return io.NewSectionReader(l.data, 0, int64(l.size))
+}
+
+// contains is true if the (virtual) address a is inside this segment
+func (l *loadableSegment) contains(a uint64) bool {
+	return a >= l.vaddr && a < l.vaddr+l.size
+}
+
+// loadableSegments walks the program headers and returns the segments to
+// send, in the order they appear in the file
+func loadableSegments(fp *elf.File) []*loadableSegment {
+	result := []*loadableSegment{}
+	for i, prog := range fp.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Memsz == 0 {
+			continue
+		}
+		name := segmentName(fp, i, prog)
+		if prog.Filesz > 0 {
+			result = append(result, newLoadableSegment(name, prog.Paddr, prog.Vaddr, prog.Filesz, prog))
+		}
+		if prog.Memsz > prog.Filesz {
+			result = append(result, newLoadableSegment(name+" zero fill", prog.Paddr+prog.Filesz,
+				prog.Vaddr+prog.Filesz, prog.Memsz-prog.Filesz, nil))
+		}
+	}
+	return result
+}
+
+// segmentName is for humans: the segment number and the sections it holds
+func segmentName(fp *elf.File, i int, prog *elf.Prog) string {
+	names := []string{}
+	for _, s := range fp.Sections {
+		if s.Flags&elf.SHF_ALLOC != 0 && s.Addr >= prog.Vaddr && s.Addr < prog.Vaddr+prog.Memsz {
+			names = append(names, s.Name)
+		}
+	}
+	return fmt.Sprintf("segment %d (%s)", i, strings.Join(names, " "))
+}
+
+// warnUncovered complains about sections that need memory on the device
+// but that no PT_LOAD segment covers, they are not going to be sent
+func warnUncovered(fp *elf.File) {
+	for _, s := range fp.Sections {
+		if s.Flags&elf.SHF_ALLOC == 0 || s.Size == 0 {
+			continue
+		}
+		if s.Flags&elf.SHF_TLS != 0 && s.Type == elf.SHT_NOBITS {
+			continue //.tbss takes no space, it's a template for each thread
+		}
+		covered := false
+		for _, prog := range fp.Progs {
+			if prog.Type == elf.PT_LOAD && s.Addr >= prog.Vaddr && s.Addr+s.Size <= prog.Vaddr+prog.Memsz {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			log.Printf("warning: sect %s (%x, size %x) is allocated but not in any loadable segment, it will not be sent",
+				s.Name, s.Addr, s.Size)
+		}
+	}
+}
+
+// physicalAddress converts a kernel (virtual) address to where it goes on
+// the device, using the segment that contains it
+func physicalAddress(segs []*loadableSegment, a uint64) uint64 {
+	for _, l := range segs {
+		if l.contains(a) {
+			return l.addr + (a - l.vaddr)
+		}
+	}
+	return a
+}
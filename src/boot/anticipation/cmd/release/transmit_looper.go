@@ -2,6 +2,7 @@ package main
 
 import (
 	"boot/anticipation"
+	"fmt"
 	"log"
 	"strings"
 )
@@ -13,7 +14,21 @@ const (
 	tsData   transmitState = 0
 	tsParams transmitState = 1
 	tsEnd    transmitState = 2
+	//asking the device to switch to binary frames, before any data
+	tsFraming transmitState = 3
+	//asking the device to accept a window of lines, before any data
+	tsWindow transmitState = 4
+	//digest (and signature) of everything sent, just before the EOF
+	tsDigest transmitState = 5
+	//asking who the device is and what it has, before anything else
+	tsDeviceInfo transmitState = 6
+	//asking if the device still has the windows of the last image
+	tsQuery transmitState = 7
 )
+
+// how many times we resend the same line (or the device asks to resync)
+// before giving up
+const maxRetries = 5
 const (
 	kernelParamAddressBlockAddr = 0 // points to BootloaderParamsDef *inside* the kernel
 )
@@ -35,6 +50,12 @@ const (
 //     at the top level.  it is primarily concerned with confirming each line was
 //     received ok and if it wasn't, sending it again.
 //
+// The transmitLooper keeps up to window lines in flight.  When the device
+// agrees to a window (ExtensionWindow) every line carries a sequence number,
+// the device acks ".SS" in order (so an ack covers everything before it too)
+// and naks "!SS" for just the line it wants again.  Without a window we are
+// stop-and-wait: one line in flight and a "!" means send that line again.
+//
 type transmitLooper struct {
 	state        transmitState
 	emitterIndex int
@@ -43,8 +64,33 @@ type transmitLooper struct {
 	inBuffer     []uint8
 	param        [4]uint64
 	in           ioProto
-	errorCount   int //in a row
 	successCount int //overall
+	asked        bool //sent a negotiation request, waiting on the answer
+	wantFraming  bool
+	wantWindow   int
+	window       int  //lines in flight, 1 is stop-and-wait
+	windowed     bool //lines carry sequence numbers
+	outstanding  []*sentLine
+	digest       []byte
+	signature    []byte //nil if not signing
+	filename     string
+	plan         *reloadPlan //nil unless doing a differential reload
+	sections     []sectionStart
+	resyncs      int //in a row, without an ack
+}
+
+// sectionStart is where we sent the line that starts a section (see
+// anticipation/watchdog.go), so we can start there again
+type sectionStart struct {
+	emitter int
+	offset  uint32
+}
+
+// sentLine is a line that has been sent but not acknowledged
+type sentLine struct {
+	seq     uint8
+	line    string
+	retries int
 }
 
 func newTransmitLooper(all []emitter, oh ioProto) *transmitLooper {
@@ -55,7 +101,224 @@ func newTransmitLooper(all []emitter, oh ioProto) *transmitLooper {
 		current:      all[0],
 		emitters:     all,
 		inBuffer:     make([]uint8, anticipation.FileXFerDataLineSize),
+		window:       1,
+	}
+}
+
+// startNegotiation picks the first thing we need to ask the device for, if
+// anything, before we start sending data
+func (t *transmitLooper) startNegotiation(framing bool, window int) {
+	t.wantFraming = framing
+	t.wantWindow = window
+	if _, ok := t.in.(reloader); ok && t.plan != nil {
+		//the queries are stop-and-wait hex lines, so they go first
+		t.state = tsDeviceInfo
+		return
+	}
+	t.negotiateLink()
+}
+
+// negotiateLink picks the first change to the link we want, framing then
+// the window, or goes straight to the data
+func (t *transmitLooper) negotiateLink() {
+	_, canFrame := t.in.(framer)
+	_, canWindow := t.in.(windower)
+	switch {
+	case t.wantFraming && canFrame:
+		t.state = tsFraming
+	case t.wantWindow > 1 && canWindow:
+		t.state = tsWindow
+	default:
+		t.state = tsData
+	}
+}
+
+func (t *transmitLooper) negotiating() bool {
+	switch t.state {
+	case tsFraming, tsWindow, tsDeviceInfo, tsQuery:
+		return true
+	}
+	return false
+}
+
+// negotiated is called with the device's answer to the request we just sent
+// and moves on to the next request or the data
+func (t *transmitLooper) negotiated(accepted bool, response string) {
+	t.asked = false
+	switch t.state {
+	case tsDeviceInfo:
+		if accepted {
+			t.plan.deviceInfo(response)
+		}
+		t.state = tsQuery
+		if !t.plan.asking() {
+			t.negotiateLink()
+		}
+	case tsQuery:
+		t.plan.answer(accepted, response)
+		if !t.plan.asking() {
+			t.negotiateLink()
+		}
+	case tsFraming:
+		if accepted {
+			t.in.(framer).SetFramed(true)
+		}
+		t.state = tsData
+		if _, ok := t.in.(windower); ok && t.wantWindow > 1 {
+			t.state = tsWindow
+		}
+	case tsWindow:
+		if accepted {
+			t.in.(windower).SetWindowed(true)
+			t.windowed = true
+			t.window = t.wantWindow
+		}
+		t.state = tsData
+	}
+}
+
+// advance moves to the next line to send and returns false if there isn't
+// one because the EOF has been sent already
+func (t *transmitLooper) advance() bool {
+	switch t.state {
+	case tsParams, tsDigest:
+		t.next() //called for effect
+		return true
+	case tsData:
+		if !t.current.next() { //done with segment?
+			if t.next() {
+				if *verbose > 0 {
+					log.Printf("@@@ file %s, %s", t.filename, t.current.name())
+				}
+			}
+			t.current.receiver().NewSegment(t.current.segment())
+		}
+		return true
+	}
+	return false
+}
+
+// fill sends lines until the window is full or we run out of lines
+func (t *transmitLooper) fill() {
+	for len(t.outstanding) < t.window {
+		if !t.advance() {
+			return
+		}
+		position := t.current.position()
+		sendLineToDevice(t)
+		seq, l := t.in.Sent()
+		t.outstanding = append(t.outstanding, &sentLine{seq: seq, line: l})
+		if t.state == tsData && startsSection(l) {
+			t.sections = append(t.sections, sectionStart{emitter: t.emitterIndex - 1, offset: position})
+		}
+	}
+}
+
+// the device counts these to tell us where to resync from
+func startsSection(l string) bool {
+	return len(l) > 9 && l[7:9] == fmt.Sprintf("%02X", int(anticipation.ExtensionBigLinearAddress))
+}
+
+// resync starts sending again from the beginning of the section the device
+// asked for, everything we sent after that is thrown away
+func (t *transmitLooper) resync(sections int, response string) error {
+	t.resyncs++
+	if t.resyncs > maxRetries {
+		return fmt.Errorf("too many resyncs (%d)", maxRetries)
+	}
+	if t.negotiating() {
+		t.asked = false //it never saw our request, send it again
+		return nil
+	}
+	if sections > len(t.sections) {
+		return fmt.Errorf("device asked to resync from section %d, but only %d were sent", sections, len(t.sections))
+	}
+	start := sectionStart{} //from the very beginning
+	if sections > 0 {
+		start = t.sections[sections-1]
+		sections-- //we send the start again, so it's added again
+	}
+	t.sections = t.sections[:sections]
+	log.Printf("device asked to resync, sending %s again from %x", t.emitters[start.emitter].name(), start.offset)
+	t.state = tsData
+	t.emitterIndex = start.emitter + 1
+	t.current = t.emitters[start.emitter]
+	t.current.seek(start.offset)
+	t.current.receiver().NewSegment(t.current.segment())
+	t.outstanding = nil
+	if t.windowed {
+		seq, ok := responseSequence(response)
+		if !ok {
+			return fmt.Errorf("resync request has no sequence number: %s", response)
+		}
+		t.in.(windower).Renumber(seq)
+	}
+	return nil
+}
+
+// finished is true when the EOF has been sent and acked
+func (t *transmitLooper) finished() bool {
+	return t.state == tsEnd && len(t.outstanding) == 0
+}
+
+// ack removes the acknowledged line, and any before it, from the outstanding
+// lines.  acks for lines we don't have are duplicates and are ignored.
+func (t *transmitLooper) ack(response string) {
+	t.resyncs = 0 //getting somewhere
+	if !t.windowed {
+		if len(t.outstanding) > 0 {
+			t.outstanding = t.outstanding[1:]
+		}
+		return
+	}
+	seq, ok := responseSequence(response)
+	if !ok {
+		return
+	}
+	for i, s := range t.outstanding {
+		if s.seq == seq {
+			t.outstanding = t.outstanding[i+1:]
+			return
+		}
+	}
+}
+
+// nak sends the line the device is asking for again.  In windowed mode a
+// nak without a sequence number (like a bad frame) is ignored, the device
+// will nak the line it is missing once it notices the gap.
+func (t *transmitLooper) nak(response string) error {
+	var target *sentLine
+	if !t.windowed {
+		if len(t.outstanding) > 0 {
+			target = t.outstanding[0]
+		}
+	} else if seq, ok := responseSequence(response); ok {
+		for _, s := range t.outstanding {
+			if s.seq == seq {
+				target = s
+				break
+			}
+		}
+	}
+	if target == nil {
+		return nil
+	}
+	target.retries++
+	if target.retries > maxRetries {
+		return fmt.Errorf("too many retries (%d) of line %s", maxRetries, target.line)
 	}
+	if *verbose > 0 {
+		log.Printf("@@@ RETRY #%d seq %02x: %s", target.retries, target.seq, target.line)
+	}
+	return t.in.Resend(target.seq, target.line)
+}
+
+// the device puts the sequence number right after the . or !
+func responseSequence(response string) (uint8, bool) {
+	if len(response) < 3 {
+		return 0, false
+	}
+	return anticipation.DecodeSequenceNumber([]byte(response[1:]))
 }
 
 //this returns false when we transition the tsEnd state, even though that
@@ -66,10 +329,14 @@ func (t *transmitLooper) next() bool {
 		log.Fatalf("bad state, transmitLooper should know its done!")
 	}
 	if t.state == tsParams {
+		t.state = tsDigest
+		return true
+	}
+	if t.state == tsDigest {
 		t.state = tsEnd
 		return true
 	}
-	if t.emitterIndex == len(t.emitters) { //sections done?
+	if t.emitterIndex == len(t.emitters) { //segments done?
 		t.state = tsParams
 		return false
 	}
@@ -102,6 +369,26 @@ func (t *transmitLooper) line() (string, error) {
 	case tsParams:
 		l := anticipation.EncodeExtensionSetParameters(t.param)
 		return l, t.in.ExtensionSetParams(l, t.param)
+	case tsDigest:
+		l := anticipation.EncodeImageDigest(t.digest, t.signature)
+		return l, t.in.ImageDigest(l, t.digest)
+	case tsFraming:
+		l := anticipation.EncodeBinaryFraming(anticipation.FramingVersion)
+		t.asked = true
+		return l, t.in.BinaryFraming(l, anticipation.FramingVersion)
+	case tsWindow:
+		l := anticipation.EncodeWindow(uint8(t.wantWindow))
+		t.asked = true
+		return l, t.in.Window(l, uint8(t.wantWindow))
+	case tsDeviceInfo:
+		l := anticipation.EncodeDeviceInfo()
+		t.asked = true
+		return l, t.in.(reloader).DeviceInfo(l)
+	case tsQuery:
+		w := t.plan.query[t.plan.next]
+		l := anticipation.EncodeWindowHash(anticipation.WindowHashQuery, w.Addr, w.Size, w.Sum)
+		t.asked = true
+		return l, t.in.(reloader).WindowHash(l, anticipation.WindowHashQuery, w.Addr)
 	}
 	panic("unexpected state for transmitLooper")
 }
@@ -0,0 +1,170 @@
+package anticipation
+
+//
+// Compressed data records use a simple run-length scheme.  This is not
+// much of a compressor, but it is trivial to decode on the device side
+// (no tables, no back references into memory) and kernels are FULL of
+// long runs of zeros (.bss, alignment padding, zeroed tables).
+//
+// The payload of an ExtensionCompressedData record is:
+//   2 bytes: big-endian count of bytes produced by decompressing
+//   tokens:
+//     0x00-0x7f: literal, (token+1) bytes follow and are copied verbatim
+//     0x80-0xff: run, the next byte is combined with the low 7 bits of
+//                the token to make a 15 bit count, (count+runMin) copies
+//                of the byte after that are produced
+//
+
+// most bytes of payload that we put in a compressed line, chosen so that the
+// encoded line (11 chars of framing + 2 per byte) fits in FileXFerDataLineSize
+const CompressedPayloadMax = 0x70
+
+// largest number of bytes a single compressed line can expand to
+const CompressedSpanMax = 0xffff
+
+const (
+	literalMax = 0x80
+	runMin     = 3
+	runMax     = 0x7fff + runMin
+)
+
+// compress consumes as much of raw as will fit in a payload of at most
+// CompressedPayloadMax bytes. It returns the payload and the number of bytes
+// of raw that the payload represents.
+func compress(raw []byte) ([]byte, int) {
+	if len(raw) > CompressedSpanMax {
+		raw = raw[:CompressedSpanMax]
+	}
+	payload := make([]byte, 2, CompressedPayloadMax)
+	consumed := 0
+	for consumed < len(raw) {
+		room := CompressedPayloadMax - len(payload)
+		run := runLength(raw[consumed:])
+		if run >= runMin {
+			if room < 3 {
+				break
+			}
+			count := run - runMin
+			payload = append(payload, 0x80|byte(count>>8), byte(count&0xff), raw[consumed])
+			consumed += run
+			continue
+		}
+		//literal bytes up until the next run worth encoding
+		lit := 0
+		for consumed+lit < len(raw) && lit < literalMax {
+			if runLength(raw[consumed+lit:]) >= runMin {
+				break
+			}
+			lit++
+		}
+		if lit > room-1 {
+			lit = room - 1
+		}
+		if lit <= 0 {
+			break
+		}
+		payload = append(payload, byte(lit-1))
+		payload = append(payload, raw[consumed:consumed+lit]...)
+		consumed += lit
+	}
+	payload[0] = byte(consumed >> 8)
+	payload[1] = byte(consumed & 0xff)
+	return payload, consumed
+}
+
+// length of the run of identical bytes at the start of b, capped at runMax
+func runLength(b []byte) int {
+	if len(b) == 0 {
+		return 0
+	}
+	i := 1
+	for i < len(b) && i < runMax && b[i] == b[0] {
+		i++
+	}
+	return i
+}
+
+// expand walks a compressed payload and calls put with each byte produced,
+// in order.  It returns false if the payload is malformed, if put returns
+// false, or if the number of bytes produced does not match the payload's
+// declared size.  The whole payload is checked before put is called at all,
+// so a bad record never leaves part of itself in memory.
+func expand(payload []byte, put func(i uint16, value uint8) bool) bool {
+	if !walk(payload, nil) {
+		return false
+	}
+	return walk(payload, put)
+}
+
+// walk does the work of expand, put is nil when only checking the payload
+func walk(payload []byte, put func(i uint16, value uint8) bool) bool {
+	if len(payload) < 2 {
+		print("!compressed payload too short:", len(payload), "\n")
+		return false
+	}
+	declared := int(payload[0])*256 + int(payload[1])
+	produced := 0
+	for p := 2; p < len(payload); {
+		token := payload[p]
+		p++
+		if token&0x80 == 0 {
+			count := int(token) + 1
+			if p+count > len(payload) || produced+count > declared {
+				print("!compressed literal overruns payload\n")
+				return false
+			}
+			for i := 0; put != nil && i < count; i++ {
+				if !put(uint16(produced+i), payload[p+i]) {
+					return false
+				}
+			}
+			produced += count
+			p += count
+			continue
+		}
+		if p+2 > len(payload) {
+			print("!compressed run is truncated\n")
+			return false
+		}
+		count := (int(token&0x7f)*256 + int(payload[p])) + runMin
+		value := payload[p+1]
+		p += 2
+		if produced+count > declared {
+			print("!compressed run overruns declared size\n")
+			return false
+		}
+		for i := 0; put != nil && i < count; i++ {
+			if !put(uint16(produced+i), value) {
+				return false
+			}
+		}
+		produced += count
+	}
+	if produced != declared {
+		print("!compressed payload expanded to ", produced, " bytes but declared ", declared, "\n")
+		return false
+	}
+	return true
+}
+
+// DecompressRecord takes a converted ExtensionCompressedData line (as returned
+// by DecodeAndCheckStringToBytes) and returns the bytes it represents.
+func DecompressRecord(converted []byte) ([]byte, error) {
+	l := int(converted[0])
+	if len(converted) < 4+l {
+		return nil, NewEncodeDecodeError("compressed record is shorter than its declared length")
+	}
+	payload := converted[4 : 4+l]
+	if len(payload) < 2 {
+		return nil, NewEncodeDecodeError("compressed record has no size")
+	}
+	result := make([]byte, int(payload[0])*256+int(payload[1]))
+	ok := expand(payload, func(i uint16, value uint8) bool {
+		result[i] = value
+		return true
+	})
+	if !ok {
+		return nil, NewEncodeDecodeError("unable to expand compressed record")
+	}
+	return result, nil
+}
@@ -0,0 +1,115 @@
+package anticipation
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding"
+	"hash"
+)
+
+//
+// The image digest is a SHA-256 over every byte the bootloader writes into
+// memory, in the order they are written.  That is the loadable sections in
+// the order they are sent (zeros for .bss) followed by the bootloader params
+// block.  Addresses are not included, the per line checksums (or frame crcs)
+// already cover those.
+//
+// The sender puts the expected digest in an ExtensionImageDigest line just
+// before the EndOfFile.  The payload is the 32 byte digest, optionally
+// followed by a 64 byte ed25519 signature of the digest.
+//
+
+const DigestSize = sha256.Size
+
+// payload of an ExtensionImageDigest line with a signature
+const SignedDigestSize = DigestSize + ed25519.SignatureSize
+
+// ImageDigest accumulates the digest one byte at a time, which is how the
+// byteBusters see the data.  Bytes are batched up before going to the hash
+// so we don't pay for a call into sha256 per byte.
+type ImageDigest struct {
+	h       hash.Hash
+	pending [64]byte
+	count   int
+}
+
+func NewImageDigest() *ImageDigest {
+	return &ImageDigest{h: sha256.New()}
+}
+
+// Add puts the byte b into the digest
+func (d *ImageDigest) Add(b uint8) {
+	d.pending[d.count] = b
+	d.count++
+	if d.count == len(d.pending) {
+		d.h.Write(d.pending[:])
+		d.count = 0
+	}
+}
+
+// Write is Add for a whole buffer, this is what the sender uses
+func (d *ImageDigest) Write(p []byte) (int, error) {
+	for _, b := range p {
+		d.Add(b)
+	}
+	return len(p), nil
+}
+
+// Sum returns the digest of everything so far, more bytes can be added after
+func (d *ImageDigest) Sum() []byte {
+	if d.count > 0 {
+		d.h.Write(d.pending[:d.count])
+		d.count = 0
+	}
+	return d.h.Sum(nil)
+}
+
+// Mark returns the state of the digest so far, Rewind goes back to it
+func (d *ImageDigest) Mark() []byte {
+	if d.count > 0 {
+		d.h.Write(d.pending[:d.count])
+		d.count = 0
+	}
+	state, err := d.h.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		panic("unable to mark digest: " + err.Error())
+	}
+	return state
+}
+
+// Rewind forgets everything added since the Mark that returned state, a
+// nil state goes back to the beginning
+func (d *ImageDigest) Rewind(state []byte) {
+	d.count = 0
+	if state == nil {
+		d.h.Reset()
+		return
+	}
+	if err := d.h.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		panic("unable to rewind digest: " + err.Error())
+	}
+}
+
+// CheckImage compares the digest of what was loaded (actual) to the one
+// the sender claimed (expected) and, if key is not nil, checks that sig is
+// a signature of it by key.  A nil expected means the sender didn't send a
+// digest at all, and we have no idea what we loaded, so that is an error.
+func CheckImage(actual []byte, expected []byte, sig []byte, key ed25519.PublicKey) error {
+	if expected == nil {
+		return NewEncodeDecodeError("image has no digest")
+	}
+	if !bytes.Equal(actual, expected) {
+		return NewEncodeDecodeError("image digest does not match")
+	}
+	if key == nil {
+		return nil
+	}
+	if sig == nil {
+		return NewEncodeDecodeError("image is not signed")
+	}
+	if !ed25519.Verify(key, expected, sig) {
+		return NewEncodeDecodeError("bad signature on image")
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package anticipation
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestDigestMatchesLibrary(t *testing.T) {
+	data := make([]byte, 1000) //not a multiple of the batch size
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	d := NewImageDigest()
+	for _, b := range data[:100] {
+		d.Add(b)
+	}
+	d.Write(data[100:])
+	expected := sha256.Sum256(data)
+	if !bytes.Equal(d.Sum(), expected[:]) {
+		t.Errorf("digest mismatch: expected %x but got %x", expected, d.Sum())
+	}
+}
+
+func TestImageDigestLine(t *testing.T) {
+	sum := sha256.Sum256([]byte("kernel"))
+	sig := bytes.Repeat([]byte{0xa5}, ed25519.SignatureSize)
+	for _, s := range [][]byte{nil, sig} {
+		l := EncodeImageDigest(sum[:], s)
+		converted, lt, _, err := DecodeAndCheckStringToBytes(l)
+		if err != nil || lt != ExtensionImageDigest {
+			t.Fatalf("unable to decode digest line %s: %v %s", l, err, lt)
+		}
+		bb := newFakeByteBuster(nil, 0)
+		hadError, done := ProcessLine(lt, converted, bb)
+		if hadError || done {
+			t.Fatalf("digest line was not accepted")
+		}
+		if !bytes.Equal(bb.digest, sum[:]) || !bytes.Equal(bb.signature, s) {
+			t.Errorf("digest line decoded to %x and %x", bb.digest, bb.signature)
+		}
+	}
+	//wrong length
+	converted, lt, _, err := DecodeAndCheckStringToBytes(EncodeImageDigest(sum[:4], nil))
+	if err != nil {
+		t.Fatalf("unable to decode short digest line: %v", err)
+	}
+	if hadError, _ := ProcessLine(lt, converted, newFakeByteBuster(nil, 0)); !hadError {
+		t.Errorf("expected short digest line to be rejected")
+	}
+}
+
+func TestCheckImage(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	sum := sha256.Sum256([]byte("kernel"))
+	bad := sha256.Sum256([]byte("kernal"))
+	sig := ed25519.Sign(priv, sum[:])
+	for i, c := range []struct {
+		expected []byte
+		sig      []byte
+		key      ed25519.PublicKey
+		ok       bool
+	}{
+		{nil, nil, nil, false}, //no digest, even without a key
+		{nil, nil, pub, false},
+		{sum[:], nil, nil, true},
+		{bad[:], nil, nil, false},
+		{sum[:], sig, nil, true},
+		{sum[:], sig, pub, true},
+		{sum[:], nil, pub, false},
+		{sum[:], sig, otherPub, false},
+	} {
+		err := CheckImage(sum[:], c.expected, c.sig, c.key)
+		if (err == nil) != c.ok {
+			t.Errorf("case %d: expected ok=%v but got %v", i, c.ok, err)
+		}
+	}
+}
@@ -36,8 +36,20 @@ const (
 	ExtensionSetParameters    HexLineType = 0x80
 	ExtensionBigLinearAddress HexLineType = 0x81
 	ExtensionBigEntryPoint    HexLineType = 0x82
+	ExtensionCompressedData   HexLineType = 0x83
+	ExtensionBinaryFraming    HexLineType = 0x84
+	ExtensionWindow           HexLineType = 0x85
+	ExtensionImageDigest      HexLineType = 0x86
+	ExtensionDeviceInfo       HexLineType = 0x87
+	ExtensionWindowHash       HexLineType = 0x88
 )
 
+// largest window the sender can ask for, it is the number of slots in a
+// LineRing so it must be a power of two.  sequence numbers are 8
+// bits so this must be well under 256 so an old sequence number can't look
+// new.
+const WindowMax = 16
+
 func (hlt HexLineType) String() string {
 	switch hlt {
 	case DataLine:
@@ -56,6 +68,18 @@ func (hlt HexLineType) String() string {
 		return "ExtensionBigLinear"
 	case ExtensionBigEntryPoint:
 		return "ExtensionBigEntryPoint"
+	case ExtensionCompressedData:
+		return "ExtensionCompressedData"
+	case ExtensionBinaryFraming:
+		return "ExtensionBinaryFraming"
+	case ExtensionWindow:
+		return "ExtensionWindow"
+	case ExtensionImageDigest:
+		return "ExtensionImageDigest"
+	case ExtensionDeviceInfo:
+		return "ExtensionDeviceInfo"
+	case ExtensionWindowHash:
+		return "ExtensionWindowHash"
 	}
 	return "unknown"
 }
@@ -78,6 +102,18 @@ func hexLineTypeFromInt(i int) HexLineType {
 		return ExtensionBigLinearAddress
 	case 0x82:
 		return ExtensionBigEntryPoint
+	case 0x83:
+		return ExtensionCompressedData
+	case 0x84:
+		return ExtensionBinaryFraming
+	case 0x85:
+		return ExtensionWindow
+	case 0x86:
+		return ExtensionImageDigest
+	case 0x87:
+		return ExtensionDeviceInfo
+	case 0x88:
+		return ExtensionWindowHash
 	}
 	panic("!unable to understand line type\n")
 }
@@ -107,6 +143,27 @@ func ProcessLine(t HexLineType, converted []byte, bb byteBuster) (bool, bool) {
 			}
 		}
 		return false, false
+	case ExtensionCompressedData:
+		l := converted[0]
+		offset := (uint64(converted[1]) * 256) + (uint64(converted[2]))
+		baseAddr := bb.BaseAddress() + offset
+		payload := converted[4 : 4+uint64(l)]
+		if len(payload) < 2 {
+			print("!compressed data line has no size\n")
+			return true, false
+		}
+		size := uint64(payload[0])*256 + uint64(payload[1])
+		if offset+size > 0x10000 {
+			print("!compressed data line crosses a 64K boundary:", offset, "+", size, "\n")
+			return true, false
+		}
+		ok := expand(payload, func(i uint16, value uint8) bool {
+			return bb.Write(baseAddr+uint64(i), value)
+		})
+		if !ok {
+			return true, false
+		}
+		return false, false
 	case EndOfFile:
 		return false, true
 	case ExtendedSegmentAddress: //16 bit addr
@@ -165,6 +222,66 @@ func ProcessLine(t HexLineType, converted []byte, bb byteBuster) (bool, bool) {
 		t := uint32(converted[4])*0x1000000 + uint32(converted[5])*0x10000 + uint32(converted[6])*0x100 + uint32(converted[7])
 		bb.SetBigEntryPoint(t)
 		return false, false
+	case ExtensionBinaryFraming: //8 bit version, the caller switches framing if we say ok
+		length := converted[0]
+		if length != 1 {
+			print("!binary framing request has wrong length:", length, "\n")
+			return true, false
+		}
+		if converted[4] != FramingVersion {
+			print("!binary framing version ", converted[4], " not supported, want ", FramingVersion, "\n")
+			return true, false
+		}
+		return false, false
+	case ExtensionWindow: //8 bit window size, the caller switches to sequenced lines if we say ok
+		length := converted[0]
+		if length != 1 {
+			print("!window request has wrong length:", length, "\n")
+			return true, false
+		}
+		if converted[4] == 0 || converted[4] > WindowMax {
+			print("!window size ", converted[4], " is not between 1 and ", WindowMax, "\n")
+			return true, false
+		}
+		return false, false
+	case ExtensionImageDigest: //sha256 of the image, maybe followed by a signature
+		length := converted[0]
+		if length != DigestSize && length != SignedDigestSize {
+			print("!image digest has wrong length:", length, "\n")
+			return true, false
+		}
+		var sig []byte
+		if length == SignedDigestSize {
+			sig = converted[4+DigestSize : 4+SignedDigestSize]
+		}
+		bb.SetImageDigest(converted[4:4+DigestSize], sig)
+		return false, false
+	case ExtensionDeviceInfo: //no payload, the caller puts the answer in the ack
+		length := converted[0]
+		if length != 0 {
+			print("!device info request has wrong length:", length, "\n")
+			return true, false
+		}
+		return false, false
+	case ExtensionWindowHash: //mode, 64 bit addr, 32 bit size, sha256 of the window
+		length := converted[0]
+		if length != WindowHashSize {
+			print("!window hash has wrong length:", length, "\n")
+			return true, false
+		}
+		w := decodeWindowHash(converted)
+		if w.Mode == WindowHashQuery {
+			return false, false //the caller answers with WindowHashAnswer
+		}
+		if !w.matches(bb) {
+			print("!window at ", w.Addr, " changed since it was queried\n")
+			return true, false
+		}
+		//the device "writes" what it already has, so it is in the image digest
+		for i := uint64(0); i < uint64(w.Size); i++ {
+			bb.Write(w.Addr+i, bb.Read(w.Addr+i))
+		}
+		return false, false
 	case StartLinearAddress: //32 bit addr
 		length := converted[0]
 		if length != 4 {
@@ -192,7 +309,7 @@ func DecodeAndCheckStringToBytes(s string) ([]byte, HexLineType, uint32, error)
 	if !ok {
 		return nil, DataLine, 0, NewEncodeDecodeError(fmt.Sprintf("unable to extract line type from: %s", s))
 	}
-	if lt == DataLine {
+	if lt == DataLine || lt == ExtensionCompressedData {
 		addr = (uint32(converted[1]) * 256) + (uint32(converted[2]))
 	}
 	if ok := ValidBufferLength(lenAs16, converted); ok == false {
@@ -256,6 +373,18 @@ func ExtractLineType(converted []byte) (HexLineType, bool) {
 		return ExtensionBigLinearAddress, true
 	case 0x82:
 		return ExtensionBigEntryPoint, true
+	case 0x83:
+		return ExtensionCompressedData, true
+	case 0x84:
+		return ExtensionBinaryFraming, true
+	case 0x85:
+		return ExtensionWindow, true
+	case 0x86:
+		return ExtensionImageDigest, true
+	case 0x87:
+		return ExtensionDeviceInfo, true
+	case 0x88:
+		return ExtensionWindowHash, true
 	case 3:
 		print("!unimplemented line type in hex transmission [StartSegmentAddress] ")
 		return DataLine, false
@@ -284,6 +413,58 @@ func ConvertBuffer(l uint16, raw []byte) []byte {
 	return converted
 }
 
+// DecodeSequenceNumber is the two hex character sequence number at the
+// front of raw.  Responses carry one like this, with nothing to check it.
+func DecodeSequenceNumber(raw []byte) (uint8, bool) {
+	if len(raw) < 2 {
+		print("!sequence number is too short:", len(raw), "\n")
+		return 0, false
+	}
+	//bufferValue looks at index and index+1
+	return bufferValue(0, raw)
+}
+
+// DecodeSequenced splits the two hex character sequence number off the front
+// of a line sent in windowed mode and returns (seq, rest of line, ok?).  The
+// line's checksum covers the sequence number (see EncodeSequenced) so it is
+// checked here, before the line can be put in the wrong slot of the window.
+// The checksum in raw is changed back to the line's own, so the rest is an
+// ordinary line (with the newline, if raw had one).
+func DecodeSequenced(raw []byte) (uint8, []byte, bool) {
+	seq, ok := DecodeSequenceNumber(raw)
+	if !ok {
+		return 0, nil, false
+	}
+	line := raw[2:]
+	l := len(line)
+	if l > 0 && line[l-1] == 10 {
+		l--
+	}
+	if l < 11 || (l-1)%2 == 1 || line[0] != ':' {
+		print("!sequenced line is malformed, length ", l, "\n")
+		return 0, nil, false
+	}
+	sum := uint8(0)
+	for i := 1; i < l; i += 2 {
+		v, ok := bufferValue(uint16(i), line)
+		if !ok {
+			return 0, nil, false
+		}
+		sum += v
+	}
+	if sum+seq != 0 {
+		print("!bad checksum on sequenced line\n")
+		return 0, nil, false
+	}
+	cs, _ := bufferValue(uint16(l-2), line)
+	cs += seq
+	line[l-2] = hexDigits[cs>>4]
+	line[l-1] = hexDigits[cs&0xf]
+	return seq, line, true
+}
+
+const hexDigits = "0123456789ABCDEF"
+
 // this hits buffer[i] and buffer[i+1] to convert an ascii byte
 // returns false to mean you had a bad character in the input
 func bufferValue(index uint16, buffer []byte) (uint8, bool) {
@@ -383,6 +564,21 @@ func EncodeDataBytes(raw []byte, offset uint16) string {
 	return buf.String()
 }
 
+// EncodeCompressedData compresses as much of raw as will fit in one line
+// and returns the line and the number of bytes of raw that were consumed.
+// The caller must make sure that offset+len(raw) does not cross a 64K boundary.
+func EncodeCompressedData(raw []byte, offset uint16) (string, int) {
+	payload, consumed := compress(raw)
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf(":%02X%04X%02X", len(payload), offset, int(ExtensionCompressedData)))
+	for _, b := range payload {
+		buf.WriteString(fmt.Sprintf("%02x", b))
+	}
+	cs := createChecksum(payload, offset, ExtensionCompressedData)
+	buf.WriteString(fmt.Sprintf("%02X", cs))
+	return buf.String(), consumed
+}
+
 func EncodeBigEntry(entry uint32) string {
 	buf := bytes.Buffer{}
 	raw := []byte{byte(entry & 0xff000000 >> 24), byte(entry & 0x00ff0000 >> 16),
@@ -432,6 +628,77 @@ func EncodeESA(base uint16) string {
 	return buf.String()
 }
 
+// asks the receiver to switch to binary frames (see binframe.go)
+func EncodeBinaryFraming(version uint8) string {
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf(":010000%02X%02X", int(ExtensionBinaryFraming), version))
+	cs := createChecksum([]byte{version}, 0, ExtensionBinaryFraming)
+	buf.WriteString(fmt.Sprintf("%02X", cs))
+	return buf.String()
+}
+
+// asks the receiver to accept up to size lines before acknowledging them,
+// which also means every line after this one carries a sequence number
+func EncodeWindow(size uint8) string {
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf(":010000%02X%02X", int(ExtensionWindow), size))
+	cs := createChecksum([]byte{size}, 0, ExtensionWindow)
+	buf.WriteString(fmt.Sprintf("%02X", cs))
+	return buf.String()
+}
+
+// the digest of the image that was sent, sig can be nil if it isn't signed
+func EncodeImageDigest(sum []byte, sig []byte) string {
+	raw := append(append([]byte{}, sum...), sig...)
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf(":%02X0000%02X", len(raw), int(ExtensionImageDigest)))
+	for _, b := range raw {
+		buf.WriteString(fmt.Sprintf("%02X", b))
+	}
+	cs := createChecksum(raw, 0, ExtensionImageDigest)
+	buf.WriteString(fmt.Sprintf("%02X", cs))
+	return buf.String()
+}
+
+// asks the receiver who it is and what it loaded last, see reload.go
+func EncodeDeviceInfo() string {
+	return fmt.Sprintf(":000000%02X%02X", int(ExtensionDeviceInfo), createChecksum(nil, 0, ExtensionDeviceInfo))
+}
+
+// asks the receiver if it has sum at addr (WindowHashQuery) or tells it
+// to keep what it has there instead of getting data (WindowHashKeep)
+func EncodeWindowHash(mode uint8, addr uint64, size uint32, sum []byte) string {
+	raw := make([]byte, 0, WindowHashSize)
+	raw = append(raw, mode)
+	for p := 7; p >= 0; p-- {
+		raw = append(raw, byte(addr>>(p*8)))
+	}
+	for p := 3; p >= 0; p-- {
+		raw = append(raw, byte(size>>(p*8)))
+	}
+	raw = append(raw, sum...)
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf(":%02X0000%02X", len(raw), int(ExtensionWindowHash)))
+	for _, b := range raw {
+		buf.WriteString(fmt.Sprintf("%02X", b))
+	}
+	cs := createChecksum(raw, 0, ExtensionWindowHash)
+	buf.WriteString(fmt.Sprintf("%02X", cs))
+	return buf.String()
+}
+
+// EncodeSequenced puts the sequence number in front of a line for windowed
+// mode.  The sequence number is added in to the line's checksum, so a
+// damaged sequence number fails the checksum like damage anywhere else.
+func EncodeSequenced(seq uint8, line string) string {
+	l := len(line)
+	if l < 11 {
+		return fmt.Sprintf("%02X%s", seq, line) //not a line, so it will fail anyway
+	}
+	cs, _ := bufferValue(uint16(l-2), []byte(line))
+	return fmt.Sprintf("%02X%s%02X", seq, line[:l-2], cs-seq)
+}
+
 // this takes 4 64 bit integers (32 bytes)
 func EncodeExtensionSetParameters(v [4]uint64) string {
 	buf := bytes.Buffer{}
@@ -1,6 +1,8 @@
 package anticipation
 
 import (
+	"bytes"
+	"fmt"
 	"strings"
 	"testing"
 )
@@ -203,3 +205,154 @@ func TestExampleParameterEncoding(t *testing.T) {
 		t.Errorf("wrong type extracted! expected set params but got %s", lt.String())
 	}
 }
+
+func TestCompressedRoundTrip(t *testing.T) {
+	//some literals, a long run of zeros, short runs that should stay literal
+	data := []byte{0xde, 0xad, 0xbe, 0xef, 1, 1, 2, 2, 3}
+	data = append(data, make([]byte, 0x5000)...)
+	for i := 0; i < 0x300; i++ {
+		data = append(data, byte(i*7))
+	}
+	data = append(data, 0xff, 0xff, 0xff, 0xff, 0xff, 0x11)
+	bb := newFakeByteBuster(data, 0x10)
+
+	consumed := 0
+	lines := 0
+	for consumed < len(data) {
+		l, n := EncodeCompressedData(data[consumed:], uint16(0x10+consumed))
+		if n == 0 {
+			t.Fatalf("encoder made no progress at byte %d", consumed)
+		}
+		if len(l) >= int(FileXFerDataLineSize) {
+			t.Errorf("compressed line is too long for the device's buffer: %d", len(l))
+		}
+		converted, lt, addr, err := DecodeAndCheckStringToBytes(l)
+		if err != nil {
+			t.Fatalf("unable to decode compressed line %s: %v", l, err)
+		}
+		if lt != ExtensionCompressedData {
+			t.Fatalf("wrong line type, expected compressed data but got %s", lt)
+		}
+		if addr != uint32(0x10+consumed) {
+			t.Errorf("wrong offset, expected %x but got %x", 0x10+consumed, addr)
+		}
+		expanded, err := DecompressRecord(converted)
+		if err != nil {
+			t.Fatalf("unable to decompress record: %v", err)
+		}
+		if !bytes.Equal(expanded, data[consumed:consumed+n]) {
+			t.Errorf("decompressed record does not match original data at byte %d", consumed)
+		}
+		hadError, isEnd := ProcessLine(lt, converted, bb)
+		if hadError || isEnd {
+			t.Fatalf("unexpected result from processing compressed line (error %v, end %v)", hadError, isEnd)
+		}
+		consumed += n
+		lines++
+	}
+	if !bb.FinishedOk() {
+		t.Errorf("wrong number of bytes written, expected %d but got %d", len(data), bb.written)
+	}
+	if lines > 16 {
+		t.Errorf("expected compression to need few lines, but needed %d", lines)
+	}
+}
+
+func TestCompressedBadSize(t *testing.T) {
+	//run of 3 0xAA but declares 4 bytes
+	payload := []byte{0x00, 0x04, 0x80, 0x00, 0xaa}
+	cs := createChecksum(payload, 0, ExtensionCompressedData)
+	l := fmt.Sprintf(":%02X0000%02X%X%02X", len(payload), int(ExtensionCompressedData), payload, cs)
+	converted, lt, _, err := DecodeAndCheckStringToBytes(l)
+	if err != nil {
+		t.Fatalf("unable to decode line %s: %v", l, err)
+	}
+	hadError, _ := ProcessLine(lt, converted, NewNullByteBuster())
+	if !hadError {
+		t.Errorf("expected an error from a compressed line with the wrong size")
+	}
+}
+
+func TestCompressedBadLineWritesNothing(t *testing.T) {
+	payloads := [][]byte{
+		{0x00, 0x04, 0x01, 0x11, 0x22, 0x80, 0x00, 0xaa}, //literal is fine, the run overruns
+		{0x00, 0x08, 0x01, 0x11, 0x22, 0x80, 0x00, 0xaa}, //both fine, but too few bytes
+	}
+	for _, payload := range payloads {
+		cs := createChecksum(payload, 0, ExtensionCompressedData)
+		l := fmt.Sprintf(":%02X0000%02X%X%02X", len(payload), int(ExtensionCompressedData), payload, cs)
+		converted, lt, _, err := DecodeAndCheckStringToBytes(l)
+		if err != nil {
+			t.Fatalf("unable to decode line %s: %v", l, err)
+		}
+		bb := NewSparseByteBuster()
+		hadError, _ := ProcessLine(lt, converted, bb)
+		if !hadError {
+			t.Errorf("%s: expected an error from a bad compressed line", l)
+		}
+		if len(bb.Memory) != 0 {
+			t.Errorf("%s: expected nothing to be written but got %v", l, bb.Memory)
+		}
+	}
+}
+
+func TestCompressedCrossing64K(t *testing.T) {
+	l, n := EncodeCompressedData(make([]byte, 0x100), 0xff80)
+	if n != 0x100 {
+		t.Fatalf("expected to consume all the zeros but consumed %d", n)
+	}
+	converted, lt, _, err := DecodeAndCheckStringToBytes(l)
+	if err != nil {
+		t.Fatalf("unable to decode line %s: %v", l, err)
+	}
+	hadError, _ := ProcessLine(lt, converted, NewNullByteBuster())
+	if !hadError {
+		t.Errorf("expected an error from a compressed line that crosses 64K")
+	}
+}
+
+func TestSequencedLine(t *testing.T) {
+	l := ":04000005000000CD2A"
+	s := EncodeSequenced(0xa5, l)
+	seq, rest, ok := DecodeSequenced([]byte(s))
+	if !ok {
+		t.Fatalf("unable to decode sequenced line %s", s)
+	}
+	if seq != 0xa5 || string(rest) != l {
+		t.Errorf("expected seq a5 and %s but got %02x and %s", l, seq, rest)
+	}
+	if _, _, ok := DecodeSequenced([]byte("zz" + l)); ok {
+		t.Errorf("expected bad sequence number to be rejected")
+	}
+	//a sequence number damaged into another good one, the line must not
+	//end up in the slot for a5
+	for _, bad := range []string{"A4", "B5", "25"} {
+		if seq, _, ok := DecodeSequenced([]byte(bad + s[2:])); ok {
+			t.Errorf("expected %s%s to fail its checksum but got seq %02x", bad, s[2:], seq)
+		}
+	}
+	if _, _, ok := DecodeSequenced([]byte(s[:len(s)-1] + "0")); ok {
+		t.Errorf("expected bad checksum to be rejected")
+	}
+	//antc hands it the line with the newline on the end
+	seq, rest, ok = DecodeSequenced([]byte(EncodeSequenced(0x07, l) + "\n"))
+	if !ok || seq != 0x07 || string(rest) != l+"\n" {
+		t.Errorf("expected seq 07 and %s with a newline but got %02x, %q, %v", l, seq, rest, ok)
+	}
+}
+
+func TestWindowRequest(t *testing.T) {
+	for _, c := range []struct {
+		size uint8
+		ok   bool
+	}{{16, true}, {1, true}, {0, false}, {WindowMax + 1, false}, {64, false}} {
+		converted, lt, _, err := DecodeAndCheckStringToBytes(EncodeWindow(c.size))
+		if err != nil || lt != ExtensionWindow {
+			t.Fatalf("unable to decode window line: %v %s", err, lt)
+		}
+		hadError, _ := ProcessLine(lt, converted, NewNullByteBuster())
+		if hadError == c.ok {
+			t.Errorf("window of size %d: expected ok=%v", c.size, c.ok)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package anticipation
+
+//
+// LineRing is where the device keeps lines between getting them (in the
+// uart interrupt, for antc) and processing them.  It starts out as a plain
+// fifo of lines, in the order received.  Once the host asks for a window
+// (SetWindow) it becomes the receive window: lines are placed in the slot
+// picked by their sequence number and handed out strictly in sequence
+// order, so lines that arrive after a lost or corrupted one wait here until
+// the missing one is resent.  It has WindowMax slots, which is why that is
+// the largest window we agree to.
+//
+// None of this blocks or touches the hardware, antc waits for interrupts
+// when there is nothing to hand out and sends the responses.  It must only
+// be used with interrupts masked.
+//
+type LineRing struct {
+	lines   []string
+	present []bool
+	head    int
+	tail    int
+
+	windowed bool
+	window   uint8
+	expected uint8 //sequence number of the next line to process
+	nakFor   uint8 //last missing line we asked for, so we only ask once
+	nakValid bool
+}
+
+const ringMask = WindowMax - 1 //all 1s at the end
+
+func NewLineRing() *LineRing {
+	return &LineRing{
+		lines:   make([]string, WindowMax),
+		present: make([]bool, WindowMax),
+	}
+}
+
+// Add puts a line at the end of the fifo, without a window
+func (l *LineRing) Add(s string) {
+	l.lines[l.head] = s
+	l.head++
+	l.head &= ringMask
+}
+
+// Empty is true when the fifo has no lines
+func (l *LineRing) Empty() bool {
+	return l.head == l.tail
+}
+
+// Next takes the line at the front of the fifo, it must not be Empty
+func (l *LineRing) Next() string {
+	line := l.lines[l.tail]
+	l.tail++
+	l.tail &= ringMask
+	return line
+}
+
+// Windowed is true once SetWindow has been called
+func (l *LineRing) Windowed() bool {
+	return l.windowed
+}
+
+// Expected is the sequence number of the line we are waiting on
+func (l *LineRing) Expected() uint8 {
+	return l.expected
+}
+
+// SetWindow switches to windowed mode, the next line must be sequence 0.
+// ProcessLine has already checked size against WindowMax.
+func (l *LineRing) SetWindow(size uint8) {
+	l.windowed = true
+	l.window = size
+	l.expected = 0
+	l.nakValid = false
+	for i := range l.present {
+		l.present[i] = false
+	}
+}
+
+// AddToWindow puts a line in its slot and returns what to tell the host
+// (without the newline), if anything.  Lines from before the window have
+// already been processed, the host must have missed our ack so we send it
+// again.  If this line is past a gap, we ask for the missing line.
+func (l *LineRing) AddToWindow(seq uint8, s string) string {
+	distance := seq - l.expected //wraps, on purpose
+	if distance >= l.window {
+		if distance > 0xff-l.window {
+			return "." + SequenceTag(seq) + " duplicate"
+		}
+		return "!" + SequenceTag(seq) + " outside window"
+	}
+	slot := seq & ringMask
+	l.lines[slot] = s
+	l.present[slot] = true
+	if distance != 0 && !l.present[l.expected&ringMask] {
+		if !l.nakValid || l.nakFor != l.expected {
+			l.nakFor = l.expected
+			l.nakValid = true
+			return "!" + SequenceTag(l.expected) + " missing"
+		}
+	}
+	return ""
+}
+
+// Ready is true when the expected line is here
+func (l *LineRing) Ready() bool {
+	return l.present[l.expected&ringMask]
+}
+
+// NextInWindow returns the expected line, it must be Ready.  The caller
+// must call Advance or Drop when done with it.
+func (l *LineRing) NextInWindow() (uint8, string) {
+	return l.expected, l.lines[l.expected&ringMask]
+}
+
+// Advance is called when the expected line has been processed ok
+func (l *LineRing) Advance() {
+	l.present[l.expected&ringMask] = false
+	l.expected++
+}
+
+// Drop is called when the expected line was bad, we need it again
+func (l *LineRing) Drop() {
+	l.present[l.expected&ringMask] = false
+}
+
+// Resync throws away every line that hasn't been processed, the host is
+// going to send them all again.  In a window, the next one is still
+// expected.
+func (l *LineRing) Resync() {
+	l.tail = l.head
+	for i := range l.present {
+		l.present[i] = false
+	}
+	l.nakValid = false
+}
+
+// SequenceTag is how a sequence number looks in a response, two hex digits
+func SequenceTag(seq uint8) string {
+	const digits = "0123456789ABCDEF"
+	return string([]byte{digits[seq>>4], digits[seq&0xf]})
+}
@@ -0,0 +1,71 @@
+package anticipation
+
+import "testing"
+
+func TestLineRingFifo(t *testing.T) {
+	l := NewLineRing()
+	for i := 0; i < 3*WindowMax; i++ {
+		l.Add(SequenceTag(uint8(i)))
+		if l.Empty() {
+			t.Fatalf("%d: empty after Add", i)
+		}
+		if s := l.Next(); s != SequenceTag(uint8(i)) {
+			t.Errorf("%d: expected %s but got %s", i, SequenceTag(uint8(i)), s)
+		}
+	}
+	if !l.Empty() {
+		t.Errorf("expected the ring to be empty")
+	}
+}
+
+func TestLineRingWindow(t *testing.T) {
+	l := NewLineRing()
+	l.SetWindow(4)
+	for _, c := range []struct {
+		seq      uint8
+		response string
+	}{
+		{1, "!00 missing"},
+		{2, ""}, //only ask once
+		{4, "!04 outside window"},
+		{0xff, ".FF duplicate"},
+	} {
+		if r := l.AddToWindow(c.seq, SequenceTag(c.seq)); r != c.response {
+			t.Errorf("line %d: expected %q but got %q", c.seq, c.response, r)
+		}
+	}
+	if l.Ready() {
+		t.Fatalf("ready without line 0")
+	}
+	l.AddToWindow(0, "bad")
+	seq, s := l.NextInWindow()
+	if seq != 0 || s != "bad" {
+		t.Fatalf("expected line 0 but got %d %s", seq, s)
+	}
+	l.Drop()
+	if l.Ready() {
+		t.Fatalf("ready after Drop")
+	}
+	l.AddToWindow(0, SequenceTag(0))
+	for i := uint8(0); i < 3; i++ {
+		if !l.Ready() {
+			t.Fatalf("line %d is not ready", i)
+		}
+		seq, s := l.NextInWindow()
+		if seq != i || s != SequenceTag(i) {
+			t.Errorf("expected line %d but got %d %s", i, seq, s)
+		}
+		l.Advance()
+	}
+	if l.Expected() != 3 || l.Ready() {
+		t.Errorf("expected to be waiting on line 3, not %d", l.Expected())
+	}
+	l.AddToWindow(4, SequenceTag(4))
+	l.Resync()
+	if l.Ready() || l.Expected() != 3 {
+		t.Errorf("resync should keep waiting on line 3")
+	}
+	if r := l.AddToWindow(4, SequenceTag(4)); r != "!03 missing" {
+		t.Errorf("resync should forget the nak, got %q", r)
+	}
+}
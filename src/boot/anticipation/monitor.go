@@ -0,0 +1,126 @@
+package anticipation
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//
+// antc's monitor is a few commands for poking at the board before (or
+// instead of) loading a kernel.  You get it by sending MonitorBreak while
+// antc is counting down, before the first line of a kernel.  Each command
+// is one line, each line of the response starts with . (ok) or ! (error)
+// just like the responses to hex lines.
+//
+
+// MonitorBreak is three control-C's, which can't be the start of a hex line
+const MonitorBreak = "\x03\x03\x03"
+
+// MonitorLoadResponse is what antc says when it leaves the monitor to load
+// a kernel, the sender can start the line protocol after it sees this
+const MonitorLoadResponse = ". load: waiting for a kernel"
+
+// the most words a single peek will print
+const MonitorMaxPeek = 64
+
+type MonitorCommand int
+
+const (
+	MonitorHelp MonitorCommand = 0
+	MonitorPeek MonitorCommand = 1
+	MonitorPoke MonitorCommand = 2
+	MonitorRegs MonitorCommand = 3
+	MonitorInfo MonitorCommand = 4
+	MonitorLoad MonitorCommand = 5
+	MonitorJump MonitorCommand = 6
+)
+
+// MonitorHelpText is one line per command, for the help command
+var MonitorHelpText = []string{
+	"peek addr [count]  print count (default 1) 64 bit words starting at addr",
+	"poke addr value    write the 64 bit value at addr",
+	"regs               print the system registers",
+	"info               print what the firmware says about the board",
+	"load               leave the monitor and wait for a kernel",
+	"jump addr          jump to addr, with interrupts off",
+}
+
+// MonitorRequest is a parsed command line.  Addr and Value are only
+// meaningful for the commands that take them, for peek Value is the count.
+type MonitorRequest struct {
+	Command MonitorCommand
+	Addr    uint64
+	Value   uint64
+}
+
+var monitorCommands = map[string]MonitorCommand{
+	"help": MonitorHelp,
+	"?":    MonitorHelp,
+	"peek": MonitorPeek,
+	"poke": MonitorPoke,
+	"regs": MonitorRegs,
+	"info": MonitorInfo,
+	"load": MonitorLoad,
+	"jump": MonitorJump,
+}
+
+// ParseMonitorLine turns a command line into a request.  Numbers are hex,
+// with or without 0x in front.  Addresses must be 8 byte aligned because
+// everything is done a 64 bit word at a time.
+func ParseMonitorLine(line string) (MonitorRequest, error) {
+	var result MonitorRequest
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return result, errors.New("empty command")
+	}
+	cmd, ok := monitorCommands[strings.ToLower(words[0])]
+	if !ok {
+		return result, errors.New("unknown command " + words[0] + ", try help")
+	}
+	result.Command = cmd
+	args := words[1:]
+	min, max := 0, 0
+	switch cmd {
+	case MonitorPeek:
+		min, max = 1, 2
+	case MonitorPoke:
+		min, max = 2, 2
+	case MonitorJump:
+		min, max = 1, 1
+	}
+	if len(args) < min || len(args) > max {
+		return result, errors.New("wrong number of arguments to " + words[0])
+	}
+	numbers := make([]uint64, len(args))
+	for i, a := range args {
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToLower(a), "0x"), 16, 64)
+		if err != nil {
+			return result, errors.New("bad number " + a)
+		}
+		numbers[i] = n
+	}
+	if len(numbers) > 0 {
+		result.Addr = numbers[0]
+		if cmd != MonitorJump && result.Addr&0x7 != 0 {
+			return result, errors.New("address must be 8 byte aligned")
+		}
+	}
+	switch cmd {
+	case MonitorPeek:
+		result.Value = 1
+		if len(numbers) == 2 {
+			result.Value = numbers[1]
+		}
+		if result.Value == 0 || result.Value > MonitorMaxPeek {
+			return result, errors.New("count must be between 1 and " + strconv.Itoa(MonitorMaxPeek))
+		}
+	case MonitorPoke:
+		result.Value = numbers[1]
+	case MonitorJump:
+		if result.Addr&0x3 != 0 {
+			return result, errors.New("address must be 4 byte aligned")
+		}
+	}
+	return result, nil
+}
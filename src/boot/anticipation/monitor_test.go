@@ -0,0 +1,48 @@
+package anticipation
+
+import "testing"
+
+func TestParseMonitorLine(t *testing.T) {
+	good := []struct {
+		line     string
+		expected MonitorRequest
+	}{
+		{"help", MonitorRequest{Command: MonitorHelp}},
+		{"  PEEK 0xfffffc0030000000 ", MonitorRequest{Command: MonitorPeek, Addr: 0xfffffc0030000000, Value: 1}},
+		{"peek 80000 10", MonitorRequest{Command: MonitorPeek, Addr: 0x80000, Value: 0x10}},
+		{"poke 3f200000 deadbeef", MonitorRequest{Command: MonitorPoke, Addr: 0x3f200000, Value: 0xdeadbeef}},
+		{"regs", MonitorRequest{Command: MonitorRegs}},
+		{"info", MonitorRequest{Command: MonitorInfo}},
+		{"load", MonitorRequest{Command: MonitorLoad}},
+		{"jump 0x80004", MonitorRequest{Command: MonitorJump, Addr: 0x80004}},
+	}
+	for _, g := range good {
+		got, err := ParseMonitorLine(g.line)
+		if err != nil {
+			t.Errorf("unexpected error for %q: %v", g.line, err)
+			continue
+		}
+		if got != g.expected {
+			t.Errorf("%q: expected %+v but got %+v", g.line, g.expected, got)
+		}
+	}
+	bad := []string{
+		"",
+		"reboot",
+		"peek",
+		"peek 80004",             //not aligned
+		"peek 80000 0",           //count too small
+		"peek 80000 41",          //count too big
+		"peek 80000 1 2",         //too many
+		"poke 80000",             //no value
+		"poke 80000 xyzzy",       //not hex
+		"jump 80002",             //not aligned for an instruction
+		"regs now",               //no args
+		"peek 10000000000000000", //too big for 64 bits
+	}
+	for _, b := range bad {
+		if _, err := ParseMonitorLine(b); err == nil {
+			t.Errorf("expected an error for %q", b)
+		}
+	}
+}
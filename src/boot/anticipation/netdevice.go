@@ -0,0 +1,95 @@
+// +build !tinygo
+
+package anticipation
+
+import (
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+//
+// NetDevice puts a SimDevice on the network: each line comes in as one
+// datagram and each response goes back as one.  This is antnet, and the
+// device end of release's -net in its tests.  antc can't do this (yet)
+// so it is only built for the host.
+//
+type NetDevice struct {
+	*SimDevice
+	// if set, it is called for every datagram, in or out, and the datagram
+	// is lost if it says so
+	Drop    func() bool
+	Verbose int
+
+	conn    *net.UDPConn
+	peer    *net.UDPAddr
+	started bool
+}
+
+func NewNetDevice(conn *net.UDPConn) *NetDevice {
+	d := &NetDevice{SimDevice: NewSimDevice(), conn: conn}
+	d.IgnoreRepeats = true //acks get lost
+	return d
+}
+
+// Serve answers datagrams until the transfer is done, and then for linger
+// more in case our last ack got lost
+func (d *NetDevice) Serve(linger time.Duration) error {
+	buffer := make([]byte, 2*FileXFerDataLineSize)
+	for !d.Done() {
+		n, from, err := d.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return err
+		}
+		if d.dropped("incoming") {
+			continue
+		}
+		d.receive(from, strings.TrimSpace(string(buffer[:n])))
+	}
+	d.conn.SetReadDeadline(time.Now().Add(linger))
+	for {
+		n, from, err := d.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return nil //nobody asked again
+		}
+		d.receive(from, strings.TrimSpace(string(buffer[:n])))
+	}
+}
+
+func (d *NetDevice) dropped(which string) bool {
+	if d.Drop == nil || !d.Drop() {
+		return false
+	}
+	if d.Verbose > 0 {
+		log.Printf("@@@ dropping %s datagram", which)
+	}
+	return true
+}
+
+func (d *NetDevice) reply(s string) {
+	if d.Verbose == 2 {
+		log.Printf("--> %s", s)
+	}
+	if d.dropped("outgoing") {
+		return
+	}
+	d.conn.WriteToUDP([]byte(s+"\n"), d.peer)
+}
+
+func (d *NetDevice) receive(from *net.UDPAddr, line string) {
+	d.peer = from
+	if d.Verbose == 2 {
+		log.Printf("<-- %s", line)
+	}
+	if len(line) == 0 { //hello
+		if !d.started {
+			d.reply(". antnet ready")
+		}
+		return
+	}
+	d.started = true
+	for _, r := range d.Receive(line) {
+		d.reply(r)
+	}
+}
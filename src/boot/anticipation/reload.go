@@ -0,0 +1,153 @@
+package anticipation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+//
+// Differential reload lets the sender skip the parts of a kernel the device
+// already has.  Memory survives a reset (but not a power cycle), so after
+// the board is reset the last kernel is still sitting there.
+//
+// The sender starts by asking who the device is (ExtensionDeviceInfo).
+// The answer is the board's id and, if memory still holds the last image
+// loaded, that image's digest.  Then, still one line at a time, it asks
+// about 64K windows (ExtensionWindowHash, WindowHashQuery) and the device
+// answers WindowSame or WindowChanged.  When sending the data, a window the
+// device has is replaced by the same line with WindowHashKeep, and the
+// device counts what it has into the image digest as if it had been sent.
+//
+
+// the payload of an ExtensionWindowHash line: mode, address, size and sum
+const WindowHashSize = 1 + 8 + 4 + DigestSize
+
+// modes of an ExtensionWindowHash line
+const (
+	WindowHashQuery = 0
+	WindowHashKeep  = 1
+)
+
+// answers to a WindowHashQuery, after the . (and sequence number)
+const (
+	WindowSame    = "same"
+	WindowChanged = "changed"
+)
+
+// "ANTCLOAD", so garbage left by a power cycle won't look like a record
+const loadRecordMagic = 0x414e54434c4f4144
+
+// LoadRecord is what the device remembers about the last image it loaded.
+// antc keeps it in low memory, which nothing else uses, so it is only
+// there after a reset.
+type LoadRecord struct {
+	Magic  uint64
+	Digest [DigestSize]byte
+	Check  uint64
+}
+
+func (r *LoadRecord) check() uint64 {
+	sum := uint64(loadRecordMagic)
+	for i, b := range r.Digest {
+		sum = (sum << 5) + sum + uint64(b) + uint64(i)
+	}
+	return sum
+}
+
+// Set records that the image with digest was loaded
+func (r *LoadRecord) Set(digest []byte) {
+	copy(r.Digest[:], digest)
+	r.Magic = loadRecordMagic
+	r.Check = r.check()
+}
+
+// Clear is for when memory is about to change, so the record is a lie
+func (r *LoadRecord) Clear() {
+	r.Magic = 0
+}
+
+// Valid is false after a power cycle (or a load that didn't finish)
+func (r *LoadRecord) Valid() bool {
+	return r.Magic == loadRecordMagic && r.Check == r.check()
+}
+
+// DeviceInfoResponse is the device's answer to ExtensionDeviceInfo
+func DeviceInfoResponse(id uint64, r *LoadRecord) string {
+	if !r.Valid() {
+		return fmt.Sprintf("device %016x cold", id)
+	}
+	return fmt.Sprintf("device %016x warm %s", id, hex.EncodeToString(r.Digest[:]))
+}
+
+// ParseDeviceInfo pulls the id and the digest of the last image out of a
+// response to ExtensionDeviceInfo.  last is nil if the device is cold.
+func ParseDeviceInfo(response string) (id uint64, last []byte, ok bool) {
+	i := strings.Index(response, "device ")
+	if i < 0 {
+		return 0, nil, false
+	}
+	var state, digest string
+	n, _ := fmt.Sscanf(response[i:], "device %x %s %s", &id, &state, &digest)
+	switch {
+	case n == 2 && state == "cold":
+		return id, nil, true
+	case n == 3 && state == "warm":
+		last, err := hex.DecodeString(digest)
+		if err != nil || len(last) != DigestSize {
+			return 0, nil, false
+		}
+		return id, last, true
+	}
+	return 0, nil, false
+}
+
+// WindowHash is a decoded ExtensionWindowHash line
+type WindowHash struct {
+	Mode uint8
+	Addr uint64
+	Size uint32
+	Sum  []byte
+}
+
+func decodeWindowHash(converted []byte) WindowHash {
+	p := converted[4 : 4+WindowHashSize]
+	w := WindowHash{Mode: p[0]}
+	for _, b := range p[1:9] {
+		w.Addr = (w.Addr << 8) | uint64(b)
+	}
+	for _, b := range p[9:13] {
+		w.Size = (w.Size << 8) | uint32(b)
+	}
+	w.Sum = p[13:]
+	return w
+}
+
+// matches is true if the memory at the window hashes to the window's sum
+func (w WindowHash) matches(bb byteBuster) bool {
+	h := sha256.New()
+	var chunk [64]byte
+	for done := uint64(0); done < uint64(w.Size); {
+		n := uint64(len(chunk))
+		if uint64(w.Size)-done < n {
+			n = uint64(w.Size) - done
+		}
+		for i := uint64(0); i < n; i++ {
+			chunk[i] = bb.Read(w.Addr + done + i)
+		}
+		h.Write(chunk[:n])
+		done += n
+	}
+	return bytes.Equal(h.Sum(nil), w.Sum)
+}
+
+// WindowHashAnswer is the device's answer to a WindowHashQuery line that
+// ProcessLine accepted
+func WindowHashAnswer(converted []byte, bb byteBuster) string {
+	if decodeWindowHash(converted).matches(bb) {
+		return WindowSame
+	}
+	return WindowChanged
+}
@@ -0,0 +1,105 @@
+package anticipation
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func TestLoadRecord(t *testing.T) {
+	var r LoadRecord
+	if r.Valid() {
+		t.Errorf("zero record should not be valid")
+	}
+	sum := sha256.Sum256([]byte("kernel"))
+	r.Set(sum[:])
+	if !r.Valid() {
+		t.Errorf("record should be valid after Set")
+	}
+	r.Digest[3]++ //like a bit flipped in memory
+	if r.Valid() {
+		t.Errorf("record with a bad check should not be valid")
+	}
+	r.Set(sum[:])
+	r.Clear()
+	if r.Valid() {
+		t.Errorf("record should not be valid after Clear")
+	}
+}
+
+func TestDeviceInfo(t *testing.T) {
+	var r LoadRecord
+	id, last, ok := ParseDeviceInfo(". " + DeviceInfoResponse(0xabcdef, &r))
+	if !ok || id != 0xabcdef || last != nil {
+		t.Errorf("cold: got %x %x %v", id, last, ok)
+	}
+	sum := sha256.Sum256([]byte("kernel"))
+	r.Set(sum[:])
+	id, last, ok = ParseDeviceInfo(".07 " + DeviceInfoResponse(42, &r))
+	if !ok || id != 42 || !bytes.Equal(last, sum[:]) {
+		t.Errorf("warm: got %x %x %v", id, last, ok)
+	}
+	for _, bad := range []string{".", ". accept: ExtensionDeviceInfo", ". device 12 warm", ". device 12 warm 1234", ". device 12 hot"} {
+		if _, _, ok := ParseDeviceInfo(bad); ok {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestWindowHash(t *testing.T) {
+	const addr = 0x30010000
+	data := bytes.Repeat([]byte("window"), 100)
+	sum := sha256.Sum256(data)
+	bb := NewSparseByteBuster()
+
+	query := EncodeWindowHash(WindowHashQuery, addr, uint32(len(data)), sum[:])
+	converted, lt, _, err := DecodeAndCheckStringToBytes(query)
+	if err != nil || lt != ExtensionWindowHash {
+		t.Fatalf("unable to decode %s: %v", query, err)
+	}
+	if wasError, _ := ProcessLine(lt, converted, bb); wasError {
+		t.Fatalf("query failed")
+	}
+	if a := WindowHashAnswer(converted, bb); a != WindowChanged {
+		t.Errorf("empty memory: expected %s but got %s", WindowChanged, a)
+	}
+	for i, b := range data {
+		bb.Memory[addr+uint64(i)] = b
+	}
+	if a := WindowHashAnswer(converted, bb); a != WindowSame {
+		t.Errorf("expected %s but got %s", WindowSame, a)
+	}
+	if len(bb.Digest()) != DigestSize || !bytes.Equal(bb.Digest(), NewSparseByteBuster().Digest()) {
+		t.Errorf("a query should not change the digest")
+	}
+
+	//keeping the window counts it in the digest just like sending it
+	keep := EncodeWindowHash(WindowHashKeep, addr, uint32(len(data)), sum[:])
+	converted, lt, _, _ = DecodeAndCheckStringToBytes(keep)
+	if wasError, _ := ProcessLine(lt, converted, bb); wasError {
+		t.Fatalf("keep failed")
+	}
+	sent := NewImageDigest()
+	sent.Write(data)
+	if !bytes.Equal(bb.Digest(), sent.Sum()) {
+		t.Errorf("digest after keep doesn't match the data")
+	}
+
+	//but only if the memory is still what the sender thinks it is
+	bb.Memory[addr+7]++
+	if wasError, _ := ProcessLine(lt, converted, bb); !wasError {
+		t.Errorf("expected keep of a changed window to fail")
+	}
+}
+
+func TestDeviceInfoLine(t *testing.T) {
+	d := NewSimDevice()
+	d.ID = 0x1234
+	r := d.Receive(EncodeDeviceInfo())
+	if len(r) != 1 {
+		t.Fatalf("expected one response, got %v", r)
+	}
+	if id, last, ok := ParseDeviceInfo(r[0]); !ok || id != 0x1234 || last != nil {
+		t.Errorf("unexpected response %s", r[0])
+	}
+}
@@ -0,0 +1,258 @@
+package anticipation
+
+import (
+	"crypto/ed25519"
+	"errors"
+)
+
+//
+// SimDevice is antc's side of the line protocol for running on the host:
+// hand it the lines the sender puts on the wire and it gives back the
+// responses antc would send.  The "memory" is a SparseByteBuster so the
+// results can be checked.  It speaks hex lines, windows and binary
+// frames: once it has agreed to framing, what comes over the wire goes to
+// ReceiveFrames instead of Receive.
+//
+type SimDevice struct {
+	Memory *SparseByteBuster
+	// if set, like antc's trustedKey, only signed images are accepted
+	Key ed25519.PublicKey
+	// antc processes a line again if it gets it again, which is fine on a
+	// serial line.  Over a network an ack can be lost, and doing a line
+	// twice makes the digest wrong, so this makes repeats just get acked.
+	IgnoreRepeats bool
+	// the board id antc reports, and its memory of the last image loaded
+	ID     uint64
+	Record LoadRecord
+	// what the watchdog does when Timeout is called over and over, and
+	// how many times it has reset the board
+	Watchdog WatchdogPolicy
+	Reboots  int
+	// like an antc from before binary framing, the request is nak'ed
+	RefuseFraming bool
+
+	done   bool
+	framed bool
+	frames *FrameDecoder
+	lines  *LineRing //the same ring (and window) antc has
+	last   string    //last line processed without a window
+	silent int       //Timeouts since the last line
+}
+
+func NewSimDevice() *SimDevice {
+	return &SimDevice{
+		Memory: NewSparseByteBuster(),
+		frames: NewFrameDecoder(),
+		lines:  NewLineRing(),
+	}
+}
+
+// Reset is antc starting again after the board is reset, memory (and so
+// the LoadRecord) survives
+func (d *SimDevice) Reset() {
+	*d = SimDevice{
+		Memory:        d.Memory.Restart(),
+		Key:           d.Key,
+		IgnoreRepeats: d.IgnoreRepeats,
+		ID:            d.ID,
+		Record:        d.Record,
+		Watchdog:      d.Watchdog,
+		Reboots:       d.Reboots,
+		RefuseFraming: d.RefuseFraming,
+		frames:        NewFrameDecoder(),
+		lines:         NewLineRing(),
+	}
+}
+
+// PowerCycle is a Reset that loses everything in memory
+func (d *SimDevice) PowerCycle() {
+	d.Reset()
+	d.Memory = NewSparseByteBuster()
+	d.Record = LoadRecord{}
+}
+
+// Done is true once the EOF has been accepted, antc would be jumping to
+// the kernel now
+func (d *SimDevice) Done() bool {
+	return d.done
+}
+
+// Framed is true once the device has agreed to binary framing
+func (d *SimDevice) Framed() bool {
+	return d.framed
+}
+
+// Timeout is what antc's watchdog says when it is waiting for a line
+func (d *SimDevice) Timeout() []string {
+	if d.done {
+		return nil
+	}
+	d.silent++
+	switch d.Watchdog.Action(d.silent) {
+	case WatchdogReboot:
+		d.Reset()
+		d.Reboots++
+		return nil
+	case WatchdogResync:
+		return []string{d.resync()}
+	}
+	if !d.lines.Windowed() {
+		return nil
+	}
+	return []string{"!" + SequenceTag(d.lines.Expected()) + " timeout"}
+}
+
+// resync throws away the lines we have and asks for the section again
+func (d *SimDevice) resync() string {
+	tag := ""
+	if d.lines.Windowed() {
+		tag = SequenceTag(d.lines.Expected())
+	}
+	d.lines.Resync()
+	d.last = "" //the start of the section will be a repeat
+	return EncodeResync(tag, d.Memory.Resync())
+}
+
+// Receive takes one line as it came over the wire (with the sequence
+// number, if windowed, and no newline) and returns the responses
+func (d *SimDevice) Receive(line string) []string {
+	d.silent = 0
+	if d.done && !d.IgnoreRepeats {
+		return nil //we'd be running the kernel
+	}
+	if d.IgnoreRepeats && line == d.last {
+		//in a window, this is the window request again and the ack was lost
+		return []string{". repeat"}
+	}
+	if !d.lines.Windowed() {
+		return d.receive(0, line)
+	}
+	seq, rest, ok := DecodeSequenced([]byte(line))
+	if !ok {
+		return []string{"! bad sequenced line"}
+	}
+	return d.receive(seq, string(rest))
+}
+
+// ReceiveFrames is Receive once framing is on, wire is the bytes as they
+// came over the wire and can hold any number of frames, or parts of them
+func (d *SimDevice) ReceiveFrames(wire []byte) []string {
+	result := []string{}
+	for _, b := range wire {
+		converted, done, err := d.frames.Feed(b)
+		if !done {
+			continue
+		}
+		d.silent = 0
+		switch {
+		case d.done:
+			return result
+		case err != nil:
+			result = append(result, "! frame error:"+err.Error())
+		default:
+			result = append(result, d.receive(d.frames.Sequence(), string(converted))...)
+		}
+	}
+	return result
+}
+
+// receive puts a line in the ring, or in its slot in the window, and
+// processes the ones that are ready like antc's main loop.  seq is ignored
+// without a window.
+func (d *SimDevice) receive(seq uint8, line string) []string {
+	result := []string{}
+	if !d.lines.Windowed() {
+		d.lines.Add(line)
+		for !d.lines.Empty() && !d.lines.Windowed() {
+			l := d.lines.Next()
+			response, ok := d.process("", l)
+			if ok {
+				d.last = l
+			}
+			result = append(result, response)
+		}
+		return result
+	}
+	if response := d.lines.AddToWindow(seq, line); response != "" {
+		result = append(result, response)
+	}
+	for !d.done && d.lines.Ready() {
+		seq, l := d.lines.NextInWindow()
+		response, ok := d.process(SequenceTag(seq), l)
+		result = append(result, response)
+		if !ok {
+			d.lines.Drop() //we need it again
+			break
+		}
+		d.lines.Advance()
+	}
+	return result
+}
+
+// process does one line and returns the response, and if it went ok
+func (d *SimDevice) process(tag string, line string) (string, bool) {
+	lt, converted, answer, err := d.processLine(line)
+	if err != nil {
+		return "!" + tag + " processing error:" + err.Error(), false
+	}
+	if answer != "" {
+		return "." + tag + " " + answer, true
+	}
+	switch lt {
+	case ExtensionBinaryFraming:
+		d.framed = true //after this ack, the host sends frames
+	case ExtensionWindow:
+		d.lines.SetWindow(converted[4])
+		d.frames.SetSequenced(true)
+	}
+	if d.done {
+		return "." + tag, true
+	}
+	return "." + tag + " accept: " + lt.String(), true
+}
+
+// processLine returns the line type, the converted line and, for the lines
+// that ask the device something, the answer.  Once framed, line is already
+// converted (the frame decoder checked it) like it is in antc.
+func (d *SimDevice) processLine(line string) (HexLineType, []byte, string, error) {
+	var converted []byte
+	var lt HexLineType
+	if d.framed {
+		converted = []byte(line)
+		lt, _ = ExtractLineType(converted)
+	} else {
+		var err error
+		converted, lt, _, err = DecodeAndCheckStringToBytes(line)
+		if err != nil {
+			return lt, nil, "", err
+		}
+	}
+	if lt == ExtensionBinaryFraming && d.RefuseFraming {
+		return lt, nil, "", errors.New("unknown line type")
+	}
+	query := lt == ExtensionDeviceInfo || (lt == ExtensionWindowHash && converted[4] == WindowHashQuery)
+	if !query {
+		d.Record.Clear() //memory is changing
+	}
+	wasError, done := ProcessLine(lt, converted, d.Memory)
+	if wasError {
+		return lt, nil, "", errors.New("unable to execute line")
+	}
+	switch {
+	case lt == ExtensionDeviceInfo:
+		return lt, converted, DeviceInfoResponse(d.ID, &d.Record), nil
+	case query:
+		return lt, converted, WindowHashAnswer(converted, d.Memory), nil
+	}
+	if done {
+		if !d.Memory.EntryPointIsSet() {
+			return lt, nil, "", errors.New("no entry point has been set")
+		}
+		if err := d.Memory.VerifyImage(d.Key); err != nil {
+			return lt, nil, "", errors.New("refusing to boot: " + err.Error())
+		}
+		d.Record.Set(d.Memory.Digest())
+		d.done = true
+	}
+	return lt, converted, "", nil
+}
@@ -0,0 +1,103 @@
+package anticipation
+
+import (
+	"fmt"
+	"strings"
+)
+
+//
+// The bootloader's watchdog is its local timer, which goes off every
+// interval that it doesn't get a line.  What it does about it depends on
+// how many intervals in a row have been silent (WatchdogPolicy).  First it
+// asks for the line it is waiting on again (when windowed), then it asks
+// the sender to resync: start again from the beginning of the current
+// section.  If that doesn't work either, it gives up and resets the board.
+//
+// A section is everything from an ExtensionBigLinearAddress line to the
+// next one, the sender puts one at the start of every 64K.  The device
+// counts them, and a resync request says how many it has seen; the last
+// one is where the sender starts again.  The device rewinds its image
+// digest to where it was at the start of that section, the bytes will be
+// written (and counted) again.  A count of zero means start from the
+// beginning.
+//
+
+// after the ! (and sequence number, when windowed) of a resync request
+const ResyncRequest = "resync"
+
+// WatchdogPolicy is what the bootloader does after some number of silent
+// intervals during a transfer.  Zero means never.
+type WatchdogPolicy struct {
+	Resync int //ask the sender to start the section again, and every this many after
+	Reboot int //reset the board
+}
+
+type WatchdogAction int
+
+const (
+	WatchdogNak    WatchdogAction = 0 //ask for the line we are waiting on, if windowed
+	WatchdogResync WatchdogAction = 1
+	WatchdogReboot WatchdogAction = 2
+)
+
+// Action is what to do when the watchdog goes off for the silent-th time
+// in a row
+func (p WatchdogPolicy) Action(silent int) WatchdogAction {
+	switch {
+	case p.Reboot > 0 && silent >= p.Reboot:
+		return WatchdogReboot
+	case p.Resync > 0 && silent > 0 && silent%p.Resync == 0:
+		return WatchdogResync
+	}
+	return WatchdogNak
+}
+
+// EncodeResync is the device's resync request, tag is the sequence number
+// it is waiting on (or empty when not windowed)
+func EncodeResync(tag string, sections int) string {
+	return fmt.Sprintf("!%s %s %d", tag, ResyncRequest, sections)
+}
+
+// ParseResync pulls the number of sections the device has seen out of a
+// resync request
+func ParseResync(response string) (int, bool) {
+	i := strings.Index(response, " "+ResyncRequest+" ")
+	if len(response) == 0 || response[0] != '!' || i < 0 {
+		return 0, false
+	}
+	var sections int
+	if n, _ := fmt.Sscanf(response[i+len(ResyncRequest)+2:], "%d", &sections); n != 1 || sections < 0 {
+		return 0, false
+	}
+	return sections, true
+}
+
+// sectionMark is the device's side of a resync, the byteBusters that keep
+// a digest have one
+type sectionMark struct {
+	sections   int    //ExtensionBigLinearAddress lines processed
+	state      []byte //of the digest at the start of the last one
+	restarting bool   //the next one is the last one again
+}
+
+// start is called for each ExtensionBigLinearAddress line processed
+func (s *sectionMark) start(d *ImageDigest) {
+	if s.restarting {
+		s.restarting = false //digest is already back where it was
+		return
+	}
+	s.sections++
+	s.state = d.Mark()
+}
+
+// resync rewinds the digest to the start of the current section, and
+// returns the number of sections for the resync request
+func (s *sectionMark) resync(d *ImageDigest) int {
+	if s.sections == 0 {
+		d.Rewind(nil)
+		return 0
+	}
+	d.Rewind(s.state)
+	s.restarting = true
+	return s.sections
+}
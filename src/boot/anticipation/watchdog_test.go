@@ -0,0 +1,89 @@
+package anticipation
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWatchdogPolicy(t *testing.T) {
+	p := WatchdogPolicy{Resync: 3, Reboot: 8}
+	expected := []WatchdogAction{WatchdogNak, WatchdogNak, WatchdogResync, WatchdogNak, WatchdogNak,
+		WatchdogResync, WatchdogNak, WatchdogReboot, WatchdogReboot}
+	for i, e := range expected {
+		if a := p.Action(i + 1); a != e {
+			t.Errorf("silent %d: expected %d but got %d", i+1, e, a)
+		}
+	}
+	var never WatchdogPolicy
+	if a := never.Action(1000); a != WatchdogNak {
+		t.Errorf("zero policy should only nak, got %d", a)
+	}
+}
+
+func TestResyncRequest(t *testing.T) {
+	for _, c := range []struct {
+		tag      string
+		sections int
+	}{{"", 0}, {"1F", 7}} {
+		l := EncodeResync(c.tag, c.sections)
+		n, ok := ParseResync(l)
+		if !ok || n != c.sections {
+			t.Errorf("%s: got %d %v", l, n, ok)
+		}
+	}
+	for _, bad := range []string{". resync 1", "!03 timeout", "! resync", "! resync -1", "! resync x"} {
+		if _, ok := ParseResync(bad); ok {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestSectionResync(t *testing.T) {
+	section := func(bb *SparseByteBuster, top uint32, fill byte) {
+		bb.SetBigBaseAddr(top)
+		for i := uint64(0); i < 100; i++ {
+			bb.Write(uint64(top)<<32+i, fill)
+		}
+	}
+	straight := NewSparseByteBuster()
+	section(straight, 1, 0xaa)
+	section(straight, 2, 0xbb)
+
+	bb := NewSparseByteBuster()
+	if n := bb.Resync(); n != 0 {
+		t.Errorf("expected no sections, got %d", n)
+	}
+	section(bb, 1, 0xaa)
+	section(bb, 2, 0xbb)
+	//twice, like a resync that doesn't get through the first time
+	for i := 0; i < 2; i++ {
+		if n := bb.Resync(); n != 2 {
+			t.Errorf("expected 2 sections, got %d", n)
+		}
+	}
+	section(bb, 2, 0xbb)
+	if !bytes.Equal(bb.Digest(), straight.Digest()) {
+		t.Errorf("digest after resending the section doesn't match")
+	}
+	if n := bb.Resync(); n != 2 {
+		t.Errorf("section should still be number 2, got %d", n)
+	}
+}
+
+func TestSimDeviceWatchdog(t *testing.T) {
+	d := NewSimDevice()
+	d.Watchdog = WatchdogPolicy{Resync: 2, Reboot: 3}
+	d.Receive(EncodeBigAddr(0xfffffc00))
+	if r := d.Timeout(); r != nil {
+		t.Errorf("first timeout without a window should say nothing, got %v", r)
+	}
+	if r := d.Timeout(); len(r) != 1 || r[0] != EncodeResync("", 1) {
+		t.Errorf("expected a resync from section 1, got %v", r)
+	}
+	if d.Timeout(); d.Reboots != 1 {
+		t.Errorf("expected a reboot")
+	}
+	if d.Watchdog.Reboot != 3 {
+		t.Errorf("the policy should survive a reboot")
+	}
+}
@@ -0,0 +1,56 @@
+package joy
+
+import (
+	"runtime/volatile"
+
+	"device/arm"
+
+	"lib/bootparams"
+)
+
+// secondaryCoresDef is secondary_cores in exception.S.  The bootloader
+// sends cores 1-3 to secondary_start (bootparams.CoreDef) before core 0
+// has cleared the bss, so this lives with the code.
+type secondaryCoresDef struct {
+	Released uint64
+	Arrived  [bootparams.MaxCores]uint64
+}
+
+//go:extern secondary_cores
+var secondaryCores secondaryCoresDef
+
+// secondaryFunc is what the other cores run once they are released
+var secondaryFunc func(core uint64)
+
+// StartSecondaries lets the cores that the bootloader started go on to fn,
+// and returns how many there were.  It should be called once, after
+// everything fn needs is set up.
+func StartSecondaries(fn func(core uint64)) int {
+	n := 0
+	for core := 1; core < bootparams.MaxCores; core++ {
+		if volatile.LoadUint64(&secondaryCores.Arrived[core]) != 0 {
+			n++
+		}
+	}
+	secondaryFunc = fn
+	volatile.StoreUint64(&secondaryCores.Released, 1)
+	arm.Asm("dsb sy")
+	arm.Asm("sev")
+	return n
+}
+
+//go:export secondary_main
+func secondaryMain(core uint64) {
+	secondaryFunc(core)
+	for {
+		arm.Asm("wfe")
+	}
+}
+
+// coreIdle is where the other cores stay until we have something for them
+// to do.  Their interrupts are masked, everything is routed to core 0.
+func coreIdle(_ uint64) {
+	for {
+		arm.Asm("wfe")
+	}
+}
@@ -2,26 +2,29 @@ package joy
 
 import (
 	"device/arm"
-	"machine"
 
 	"lib/trust"
+	"lib/upbeat"
 )
 
 //export raw_exception_handler
-func rawExceptionHandler(t uint64, esr uint64, addr uint64, el uint64, procId uint64) {
+func rawExceptionHandler(t uint64, esr uint64, addr uint64, el uint64, procId uint64, far uint64, fp uint64) {
 	if t == 5 {
-		if !machine.QA7.LocalTimerControl.InterruptPendingIsSet() {
-			trust.Debugf("No interrupt pending line is set for timer, exiting")
-			return
+		if irqs.Dispatch() == 0 {
+			trust.Debugf("No handler for any pending interrupt, exiting")
 		}
-		machine.QA7.LocalTimerClearReload.SetClear() //ugh, nomenclature
-		machine.QA7.LocalTimerClearReload.SetReload()
-		timerTick()
 		return
 	}
 	trust.Infof("raw exception handler:exception type %d and "+
 		"esr %x with addr %x and EL=%d, ProcID=%x\n",
 		t, esr, addr, el, procId)
+	//release turns these into a crash report with symbols
+	trust.Errorf("fault address %x", far)
+	var pcs [upbeat.MaxBacktrace]uint64
+	n := upbeat.Backtrace(fp, kramStart, kramStart+(knumPages*kpageSize), pcs[:])
+	for i := 0; i < n; i++ {
+		trust.Errorf("frame %d: %x", i, pcs[i])
+	}
 	trust.Errorf("DEADLOOP!")
 	for {
 		arm.Asm("nop")
@@ -22,12 +22,18 @@ func KernelMain() {
 	tgr.ReInit()
 	initExceptionVector()
 
+	//before we use anything the bootloader gave us
+	if err := upbeat.BootloaderParams.Check(); err != nil {
+		panic(err.Error())
+	}
 	trust.Debugf("kernelMain1")
 	err := KMemAPI.Init()
 	if err != JoyNoError {
 		panic(JoyErrorMessage(err))
 	}
 	trust.Debugf("kernelMain2")
+	n := StartSecondaries(coreIdle)
+	trust.Infof("%d other cores started", n)
 	FamilyAPI.Init()
 	InitGIC()
 	InitSchedulingTimer()
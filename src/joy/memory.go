@@ -1,6 +1,7 @@
 package joy
 
 import (
+	"lib/bootparams"
 	"lib/trust"
 	"lib/upbeat"
 
@@ -133,6 +134,13 @@ func kmemInit() JoyError {
 	}
 
 	trust.Infof("kmem init5")
+	//stacks of the other cores and modules the bootloader put after the heap
+	if err := kmemReserveCoreStacks(); err != JoyNoError {
+		return err
+	}
+	if err := kmemReserveModules(); err != JoyNoError {
+		return err
+	}
 
 	//kernel process init
 	bottom.HeapStart = unsafe.Pointer(uintptr(start))
@@ -142,6 +150,57 @@ func kmemInit() JoyError {
 	return JoyNoError
 }
 
+// kmemReserveCoreStacks marks the pages of the stacks the bootloader
+// gave cores 1-3 as in use, they are on them whether we use them or not
+func kmemReserveCoreStacks() JoyError {
+	p := &upbeat.BootloaderParams
+	for core := 1; core < bootparams.MaxCores; core++ {
+		sp := p.Cores[core].StackPointer
+		if sp == 0 {
+			continue
+		}
+		if sp < kramStart+bootparams.StackSize {
+			return MakeError(ErrorMemoryBadPageRequest)
+		}
+		last := (sp - kramStart) / kpageSize
+		for pg := last + 1 - (bootparams.StackSize / kpageSize); pg <= last; pg++ {
+			if pg >= knumPages {
+				return MakeError(ErrorMemoryBadPageRequest)
+			}
+			if _, err := kmemSetInUse(KPageId(pg)); err != JoyNoError {
+				return err
+			}
+		}
+	}
+	return JoyNoError
+}
+
+// kmemReserveModules marks the pages of the modules loaded by the
+// bootloader as in use, so we don't hand them out
+func kmemReserveModules() JoyError {
+	p := &upbeat.BootloaderParams
+	for i := uint64(0); i < p.ModuleCount && i < bootparams.MaxModules; i++ {
+		m := p.Modules[i]
+		if m.Length == 0 {
+			continue
+		}
+		if m.Addr < kramStart {
+			return MakeError(ErrorMemoryBadPageRequest)
+		}
+		first := (m.Addr - kramStart) / kpageSize
+		last := (m.Addr + m.Length - 1 - kramStart) / kpageSize
+		for pg := first; pg <= last; pg++ {
+			if pg >= knumPages {
+				return MakeError(ErrorMemoryBadPageRequest)
+			}
+			if _, err := kmemSetInUse(KPageId(pg)); err != JoyNoError {
+				return err
+			}
+		}
+	}
+	return JoyNoError
+}
+
 func kmemReleasePage(pg KPageId) (KPageId, JoyError) {
 	if pg < 0 || pg >= knumPages {
 		return NoKPageId, MakeError(ErrorMemoryBadPageRequest)
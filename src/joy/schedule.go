@@ -21,25 +21,32 @@ func DisableIRQAndFIQ() {
 
 // We use local arm timer for the ticks for the preemption counter.
 func InitSchedulingTimer() {
-	machine.QA7.LocalTimerControl.SetInterruptEnable()
-	machine.QA7.LocalTimerControl.SetReloadValue(quanta)
-	machine.QA7.LocalTimerControl.SetTimerEnable()
+	machine.QA7.LocalTimerControl.Modify(func(v *machine.LocalTimerControlValue) {
+		v.SetInterruptEnable()
+		v.SetReloadValue(quanta)
+		v.SetTimerEnable()
+	})
 
 }
 
+// irqs are the handlers for the interrupts we use, rawExceptionHandler
+// dispatches them
+var irqs machine.IRQTable
+
 // GIC is the generic interrupt controller.  It's actually be used by the
-// bootloader, so there isn't much to do.
+// bootloader, so there isn't much to do.  The local timer and the GPU's
+// interrupts go to core 0 (that's what they do after a reset too), which
+// is where IRQLocalTimer is looked for.
 func InitGIC() {
-	// this *should* already have been done by the bootloader
-
-	//route BOTH local timer and GPU to core 0 on IRQ
-	machine.QA7.GPUInterruptRouting.IRQToCore0()
-	machine.QA7.LocalInterrupt.SetCore0IRQ()
-
-	//Tell Core0 which interrupts to consume
-	machine.QA7.TimerInterruptControl[0].SetPhysicalNonSecureTimerIRQ()
-	machine.QA7.IRQSource[0].SetGPU()
+	irqs.Register("LocalTimer", func(machine.IRQ) { localTimerTick() })
+}
 
+// localTimerTick acks the local timer's interrupt and starts the next
+// quanta
+func localTimerTick() {
+	machine.QA7.LocalTimerClearReload.SetClear() //ugh, nomenclature
+	machine.QA7.LocalTimerClearReload.SetReload()
+	timerTick()
 }
 
 func timerTick() {
@@ -1,6 +1,19 @@
 package joy
 
-const MemoryMappedIO = 0x3F00_0000
+import "machine"
+
+// MemoryMappedIO is where the peripherals start, the SOC's region in the
+// machine package's MemoryMap (from sys/rpi3.go or sys/rpi3_qemu.go)
+var MemoryMappedIO = memoryMappedIO()
+
+func memoryMappedIO() uintptr {
+	for _, r := range machine.MemoryMap {
+		if r.Name == "SOC" {
+			return r.Base
+		}
+	}
+	panic("no SOC in the machine package's memory map")
+}
 
 //
 // CPUContext
@@ -0,0 +1,157 @@
+package bootparams
+
+import (
+	"errors"
+	"unsafe"
+)
+
+//
+// This is the ABI between the bootloader and the kernel: the bootloader
+// fills in a BootloaderParamsDef and writes it into the kernel at the
+// bootloader_params symbol.  Both release (with the host's go) and the
+// kernel (with tinygo) use this package, so it must not import anything
+// that only one of them can build.
+//
+// The start code in joy/exception.S uses the offsets of StackPointer,
+// HeapStart and HeapEnd, and reserves Size bytes.  antc's secondary_boot
+// (set_regs.S) uses the offset and size of the Cores.  If you change the
+// layout, change those and the Version.
+//
+
+// Magic is the first thing in the params, "BOOT" in memory
+const Magic = 0x544f4f42
+
+// Version 1 had the module table but no magic and no size, version 2
+// had no Cores
+const Version = 3
+
+// Size is the size in bytes of BootloaderParamsDef, and of bootloader_params
+const Size = 320
+
+// MaxModules is how many entries fit in the module table
+const MaxModules = 8
+
+// MaxCores is the number of cores on the board, and entries in Cores
+const MaxCores = 4
+
+// KernelLoadPoint is the start of the kernel's address space
+const KernelLoadPoint = 0xfffffc0000000000
+
+// PageSize is the size of the pages SetLayout hands out
+const PageSize = 0x10000
+
+// pages after the kernel's code
+const (
+	stackPages = 2
+	heapPages  = 8
+)
+
+// StackSize is the size of each core's stack
+const StackSize = stackPages * PageSize
+
+// kinds of modules the bootloader can load along with the kernel
+const (
+	ModuleBlob    = 0 //something the kernel will figure out
+	ModuleRamdisk = 1 //initial ramdisk
+	ModuleConfig  = 2
+	ModuleFont    = 3
+)
+
+// ModuleDef is one file the bootloader loaded after the kernel's heap.
+// Addr is a kernel (virtual) address and is page aligned.
+type ModuleDef struct {
+	Kind   uint64
+	Addr   uint64
+	Length uint64
+}
+
+// CoreDef is where the bootloader sends one core, and the stack it has
+// when it gets there.  Core 0 goes to EntryPoint with StackPointer (the
+// same values are in Cores[0]), the others are sent to their EntryPoint if
+// it is not zero.  They are started with their own stack, the params in x0
+// and their core number in x1.
+type CoreDef struct {
+	EntryPoint   uint64
+	StackPointer uint64
+}
+
+type BootloaderParamsDef struct {
+	Magic        uint32
+	Version      uint16
+	Size         uint16
+	EntryPoint   uint64
+	KernelLast   uint64
+	UnixTime     uint64
+	StackPointer uint64
+	HeapStart    uint64
+	HeapEnd      uint64
+	ModuleCount  uint64
+	Modules      [MaxModules]ModuleDef
+	Cores        [MaxCores]CoreDef
+}
+
+// New returns params with the header filled in, and nothing else
+func New() BootloaderParamsDef {
+	return BootloaderParamsDef{Magic: Magic, Version: Version, Size: Size}
+}
+
+// Check returns an error if the params weren't written by a bootloader
+// that agrees with us about the layout
+func (p *BootloaderParamsDef) Check() error {
+	if p.Magic != Magic {
+		return errors.New("bootloader params have a bad magic number, bootloader is too old?")
+	}
+	if p.Version != Version {
+		return errors.New("bootloader params are the wrong version")
+	}
+	if p.Size != Size || unsafe.Sizeof(*p) != Size {
+		return errors.New("bootloader params are the wrong size")
+	}
+	return nil
+}
+
+// SetLayout puts the stack and heap in the pages after the kernel (which
+// ends at KernelLast).  The kernel code takes N pages, the stack the next
+// two and the heap the eight after that.  The stacks of the other cores,
+// two pages each, come after the heap.
+func (p *BootloaderParamsDef) SetLayout() {
+	page := uint64(KernelLoadPoint)
+	//does this page cover the kernel's loaded size
+	for page+(PageSize-1) < p.KernelLast {
+		page += PageSize
+	}
+	page += (stackPages * PageSize)
+	//this is the "wrong" end of the stack page (if stack reaches here, we are hosed)
+	p.StackPointer = page + (PageSize - 0x10) //16 byte alignment required
+	page += PageSize
+	p.HeapStart = page
+	page += ((heapPages - 1) * PageSize)
+	p.HeapEnd = page + (PageSize - 8) //END of the last heap page
+	p.Cores[0].StackPointer = p.StackPointer
+	for i := 1; i < MaxCores; i++ {
+		page += StackSize
+		p.Cores[i].StackPointer = page + (PageSize - 0x10)
+	}
+}
+
+// ModuleBase is the first page after the heap and the stacks of the
+// other cores, where modules go
+func (p *BootloaderParamsDef) ModuleBase() uint64 {
+	return PageAlign(p.Cores[MaxCores-1].StackPointer)
+}
+
+// PageAlign rounds up to the next page
+func PageAlign(a uint64) uint64 {
+	return (a + PageSize - 1) &^ (PageSize - 1)
+}
+
+// Module returns the first module of the given kind, if the bootloader
+// loaded one
+func (p *BootloaderParamsDef) Module(kind uint64) (ModuleDef, bool) {
+	for i := uint64(0); i < p.ModuleCount && i < MaxModules; i++ {
+		if p.Modules[i].Kind == kind {
+			return p.Modules[i], true
+		}
+	}
+	return ModuleDef{}, false
+}
@@ -0,0 +1,73 @@
+package bootparams
+
+import (
+	"testing"
+	"unsafe"
+)
+
+func TestSize(t *testing.T) {
+	if unsafe.Sizeof(BootloaderParamsDef{}) != Size {
+		t.Fatalf("BootloaderParamsDef is %d bytes but Size is %d", unsafe.Sizeof(BootloaderParamsDef{}), Size)
+	}
+	//exception.S loads these by offset
+	p := BootloaderParamsDef{}
+	for _, c := range []struct {
+		name     string
+		offset   uintptr
+		expected uintptr
+	}{
+		{"StackPointer", unsafe.Offsetof(p.StackPointer), 32},
+		{"HeapStart", unsafe.Offsetof(p.HeapStart), 40},
+		{"HeapEnd", unsafe.Offsetof(p.HeapEnd), 48},
+	} {
+		if c.offset != c.expected {
+			t.Errorf("%s is at offset %d, exception.S expects %d", c.name, c.offset, c.expected)
+		}
+	}
+	//antc's set_regs.S finds a core's entry and stack by offset
+	if unsafe.Offsetof(p.Cores) != 256 || unsafe.Sizeof(p.Cores[0]) != 16 {
+		t.Errorf("Cores is at offset %d with %d byte entries, set_regs.S expects 256 and 16",
+			unsafe.Offsetof(p.Cores), unsafe.Sizeof(p.Cores[0]))
+	}
+}
+
+func TestCheck(t *testing.T) {
+	p := New()
+	if err := p.Check(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	for _, bad := range []BootloaderParamsDef{
+		{},
+		{Magic: Magic, Version: Version - 1, Size: Size},
+		{Magic: Magic, Version: Version, Size: Size - 8},
+	} {
+		if err := bad.Check(); err == nil {
+			t.Errorf("expected an error for %+v", bad)
+		}
+	}
+}
+
+func TestLayout(t *testing.T) {
+	p := New()
+	p.KernelLast = 0xfffffc0030020800
+	p.SetLayout()
+	if p.StackPointer != 0xfffffc003004fff0 || p.HeapStart != 0xfffffc0030050000 || p.HeapEnd != 0xfffffc00300cfff8 {
+		t.Errorf("unexpected layout: stack %x, heap %x to %x", p.StackPointer, p.HeapStart, p.HeapEnd)
+	}
+	if p.Cores[0].StackPointer != p.StackPointer || p.Cores[1].StackPointer != 0xfffffc00300efff0 ||
+		p.Cores[3].StackPointer != 0xfffffc003012fff0 {
+		t.Errorf("unexpected core stacks: %x %x %x %x", p.Cores[0].StackPointer, p.Cores[1].StackPointer,
+			p.Cores[2].StackPointer, p.Cores[3].StackPointer)
+	}
+	if p.ModuleBase() != 0xfffffc0030130000 {
+		t.Errorf("unexpected module base %x", p.ModuleBase())
+	}
+	p.Modules[0] = ModuleDef{Kind: ModuleFont, Addr: p.ModuleBase(), Length: 10}
+	if _, ok := p.Module(ModuleFont); ok {
+		t.Errorf("found a module past ModuleCount")
+	}
+	p.ModuleCount = 1
+	if m, ok := p.Module(ModuleFont); !ok || m.Length != 10 {
+		t.Errorf("unable to find font module")
+	}
+}
@@ -0,0 +1,360 @@
+package mmu
+
+import (
+	"fmt"
+)
+
+//
+// This builds aarch64 translation tables from a list of regions, so the
+// programs that turn on the MMU say what they want mapped rather than how.
+// The tables work for both TTBR0 and TTBR1: a region's VA can be in the
+// bottom of the address space or the top (like the kernel's
+// 0xfffffc0000000000), only the bottom VABits of it index the tables.
+//
+// Entries are blocks when the region lines up with one (and the granule
+// allows a block at that level), otherwise pages.  Everything not in a
+// region faults.
+//
+// Tables are written through a Memory so that they can be built and
+// walked on the host.  On the board Physical writes them where they go.
+//
+
+// Granule is the translation granule, as the log2 of its size
+type Granule uint
+
+const (
+	Granule4K  Granule = 12
+	Granule16K Granule = 14
+	Granule64K Granule = 16
+)
+
+// Size is the size of a page, and of every table Build makes
+func (g Granule) Size() uint64 {
+	return 1 << g
+}
+
+// bitsPerLevel of the VA index a table, each table is a page of 8 byte entries
+func (g Granule) bitsPerLevel() uint {
+	return uint(g) - 3
+}
+
+// shift is the log2 of the size of what one entry at level maps
+func (g Granule) shift(level int) uint {
+	return uint(g) + uint(3-level)*g.bitsPerLevel()
+}
+
+// blockOK is true if an entry at level can be a block.  Without the 52 bit
+// extensions that is levels 1 and 2 with 4K, and just level 2 otherwise.
+func (g Granule) blockOK(level int) bool {
+	return (level == 1 || level == 2) && g.shift(level) <= 30
+}
+
+// Perm is the access to a region, the zero value is read/write (and
+// execute) at EL1 and nothing at EL0
+type Perm uint8
+
+const (
+	PermReadOnly  Perm = 1 << iota //no writes, at any EL
+	PermUser                       //EL0 has the same access as EL1
+	PermNoExecute                  //at any EL
+)
+
+// descriptor bits
+const (
+	descValid   = 1 << 0
+	descTable   = 1 << 1 //or page, at level 3
+	descNS      = 1 << 5
+	descAPUser  = 1 << 6
+	descAPRO    = 1 << 7
+	descAF      = 1 << 10
+	descPXN     = 1 << 53
+	descUXN     = 1 << 54
+	descNSTable = 1 << 63
+
+	descAttrShift = 2
+	descAttrMask  = 0x7 << descAttrShift
+	addrMask      = 0x0000_ffff_ffff_f000 //bits 47:12, less for bigger granules
+)
+
+// Region is one range of VAs and where it goes
+type Region struct {
+	Name string //for errors
+	VA   uint64
+	PA   uint64
+	Size uint64
+	Attr uint64 //index in MAIR
+	Perm Perm
+}
+
+// Layout is everything the tables map
+type Layout struct {
+	Granule  Granule
+	VABits   uint //T0SZ (and T1SZ) is 64 minus this
+	NoBlocks bool //use pages even where a block would do
+	Regions  []Region
+}
+
+// Memory is where tables are built, by physical address
+type Memory interface {
+	Read(addr uint64) uint64
+	Write(addr uint64, value uint64)
+}
+
+// startLevel is the level of the root table
+func (l *Layout) startLevel() int {
+	level := 3
+	for l.Granule.shift(level)+l.Granule.bitsPerLevel() < l.VABits {
+		level--
+	}
+	return level
+}
+
+// rootEntries is the number of entries in the root table, which can be
+// fewer than a page's worth
+func (l *Layout) rootEntries() uint64 {
+	return 1 << (l.VABits - l.Granule.shift(l.startLevel()))
+}
+
+// offset is where va is in the part of the address space the tables
+// cover, false if it is in neither the top or the bottom of it
+func (l *Layout) offset(va uint64) (uint64, bool) {
+	space := uint64(1) << l.VABits
+	switch {
+	case va < space:
+		return va, true
+	case va >= -space:
+		return va - (-space), true
+	}
+	return 0, false
+}
+
+// Find returns the region that va is in
+func (l *Layout) Find(va uint64) (Region, bool) {
+	for _, r := range l.Regions {
+		if va >= r.VA && va-r.VA < r.Size {
+			return r, true
+		}
+	}
+	return Region{}, false
+}
+
+// Add puts r in the layout, rounded out to the granule.  If that touches
+// or overlaps a region with the same attributes (and the same VA to PA
+// offset) the two become one.  This is for the memory map of a device,
+// where several peripherals can share a page.
+func (l *Layout) Add(r Region) {
+	size := l.Granule.Size()
+	end := (r.VA + r.Size + size - 1) &^ (size - 1)
+	r.PA -= r.VA & (size - 1)
+	r.VA &^= size - 1
+	r.Size = end - r.VA
+	for i := 0; i < len(l.Regions); i++ {
+		e := l.Regions[i]
+		if e.Attr != r.Attr || e.Perm != r.Perm || e.VA-e.PA != r.VA-r.PA ||
+			e.VA > r.VA+r.Size || r.VA > e.VA+e.Size {
+			continue
+		}
+		if e.VA < r.VA {
+			r.Name = e.Name + "," + r.Name
+			r.Size += r.VA - e.VA
+			r.VA, r.PA = e.VA, e.PA
+		} else {
+			r.Name += "," + e.Name
+		}
+		if e.VA+e.Size > r.VA+r.Size {
+			r.Size = e.VA + e.Size - r.VA
+		}
+		//it might touch another one now
+		l.Regions = append(l.Regions[:i], l.Regions[i+1:]...)
+		i = -1
+	}
+	l.Regions = append(l.Regions, r)
+}
+
+// DeviceMap is a memory map like the one sysdec generates, the machine
+// package's MemoryMap.  Attr is the generated MemoryAttr.
+type DeviceMap interface {
+	Len() int
+	Region(i int) (name string, base uint64, size uint64, attr int)
+}
+
+// AddDevices puts every region of m in the layout, at the same VA as PA,
+// with mair[attr] as its index in MAIR.  Peripherals that share a page
+// (or are inside a bigger one, like the whole peripheral window) end up
+// as one region.
+func (l *Layout) AddDevices(m DeviceMap, mair []uint64) error {
+	for i := 0; i < m.Len(); i++ {
+		name, base, size, attr := m.Region(i)
+		if attr < 0 || attr >= len(mair) {
+			return fmt.Errorf("%s has memory attribute %d, which isn't in MAIR", name, attr)
+		}
+		l.Add(Region{Name: name, VA: base, PA: base, Size: size, Attr: mair[attr]})
+	}
+	return nil
+}
+
+// TCR is the translation control register for these tables, used for
+// both halves of the address space: write back caches and inner shareable
+// walks, 32 bit physical addresses.
+func (l *Layout) TCR() uint64 {
+	var tg0, tg1 uint64
+	switch l.Granule {
+	case Granule4K:
+		tg0, tg1 = 0b00, 0b10
+	case Granule16K:
+		tg0, tg1 = 0b10, 0b01
+	case Granule64K:
+		tg0, tg1 = 0b01, 0b11
+	}
+	sz := uint64(64 - l.VABits)
+	return (tg1 << 30) | // granule size in kernel
+		(0b11 << 28) | // inner shareable
+		(0b01 << 26) | // write back (outer)
+		(0b01 << 24) | // write back (inner)
+		(sz << 16) | // T1SZ
+		(tg0 << 14) | // granule size in user
+		(0b11 << 12) | //inner shareable
+		(0b01 << 10) | //write back (outer)
+		(0b01 << 8) | //write back (inner)
+		(sz << 0) // T0SZ
+}
+
+type builder struct {
+	*Layout
+	mem  Memory
+	next uint64 //where the next table goes
+}
+
+// Build writes the tables at base, which must be aligned to the granule,
+// and returns the root table (for the TTBRs) and the first address after
+// the tables.
+func (l *Layout) Build(mem Memory, base uint64) (uint64, uint64, error) {
+	switch l.Granule {
+	case Granule4K, Granule16K, Granule64K:
+	default:
+		return 0, 0, fmt.Errorf("bad granule %d", l.Granule)
+	}
+	if l.VABits < uint(l.Granule)+l.Granule.bitsPerLevel() || l.VABits > 48 {
+		return 0, 0, fmt.Errorf("can't have a %d bit address space with %dK pages", l.VABits, l.Granule.Size()>>10)
+	}
+	if base%l.Granule.Size() != 0 {
+		return 0, 0, fmt.Errorf("tables at %x are not aligned to the granule", base)
+	}
+	b := &builder{Layout: l, mem: mem, next: base}
+	root := b.table()
+	for i := range l.Regions {
+		r := &l.Regions[i]
+		if r.Size == 0 || (r.VA|r.PA|r.Size)%l.Granule.Size() != 0 {
+			return 0, 0, fmt.Errorf("region %s is not aligned to the granule", r.Name)
+		}
+		first, ok := l.offset(r.VA)
+		last, lastOK := l.offset(r.VA + r.Size - 1)
+		if !ok || !lastOK || last < first {
+			return 0, 0, fmt.Errorf("region %s is outside the %d bit address space", r.Name, l.VABits)
+		}
+		if err := b.fill(root, l.startLevel(), first, r.PA, r.Size, r); err != nil {
+			return 0, 0, err
+		}
+	}
+	return root, b.next, nil
+}
+
+// table makes a new table with nothing in it
+func (b *builder) table() uint64 {
+	t := b.next
+	b.next += b.Granule.Size()
+	for a := t; a < b.next; a += 8 {
+		b.mem.Write(a, 0)
+	}
+	return t
+}
+
+// fill maps size bytes from va (an offset in the tables' address space)
+// to pa in the table at level
+func (b *builder) fill(table uint64, level int, va uint64, pa uint64, size uint64, r *Region) error {
+	shift := b.Granule.shift(level)
+	span := uint64(1) << shift
+	entries := uint64(1) << b.Granule.bitsPerLevel()
+	for size > 0 {
+		addr := table + ((va>>shift)&(entries-1))*8
+		entry := b.mem.Read(addr)
+		n := span - (va & (span - 1)) //to the end of this entry
+		if n > size {
+			n = size
+		}
+		switch {
+		case level == 3 || (n == span && pa&(span-1) == 0 && b.Granule.blockOK(level) && !b.NoBlocks):
+			if entry&descValid != 0 {
+				return fmt.Errorf("region %s overlaps another at %x", r.Name, va)
+			}
+			b.mem.Write(addr, leaf(level, pa, r))
+		default:
+			if entry&descValid != 0 && entry&descTable == 0 {
+				return fmt.Errorf("region %s overlaps another at %x", r.Name, va)
+			}
+			next := entry & addrMask
+			if entry&descValid == 0 {
+				next = b.table()
+				b.mem.Write(addr, next|descNSTable|descTable|descValid)
+			}
+			if err := b.fill(next, level+1, va, pa, n, r); err != nil {
+				return err
+			}
+		}
+		va += n
+		pa += n
+		size -= n
+	}
+	return nil
+}
+
+// leaf is a block or page entry for pa
+func leaf(level int, pa uint64, r *Region) uint64 {
+	e := pa | descAF | descNS | (r.Attr<<descAttrShift)&descAttrMask | descValid
+	if level == 3 {
+		e |= descTable
+	}
+	if r.Perm&PermReadOnly != 0 {
+		e |= descAPRO
+	}
+	if r.Perm&PermUser != 0 {
+		e |= descAPUser
+	}
+	if r.Perm&PermNoExecute != 0 {
+		e |= descPXN | descUXN
+	}
+	return e
+}
+
+// Walk translates va with the tables at root, the way the MMU would.  It
+// returns the physical address, the block or page entry that maps it, and
+// the level that entry is at.
+func (l *Layout) Walk(mem Memory, root uint64, va uint64) (uint64, uint64, int, bool) {
+	offset, ok := l.offset(va)
+	if !ok {
+		return 0, 0, 0, false
+	}
+	table := root
+	for level := l.startLevel(); level <= 3; level++ {
+		shift := l.Granule.shift(level)
+		index := offset >> shift
+		if level == l.startLevel() {
+			index &= l.rootEntries() - 1
+		} else {
+			index &= (1 << l.Granule.bitsPerLevel()) - 1
+		}
+		entry := mem.Read(table + index*8)
+		if entry&descValid == 0 {
+			return 0, 0, level, false
+		}
+		if level == 3 || entry&descTable == 0 {
+			if level < 3 && !l.Granule.blockOK(level) {
+				return 0, 0, level, false //reserved encoding
+			}
+			span := uint64(1) << shift
+			return entry&addrMask&^(span-1) | offset&(span-1), entry, level, true
+		}
+		table = entry & addrMask
+	}
+	return 0, 0, 3, false
+}
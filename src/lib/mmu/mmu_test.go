@@ -0,0 +1,245 @@
+package mmu
+
+import (
+	"testing"
+)
+
+type testMemory map[uint64]uint64
+
+func (m testMemory) Read(addr uint64) uint64 {
+	return m[addr]
+}
+
+func (m testMemory) Write(addr uint64, value uint64) {
+	m[addr] = value
+}
+
+const kernelHalf = 0xfffffc0000000000
+
+// antc's layout, with a small kernel region that is read only
+func testLayout(g Granule) *Layout {
+	return &Layout{
+		Granule: g,
+		VABits:  42,
+		Regions: []Region{
+			{Name: "ram", VA: 0, PA: 0, Size: 0x3c00_0000, Attr: 2},
+			{Name: "framebuffer", VA: 0x3c00_0000, PA: 0x3c00_0000, Size: 0x300_0000, Attr: 1},
+			{Name: "peripherals", VA: 0x3f00_0000, PA: 0x3f00_0000, Size: 0x100_0000, Attr: 0, Perm: PermNoExecute},
+			{Name: "qa7", VA: 0x4000_0000, PA: 0x4000_0000, Size: 0x4_0000, Attr: 0, Perm: PermNoExecute},
+			{Name: "kernel", VA: kernelHalf + 0x1_0000_0000, PA: 0x3000_0000, Size: 0x20_0000, Attr: 2,
+				Perm: PermReadOnly | PermUser},
+		},
+	}
+}
+
+func TestWalk(t *testing.T) {
+	for _, g := range []Granule{Granule4K, Granule16K, Granule64K} {
+		l := testLayout(g)
+		mem := testMemory{}
+		root, end, err := l.Build(mem, 0x10000)
+		if err != nil {
+			t.Fatalf("%dK: %v", g.Size()>>10, err)
+		}
+		if root != 0x10000 || end <= root || (end-root)%g.Size() != 0 {
+			t.Errorf("%dK: unexpected tables from %x to %x", g.Size()>>10, root, end)
+		}
+		for _, c := range []struct {
+			va   uint64
+			pa   uint64
+			attr uint64
+			ok   bool
+		}{
+			{0x0, 0x0, 2, true},
+			{0x80820, 0x80820, 2, true},
+			{0x3bff_fff8, 0x3bff_fff8, 2, true},
+			{0x3c00_0000, 0x3c00_0000, 1, true},
+			{0x3f21_5040, 0x3f21_5040, 0, true},
+			{0x4000_0034, 0x4000_0034, 0, true},
+			{0x4004_0000, 0, 0, false},
+			{0x8000_0000, 0, 0, false},
+			{kernelHalf + 0x3000_104c, 0x3000_104c, 2, true}, //same tables for both halves
+			{kernelHalf + 0x1_0000_1000, 0x3000_1000, 2, true},
+			{kernelHalf + 0x1_0020_0000, 0, 0, false},
+			{0x0000_1000_0000_0000, 0, 0, false}, //neither half
+		} {
+			pa, entry, _, ok := l.Walk(mem, root, c.va)
+			if ok != c.ok || pa != c.pa || (ok && (entry&descAttrMask)>>descAttrShift != c.attr) {
+				t.Errorf("%dK: %x walked to %x (entry %x, %v)", g.Size()>>10, c.va, pa, entry, ok)
+			}
+		}
+		_, entry, _, _ := l.Walk(mem, root, kernelHalf+0x1_0000_0000)
+		if entry&(descAPRO|descAPUser) != descAPRO|descAPUser || entry&descUXN != 0 {
+			t.Errorf("%dK: kernel region has the wrong permissions: %x", g.Size()>>10, entry)
+		}
+		_, entry, _, _ = l.Walk(mem, root, 0x3f00_0000)
+		if entry&(descPXN|descUXN) != descPXN|descUXN || entry&descAPRO != 0 {
+			t.Errorf("%dK: peripherals have the wrong permissions: %x", g.Size()>>10, entry)
+		}
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	for _, c := range []struct {
+		g      Granule
+		blocks bool
+		level  int //of the entry for 0x0
+		tables int
+	}{
+		{Granule4K, true, 2, 6},   //root, level 1, level 2 for 0G, 1G and 4G, level 3 for qa7
+		{Granule16K, true, 2, 5},  //root, level 2, level 3 for 0x3e00_0000, qa7 and the kernel
+		{Granule64K, true, 2, 4},  //root, level 3 for 512M, qa7 and the kernel
+		{Granule64K, false, 3, 5}, //and one for the first 512M
+	} {
+		l := testLayout(c.g)
+		l.NoBlocks = !c.blocks
+		mem := testMemory{}
+		root, end, err := l.Build(mem, 0)
+		if err != nil {
+			t.Fatalf("%dK: %v", c.g.Size()>>10, err)
+		}
+		if n := int(end / c.g.Size()); n != c.tables {
+			t.Errorf("%dK (blocks %v): expected %d tables, got %d", c.g.Size()>>10, c.blocks, c.tables, n)
+		}
+		_, _, level, ok := l.Walk(mem, root, 0)
+		if !ok || level != c.level {
+			t.Errorf("%dK (blocks %v): expected 0 to be mapped at level %d, got %d", c.g.Size()>>10, c.blocks, c.level, level)
+		}
+	}
+}
+
+func TestMatchesOldTables(t *testing.T) {
+	//setupVM's page entries were address, AF, NS, attr and 0b11
+	l := testLayout(Granule64K)
+	l.NoBlocks = true
+	mem := testMemory{}
+	root, _, _ := l.Build(mem, 0x10000)
+	_, entry, _, _ := l.Walk(mem, root, 0x3c01_0000)
+	if expected := uint64(0x3c01_0000 | 1<<10 | 1<<5 | 1<<2 | 0b11); entry != expected {
+		t.Errorf("expected %x but got %x", expected, entry)
+	}
+	if mem.Read(root)&^addrMask != 1<<63|0b11 {
+		t.Errorf("unexpected table entry %x", mem.Read(root))
+	}
+	if tcr := l.TCR(); tcr != 0xf5167516 {
+		t.Errorf("unexpected tcr %x", tcr)
+	}
+}
+
+func TestBadLayouts(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		l    Layout
+	}{
+		{"granule", Layout{Granule: 13, VABits: 42}},
+		{"address space", Layout{Granule: Granule4K, VABits: 52}},
+		{"alignment", Layout{Granule: Granule64K, VABits: 42, Regions: []Region{{VA: 0x1000, Size: 0x1_0000}}}},
+		{"empty", Layout{Granule: Granule64K, VABits: 42, Regions: []Region{{VA: 0x1_0000}}}},
+		{"outside", Layout{Granule: Granule64K, VABits: 42, Regions: []Region{{VA: 0x400_0000_0000, Size: 0x1_0000}}}},
+		{"overlap", Layout{Granule: Granule64K, VABits: 42, Regions: []Region{
+			{VA: 0, Size: 0x4000_0000}, {VA: 0x3000_0000, Size: 0x1_0000}}}},
+		{"overlap block", Layout{Granule: Granule64K, VABits: 42, Regions: []Region{
+			{VA: 0x1_0000, Size: 0x1_0000}, {VA: 0, Size: 0x2000_0000}}}},
+	} {
+		if _, _, err := c.l.Build(testMemory{}, 0); err == nil {
+			t.Errorf("%s: expected an error", c.name)
+		}
+	}
+	if _, _, err := testLayout(Granule64K).Build(testMemory{}, 0x1000); err == nil {
+		t.Errorf("expected an error for unaligned tables")
+	}
+}
+
+func TestFind(t *testing.T) {
+	l := testLayout(Granule64K)
+	if r, ok := l.Find(0x3c10_0000); !ok || r.Name != "framebuffer" {
+		t.Errorf("expected the framebuffer, got %+v", r)
+	}
+	if _, ok := l.Find(0x4004_0000); ok {
+		t.Errorf("expected 0x4004_0000 to be in no region")
+	}
+}
+
+func TestAdd(t *testing.T) {
+	l := &Layout{Granule: Granule64K, VABits: 42}
+	for _, r := range []Region{
+		{Name: "SystemTimer", VA: 0x3f00_3000, PA: 0x3f00_3000, Size: 0x20},
+		{Name: "PM", VA: 0x3f10_0000, PA: 0x3f10_0000, Size: 0x28},
+		{Name: "GPIO", VA: 0x3f20_0000, PA: 0x3f20_0000, Size: 0xa0},
+		{Name: "IC", VA: 0x3f00_b200, PA: 0x3f00_b200, Size: 0x2c},
+		{Name: "Aux", VA: 0x3f21_5000, PA: 0x3f21_5000, Size: 0x6c},
+		{Name: "VCMemory", VA: 0x3c00_0000, PA: 0x3c00_0000, Size: 0x300_0000, Attr: 1},
+		{Name: "Between", VA: 0x3f11_0000, PA: 0x3f11_0000, Size: 0xf_0000},
+	} {
+		l.Add(r)
+	}
+	expected := []Region{
+		{VA: 0x3f00_0000, PA: 0x3f00_0000, Size: 0x1_0000},
+		{VA: 0x3c00_0000, PA: 0x3c00_0000, Size: 0x300_0000, Attr: 1},
+		{VA: 0x3f10_0000, PA: 0x3f10_0000, Size: 0x12_0000},
+	}
+	if len(l.Regions) != len(expected) {
+		t.Fatalf("expected %d regions but got %+v", len(expected), l.Regions)
+	}
+	for i, e := range expected {
+		r := l.Regions[i]
+		if r.VA != e.VA || r.PA != e.PA || r.Size != e.Size || r.Attr != e.Attr {
+			t.Errorf("region %d: expected %+v but got %+v", i, e, r)
+		}
+	}
+	if l.Regions[2].Name != "PM,Between,GPIO,Aux" {
+		t.Errorf("unexpected name %s", l.Regions[2].Name)
+	}
+	if _, _, err := l.Build(testMemory{}, 0); err != nil {
+		t.Errorf("unable to build: %v", err)
+	}
+}
+
+// testDeviceMap is the bottom of the rpi3's MemoryMap
+type testDeviceMap []Region
+
+func (m testDeviceMap) Len() int {
+	return len(m)
+}
+
+func (m testDeviceMap) Region(i int) (string, uint64, uint64, int) {
+	return m[i].Name, m[i].PA, m[i].Size, int(m[i].Attr)
+}
+
+func TestAddDevices(t *testing.T) {
+	devices := testDeviceMap{
+		{Name: "VCMemory", PA: 0x3c00_0000, Size: 0x300_0000, Attr: 1},
+		{Name: "SOC", PA: 0x3f00_0000, Size: 0x100_0000},
+		{Name: "SystemTimer", PA: 0x3f00_3000, Size: 0x20},
+		{Name: "Aux", PA: 0x3f21_5000, Size: 0x6c},
+		{Name: "QA7", PA: 0x4000_0000, Size: 0x104},
+	}
+	l := &Layout{Granule: Granule64K, VABits: 42, Regions: []Region{
+		{Name: "ram", VA: 0, PA: 0, Size: 0x3c00_0000, Attr: 2},
+	}}
+	//machine's attrs are device, no cache, normal
+	if err := l.AddDevices(devices, []uint64{0: 4, 1: 3, 2: 2}); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		va   uint64
+		name string
+		attr uint64
+	}{
+		{0x3c00_0000, "VCMemory", 3},
+		{0x3f00_0000, "SystemTimer,SOC,Aux,QA7", 4},
+		{0x3f30_0000, "SystemTimer,SOC,Aux,QA7", 4}, //emmc, not in the map
+		{0x3fff_ffff, "SystemTimer,SOC,Aux,QA7", 4},
+		{0x4000_0100, "SystemTimer,SOC,Aux,QA7", 4}, //touches the window
+	} {
+		r, ok := l.Find(test.va)
+		if !ok || r.Name != test.name || r.Attr != test.attr {
+			t.Errorf("0x%x: expected %s with attr %d but got %+v", test.va, test.name, test.attr, r)
+		}
+	}
+	if _, ok := l.Find(0x4001_0000); ok {
+		t.Errorf("expected 0x4001_0000 to be in no region")
+	}
+	if err := l.AddDevices(devices, []uint64{0: 4}); err == nil {
+		t.Errorf("expected an error for VCMemory's attr")
+	}
+}
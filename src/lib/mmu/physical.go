@@ -0,0 +1,17 @@
+// +build tinygo
+
+package mmu
+
+import "unsafe"
+
+// Physical is memory itself, for building tables before the MMU is on
+// (or with the tables identity mapped)
+type Physical struct{}
+
+func (Physical) Read(addr uint64) uint64 {
+	return *(*uint64)(unsafe.Pointer(uintptr(addr)))
+}
+
+func (Physical) Write(addr uint64, value uint64) {
+	*(*uint64)(unsafe.Pointer(uintptr(addr))) = value
+}
@@ -0,0 +1,82 @@
+package regfile
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMachine builds a machine package for the host out of what sysdec
+// -mock generates for the rpi3 (the golden file, so that is compiled) and
+// the board's real driver code, and runs the tests in
+// testdata/src/machine against it.  testdata/src also has what the driver
+// needs of tinygo to build.
+func TestMachine(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test")
+	}
+	gobin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("no go command")
+	}
+	root, err := filepath.Abs("../../..") //the GOPATH entry we are in
+	if err != nil {
+		t.Fatal(err)
+	}
+	gopath, err := ioutil.TempDir("", "regfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(gopath)
+	if err := copyTree("testdata/src", filepath.Join(gopath, "src")); err != nil {
+		t.Fatal(err)
+	}
+	machine := filepath.Join(gopath, "src", "machine")
+	for from, to := range map[string]string{
+		"../../tools/sysdec/testdata/rpi3_mock.sysdec.go.golden":  "rpi3_mock.sysdec.go",
+		"../../../modtinygo/rpi3-files/src/machine/board_rpi3.go": "board_rpi3.go",
+	} {
+		if err := copyFile(from, filepath.Join(machine, to)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//vet has complaints about the board's code that aren't ours
+	cmd := exec.Command(gobin, "test", "-vet=off", "-tags", "rpi3", "machine")
+	cmd.Dir = machine
+	cmd.Env = append(os.Environ(), "GO111MODULE=off",
+		"GOPATH="+gopath+string(os.PathListSeparator)+root)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if testing.Verbose() {
+		t.Logf("%s", strings.TrimSpace(string(out)))
+	}
+}
+
+func copyTree(from, to string) error {
+	return filepath.Walk(from, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		return copyFile(path, filepath.Join(to, rel))
+	})
+}
+
+func copyFile(from, to string) error {
+	data, err := ioutil.ReadFile(from)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(to, data, 0644)
+}
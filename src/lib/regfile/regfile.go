@@ -0,0 +1,249 @@
+package regfile
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+//
+// This is runtime/volatile for the host.  sysdec -mock generates the
+// machine package against this instead: every peripheral is Map'ed into
+// host memory in the Default File, and every access to a Register32 goes
+// through the File, so a test can see (Log) and change (OnRead, OnWrite)
+// what a driver does with the hardware.
+//
+// Registers are known by their physical address on the board, the same
+// as the datasheets and the machine package's MemoryMap.  SetBits,
+// ClearBits and ReplaceBits are a read and then a write, like they are on
+// the board.
+//
+
+// Register32 has the same methods as volatile.Register32
+type Register32 struct {
+	Reg uint32
+}
+
+// Access is one read or write of a register
+type Access struct {
+	Addr  uintptr //physical
+	Write bool
+	Value uint32 //what the driver read or wrote
+}
+
+func (a Access) String() string {
+	if a.Write {
+		return fmt.Sprintf("write %08x to %x", a.Value, a.Addr)
+	}
+	return fmt.Sprintf("read %08x from %x", a.Value, a.Addr)
+}
+
+// ReadHook is called for a read of the register at addr, which holds
+// value.  What it returns is what the driver gets.
+type ReadHook func(addr uintptr, value uint32) uint32
+
+// WriteHook is called for a write of value to the register at addr,
+// which holds old.  What it returns is what the register holds afterwards.
+type WriteHook func(addr uintptr, old uint32, value uint32) uint32
+
+type region struct {
+	name string
+	base uintptr //physical
+	regs []Register32
+}
+
+// File is the registers of all the peripherals that have been Map'ed
+type File struct {
+	lock    sync.Mutex
+	regions []*region
+	reads   map[uintptr]ReadHook
+	writes  map[uintptr]WriteHook
+	log     []Access
+}
+
+// Default is the File that the generated code maps its peripherals in, a
+// Register32 can only be in this one
+var Default = &File{reads: map[uintptr]ReadHook{}, writes: map[uintptr]WriteHook{}}
+
+// Map is what the generated code uses to place a peripheral, size bytes at
+// the physical address base.  It returns the host memory for it.
+func Map(name string, base uintptr, size uintptr) unsafe.Pointer {
+	return Default.Map(name, base, size)
+}
+
+// Map makes size bytes of registers (all zero) at the physical address base
+func (f *File) Map(name string, base uintptr, size uintptr) unsafe.Pointer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	r := &region{name: name, base: base, regs: make([]Register32, (size+3)/4)}
+	f.regions = append(f.regions, r)
+	return unsafe.Pointer(&r.regs[0])
+}
+
+// find returns the register at the physical address addr
+func (f *File) find(addr uintptr) (*Register32, bool) {
+	for _, r := range f.regions {
+		if addr >= r.base && addr-r.base < uintptr(len(r.regs))*4 && addr%4 == 0 {
+			return &r.regs[(addr-r.base)/4], true
+		}
+	}
+	return nil, false
+}
+
+// Addr is the physical address of reg, which must be in one of the
+// peripherals, like Addr(unsafe.Pointer(&machine.Aux.MULSR))
+func (f *File) Addr(reg unsafe.Pointer) uintptr {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.addr((*Register32)(reg))
+}
+
+func (f *File) addr(reg *Register32) uintptr {
+	p := uintptr(unsafe.Pointer(reg))
+	for _, r := range f.regions {
+		start := uintptr(unsafe.Pointer(&r.regs[0]))
+		if p >= start && p-start < uintptr(len(r.regs))*4 {
+			return r.base + (p - start)
+		}
+	}
+	panic(fmt.Sprintf("register at %x is not in a peripheral", p))
+}
+
+// Name is the peripheral and offset of addr, for messages
+func (f *File) Name(addr uintptr) string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, r := range f.regions {
+		if addr >= r.base && addr-r.base < uintptr(len(r.regs))*4 {
+			return fmt.Sprintf("%s+0x%x", r.name, addr-r.base)
+		}
+	}
+	return fmt.Sprintf("0x%x", addr)
+}
+
+// OnRead sets (or with nil, removes) the hook for reads of addr
+func (f *File) OnRead(addr uintptr, hook ReadHook) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if hook == nil {
+		delete(f.reads, addr)
+		return
+	}
+	f.reads[addr] = hook
+}
+
+// OnWrite sets (or with nil, removes) the hook for writes to addr
+func (f *File) OnWrite(addr uintptr, hook WriteHook) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if hook == nil {
+		delete(f.writes, addr)
+		return
+	}
+	f.writes[addr] = hook
+}
+
+// Peek is the value of the register at addr, without hooks or the log
+func (f *File) Peek(addr uintptr) uint32 {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	r, ok := f.find(addr)
+	if !ok {
+		panic(fmt.Sprintf("no register at 0x%x", addr))
+	}
+	return r.Reg
+}
+
+// Poke sets the register at addr, without hooks or the log.  This is how
+// a test sets up the state the hardware is in.
+func (f *File) Poke(addr uintptr, value uint32) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	r, ok := f.find(addr)
+	if !ok {
+		panic(fmt.Sprintf("no register at 0x%x", addr))
+	}
+	r.Reg = value
+}
+
+// Log returns the accesses since the last Reset (or Log), in order
+func (f *File) Log() []Access {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	result := f.log
+	f.log = nil
+	return result
+}
+
+// Reset zeros all the registers and forgets the hooks and the log, for
+// the start of a test
+func (f *File) Reset() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, r := range f.regions {
+		for i := range r.regs {
+			r.regs[i].Reg = 0
+		}
+	}
+	f.reads = map[uintptr]ReadHook{}
+	f.writes = map[uintptr]WriteHook{}
+	f.log = nil
+}
+
+// read and write are what the Register32 methods come to.  Hooks are
+// called without the lock, so they can Peek and Poke.
+func (f *File) read(reg *Register32) uint32 {
+	f.lock.Lock()
+	addr := f.addr(reg)
+	value := reg.Reg
+	hook := f.reads[addr]
+	f.lock.Unlock()
+	if hook != nil {
+		value = hook(addr, value)
+	}
+	f.lock.Lock()
+	f.log = append(f.log, Access{Addr: addr, Value: value})
+	f.lock.Unlock()
+	return value
+}
+
+func (f *File) write(reg *Register32, value uint32) {
+	f.lock.Lock()
+	addr := f.addr(reg)
+	old := reg.Reg
+	hook := f.writes[addr]
+	f.log = append(f.log, Access{Addr: addr, Write: true, Value: value})
+	f.lock.Unlock()
+	stored := value
+	if hook != nil {
+		stored = hook(addr, old, value)
+	}
+	f.lock.Lock()
+	reg.Reg = stored
+	f.lock.Unlock()
+}
+
+func (r *Register32) Get() uint32 {
+	return Default.read(r)
+}
+
+func (r *Register32) Set(value uint32) {
+	Default.write(r, value)
+}
+
+func (r *Register32) SetBits(value uint32) {
+	r.Set(r.Get() | value)
+}
+
+func (r *Register32) ClearBits(value uint32) {
+	r.Set(r.Get() &^ value)
+}
+
+func (r *Register32) HasBits(value uint32) bool {
+	return r.Get()&value != 0
+}
+
+// ReplaceBits is like tinygo's: mask and value are not shifted
+func (r *Register32) ReplaceBits(value uint32, mask uint32, pos uint8) {
+	r.Set(r.Get()&^(mask<<pos) | value<<pos)
+}
@@ -0,0 +1,95 @@
+package regfile
+
+import (
+	"testing"
+	"unsafe"
+)
+
+// a peripheral that is just four registers, machine_test.go uses the
+// generated one
+type testBlockDef struct {
+	A Register32 // 0x0
+	B Register32 // 0x4
+	C Register32 // 0x8
+	D Register32 // 0xc
+}
+
+var testBlock = (*testBlockDef)(Map("Block", 0x1000, unsafe.Sizeof(testBlockDef{})))
+
+func TestReadHook(t *testing.T) {
+	Default.Reset()
+	Default.OnRead(0x1004, func(addr uintptr, value uint32) uint32 {
+		Default.Poke(0x1008, value+1)
+		return value | 0x10
+	})
+	Default.Poke(0x1004, 1)
+	if v := testBlock.B.Get(); v != 0x11 {
+		t.Errorf("expected 0x11 but got %x", v)
+	}
+	if v := testBlock.C.Get(); v != 2 {
+		t.Errorf("expected the hook to poke 2 but got %x", v)
+	}
+	Default.OnRead(0x1004, nil)
+	if v := testBlock.B.Get(); v != 1 {
+		t.Errorf("expected the hook to be gone but got %x", v)
+	}
+	expected := []Access{{Addr: 0x1004, Value: 0x11}, {Addr: 0x1008, Value: 2}, {Addr: 0x1004, Value: 1}}
+	log := Default.Log()
+	if len(log) != len(expected) {
+		t.Fatalf("expected %d accesses but got %v", len(expected), log)
+	}
+	for i := range expected {
+		if log[i] != expected[i] {
+			t.Errorf("%d: expected %v but got %v", i, expected[i], log[i])
+		}
+	}
+	if len(Default.Log()) != 0 {
+		t.Errorf("log was not cleared")
+	}
+}
+
+func TestWriteHook(t *testing.T) {
+	Default.Reset()
+	//the bottom bits are the only ones that stick
+	Default.OnWrite(0x100c, func(addr uintptr, old uint32, value uint32) uint32 {
+		return old | value&0x3
+	})
+	testBlock.D.SetBits(0xf1)
+	testBlock.D.ReplaceBits(1, 1, 1)
+	if v := Default.Peek(0x100c); v != 0x3 {
+		t.Errorf("expected 0x3 but got %x", v)
+	}
+	expected := []Access{
+		{Addr: 0x100c},
+		{Addr: 0x100c, Write: true, Value: 0xf1},
+		{Addr: 0x100c, Value: 0x1},
+		{Addr: 0x100c, Write: true, Value: 0x3},
+	}
+	log := Default.Log()
+	if len(log) != len(expected) {
+		t.Fatalf("expected %d accesses but got %v", len(expected), log)
+	}
+	for i := range expected {
+		if log[i] != expected[i] {
+			t.Errorf("%d: expected %v but got %v", i, expected[i], log[i])
+		}
+	}
+}
+
+func TestAddrAndName(t *testing.T) {
+	Default.Reset()
+	if a := Default.Addr(unsafe.Pointer(&testBlock.C)); a != 0x1008 {
+		t.Errorf("expected 1008 but got %x", a)
+	}
+	if n := Default.Name(0x1004); n != "Block+0x4" {
+		t.Errorf("expected Block+0x4 but got %s", n)
+	}
+	if n := Default.Name(0x2000); n != "0x2000" {
+		t.Errorf("expected 0x2000 but got %s", n)
+	}
+	Default.Poke(0x1004, 7)
+	Default.Reset()
+	if testBlock.B.Get() != 0 {
+		t.Errorf("reset did not zero the registers")
+	}
+}
@@ -0,0 +1,7 @@
+// Package arm is what the machine package needs of tinygo's device/arm to
+// build on the host, the assembly does nothing
+package arm
+
+func Asm(asm string) {}
+
+func AsmFull(asm string, regs map[string]interface{}) {}
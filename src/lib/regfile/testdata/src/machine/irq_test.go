@@ -0,0 +1,92 @@
+package machine
+
+import (
+	"testing"
+
+	"lib/regfile"
+)
+
+// the interrupt controller's registers for each bank, at 0x3f00b200
+var irqBanks = []struct {
+	irq                      IRQ
+	bit                      uint32
+	enable, disable, pending uintptr
+}{
+	{IRQSystemTimer1, 1 << 1, 0x3f00_b210, 0x3f00_b21c, 0x3f00_b204},
+	{IRQAux, 1 << 29, 0x3f00_b210, 0x3f00_b21c, 0x3f00_b204},
+	{IRQGPIO0, 1 << 17, 0x3f00_b214, 0x3f00_b220, 0x3f00_b208},
+	{IRQMailbox, 1 << 1, 0x3f00_b218, 0x3f00_b224, 0x3f00_b200},
+}
+
+// TestIRQEnable checks that each interrupt is one write, of its bit, to
+// the register for its bank
+func TestIRQEnable(t *testing.T) {
+	for _, b := range irqBanks {
+		regfile.Default.Reset()
+		b.irq.Enable()
+		b.irq.Disable()
+		checkLog(t, []regfile.Access{
+			{Addr: b.enable, Write: true, Value: b.bit},
+			{Addr: b.disable, Write: true, Value: b.bit},
+		})
+		if b.irq.IsPending() {
+			t.Errorf("%d: expected it not to be pending", b.irq)
+		}
+		regfile.Default.Poke(b.pending, b.bit)
+		if !b.irq.IsPending() {
+			t.Errorf("%d: expected it to be pending", b.irq)
+		}
+	}
+}
+
+// TestDispatch has an interrupt pending in each bank, and one without a
+// handler
+func TestDispatch(t *testing.T) {
+	regfile.Default.Reset()
+	var irqs IRQTable
+	called := map[IRQ]int{}
+	for _, name := range []string{"SystemTimer1", "Aux", "GPIO0", "Mailbox"} {
+		if !irqs.Register(name, func(i IRQ) { called[i]++ }) {
+			t.Fatalf("unable to register %s", name)
+		}
+	}
+	if irqs.Register("Nope", func(IRQ) {}) {
+		t.Errorf("expected Nope not to be an interrupt")
+	}
+	regfile.Default.Poke(0x3f00_b204, 1<<29|1<<3) //Aux, and 3 has no handler
+	regfile.Default.Poke(0x3f00_b208, 1<<17)      //GPIO0
+	regfile.Default.Poke(0x3f00_b200, 1<<1)       //Mailbox
+	if n := irqs.Dispatch(); n != 3 {
+		t.Errorf("expected 3 handlers to be called but got %d", n)
+	}
+	for _, i := range []IRQ{IRQAux, IRQGPIO0, IRQMailbox} {
+		if called[i] != 1 {
+			t.Errorf("%d: expected its handler to be called once but got %d", i, called[i])
+		}
+	}
+	if called[IRQSystemTimer1] != 0 {
+		t.Errorf("SystemTimer1 was not pending but its handler was called")
+	}
+}
+
+// core 0's interrupt sources in QA7, at 0x40000000
+const irqSource0 = 0x4000_0060
+
+// TestLocalTimer checks the bank with only a pending register: Enable and
+// Disable don't touch anything, and Dispatch looks at core 0's sources
+func TestLocalTimer(t *testing.T) {
+	regfile.Default.Reset()
+	IRQLocalTimer.Enable()
+	IRQLocalTimer.Disable()
+	checkLog(t, []regfile.Access{})
+	var irqs IRQTable
+	ticks := 0
+	irqs.Register("LocalTimer", func(IRQ) { ticks++ })
+	regfile.Default.Poke(irqSource0, 1<<11|1<<8) //LocalTimer, and the GPU
+	if !IRQLocalTimer.IsPending() {
+		t.Errorf("expected the local timer to be pending")
+	}
+	if n := irqs.Dispatch(); n != 1 || ticks != 1 {
+		t.Errorf("expected the local timer's handler to be called once but got %d (%d calls)", ticks, n)
+	}
+}
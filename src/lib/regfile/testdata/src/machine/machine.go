@@ -0,0 +1,6 @@
+package machine
+
+// Pin is from tinygo's machine.go, the rest of the package is
+// rpi3_mock.sysdec.go and the board's board_rpi3.go (see
+// lib/regfile/machine_test.go)
+type Pin uint8
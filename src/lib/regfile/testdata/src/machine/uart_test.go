@@ -0,0 +1,165 @@
+package machine
+
+import (
+	"testing"
+	"unsafe"
+
+	"lib/regfile"
+)
+
+// the mini uart's registers, by their physical address
+var (
+	muData = regfile.Default.Addr(unsafe.Pointer(&Aux.MUData))
+	muIER  = regfile.Default.Addr(unsafe.Pointer(&Aux.MUIER))
+	muLCR  = regfile.Default.Addr(unsafe.Pointer(&Aux.MULCR))
+	muLSR  = regfile.Default.Addr(unsafe.Pointer(&Aux.MULSR))
+)
+
+func checkLog(t *testing.T, expected []regfile.Access) {
+	t.Helper()
+	log := regfile.Default.Log()
+	if len(log) != len(expected) {
+		t.Fatalf("expected %d accesses but got %v", len(expected), log)
+	}
+	for i := range expected {
+		if log[i] != expected[i] {
+			t.Errorf("%d: expected %v but got %v", i, expected[i], log[i])
+		}
+	}
+}
+
+func TestAddresses(t *testing.T) {
+	if muLSR != 0x3f21_5054 || muData != 0x3f21_5040 {
+		t.Errorf("expected MULSR at 0x3f215054 and MUData at 0x3f215040 but got %x and %x", muLSR, muData)
+	}
+	if n := regfile.Default.Name(muIER); n != "Aux+0x44" {
+		t.Errorf("expected Aux+0x44 but got %s", n)
+	}
+	regfile.Default.Poke(muIER, 7)
+	regfile.Default.Reset()
+	if Aux.MUIER.ReceiveIsSet() {
+		t.Errorf("reset did not zero the registers")
+	}
+}
+
+// TestReadByte has data show up on the third look at the line status
+func TestReadByte(t *testing.T) {
+	regfile.Default.Reset()
+	reads := 0
+	regfile.Default.OnRead(muLSR, func(addr uintptr, value uint32) uint32 {
+		reads++
+		if reads == 3 {
+			regfile.Default.Poke(muData, 0x100|'x') //only 8 bits are the data
+			return value | 1                        //DataReady
+		}
+		return value
+	})
+	uart := NewUART()
+	if b := uart.ReadByte(); b != 'x' {
+		t.Errorf("expected x but got %q", b)
+	}
+	checkLog(t, []regfile.Access{
+		{Addr: muLSR},
+		{Addr: muLSR},
+		{Addr: muLSR, Value: 1},
+		{Addr: muData, Value: 0x100 | 'x'},
+	})
+}
+
+// TestWriteString makes the transmitter busy for every other look at the
+// line status, each byte has to wait for it
+func TestWriteString(t *testing.T) {
+	regfile.Default.Reset()
+	busy := false
+	regfile.Default.OnRead(muLSR, func(addr uintptr, value uint32) uint32 {
+		busy = !busy
+		if busy {
+			return value
+		}
+		return value | 1<<5 //TransmitterEmpty
+	})
+	sent := []byte{}
+	regfile.Default.OnWrite(muData, func(addr uintptr, old uint32, value uint32) uint32 {
+		sent = append(sent, byte(value))
+		return 0
+	})
+	uart := NewUART()
+	uart.WriteString("hi")
+	if string(sent) != "hi" {
+		t.Errorf("expected hi but got %q", sent)
+	}
+	//SetTransmit is a read and a write
+	checkLog(t, []regfile.Access{
+		{Addr: muLSR},
+		{Addr: muLSR, Value: 1 << 5},
+		{Addr: muData},
+		{Addr: muData, Write: true, Value: 'h'},
+		{Addr: muLSR},
+		{Addr: muLSR, Value: 1 << 5},
+		{Addr: muData},
+		{Addr: muData, Write: true, Value: 'i'},
+	})
+}
+
+// TestWriteHook has a register where only some of the bits stick
+func TestWriteHook(t *testing.T) {
+	regfile.Default.Reset()
+	regfile.Default.OnWrite(muIER, func(addr uintptr, old uint32, value uint32) uint32 {
+		return value & 0x3
+	})
+	Aux.MUIER.SetReadErr()
+	Aux.MUIER.SetReceive()
+	if v := regfile.Default.Peek(muIER); v != 0x1 {
+		t.Errorf("expected 0x1 but got %x", v)
+	}
+	checkLog(t, []regfile.Access{
+		{Addr: muIER},
+		{Addr: muIER, Write: true, Value: 1 << 2},
+		{Addr: muIER},
+		{Addr: muIER, Write: true, Value: 1},
+	})
+}
+
+// TestModify checks that several fields are one read and one write
+func TestModify(t *testing.T) {
+	regfile.Default.Reset()
+	regfile.Default.Poke(muLCR, 0x80)
+	Aux.MULCR.Modify(func(v *MULCRValue) {
+		v.SetEightBit()
+		v.SetBreak()
+		if !v.EightBit() {
+			t.Errorf("the copy was not changed")
+		}
+	})
+	checkLog(t, []regfile.Access{
+		{Addr: muLCR, Value: 0x80},
+		{Addr: muLCR, Write: true, Value: 0x80 | 1<<6 | 3},
+	})
+	//without it, each one is a read and a write
+	Aux.MULCR.SetSevenBit()
+	Aux.MULCR.ClearBreak()
+	checkLog(t, []regfile.Access{
+		{Addr: muLCR, Value: 0xc3},
+		{Addr: muLCR, Write: true, Value: 0xc0},
+		{Addr: muLCR, Value: 0xc0},
+		{Addr: muLCR, Write: true, Value: 0x80},
+	})
+}
+
+// TestMaskedRead checks that fields (and their enumerated values) only
+// look at their own bits
+func TestMaskedRead(t *testing.T) {
+	regfile.Default.Reset()
+	regfile.Default.Poke(muLCR, 1<<6|3) //Break and EightBit
+	if !Aux.MULCR.EightBit() || Aux.MULCR.SevenBit() || Aux.MULCR.DataSize() != MULCRDataSizeEightBit {
+		t.Errorf("expected EightBit in %x", regfile.Default.Peek(muLCR))
+	}
+	regfile.Default.Poke(muLCR, 1<<6)
+	if !Aux.MULCR.SevenBit() || !Aux.MULCR.BreakIsSet() {
+		t.Errorf("expected SevenBit and Break in %x", regfile.Default.Peek(muLCR))
+	}
+	regfile.Default.Poke(muData, 0xff41)
+	if r := Aux.MUData.Receive(); r != 0x41 {
+		t.Errorf("expected 0x41 but got %x", r)
+	}
+}
@@ -0,0 +1,15 @@
+// Package volatile is tinygo's runtime/volatile for the host, the machine
+// package's mailbox uses it for memory that isn't a register
+package volatile
+
+type Register32 struct {
+	Reg uint32
+}
+
+func (r *Register32) Get() uint32 {
+	return r.Reg
+}
+
+func (r *Register32) Set(value uint32) {
+	r.Reg = value
+}
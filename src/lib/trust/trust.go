@@ -125,6 +125,8 @@ func (l *Logger) logf(m MaskLevel, format string, params ...interface{}) {
 	}
 	start := 0
 	switch {
+	case m&fatalMask > 0:
+		l.sink.Printf("FATAL:")
 	case m&ErrorMask > 0:
 		l.sink.Printf("ERROR:")
 	case m&WarnMask > 0:
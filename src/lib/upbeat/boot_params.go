@@ -1,13 +1,9 @@
 package upbeat
 
-type BootloaderParamsDef struct {
-	EntryPoint   uint64
-	KernelLast   uint64
-	UnixTime     uint64
-	StackPointer uint64
-	HeapStart    uint64
-	HeapEnd      uint64
-}
+import "lib/bootparams"
+
+// the definition is shared with release, see bootparams
+type BootloaderParamsDef = bootparams.BootloaderParamsDef
 
 //go:extern bootloader_params
 var BootloaderParams BootloaderParamsDef
@@ -2,6 +2,8 @@ package upbeat
 
 import (
 	"device/arm"
+	"unsafe"
+
 	"lib/trust"
 )
 
@@ -110,6 +112,29 @@ func PrintoutException(esr uint64, c trust.Logger) {
 
 }
 
+// MaxBacktrace is the most frames an exception handler should ask for
+const MaxBacktrace = 16
+
+// Backtrace follows the frame records (saved x29 then x30) starting at fp
+// and puts the return address from each one in pcs.  Every record must be
+// between low and high, because reading anything unmapped would fault
+// again while we are already handling a fault.  It stops at the first
+// record that isn't, or when the chain stops going up the stack.  This
+// only finds something if the code was compiled with frame pointers.
+func Backtrace(fp uint64, low uint64, high uint64, pcs []uint64) int {
+	n := 0
+	for n < len(pcs) && fp&0x7 == 0 && fp >= low && fp+16 <= high {
+		pcs[n] = *(*uint64)(unsafe.Pointer(uintptr(fp + 8)))
+		n++
+		next := *(*uint64)(unsafe.Pointer(uintptr(fp)))
+		if next <= fp {
+			break
+		}
+		fp = next
+	}
+	return n
+}
+
 // MaskDAIF sets the value of the four D-A-I-F interupt masking on the ARM
 func MaskDAIF() {
 	arm.Asm("msr    daifset, #0x3") // IRQ + FIQ
@@ -0,0 +1,344 @@
+package sysdec
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// Check finds the mistakes in a description that the generator would
+// turn into wrong code without complaint: things that overlap, things that
+// don't fit, and reset values that can't be.  Locate then finds where each
+// one is in the source of the sys package, so they can be reported like
+// compiler errors.
+//
+
+// Problem is one mistake in a description.  Register, Field and Enum are
+// map keys, and can be empty; Key is the name of the field of the Def
+// (AddressOffset, BitRange...) that is wrong, if there is one.
+type Problem struct {
+	Pos        string //file:line, filled in by Locate
+	Peripheral string
+	Register   string
+	Field      string
+	Enum       string
+	Key        string
+	Message    string
+}
+
+func (p Problem) String() string {
+	where := p.Peripheral
+	for _, name := range []string{p.Register, p.Field, p.Enum} {
+		if name != "" {
+			where += "." + name
+		}
+	}
+	if p.Pos != "" {
+		where = p.Pos + ": " + where
+	}
+	return where + ": " + p.Message
+}
+
+// Check returns the problems in device, in order by name
+func Check(device DeviceDef) []Problem {
+	result := []Problem{}
+	for _, pname := range sortedKeys(device.Peripheral) {
+		result = append(result, checkPeripheral(pname, device.Peripheral[pname])...)
+	}
+	return append(result, checkInterrupts(device)...)
+}
+
+// checkInterrupts finds peripherals with the same interrupt, and ones
+// that none of the banks have
+func checkInterrupts(device DeviceDef) []Problem {
+	result := []Problem{}
+	numbers := map[int]string{}
+	for _, pname := range sortedKeys(device.Peripheral) {
+		i := device.Peripheral[pname].Interrupt
+		if i == (InterruptDef{}) {
+			continue
+		}
+		problem := func(format string, args ...interface{}) {
+			result = append(result, Problem{Peripheral: pname, Key: "Interrupt",
+				Message: fmt.Sprintf(format, args...)})
+		}
+		if other, ok := numbers[i.Value]; ok {
+			problem("has the same interrupt (%d) as %s", i.Value, other)
+		} else {
+			numbers[i.Value] = pname
+		}
+		found := len(device.InterruptBank) == 0 //nothing to check against
+		for _, bank := range device.InterruptBank {
+			if i.Value >= bank.First && i.Value < bank.First+bank.Count {
+				found = true
+			}
+		}
+		if !found {
+			problem("interrupt %d is not in any of the interrupt banks", i.Value)
+		}
+	}
+	return result
+}
+
+// span is the bytes that a register (or all of a Dim array of them) takes
+func span(r *RegisterDef) (int, int) {
+	end := r.AddressOffset + 4
+	if r.Dim > 0 {
+		end += (r.Dim - 1) * r.DimIncrement
+	}
+	return r.AddressOffset, end
+}
+
+func checkPeripheral(pname string, p *PeripheralDef) []Problem {
+	result := []Problem{}
+	names := sortedKeys(p.Register)
+	for i, rname := range names {
+		r := p.Register[rname]
+		problem := func(key string, format string, args ...interface{}) {
+			result = append(result, Problem{Peripheral: pname, Register: rname, Key: key,
+				Message: fmt.Sprintf(format, args...)})
+		}
+		start, end := span(r)
+		for _, other := range names[:i] {
+			ostart, oend := span(p.Register[other])
+			if start < oend && ostart < end {
+				problem("AddressOffset", "overlaps %s (0x%x-0x%x)", other, ostart, oend-1)
+			}
+		}
+		//the registers go up to and including AddressBlock.Size
+		if end-4 > p.AddressBlock.Size {
+			problem("AddressOffset", "0x%x-0x%x is outside the address block (0x%x)",
+				start, end-1, p.AddressBlock.Size)
+		}
+		if r.ResetMask != 0 && r.ResetValue&^r.ResetMask != 0 {
+			problem("ResetValue", "reset value 0x%x has bits outside the reset mask 0x%x",
+				r.ResetValue, r.ResetMask)
+		}
+		if !r.Access.IsSet() && len(r.Field) == 0 {
+			problem("Access", "has no access level (r, w, or rw)")
+		}
+		result = append(result, checkFields(pname, rname, r)...)
+	}
+	return result
+}
+
+func checkFields(pname string, rname string, r *RegisterDef) []Problem {
+	result := []Problem{}
+	size := r.Size
+	if size == 0 {
+		size = 32
+	}
+	names := sortedKeys(r.Field)
+	for i, fname := range names {
+		f := r.Field[fname]
+		problem := func(key string, format string, args ...interface{}) {
+			result = append(result, Problem{Peripheral: pname, Register: rname, Field: fname,
+				Key: key, Message: fmt.Sprintf(format, args...)})
+		}
+		if f.BitRange.Msb >= size {
+			problem("BitRange", "%s is beyond the register's %d bits", f.BitRange.String(), size)
+		}
+		for _, other := range names[:i] {
+			o := r.Field[other]
+			//a read only field and a write only one can share bits, like
+			//the receive and transmit halves of a uart's data register
+			shared := (canRead(r, f) && canRead(r, o)) || (canWrite(r, f) && canWrite(r, o))
+			if shared && f.BitRange.Lsb <= o.BitRange.Msb && o.BitRange.Lsb <= f.BitRange.Msb {
+				problem("BitRange", "%s overlaps %s %s", f.BitRange.String(), other, o.BitRange.String())
+			}
+		}
+		if !f.Access.IsSet() && !r.Access.IsSet() {
+			problem("Access", "neither the field nor the register has an access level (r, w, or rw)")
+		}
+		values := map[int]string{}
+		for _, ename := range sortedKeys(f.EnumeratedValue) {
+			e := f.EnumeratedValue[ename]
+			enumProblem := func(format string, args ...interface{}) {
+				result = append(result, Problem{Peripheral: pname, Register: rname, Field: fname,
+					Enum: ename, Key: "Value", Message: fmt.Sprintf(format, args...)})
+			}
+			if other, ok := values[e.Value]; ok {
+				enumProblem("has the same value (%d) as %s", e.Value, other)
+			} else {
+				values[e.Value] = ename
+			}
+			if e.Value < 0 || uint64(e.Value) > f.BitRange.Mask() {
+				enumProblem("value %d does not fit in %d bits", e.Value, f.BitRange.Width())
+			}
+		}
+	}
+	return result
+}
+
+// canRead and canWrite are the access of f, which comes from r if f
+// doesn't have its own
+func canRead(r *RegisterDef, f *FieldDef) bool {
+	if f.Access.IsSet() {
+		return f.Access.CanRead()
+	}
+	return r.Access.CanRead()
+}
+
+func canWrite(r *RegisterDef, f *FieldDef) bool {
+	if f.Access.IsSet() {
+		return f.Access.CanWrite()
+	}
+	return r.Access.CanWrite()
+}
+
+// sortedKeys is the keys of a map of peripherals, registers, fields or
+// enumerated values, sorted
+func sortedKeys(m interface{}) []string {
+	result := []string{}
+	switch m := m.(type) {
+	case map[string]*PeripheralDef:
+		for k := range m {
+			result = append(result, k)
+		}
+	case map[string]*RegisterDef:
+		for k := range m {
+			result = append(result, k)
+		}
+	case map[string]*FieldDef:
+		for k := range m {
+			result = append(result, k)
+		}
+	case map[string]*EnumeratedValueDef:
+		for k := range m {
+			result = append(result, k)
+		}
+	default:
+		panic(fmt.Sprintf("no keys for %T", m))
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Locate fills in the Pos of each problem in the description called name,
+// from the source of the sys package in dir.  It follows the entry for
+// name in Devices, then the peripheral's entry in the device, and so on,
+// so Pos is the line of the deepest thing that it could find.
+func Locate(problems []Problem, name string, dir string) error {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, nil, 0)
+	if err != nil {
+		return err
+	}
+	src := &source{vars: map[string]ast.Expr{}}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					v := spec.(*ast.ValueSpec)
+					for i, ident := range v.Names {
+						if i < len(v.Values) {
+							src.vars[ident.Name] = v.Values[i]
+						}
+					}
+				}
+			}
+		}
+	}
+	devices, ok := src.vars["Devices"]
+	if !ok {
+		return fmt.Errorf("no Devices in %s", dir)
+	}
+	wd, _ := filepath.Abs(".")
+	for i := range problems {
+		p := &problems[i]
+		path := []string{name, "Peripheral", p.Peripheral}
+		if p.Register != "" {
+			path = append(path, "Register", p.Register)
+		}
+		if p.Field != "" {
+			path = append(path, "Field", p.Field)
+		}
+		if p.Enum != "" {
+			path = append(path, "EnumeratedValue", p.Enum)
+		}
+		if p.Key != "" {
+			path = append(path, p.Key)
+		}
+		if pos := src.find(devices, path); pos.IsValid() {
+			position := fset.Position(pos)
+			filename := position.Filename
+			if rel, err := filepath.Rel(wd, filename); err == nil && !strings.HasPrefix(rel, "..") {
+				filename = rel
+			}
+			p.Pos = fmt.Sprintf("%s:%d", filename, position.Line)
+		}
+	}
+	return nil
+}
+
+// source is the top level vars of the sys package
+type source struct {
+	vars map[string]ast.Expr
+}
+
+// find follows path (map keys or names of fields) from e, and returns
+// where the last one it found is
+func (s *source) find(e ast.Expr, path []string) token.Pos {
+	var pos token.Pos
+	for _, key := range path {
+		lit := s.literal(e)
+		if lit == nil {
+			break
+		}
+		kv := element(lit, key)
+		if kv == nil {
+			break
+		}
+		pos = kv.Key.Pos()
+		e = kv.Value
+	}
+	return pos
+}
+
+// literal is the composite literal that e is, is the address of, or is
+// the var for
+func (s *source) literal(e ast.Expr) *ast.CompositeLit {
+	switch e := e.(type) {
+	case *ast.CompositeLit:
+		return e
+	case *ast.UnaryExpr:
+		return s.literal(e.X)
+	case *ast.Ident:
+		if v, ok := s.vars[e.Name]; ok {
+			return s.literal(v)
+		}
+	}
+	return nil
+}
+
+// element is the key: value in lit for a struct field called key, or a
+// string key in a map
+func element(lit *ast.CompositeLit, key string) *ast.KeyValueExpr {
+	for _, elt := range lit.Elts {
+		kv, ok := elt.(*ast.KeyValueExpr)
+		if !ok {
+			continue
+		}
+		switch k := kv.Key.(type) {
+		case *ast.Ident:
+			if k.Name == key {
+				return kv
+			}
+		case *ast.BasicLit:
+			if s, err := strconv.Unquote(k.Value); err == nil && k.Kind == token.STRING && s == key {
+				return kv
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package sysdec_test
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+
+	"tools/sysdec"
+	"tools/sysdec/sys"
+)
+
+// TestCheckDevices runs the checks over everything in sys, like
+// sysdec -check does
+func TestCheckDevices(t *testing.T) {
+	for name, device := range sys.Devices {
+		problems := sysdec.Check(*device)
+		if err := sysdec.Locate(problems, name, "sys"); err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range problems {
+			t.Errorf("%s: %v", name, p)
+		}
+	}
+}
+
+// a peripheral with one of each mistake, and two more with bad interrupts
+func badDevice() sysdec.DeviceDef {
+	return sysdec.DeviceDef{
+		InterruptBank: []sysdec.InterruptBankDef{{Peripheral: "Bad", First: 0, Count: 32}},
+		Peripheral: map[string]*sysdec.PeripheralDef{
+			"Worse": {Interrupt: sysdec.InterruptDef{Value: 3}},
+			"Worst": {Interrupt: sysdec.InterruptDef{Value: 40}},
+			"Bad": {
+				AddressBlock: sysdec.AddressBlockDef{Size: 0x10},
+				Interrupt:    sysdec.InterruptDef{Value: 3},
+				Register: map[string]*sysdec.RegisterDef{
+					"A": {AddressOffset: 0x0, Size: 8, Access: sysdec.Access("rw"),
+						ResetValue: 0x1ff, ResetMask: 0xff,
+						Field: map[string]*sysdec.FieldDef{
+							"Low":  {BitRange: sysdec.BitRange(3, 0)},
+							"Mid":  {BitRange: sysdec.BitRange(5, 3)},
+							"High": {BitRange: sysdec.BitRange(8, 6)},
+						}},
+					"B": {AddressOffset: 0x8, Dim: 4, DimIncrement: 4, Access: sysdec.Access("r")},
+					"C": {AddressOffset: 0xc},
+					"D": {AddressOffset: 0x4, Size: 32, Access: sysdec.Access("rw"),
+						Field: map[string]*sysdec.FieldDef{
+							"Receive":  {BitRange: sysdec.BitRange(7, 0), Access: sysdec.Access("r")},
+							"Transmit": {BitRange: sysdec.BitRange(7, 0), Access: sysdec.Access("w")},
+							"Mode": {BitRange: sysdec.BitRange(9, 8),
+								EnumeratedValue: map[string]*sysdec.EnumeratedValueDef{
+									"Slow": {Value: 1},
+									"Fast": {Value: 1},
+									"Huge": {Value: 4},
+								}},
+						}},
+				},
+			},
+		},
+	}
+}
+
+func TestCheck(t *testing.T) {
+	expected := []string{
+		"Bad.A: reset value 0x1ff has bits outside the reset mask 0xff",
+		"Bad.A.High: [8:6] is beyond the register's 8 bits",
+		"Bad.A.Mid: [5:3] overlaps Low [3:0]",
+		"Bad.B: 0x8-0x17 is outside the address block (0x10)",
+		"Bad.C: overlaps B (0x8-0x17)",
+		"Bad.C: has no access level (r, w, or rw)",
+		"Bad.D.Mode.Huge: value 4 does not fit in 2 bits",
+		"Bad.D.Mode.Slow: has the same value (1) as Fast",
+		"Worse: has the same interrupt (3) as Bad",
+		"Worst: interrupt 40 is not in any of the interrupt banks",
+	}
+	problems := sysdec.Check(badDevice())
+	if len(problems) != len(expected) {
+		t.Fatalf("expected %d problems but got %v", len(expected), problems)
+	}
+	for i, p := range problems {
+		if p.String() != expected[i] {
+			t.Errorf("expected '%s' but got '%s'", expected[i], p)
+		}
+	}
+}
+
+// TestLocate puts a problem in the real Aux and checks that it is found
+// on the line that declares the field
+func TestLocate(t *testing.T) {
+	problems := []sysdec.Problem{
+		{Peripheral: "Aux", Register: "MULSR", Field: "DataReady", Message: "made up"},
+		{Peripheral: "SystemTimer", Register: "SystemTimerLower32", Key: "Access", Message: "made up"},
+		{Peripheral: "NotThere", Message: "made up"},
+	}
+	if err := sysdec.Locate(problems, "rpi3_qemu", "sys"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct {
+		file, text string
+	}{
+		{"sys/bcm-2837-aux.go", `"DataReady": {`},
+		{"sys/bcm-2837-timers-qemu.go", `Access:`},
+		{"sys/rpi3_qemu.go", `Peripheral:`}, //not there, so it stops at the device
+	}
+	for i, e := range expected {
+		pos := problems[i].Pos
+		colon := strings.LastIndex(pos, ":")
+		if colon < 0 || pos[:colon] != e.file {
+			t.Errorf("%d: expected a line in %s but got '%s'", i, e.file, pos)
+			continue
+		}
+		line, _ := strconv.Atoi(pos[colon+1:])
+		src, err := ioutil.ReadFile(e.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(src), "\n")
+		if line < 1 || line > len(lines) || !strings.Contains(lines[line-1], e.text) {
+			t.Errorf("%d: expected %s at %s", i, e.text, pos)
+		}
+	}
+}
@@ -2,40 +2,199 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/token"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 
 	"tools/sysdec"
+	"tools/sysdec/sys"
 )
 
 var outfile = flag.String("o", "", "output filename")
-var dump = flag.Bool("d", false, "dump human readable version (debugging use only")
+var dump = flag.Bool("d", false, "dump the description as svd on stderr (debugging use only)")
 var pkg = flag.String("p", "main", "package to emit generated code into")
 var outtags = flag.String("b", "", "output build tags (copied verbatim to output)")
-var intags = flag.String("t", "", "input build tags (in correct go format)")
 var imp = flag.String("i", "runtime/volatile", "package name that has volatile.Register")
-var leave = flag.Bool("l", false, "leave work products")
+var check = flag.Bool("check", false, "look for mistakes in the description, rather than generating")
+var mock = flag.Bool("mock", false, "map the peripherals in a register file on the host (-i defaults to lib/regfile)")
+var svd = flag.Bool("svd", false, "write the description as CMSIS-SVD rather than go")
+var doc = flag.String("doc", "", "write a register reference (md or html) rather than go")
+var diff = flag.String("diff", "", "with -doc, write the differences from this description instead")
 
 func main() {
 	flag.Parse()
+	if *mock && !isSet("i") {
+		*imp = "lib/regfile"
+	}
 	if flag.NArg() == 0 {
-		log.Fatalf("usage svd2go -d -p <pkg> -o <outputfile> <input filename, either .csvd or .svd>")
+		log.Fatalf("usage sysdec -check -d -svd -mock -doc <md|html> -diff <old> -p <pkg> -o <outputfile> "+
+			"<device, one of %s, an .svd file, or a file in sys>", strings.Join(deviceNames(), ", "))
 	}
-	fp, err := os.Open(flag.Arg(0))
+	device, err := loadDevice(flag.Arg(0))
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer fp.Close()
+	var old *sysdec.DeviceDef
+	if *diff != "" {
+		if *doc == "" {
+			log.Fatal("-diff needs -doc to say what kind of document to write")
+		}
+		if old, err = loadDevice(*diff); err != nil {
+			log.Fatal(err)
+		}
+		old = pairPeripherals(old, device)
+	}
+	if *check {
+		checkDevice(device, flag.Arg(0))
+		return
+	}
 	opts := &sysdec.UserOptions{
 		Out:           *outfile,
 		Dump:          *dump,
 		Pkg:           *pkg,
 		InputFilename: flag.Arg(0),
 		OutTags:       *outtags,
-		InTags:        *intags,
 		Import:        *imp,
-		Leave:         *leave,
+		SVD:           *svd,
+		Mock:          *mock,
+		Doc:           *doc,
+		Diff:          old,
+	}
+	if err := sysdec.ProcessSysdec(device, opts); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadDevice reads an svd file, or finds the name in sys.Devices.  The
+// name can also be the file it is declared in (sys/rpi3.go), which is how
+// sysdec used to be run.  A file in sys that declares peripherals instead
+// (sys/bcm-2837-timers.go) is a device of just those.
+func loadDevice(arg string) (*sysdec.DeviceDef, error) {
+	if strings.HasSuffix(arg, ".svd") {
+		fp, err := os.Open(arg)
+		if err != nil {
+			return nil, err
+		}
+		defer fp.Close()
+		device, err := sysdec.ReadSVD(fp)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", arg, err)
+		}
+		return device, nil
+	}
+	name := strings.TrimSuffix(filepath.Base(arg), ".go")
+	device, ok := sys.Devices[name]
+	if ok {
+		return device, nil
+	}
+	if strings.HasSuffix(arg, ".go") {
+		return loadPeripherals(filepath.Base(arg))
+	}
+	return nil, fmt.Errorf("unknown device %s, expected one of %s", name,
+		strings.Join(deviceNames(), ", "))
+}
+
+// loadPeripherals makes a device of the peripherals declared in the file
+// called name in sys, they aren't bound to an address
+func loadPeripherals(name string) (*sysdec.DeviceDef, error) {
+	dir, err := sysDir()
+	if err != nil {
+		return nil, err
+	}
+	file, err := parser.ParseFile(token.NewFileSet(), filepath.Join(dir, name), nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	device := &sysdec.DeviceDef{Name: name, Peripheral: map[string]*sysdec.PeripheralDef{}}
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			for _, ident := range spec.(*ast.ValueSpec).Names {
+				if p, ok := sys.Peripherals[ident.Name]; ok {
+					device.Peripheral[ident.Name] = p
+				}
+			}
+		}
+	}
+	if len(device.Peripheral) == 0 {
+		return nil, fmt.Errorf("%s doesn't declare any of sys.Peripherals", name)
+	}
+	return device, nil
+}
+
+// pairPeripherals lets two files of one peripheral each be compared,
+// like bcm-2837-timers.go and bcm-2837-timers-qemu.go, by giving old's
+// peripheral the name of new's
+func pairPeripherals(old *sysdec.DeviceDef, new *sysdec.DeviceDef) *sysdec.DeviceDef {
+	if len(old.Peripheral) != 1 || len(new.Peripheral) != 1 || len(old.MMIOBindings) != 0 {
+		return old
+	}
+	paired := *old
+	paired.Peripheral = map[string]*sysdec.PeripheralDef{}
+	for name := range new.Peripheral {
+		for _, p := range old.Peripheral {
+			paired.Peripheral[name] = p
+		}
+	}
+	return &paired
+}
+
+// sysDir is where the source of the sys package is
+func sysDir() (string, error) {
+	pkg, err := build.Import("tools/sysdec/sys", "", build.FindOnly)
+	if err != nil {
+		return "", err
+	}
+	return pkg.Dir, nil
+}
+
+// checkDevice prints the problems in device, with where they are if it
+// came from sys, and exits with 1 if there are any
+func checkDevice(device *sysdec.DeviceDef, arg string) {
+	problems := sysdec.Check(*device)
+	if !strings.HasSuffix(arg, ".svd") {
+		dir, err := sysDir()
+		if err == nil {
+			err = sysdec.Locate(problems, strings.TrimSuffix(filepath.Base(arg), ".go"), dir)
+		}
+		if err != nil {
+			log.Printf("unable to find the source of %s: %v", arg, err)
+		}
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// isSet is true if the flag was given on the command line
+func isSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func deviceNames() []string {
+	names := []string{}
+	for name := range sys.Devices {
+		names = append(names, name)
 	}
-	//it was _just_ an svd
-	sysdec.ProcessSysdec(fp, opts)
+	sort.Strings(names)
+	return names
 }
@@ -0,0 +1,442 @@
+package sysdec
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+//
+// WriteDoc makes a register reference (markdown or html) from a
+// description: for each peripheral where it is, and for each register
+// its access, reset value, a diagram of its bits and the fields with
+// their enumerated values.  WriteDiff shows what is different between two
+// descriptions in the same way.
+//
+// Both work from a docDevice, the description sorted by address and
+// turned into the strings the templates show.
+//
+
+// DocFormat is the kind of document WriteDoc and WriteDiff make
+type DocFormat string
+
+const (
+	DocMarkdown DocFormat = "md"
+	DocHTML     DocFormat = "html"
+)
+
+type docDevice struct {
+	Name        string
+	Description string
+	Peripherals []*docPeripheral
+}
+
+type docPeripheral struct {
+	Name        string
+	Description string
+	Address     string //"" if it isn't bound
+	Size        string
+	Interrupt   string
+	Registers   []*docRegister
+}
+
+type docRegister struct {
+	Name        string //with [n] for an array
+	Description string
+	Offset      string
+	Address     string
+	Access      string
+	Reset       string
+	Layout      []docBits
+	Fields      []*docField
+}
+
+type docField struct {
+	Name        string
+	Description string
+	Bits        string
+	Access      string
+	Enums       []*docEnum
+}
+
+type docEnum struct {
+	Name        string
+	Description string
+	Value       int
+}
+
+// docBits is one box in the diagram of a register, the bits from Msb to
+// Lsb belong to the field(s) in Name, or no field if it is empty
+type docBits struct {
+	Msb, Lsb int
+	Name     string
+}
+
+// Span is the number of bits in the box, the colspan in the html
+func (b docBits) Span() int {
+	return b.Msb - b.Lsb + 1
+}
+
+// Bits is like BitRangeDef.String, but just one number for one bit
+func (b docBits) Bits() string {
+	if b.Msb == b.Lsb {
+		return fmt.Sprint(b.Msb)
+	}
+	return fmt.Sprintf("%d-%d", b.Msb, b.Lsb)
+}
+
+// oneLine is a description with the line breaks taken out, for places
+// like a list item that can't have them
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "_", `\_`,
+	"`", "\\`", "<", `\<`, "[", `\[`, "|", `\|`)
+
+// mdEscape keeps the text of a description from being taken as markdown,
+// the datasheets say things like 2**31
+func mdEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
+
+// paragraphs is a description without the indentation of the source, for
+// places that can have line breaks
+func paragraphs(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimSpace(l)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// newDocDevice sorts device by address and makes the strings for the
+// templates.  Peripherals without an MMIOBinding are left out, like the
+// generator does, unless none of them have one (a description of one
+// peripheral for a diff).
+func newDocDevice(device DeviceDef) *docDevice {
+	result := &docDevice{Name: device.Name, Description: paragraphs(device.Description)}
+	type bound struct {
+		name string
+		base int
+	}
+	all := []bound{}
+	for name, p := range device.Peripheral {
+		addr, ok := device.MMIOBindings[name]
+		if !ok && len(device.MMIOBindings) > 0 {
+			continue
+		}
+		all = append(all, bound{name, addr + p.AddressBlock.BaseAddress})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].base == all[j].base {
+			return all[i].name < all[j].name
+		}
+		return all[i].base < all[j].base
+	})
+	for _, b := range all {
+		p := device.Peripheral[b.name]
+		_, isBound := device.MMIOBindings[b.name]
+		result.Peripherals = append(result.Peripherals, newDocPeripheral(b.name, p, b.base, isBound))
+	}
+	return result
+}
+
+func newDocPeripheral(name string, p *PeripheralDef, base int, bound bool) *docPeripheral {
+	result := &docPeripheral{
+		Name:        name,
+		Description: paragraphs(p.Description),
+		Size:        fmt.Sprintf("0x%x", p.AddressBlock.Size),
+	}
+	if bound {
+		result.Address = fmt.Sprintf("0x%08x", base)
+	}
+	if p.Interrupt != (InterruptDef{}) {
+		iname := p.Interrupt.Name
+		if iname == "" {
+			iname = name
+		}
+		result.Interrupt = fmt.Sprintf("%s (%d)", iname, p.Interrupt.Value)
+	}
+	names := sortedKeys(p.Register)
+	sort.SliceStable(names, func(i, j int) bool {
+		return p.Register[names[i]].AddressOffset < p.Register[names[j]].AddressOffset
+	})
+	for _, rname := range names {
+		r := p.Register[rname]
+		reg := &docRegister{
+			Name:        strings.TrimSuffix(rname, "[%s]"),
+			Description: paragraphs(r.Description),
+			Offset:      fmt.Sprintf("0x%x", r.AddressOffset),
+			Access:      svdAccessName(r.Access), //the same names as in svd
+			Reset:       resetName(r),
+			Layout:      layout(r),
+		}
+		if r.Dim != 0 {
+			reg.Name += fmt.Sprintf("[%d]", r.Dim)
+			reg.Offset += fmt.Sprintf(" (every 0x%x)", r.DimIncrement)
+		}
+		if bound {
+			reg.Address = fmt.Sprintf("0x%08x", base+r.AddressOffset)
+		}
+		if reg.Access == "" {
+			reg.Access = "by field"
+		}
+		fields := sortedKeys(r.Field)
+		sort.SliceStable(fields, func(i, j int) bool {
+			return r.Field[fields[i]].BitRange.Msb > r.Field[fields[j]].BitRange.Msb
+		})
+		for _, fname := range fields {
+			f := r.Field[fname]
+			field := &docField{
+				Name:        fname,
+				Description: oneLine(f.Description),
+				Bits:        f.BitRange.String(),
+				Access:      svdAccessName(f.Access),
+			}
+			if field.Access == "" {
+				field.Access = svdAccessName(r.Access)
+			}
+			enums := sortedKeys(f.EnumeratedValue)
+			sort.SliceStable(enums, func(i, j int) bool {
+				return f.EnumeratedValue[enums[i]].Value < f.EnumeratedValue[enums[j]].Value
+			})
+			for _, ename := range enums {
+				e := f.EnumeratedValue[ename]
+				field.Enums = append(field.Enums, &docEnum{Name: ename,
+					Description: oneLine(e.Description), Value: e.Value})
+			}
+			reg.Fields = append(reg.Fields, field)
+		}
+		result.Registers = append(result.Registers, reg)
+	}
+	return result
+}
+
+// resetName is the reset value (and mask, if it isn't all of them), ""
+// if the description doesn't say
+func resetName(r *RegisterDef) string {
+	switch {
+	case r.ResetValue == 0 && r.ResetMask == 0:
+		return ""
+	case r.ResetMask == 0 || r.ResetMask == 0xffffffff:
+		return fmt.Sprintf("0x%08x", r.ResetValue)
+	}
+	return fmt.Sprintf("0x%08x (mask 0x%08x)", r.ResetValue, r.ResetMask)
+}
+
+// layout is the boxes in the diagram of r, from bit 31 down.  A read only
+// and a write only field can share bits, so a box is named for all the
+// fields its bits are in.
+func layout(r *RegisterDef) []docBits {
+	owners := [32]string{}
+	for _, fname := range sortedKeys(r.Field) {
+		f := r.Field[fname]
+		for bit := f.BitRange.Lsb; bit <= f.BitRange.Msb && bit < 32; bit++ {
+			if owners[bit] != "" {
+				owners[bit] += "/"
+			}
+			owners[bit] += fname
+		}
+	}
+	result := []docBits{}
+	for bit := 31; bit >= 0; bit-- {
+		if n := len(result); n > 0 && result[n-1].Name == owners[bit] {
+			result[n-1].Lsb = bit
+			continue
+		}
+		result = append(result, docBits{Msb: bit, Lsb: bit, Name: owners[bit]})
+	}
+	return result
+}
+
+// WriteDoc writes the register reference for device to w
+func WriteDoc(device DeviceDef, format DocFormat, w io.Writer) error {
+	doc := newDocDevice(device)
+	switch format {
+	case DocMarkdown:
+		t := template.Must(template.New("doc").Funcs(template.FuncMap{"md": mdEscape,
+			"lower": strings.ToLower}).Parse(markdownDocTemplateText))
+		return t.Execute(w, doc)
+	case DocHTML:
+		t := htmltemplate.Must(htmltemplate.New("doc").Parse(htmlDocTemplateText))
+		return t.Execute(w, doc)
+	}
+	return fmt.Errorf("unknown document format '%s', expected %s or %s", format, DocMarkdown, DocHTML)
+}
+
+// Difference is one thing that is different between two descriptions.
+// Where is the peripheral, register and field (joined by dots) and Old or
+// New is empty if it is only in one of them.
+type Difference struct {
+	Where string
+	What  string
+	Old   string
+	New   string
+}
+
+func (d Difference) String() string {
+	switch {
+	case d.Old == "":
+		return fmt.Sprintf("%s: %s added: %s", d.Where, d.What, d.New)
+	case d.New == "":
+		return fmt.Sprintf("%s: %s removed: %s", d.Where, d.What, d.Old)
+	}
+	return fmt.Sprintf("%s: %s was %s, now %s", d.Where, d.What, d.Old, d.New)
+}
+
+// Diff is the differences from old to new, peripherals and registers are
+// matched by name
+func Diff(old DeviceDef, new DeviceDef) []Difference {
+	a, b := newDocDevice(old), newDocDevice(new)
+	result := []Difference{}
+	add := func(where string, what string, o string, n string) {
+		if o != n {
+			result = append(result, Difference{Where: where, What: what, Old: o, New: n})
+		}
+	}
+	bp := map[string]*docPeripheral{}
+	for _, p := range b.Peripherals {
+		bp[p.Name] = p
+	}
+	for _, p := range a.Peripherals {
+		other, ok := bp[p.Name]
+		if !ok {
+			add(p.Name, "peripheral", "at "+orUnbound(p.Address), "")
+			continue
+		}
+		delete(bp, p.Name)
+		add(p.Name, "address", p.Address, other.Address)
+		add(p.Name, "address block size", p.Size, other.Size)
+		add(p.Name, "interrupt", p.Interrupt, other.Interrupt)
+		add(summaries(p.Name, p.Description, other.Description))
+		result = append(result, diffRegisters(p, other)...)
+	}
+	for _, p := range b.Peripherals {
+		if _, ok := bp[p.Name]; ok {
+			add(p.Name, "peripheral", "", "at "+orUnbound(p.Address))
+		}
+	}
+	return result
+}
+
+func diffRegisters(a *docPeripheral, b *docPeripheral) []Difference {
+	result := []Difference{}
+	add := func(where string, what string, o string, n string) {
+		if o != n {
+			result = append(result, Difference{Where: where, What: what, Old: o, New: n})
+		}
+	}
+	br := map[string]*docRegister{}
+	for _, r := range b.Registers {
+		br[r.Name] = r
+	}
+	for _, r := range a.Registers {
+		where := a.Name + "." + r.Name
+		other, ok := br[r.Name]
+		if !ok {
+			add(where, "register", "at "+r.Offset, "")
+			continue
+		}
+		delete(br, r.Name)
+		add(where, "offset", r.Offset, other.Offset)
+		add(where, "access", r.Access, other.Access)
+		add(where, "reset", r.Reset, other.Reset)
+		add(summaries(where, r.Description, other.Description))
+		bf := map[string]*docField{}
+		for _, f := range other.Fields {
+			bf[f.Name] = f
+		}
+		for _, f := range r.Fields {
+			fwhere := where + "." + f.Name
+			of, ok := bf[f.Name]
+			if !ok {
+				add(fwhere, "field", f.Bits, "")
+				continue
+			}
+			delete(bf, f.Name)
+			add(fwhere, "bits", f.Bits, of.Bits)
+			add(fwhere, "access", f.Access, of.Access)
+			add(fwhere, "enumerated values", enumNames(f), enumNames(of))
+			add(summaries(fwhere, f.Description, of.Description))
+		}
+		for _, f := range other.Fields {
+			if _, ok := bf[f.Name]; ok {
+				add(where+"."+f.Name, "field", "", f.Bits)
+			}
+		}
+	}
+	for _, r := range b.Registers {
+		if _, ok := br[r.Name]; ok {
+			add(a.Name+"."+r.Name, "register", "", "at "+r.Offset)
+		}
+	}
+	return result
+}
+
+func orUnbound(address string) string {
+	if address == "" {
+		return "no address"
+	}
+	return address
+}
+
+// summaries is the arguments to add for two descriptions: the part of
+// each where they start to be different, enough to see what changed.  If
+// they are the same (but for the line breaks) they are both "".
+func summaries(where string, old string, new string) (string, string, string, string) {
+	o, n := []rune(oneLine(old)), []rune(oneLine(new))
+	same := 0
+	for same < len(o) && same < len(n) && o[same] == n[same] {
+		same++
+	}
+	if same == len(o) && same == len(n) {
+		return where, "description", "", ""
+	}
+	start := same - 10
+	if start < 0 {
+		start = 0
+	}
+	part := func(r []rune) string {
+		s := `"`
+		if start > 0 {
+			s += "..."
+		}
+		if len(r)-start > 40 {
+			return s + string(r[start:start+40]) + `..."`
+		}
+		return s + string(r[start:]) + `"`
+	}
+	return where, "description", part(o), part(n)
+}
+
+func enumNames(f *docField) string {
+	names := []string{}
+	for _, e := range f.Enums {
+		names = append(names, fmt.Sprintf("%s=%d", e.Name, e.Value))
+	}
+	return strings.Join(names, " ")
+}
+
+type docDiff struct {
+	Old, New    string
+	Differences []Difference
+}
+
+// WriteDiff writes the differences from old to new to w
+func WriteDiff(old DeviceDef, new DeviceDef, format DocFormat, w io.Writer) error {
+	diff := &docDiff{Old: old.Name, New: new.Name, Differences: Diff(old, new)}
+	switch format {
+	case DocMarkdown:
+		t := template.Must(template.New("diff").Funcs(template.FuncMap{"md": mdEscape}).
+			Parse(markdownDiffTemplateText))
+		return t.Execute(w, diff)
+	case DocHTML:
+		t := htmltemplate.Must(htmltemplate.New("diff").Parse(htmlDiffTemplateText))
+		return t.Execute(w, diff)
+	}
+	return fmt.Errorf("unknown document format '%s', expected %s or %s", format, DocMarkdown, DocHTML)
+}
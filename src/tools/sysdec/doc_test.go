@@ -0,0 +1,122 @@
+package sysdec_test
+
+import (
+	"bytes"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strings"
+	"testing"
+
+	"tools/sysdec"
+	"tools/sysdec/sys"
+)
+
+func TestDoc(t *testing.T) {
+	expected := map[sysdec.DocFormat][]string{
+		sysdec.DocMarkdown: {
+			"### Aux.MULCR\n",
+			"| 31-7 | 6 | 5-2 | 1-0 |\n",
+			"|  | Break |  | DataSize |\n",
+			"* **DataSize** `[1:0]` read-write: ",
+			"  * `3` EightBit\n",
+			"|  | Receive/Transmit |\n",
+			"| [Aux](#aux) | `0x3f215000` | Aux (29) |\n",
+		},
+		sysdec.DocHTML: {
+			`<h3 id="Aux.MULCR">Aux.MULCR</h3>`,
+			`<td colspan="25" class="reserved"></td><td colspan="1">Break</td>`,
+			`<li><code>3</code> EightBit</li>`,
+			`2**31`,
+		},
+	}
+	for format, parts := range expected {
+		var out bytes.Buffer
+		if err := sysdec.WriteDoc(*sys.Devices["rpi3"], format, &out); err != nil {
+			t.Fatal(err)
+		}
+		for _, part := range parts {
+			if !strings.Contains(out.String(), part) {
+				t.Errorf("%s: expected %q", format, part)
+			}
+		}
+	}
+	var out bytes.Buffer
+	if err := sysdec.WriteDoc(*sys.Devices["rpi3"], "pdf", &out); err == nil {
+		t.Errorf("expected an error for pdf")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	if d := sysdec.Diff(*sys.Devices["rpi3"], *sys.Devices["rpi3"]); len(d) != 0 {
+		t.Errorf("expected no differences but got %v", d)
+	}
+	differences := map[string]bool{}
+	for _, d := range sysdec.Diff(*sys.Devices["rpi3"], *sys.Devices["rpi3_qemu"]) {
+		differences[d.String()] = true
+	}
+	for _, d := range []string{
+		"GPIO: peripheral removed: at 0x3f200000",
+		"SystemTimer.CS: register removed: at 0x0",
+		"SystemTimer.SystemTimerLower32: register added: at 0x4",
+	} {
+		if !differences[d] {
+			t.Errorf("expected '%s' in %v", d, differences)
+		}
+	}
+	//one peripheral against another, with a field that changed
+	old := sysdec.DeviceDef{Name: "old", Peripheral: map[string]*sysdec.PeripheralDef{"P": {
+		Register: map[string]*sysdec.RegisterDef{"R": {Access: sysdec.Access("rw"),
+			Field: map[string]*sysdec.FieldDef{"F": {BitRange: sysdec.BitRange(3, 0)}}}}}}}
+	new := sysdec.DeviceDef{Name: "new", Peripheral: map[string]*sysdec.PeripheralDef{"P": {
+		Register: map[string]*sysdec.RegisterDef{"R": {Access: sysdec.Access("r"),
+			Field: map[string]*sysdec.FieldDef{"F": {BitRange: sysdec.BitRange(4, 0)}}}}}}}
+	var out bytes.Buffer
+	if err := sysdec.WriteDiff(old, new, sysdec.DocMarkdown, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# old to new\n\n" +
+		"* **P.R** access: read-write is now read-only\n" +
+		"* **P.R.F** bits: \\[3:0] is now \\[4:0]\n" +
+		"* **P.R.F** access: read-write is now read-only\n"
+	if out.String() != expected {
+		t.Errorf("expected\n%s\nbut got\n%s", expected, out.String())
+	}
+}
+
+// TestPeripheralsRegistry checks that every peripheral in sys can be found
+// by the name of its var
+func TestPeripheralsRegistry(t *testing.T) {
+	pkgs, err := parser.ParseDir(token.NewFileSet(), "sys", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.VAR {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					v := spec.(*ast.ValueSpec)
+					for i, ident := range v.Names {
+						unary, ok := v.Values[i].(*ast.UnaryExpr)
+						if !ok {
+							continue
+						}
+						lit, ok := unary.X.(*ast.CompositeLit)
+						if !ok {
+							continue
+						}
+						if sel, ok := lit.Type.(*ast.SelectorExpr); ok && sel.Sel.Name == "PeripheralDef" {
+							if _, ok := sys.Peripherals[ident.Name]; !ok {
+								t.Errorf("%s is not in sys.Peripherals", ident.Name)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+}
@@ -3,24 +3,25 @@ package sysdec
 import (
 	"bytes"
 	"fmt"
-	"go/ast"
-	"go/parser"
-	"go/token"
+	"go/format"
 	"io"
 	"log"
 	"os"
-	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"text/template"
 )
 
 type templateGroup struct {
-	device       *template.Template
-	bitField     *template.Template
-	preamble     *template.Template
-	constant     *template.Template
-	intermediate *template.Template
-	register     *template.Template
+	device    *template.Template
+	bitField  *template.Template
+	preamble  *template.Template
+	constant  *template.Template
+	register  *template.Template
+	memoryMap *template.Template
+	interrupt *template.Template
 }
 
 func createOutputTemplates() *templateGroup {
@@ -40,127 +41,82 @@ func createOutputTemplates() *templateGroup {
 	constantTemplate := template.New("constant")
 	constantTemplate = template.Must(constantTemplate.Parse(constantTemplateText))
 
-	intermediateTemplate := template.New("intermediate")
-	intermediateTemplate = template.Must(intermediateTemplate.Parse(intermediatTemplateText))
-
 	registerTemplate := template.New("register")
 	registerTemplate = template.Must(registerTemplate.Parse(registerTemplateText))
 
+	memoryMapTemplate := template.New("memoryMap")
+	memoryMapTemplate = template.Must(memoryMapTemplate.Parse(memoryMapTemplateText))
+
+	interruptTemplate := template.New("interrupt")
+	interruptTemplate = template.Must(interruptTemplate.Parse(interruptTemplateText))
+
 	return &templateGroup{device: deviceTemplate,
-		bitField:     bitFieldDeclTemplate,
-		preamble:     preambleTemplate,
-		constant:     constantTemplate,
-		intermediate: intermediateTemplate,
-		register:     registerTemplate,
+		bitField:  bitFieldDeclTemplate,
+		preamble:  preambleTemplate,
+		constant:  constantTemplate,
+		register:  registerTemplate,
+		memoryMap: memoryMapTemplate,
+		interrupt: interruptTemplate,
 	}
 }
 
-type intermediateResult struct {
-	InTags     string
-	Pkg        string //intermediate package
-	Root       string
-	Dump       bool
-	OutTags    string
-	Package    string //output package
-	Import     string
-	SourceFile string
-}
-
-func ProcessSysdec(fp *os.File, opts *UserOptions) {
-
-	//system:=SystemDeclaration{}
-	fset := token.NewFileSet()
-	file, err := parser.ParseFile(fset, "sysdec", fp, parser.ParseComments)
-	if err != nil {
-		panic(err)
-	}
-	name := fileToName(file, opts.InputFilename)
+// ProcessSysdec writes the output for device (go, svd with -svd, or a
+// register reference with -doc) to opts.Out, or stdout if that isn't set
+func ProcessSysdec(device *DeviceDef, opts *UserOptions) error {
 	log.Printf("creating outputfile based on system declaration of '%s'",
-		name)
-
-	//setup template machinery
-	group := createOutputTemplates()
-	var output bytes.Buffer
-	p := intermediateResult{
-		InTags:     opts.InTags,
-		Pkg:        "main",
-		Root:       name,
-		Dump:       opts.Dump,
-		OutTags:    opts.OutTags,
-		Package:    opts.Pkg,
-		Import:     opts.Import,
-		SourceFile: opts.InputFilename,
-	}
-
-	//create the new main
-	t := filepath.Join("tmp", "int_main.go")
-	if err := group.intermediate.Execute(&output, p); err != nil {
-		log.Fatalf("error running intermediate template: %v", err)
-	}
-	out, err := os.Create(t)
-	if err != nil {
-		log.Fatalf("error creating intermediate main: %v", err)
-	}
-	copied, err := io.Copy(out, &output)
-	if err != nil {
-		log.Fatalf("unable to copy to intermediate main: %v", err)
-	}
-	out.Close()
-	if opts.Leave {
-		log.Printf("created intermediate file (%d bytes) %s",
-			copied, t)
+		device.Name)
+	if opts.Dump {
+		if err := WriteSVD(*device, os.Stderr); err != nil {
+			return err
+		}
 	}
-
-	tmp := os.TempDir()
-	outFile := compileIntermediate(t, tmp, opts)
-	runIntermediate(outFile, tmp, opts)
-}
-
-func fileToName(file *ast.File, filename string) string {
-	var d *ast.GenDecl
-	var s *ast.ValueSpec
-	ok := false
-	found := false
-	for _, candidate := range file.Decls {
-		d, ok = candidate.(*ast.GenDecl)
-		if !ok {
-			log.Fatalf("%s: unexpected type %T found in "+
-				"declarations, aborting", candidate)
+	var output bytes.Buffer
+	switch {
+	case opts.SVD:
+		if err := WriteSVD(*device, &output); err != nil {
+			return fmt.Errorf("unable to write svd: %v", err)
 		}
-		for _, spec := range d.Specs {
-			s, ok = spec.(*ast.ValueSpec)
-			if ok {
-				if !found {
-					found = true
-					continue
-				}
-				log.Fatalf("%s: can only process one file at a time, "+
-					"one declaration at a time, aborting",
-					filename)
-			}
+	case opts.Doc != "" && opts.Diff != nil:
+		if err := WriteDiff(*opts.Diff, *device, DocFormat(opts.Doc), &output); err != nil {
+			return err
+		}
+	case opts.Doc != "":
+		if err := WriteDoc(*device, DocFormat(opts.Doc), &output); err != nil {
+			return err
+		}
+	default:
+		if err := GenerateDeviceDecls(*device, opts, &output); err != nil {
+			return err
 		}
 	}
-	if d == nil || s == nil {
-		log.Fatalf("%s: no top level  declaration found, aborting",
-			filename)
+	if opts.Out == "" {
+		_, err := io.Copy(os.Stdout, &output)
+		return err
 	}
-	if len(s.Names) != 1 {
-		log.Fatalf("%s: expected to find one name in the declaration "+
-			"but found: %d", filename, len(s.Names))
+	out, err := os.Create(opts.Out)
+	if err != nil {
+		return fmt.Errorf("unable to create output file: %v", err)
 	}
-	ident := s.Names[0]
-	return ident.Name
+	if _, err := io.Copy(out, &output); err != nil {
+		out.Close()
+		return fmt.Errorf("unable to copy output: %v", err)
+	}
+	return out.Close()
 }
 
-func GenerateDeviceDecls(device DeviceDef, outTags string, pkg string,
-	imp string, source string, fp io.Writer) {
+// GenerateDeviceDecls writes the go declarations for device to fp, with
+// the package, build tags and so on from opts.  It works on a copy of
+// device, so the same DeviceDef (or peripherals shared between two of
+// them) can be used again, and gives the same output every time.
+func GenerateDeviceDecls(device DeviceDef, opts *UserOptions, fp io.Writer) error {
 	var output bytes.Buffer
 
-	//for intermediate main
-	device.OutTags = outTags
-	device.Import = imp
-	device.Package = pkg
-	device.SourceFilename = source
+	device = copyDevice(device)
+	device.OutTags = opts.OutTags
+	device.Import = opts.Import
+	device.Package = opts.Pkg
+	device.SourceFilename = opts.InputFilename
+	device.Mock = opts.Mock
 
 	group := createOutputTemplates()
 
@@ -199,6 +155,9 @@ func GenerateDeviceDecls(device DeviceDef, outTags string, pkg string,
 	for _, p := range device.Peripheral {
 		count := 0
 		p.RegistersWithReserved = []*RegisterDef{}
+		if len(p.Register) == 0 {
+			continue //just memory, only in the memory map
+		}
 		for i := 0; i <= p.AddressBlock.Size; i += 4 {
 			n, ok := findRegisterAtOffset(p.Register, i)
 			if !ok {
@@ -221,13 +180,21 @@ func GenerateDeviceDecls(device DeviceDef, outTags string, pkg string,
 					constants[k] = v
 				}
 				if def.DimIncrement != 4 {
-					panic("unable to handle non-32 bit registers in arrays:" + def.Name)
+					return fmt.Errorf("unable to handle non-32 bit registers in arrays: %s", def.Name)
 				}
 			}
 			p.RegistersWithReserved = append(p.RegistersWithReserved, def)
 		}
 	}
 
+	var err error
+	if device.MemoryMap, err = memoryMap(device); err != nil {
+		return err
+	}
+	if device.Interrupts, device.NumInterrupts, err = interrupts(device); err != nil {
+		return err
+	}
+
 	//send all the bitfields of registers to the templates so we can
 	//emit nice helpers
 	fields := []*FieldDef{}
@@ -236,21 +203,25 @@ func GenerateDeviceDecls(device DeviceDef, outTags string, pkg string,
 			if reg.Dim != 0 {
 				reg.Name = strings.TrimSuffix(regname, "[%s]")
 			}
+			reg.CanRead = reg.Access.CanRead()
+			reg.CanWrite = reg.Access.CanWrite()
 			for name, f := range reg.Field {
 				f.Name = name
-				f.RegName = regname
+				f.RegName = reg.Name //without the [%s]
 				if f.Access.IsSet() {
 					f.CanRead = f.Access.CanRead()
 					f.CanWrite = f.Access.CanWrite()
 				} else {
 					if !reg.Access.IsSet() {
-						log.Fatalf("neither register %s nor field %s "+
-							" has declared access level (r,w, or rw): ",
+						return fmt.Errorf("neither register %s nor field %s "+
+							" has declared access level (r,w, or rw)",
 							regname, name)
 					}
 					f.CanWrite = reg.Access.CanWrite()
 					f.CanRead = reg.Access.CanRead()
 				}
+				reg.CanRead = reg.CanRead || f.CanRead
+				reg.CanWrite = reg.CanWrite || f.CanWrite
 				fields = append(fields, f)
 				for ename, e := range f.EnumeratedValue {
 					e.Name = ename //copy name from map
@@ -259,39 +230,249 @@ func GenerateDeviceDecls(device DeviceDef, outTags string, pkg string,
 			}
 		}
 	}
+	//maps don't have an order
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].RegName == fields[j].RegName {
+			return fields[i].Name < fields[j].Name
+		}
+		return fields[i].RegName < fields[j].RegName
+	})
 	//preamble has just package, build tags, etc
 	if err := group.preamble.Execute(&output, device); err != nil {
-		log.Fatalf("failed to execute the preamble template: %v", err)
+		return fmt.Errorf("failed to execute the preamble template: %v", err)
 	}
 	//this has the fun stuff
 	if err := group.device.Execute(&output, device); err != nil {
-		log.Fatalf("failed to execute the device template: %v", err)
+		return fmt.Errorf("failed to execute the device template: %v", err)
 	}
 	//registers
 	if err := group.register.Execute(&output, device); err != nil {
-		log.Fatalf("failed to execute the device template: %v", err)
+		return fmt.Errorf("failed to execute the register template: %v", err)
 	}
 	// do bitfields
 	for _, f := range fields {
 		if err := group.bitField.Execute(&output, f); err != nil {
-			log.Fatalf("failed to execute the bitfield template: %v", err)
+			return fmt.Errorf("failed to execute the bitfield template: %v", err)
 		}
 	}
 	if err := group.constant.Execute(&output, constants); err != nil {
-		log.Fatalf("failed to execute the constants template: %v", err)
+		return fmt.Errorf("failed to execute the constants template: %v", err)
+	}
+	if err := group.memoryMap.Execute(&output, device); err != nil {
+		return fmt.Errorf("failed to execute the memory map template: %v", err)
+	}
+	if err := group.interrupt.Execute(&output, device); err != nil {
+		return fmt.Errorf("failed to execute the interrupt template: %v", err)
 	}
 
-	_, err := io.Copy(fp, &output)
+	formatted, err := tidy(output.Bytes())
 	if err != nil {
-		log.Fatalf("unable to copy output: %v", err)
+		return err
+	}
+	_, err = fp.Write(formatted)
+	return err
+}
+
+var blankLines = regexp.MustCompile(`(?m)^[ \t]*\n`)
+
+// tidy takes the blank lines the templates leave out (the ones that
+// should stay are marked with xxxblankxxx) and gofmts what's left
+func tidy(src []byte) ([]byte, error) {
+	src = blankLines.ReplaceAll(src, nil)
+	src = bytes.ReplaceAll(src, []byte("xxxblankxxx"), nil)
+	formatted, err := format.Source(src)
+	if err != nil {
+		return nil, fmt.Errorf("generated code does not parse: %v", err)
+	}
+	return formatted, nil
+}
+
+// copyDevice copies everything that GenerateDeviceDecls changes
+func copyDevice(device DeviceDef) DeviceDef {
+	bindings := map[string]int{}
+	for name, addr := range device.MMIOBindings {
+		bindings[name] = addr
 	}
+	device.MMIOBindings = bindings
+	peripherals := map[string]*PeripheralDef{}
+	for name, p := range device.Peripheral {
+		copied := *p
+		copied.Register = map[string]*RegisterDef{}
+		for rname, r := range p.Register {
+			copied.Register[rname] = copyRegister(r)
+		}
+		peripherals[name] = &copied
+	}
+	device.Peripheral = peripherals
+	return device
+}
+
+// copyRegister copies r and its fields, the generator fills in fields
+// with the name of the register they belong to
+func copyRegister(r *RegisterDef) *RegisterDef {
+	copied := *r
+	copied.Field = map[string]*FieldDef{}
+	for name, f := range r.Field {
+		field := *f
+		field.EnumeratedValue = nil
+		for ename, e := range f.EnumeratedValue {
+			if field.EnumeratedValue == nil {
+				field.EnumeratedValue = map[string]*EnumeratedValueDef{}
+			}
+			value := *e
+			field.EnumeratedValue[ename] = &value
+		}
+		copied.Field[name] = &field
+	}
+	return &copied
 }
 
+// findRegisterAtOffset returns the first (by name) register at offset, so
+// that two at the same place always come out the same way
 func findRegisterAtOffset(all map[string]*RegisterDef, offset int) (string, bool) {
+	found := ""
 	for name, def := range all {
-		if def.AddressOffset == offset {
-			return name, true
+		if def.AddressOffset == offset && (found == "" || name < found) {
+			found = name
 		}
 	}
-	return "", false
+	return found, found != ""
+}
+
+// memoryMap has a region for each peripheral (after the ones without an
+// MMIOBinding have been removed), in address order.  A peripheral's
+// registers go up to and including AddressBlock.Size, so its region is as
+// big as the struct for it.  One without registers is just memory, and is
+// AddressBlock.Size bytes.
+func memoryMap(device DeviceDef) ([]*MemoryRegionDef, error) {
+	result := []*MemoryRegionDef{}
+	for _, p := range device.Peripheral {
+		attr, err := memoryAttr(p)
+		if err != nil {
+			return nil, err
+		}
+		r := &MemoryRegionDef{
+			Name: p.Name,
+			Base: p.MMIOBase + p.AddressBlock.BaseAddress,
+			Size: p.AddressBlock.Size,
+			Attr: attr,
+		}
+		if n := len(p.RegistersWithReserved); n > 0 {
+			last := p.RegistersWithReserved[n-1]
+			dim := 1
+			if last.Dim != 0 {
+				dim = last.Dim
+			}
+			r.Size = last.AddressOffset + dim*4
+		}
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Base < result[j].Base
+	})
+	return result, nil
+}
+
+// interrupts is the interrupt of each peripheral that has one (and is
+// still there after the ones without an MMIOBinding have been removed), in
+// order by number, and the size of a table of them.  Each bank has to be
+// in a peripheral with the registers it names, since the generated code
+// uses them.
+func interrupts(device DeviceDef) ([]InterruptDef, int, error) {
+	result := []InterruptDef{}
+	size := 0
+	for _, bank := range device.InterruptBank {
+		p, ok := device.Peripheral[bank.Peripheral]
+		if !ok {
+			return nil, 0, fmt.Errorf("interrupt bank %d-%d is in %s, which isn't a peripheral",
+				bank.First, bank.First+bank.Count-1, bank.Peripheral)
+		}
+		if (bank.Enable == "") != (bank.Disable == "") {
+			return nil, 0, fmt.Errorf("interrupt bank %d-%d needs both Enable and Disable, or neither",
+				bank.First, bank.First+bank.Count-1)
+		}
+		for i, name := range []string{bank.Enable, bank.Disable, bank.Pending} {
+			pending := i == 2
+			if name == "" && !pending {
+				continue
+			}
+			r, ok := bankRegister(p, name)
+			if !ok {
+				return nil, 0, fmt.Errorf("interrupt bank %d-%d uses %s.%s, which isn't a register",
+					bank.First, bank.First+bank.Count-1, bank.Peripheral, name)
+			}
+			if (pending && !r.Access.CanRead()) || (!pending && !r.Access.CanWrite()) {
+				return nil, 0, fmt.Errorf("interrupt bank %d-%d can't use %s.%s, it is %s",
+					bank.First, bank.First+bank.Count-1, bank.Peripheral, name, svdAccessName(r.Access))
+			}
+		}
+		if bank.Count < 1 || bank.Count > 32 {
+			return nil, 0, fmt.Errorf("interrupt bank at %d has %d interrupts, it can have 1 to 32",
+				bank.First, bank.Count)
+		}
+		if bank.First+bank.Count > size {
+			size = bank.First + bank.Count
+		}
+	}
+	names := map[string]string{}
+	for pname, p := range device.Peripheral {
+		if p.Interrupt == (InterruptDef{}) {
+			continue
+		}
+		i := p.Interrupt
+		if i.Name == "" {
+			i.Name = pname
+		}
+		i.Description = strings.TrimSpace(strings.Split(strings.TrimSpace(i.Description), "\n")[0])
+		if other, ok := names[i.Name]; ok {
+			return nil, 0, fmt.Errorf("peripherals %s and %s both have an interrupt called %s",
+				other, pname, i.Name)
+		}
+		names[i.Name] = pname
+		if i.Value+1 > size {
+			size = i.Value + 1
+		}
+		result = append(result, i)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Value == result[j].Value {
+			return result[i].Name < result[j].Name
+		}
+		return result[i].Value < result[j].Value
+	})
+	return result, size, nil
+}
+
+// bankRegister is the register an interrupt bank calls name, which is
+// either a plain register or one of an array of them, like "IRQSource[0]"
+func bankRegister(p *PeripheralDef, name string) (*RegisterDef, bool) {
+	i := strings.Index(name, "[")
+	if i < 0 {
+		r, ok := p.Register[name]
+		return r, ok && r.Dim == 0
+	}
+	if !strings.HasSuffix(name, "]") {
+		return nil, false
+	}
+	index, err := strconv.Atoi(name[i+1 : len(name)-1])
+	if err != nil {
+		return nil, false
+	}
+	r, ok := p.Register[name[:i]]
+	return r, ok && index >= 0 && index < r.Dim
+}
+
+// memoryAttr is the suggested memory attribute for a peripheral, based on
+// the usage of its address block
+func memoryAttr(p *PeripheralDef) (string, error) {
+	switch p.AddressBlock.Usage {
+	case "", "registers":
+		return "MemoryDevice", nil
+	case "buffer":
+		return "MemoryNoCache", nil
+	case "memory":
+		return "MemoryNormal", nil
+	}
+	return "", fmt.Errorf("peripheral %s has an address block with unknown usage '%s'",
+		p.Name, p.AddressBlock.Usage)
 }
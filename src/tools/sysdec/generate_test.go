@@ -0,0 +1,162 @@
+package sysdec_test
+
+import (
+	"bytes"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"tools/sysdec"
+	"tools/sysdec/sys"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func options(name string) *sysdec.UserOptions {
+	return &sysdec.UserOptions{Pkg: "machine", InputFilename: name,
+		OutTags: name, Import: "runtime/volatile"}
+}
+
+func generate(t *testing.T, name string) []byte {
+	return generateWith(t, name, options(name))
+}
+
+func generateWith(t *testing.T, name string, opts *sysdec.UserOptions) []byte {
+	var out bytes.Buffer
+	err := sysdec.GenerateDeviceDecls(*sys.Devices[name], opts, &out)
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return out.Bytes()
+}
+
+// TestGolden compares the output for each device with testdata, run with
+// -update after changing the templates or the declarations (and look at
+// the diff).  rpi3_mock is rpi3 with -mock.
+func TestGolden(t *testing.T) {
+	outputs := map[string]func() []byte{}
+	for name := range sys.Devices {
+		name := name
+		outputs[name] = func() []byte { return generate(t, name) }
+	}
+	outputs["rpi3_mock"] = func() []byte {
+		opts := options("rpi3")
+		opts.OutTags = "!tinygo"
+		opts.Import = "lib/regfile"
+		opts.Mock = true
+		return generateWith(t, "rpi3", opts)
+	}
+	for name, generate := range outputs {
+		out := generate()
+		golden := filepath.Join("testdata", name+".sysdec.go.golden")
+		if *update {
+			if err := ioutil.WriteFile(golden, out, 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		expected, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, expected) {
+			t.Errorf("%s: output differs from %s", name, golden)
+		}
+	}
+}
+
+// TestGenerateIsPure checks that generating doesn't change the
+// declarations, the two devices share most of their peripherals
+func TestGenerateIsPure(t *testing.T) {
+	first := generate(t, "rpi3")
+	generate(t, "rpi3_qemu")
+	if !bytes.Equal(first, generate(t, "rpi3")) {
+		t.Errorf("second time is different")
+	}
+	gpio := sys.Devices["rpi3"].Peripheral["GPIO"]
+	if strings.HasPrefix(gpio.Description, "//") || gpio.Name != "" ||
+		len(gpio.RegistersWithReserved) != 0 {
+		t.Errorf("the GPIO declaration was changed")
+	}
+	if sys.Devices["rpi3"].MemoryMap != nil {
+		t.Errorf("the device was changed")
+	}
+}
+
+// TestPeripheralWindow checks that the SOC covers all of the peripherals
+// at 0x3f00_0000, so the memory map (and the page tables antc makes from
+// it) has the ones we don't describe too
+func TestPeripheralWindow(t *testing.T) {
+	for _, name := range []string{"rpi3", "rpi3_qemu"} {
+		device := sys.Devices[name]
+		soc := device.Peripheral["SOC"]
+		start := device.MMIOBindings["SOC"] + soc.AddressBlock.BaseAddress
+		end := start + soc.AddressBlock.Size
+		if start != 0x3f00_0000 || end != 0x4000_0000 {
+			t.Errorf("%s: expected the SOC at 0x3f000000-0x3fffffff but got 0x%x-0x%x", name, start, end-1)
+		}
+		for pname, base := range device.MMIOBindings {
+			p := device.Peripheral[pname]
+			if base != 0x3f00_0000 || p == soc {
+				continue
+			}
+			if p.AddressBlock.BaseAddress+p.AddressBlock.Size > soc.AddressBlock.Size {
+				t.Errorf("%s: %s is past the end of the SOC", name, pname)
+			}
+		}
+		expected := `{Name: "SOC", Base: 0x3f000000, Size: 0x1000000, Attr: MemoryDevice},`
+		if !bytes.Contains(generate(t, name), []byte(expected)) {
+			t.Errorf("%s: the SOC isn't in the memory map", name)
+		}
+	}
+}
+
+func TestSVDRoundTrip(t *testing.T) {
+	for name, device := range sys.Devices {
+		var first, second bytes.Buffer
+		if err := sysdec.WriteSVD(*device, &first); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		read, err := sysdec.ReadSVD(bytes.NewReader(first.Bytes()))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err := sysdec.WriteSVD(*read, &second); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !bytes.Equal(first.Bytes(), second.Bytes()) {
+			t.Errorf("%s: svd is different after reading it back", name)
+		}
+		//and it makes a machine package
+		var out bytes.Buffer
+		opts := options(name + ".svd")
+		opts.OutTags = ""
+		if err := sysdec.GenerateDeviceDecls(*read, opts, &out); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+// TestInterruptBanks checks that a bank has to name registers that the
+// generated code can use
+func TestInterruptBanks(t *testing.T) {
+	for _, bank := range []sysdec.InterruptBankDef{
+		{Peripheral: "Nope", First: 0, Count: 32, Enable: "Enable1", Disable: "Disable1", Pending: "Pending1"},
+		{Peripheral: "IC", First: 0, Count: 32, Enable: "Enable1", Disable: "Disable1", Pending: "Nope"},
+		{Peripheral: "IC", First: 0, Count: 32, Enable: "Pending1", Disable: "Disable1", Pending: "Pending1"},
+		{Peripheral: "IC", First: 0, Count: 33, Enable: "Enable1", Disable: "Disable1", Pending: "Pending1"},
+		{Peripheral: "IC", First: 0, Count: 32, Enable: "Enable1", Pending: "Pending1"},
+		{Peripheral: "QA7", First: 72, Count: 12, Pending: "IRQSource"},
+		{Peripheral: "QA7", First: 72, Count: 12, Pending: "IRQSource[4]"},
+		{Peripheral: "QA7", First: 72, Count: 12, Pending: "IRQSource[x]"},
+	} {
+		device := *sys.Devices["rpi3"]
+		device.InterruptBank = []sysdec.InterruptBankDef{bank}
+		var out bytes.Buffer
+		if err := sysdec.GenerateDeviceDecls(device, options("rpi3"), &out); err == nil {
+			t.Errorf("expected an error for %+v", bank)
+		}
+	}
+}
@@ -12,10 +12,24 @@ type DeviceDef struct {
 	NumCores       int
 	MMIOBindings   map[string]int
 	Peripheral     map[string]*PeripheralDef
-	Package        string // this comes from the user opts
-	SourceFilename string // this is the filename used to create all this
-	OutTags        string //this comes from the command line option
-	Import         string //this comes from command line option
+	InterruptBank  []InterruptBankDef
+	Package        string             // this comes from the user opts
+	SourceFilename string             // this is the filename used to create all this
+	OutTags        string             //this comes from the command line option
+	Import         string             //this comes from command line option
+	Mock           bool               //this comes from command line option
+	MemoryMap      []*MemoryRegionDef //computed by the generator
+	Interrupts     []InterruptDef     //computed by the generator, from the peripherals
+	NumInterrupts  int                //computed by the generator
+}
+
+// MemoryRegionDef is the physical memory used by one peripheral, computed
+// by the generator from MMIOBindings and the AddressBlock
+type MemoryRegionDef struct {
+	Name string
+	Base int
+	Size int
+	Attr string //name of the MemoryAttr constant in the output
 }
 
 type CPUDef struct {
@@ -52,13 +66,30 @@ type PeripheralDef struct {
 type AddressBlockDef struct {
 	BaseAddress int
 	Size        int
-	Usage       string
+	Usage       string //"registers" (the default), "buffer" or "memory", see memoryAttr
 }
 
 type InterruptDef struct {
-	Name        string
+	Name        string //if not set, the peripheral's name
 	Description string
-	Value       int
+	Value       int //the interrupt number, how the banks know it
+}
+
+// InterruptBankDef is Count interrupts, starting with First, in the
+// interrupt controller Peripheral.  Each has a bit (bit 0 is First) in the
+// registers named Enable, Disable and Pending: writing a one to it in
+// Enable turns the interrupt on, in Disable turns it off, and it is set in
+// Pending while the interrupt is happening.  Enable and Disable can both
+// be left out when the interrupts are turned on and off in their own
+// peripherals, and Pending can be one of an array of registers, like
+// "IRQSource[0]".
+type InterruptBankDef struct {
+	Peripheral string
+	First      int
+	Count      int
+	Enable     string
+	Disable    string
+	Pending    string
 }
 
 type RegisterDef struct {
@@ -71,6 +102,8 @@ type RegisterDef struct {
 	ResetMask     int
 	Field         map[string]*FieldDef
 	IsReserved    bool //computed internally
+	CanRead       bool //computed, the register or any of its fields
+	CanWrite      bool //computed, the register or any of its fields
 	Dim           int
 	DimIncrement  int
 	//these indice names are not crosschecked nor namespaced
@@ -0,0 +1,785 @@
+package sysdec
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//
+// CMSIS-SVD is the xml that vendors (and tools like svd2rust and debuggers)
+// use for the same thing as the DeviceDef tree.  ReadSVD turns one into a
+// DeviceDef, so a vendor's file can be used directly, and WriteSVD goes the
+// other way for our hand-written descriptions.
+//
+// The differences that matter:
+// * An svd peripheral has an absolute base address, ours is an MMIOBinding
+//   plus the AddressBlock's BaseAddress.  Read puts the whole address in the
+//   AddressBlock (and a binding of 0), write adds them back together.
+// * Our AddressBlock.Size is the offset of the last register (the generator
+//   goes up to and including it) unless there are no registers.  svd's is
+//   the size in bytes.
+// * svd lets size, access and the reset values be inherited from the
+//   peripheral or device, we don't, so Read fills them in.
+// * Register names are types in the output, so they have to be unique
+//   across the device (see renameSVDRegisters).
+// * Clusters are not supported, nor are enumerated values with don't care
+//   bits (#1x0).
+// * An svd peripheral can have several interrupts, Read keeps the first.
+//   svd has nothing like InterruptBank, so that isn't written.
+//
+
+type svdDevice struct {
+	XMLName         xml.Name `xml:"device"`
+	SchemaVersion   string   `xml:"schemaVersion,attr,omitempty"`
+	Vendor          string   `xml:"vendor,omitempty"`
+	VendorID        string   `xml:"vendorID,omitempty"`
+	Name            string   `xml:"name"`
+	Series          string   `xml:"series,omitempty"`
+	Version         string   `xml:"version"`
+	Description     string   `xml:"description"`
+	LicenseText     string   `xml:"licenseText,omitempty"`
+	CPU             *svdCPU  `xml:"cpu,omitempty"`
+	AddressUnitBits string   `xml:"addressUnitBits"`
+	Width           string   `xml:"width"`
+	svdRegisterProperties
+	Peripherals []*svdPeripheral `xml:"peripherals>peripheral"`
+}
+
+type svdCPU struct {
+	Name                string `xml:"name"`
+	Revision            string `xml:"revision"`
+	Endian              string `xml:"endian"`
+	MPUPresent          bool   `xml:"mpuPresent"`
+	FPUPresent          bool   `xml:"fpuPresent"`
+	DSPPresent          bool   `xml:"dspPresent,omitempty"`
+	ICachePresent       bool   `xml:"icachePresent,omitempty"`
+	DCachePresent       bool   `xml:"dcachePresent,omitempty"`
+	NVICPrioBits        string `xml:"nvicPrioBits"`
+	VendorSystickConfig bool   `xml:"vendorSystickConfig"`
+	DeviceNumInterrupts string `xml:"deviceNumInterrupts,omitempty"`
+}
+
+// svdRegisterProperties are the defaults that devices and peripherals can
+// give their registers
+type svdRegisterProperties struct {
+	Size       string `xml:"size,omitempty"`
+	Access     string `xml:"access,omitempty"`
+	ResetValue string `xml:"resetValue,omitempty"`
+	ResetMask  string `xml:"resetMask,omitempty"`
+}
+
+type svdPeripheral struct {
+	DerivedFrom      string `xml:"derivedFrom,attr,omitempty"`
+	Name             string `xml:"name"`
+	Version          string `xml:"version,omitempty"`
+	Description      string `xml:"description,omitempty"`
+	GroupName        string `xml:"groupName,omitempty"`
+	PrependToName    string `xml:"prependToName,omitempty"`
+	AppendToName     string `xml:"appendToName,omitempty"`
+	HeaderStructName string `xml:"headerStructName,omitempty"`
+	BaseAddress      string `xml:"baseAddress"`
+	svdRegisterProperties
+	AddressBlock []svdAddressBlock `xml:"addressBlock"`
+	Interrupt    []svdInterrupt    `xml:"interrupt"`
+	Registers    *svdRegisters     `xml:"registers,omitempty"`
+}
+
+type svdAddressBlock struct {
+	Offset string `xml:"offset"`
+	Size   string `xml:"size"`
+	Usage  string `xml:"usage"`
+}
+
+type svdInterrupt struct {
+	Name        string `xml:"name"`
+	Description string `xml:"description,omitempty"`
+	Value       string `xml:"value"`
+}
+
+type svdRegisters struct {
+	Register []*svdRegister `xml:"register"`
+	Cluster  []xml.Name     `xml:"cluster"` //only to notice them
+}
+
+type svdRegister struct {
+	Dim           string `xml:"dim,omitempty"`
+	DimIncrement  string `xml:"dimIncrement,omitempty"`
+	DimIndex      string `xml:"dimIndex,omitempty"`
+	Name          string `xml:"name"`
+	Description   string `xml:"description,omitempty"`
+	AddressOffset string `xml:"addressOffset"`
+	svdRegisterProperties
+	Fields *svdFields `xml:"fields,omitempty"`
+}
+
+type svdFields struct {
+	Field []*svdField `xml:"field"`
+}
+
+type svdField struct {
+	Name             string                `xml:"name"`
+	Description      string                `xml:"description,omitempty"`
+	BitOffset        string                `xml:"bitOffset,omitempty"`
+	BitWidth         string                `xml:"bitWidth,omitempty"`
+	Lsb              string                `xml:"lsb,omitempty"`
+	Msb              string                `xml:"msb,omitempty"`
+	BitRange         string                `xml:"bitRange,omitempty"`
+	Access           string                `xml:"access,omitempty"`
+	EnumeratedValues []svdEnumeratedValues `xml:"enumeratedValues,omitempty"`
+}
+
+type svdEnumeratedValues struct {
+	Name            string               `xml:"name,omitempty"`
+	Usage           string               `xml:"usage,omitempty"`
+	EnumeratedValue []svdEnumeratedValue `xml:"enumeratedValue"`
+}
+
+type svdEnumeratedValue struct {
+	Name        string `xml:"name"`
+	Description string `xml:"description,omitempty"`
+	Value       string `xml:"value,omitempty"`
+	IsDefault   bool   `xml:"isDefault,omitempty"`
+}
+
+// ReadSVD parses a CMSIS-SVD file into a DeviceDef, every peripheral is
+// bound at 0 since the svd has the absolute address
+func ReadSVD(r io.Reader) (*DeviceDef, error) {
+	var d svdDevice
+	if err := xml.NewDecoder(r).Decode(&d); err != nil {
+		return nil, fmt.Errorf("unable to parse svd: %v", err)
+	}
+	device := &DeviceDef{
+		Vendor:       d.Vendor,
+		VendorID:     d.VendorID,
+		Name:         d.Name,
+		Series:       d.Series,
+		Description:  strings.TrimSpace(d.Description),
+		LicenseText:  d.LicenseText,
+		NumCores:     1,
+		MMIOBindings: map[string]int{},
+		Peripheral:   map[string]*PeripheralDef{},
+	}
+	device.Version, _ = strconv.Atoi(d.Version) //svd versions are often "1.2"
+	if d.CPU != nil {
+		device.Cpu = CPUDef{
+			Name:          d.CPU.Name,
+			Revision:      d.CPU.Revision,
+			LittleEndian:  d.CPU.Endian == "little",
+			FPUPresent:    d.CPU.FPUPresent,
+			DSPPresent:    d.CPU.DSPPresent,
+			ICachePresent: d.CPU.ICachePresent,
+			DCachePresent: d.CPU.DCachePresent,
+		}
+		if d.CPU.DeviceNumInterrupts != "" {
+			n, err := parseSVDInt(d.CPU.DeviceNumInterrupts)
+			if err != nil {
+				return nil, fmt.Errorf("cpu: %v", err)
+			}
+			device.Cpu.DeviceNumInterrupts = n
+		}
+	}
+	byName := map[string]*svdPeripheral{}
+	for _, p := range d.Peripherals {
+		byName[p.Name] = p
+	}
+	for _, p := range d.Peripherals {
+		def, err := readSVDPeripheral(p, byName, d.svdRegisterProperties)
+		if err != nil {
+			return nil, fmt.Errorf("peripheral %s: %v", p.Name, err)
+		}
+		device.Peripheral[p.Name] = def
+		device.MMIOBindings[p.Name] = 0
+	}
+	renameSVDRegisters(device)
+	return device, nil
+}
+
+// renameSVDRegisters makes the register names unique across the device,
+// the generator makes a type for each one and vendors (and derivedFrom)
+// use the same names in lots of peripherals.  A clash gets the
+// peripheral's prependToName, or its name, in front.
+func renameSVDRegisters(device *DeviceDef) {
+	count := map[string]int{}
+	for _, p := range device.Peripheral {
+		for name := range p.Register {
+			count[name]++
+		}
+	}
+	for _, p := range device.Peripheral {
+		prefix := p.PrependToName
+		if prefix == "" {
+			prefix = p.Name
+		}
+		renamed := map[string]*RegisterDef{}
+		for name, r := range p.Register {
+			if count[name] > 1 {
+				r = copyRegister(r)
+				r.Name = prefix + name
+			}
+			renamed[r.Name] = r
+		}
+		p.Register = renamed
+	}
+}
+
+func readSVDPeripheral(p *svdPeripheral, byName map[string]*svdPeripheral,
+	defaults svdRegisterProperties) (*PeripheralDef, error) {
+	base, err := parseSVDInt(p.BaseAddress)
+	if err != nil {
+		return nil, fmt.Errorf("base address: %v", err)
+	}
+	//a derived peripheral is a copy with a new address, anything it sets
+	//itself wins
+	from := p
+	if p.DerivedFrom != "" {
+		var ok bool
+		if from, ok = byName[p.DerivedFrom]; !ok {
+			return nil, fmt.Errorf("derived from unknown peripheral %s", p.DerivedFrom)
+		}
+	}
+	pick := func(mine, theirs string) string {
+		if mine != "" {
+			return mine
+		}
+		return theirs
+	}
+	def := &PeripheralDef{
+		Name:             p.Name,
+		Description:      strings.TrimSpace(pick(p.Description, from.Description)),
+		GroupName:        pick(p.GroupName, from.GroupName),
+		PrependToName:    pick(p.PrependToName, from.PrependToName),
+		AppendToName:     pick(p.AppendToName, from.AppendToName),
+		HeaderStructName: pick(p.HeaderStructName, from.HeaderStructName),
+		AddressBlock:     AddressBlockDef{BaseAddress: base},
+		Register:         map[string]*RegisterDef{},
+	}
+	def.Version, _ = strconv.Atoi(pick(p.Version, from.Version))
+	interrupts := p.Interrupt
+	if len(interrupts) == 0 {
+		interrupts = from.Interrupt
+	}
+	if len(interrupts) > 0 { //we only have room for one
+		v, err := parseSVDInt(interrupts[0].Value)
+		if err != nil {
+			return nil, fmt.Errorf("interrupt %s: %v", interrupts[0].Name, err)
+		}
+		def.Interrupt = InterruptDef{Name: interrupts[0].Name,
+			Description: strings.TrimSpace(interrupts[0].Description), Value: v}
+	}
+	blocks := p.AddressBlock
+	if len(blocks) == 0 {
+		blocks = from.AddressBlock
+	}
+	defaults = mergeSVDProperties(mergeSVDProperties(defaults, from.svdRegisterProperties), p.svdRegisterProperties)
+	registers := p.Registers
+	if registers == nil {
+		registers = from.Registers
+	}
+	if registers != nil && len(registers.Cluster) > 0 {
+		return nil, fmt.Errorf("clusters are not supported")
+	}
+	if registers == nil || len(registers.Register) == 0 {
+		//just memory
+		if len(blocks) > 0 {
+			offset, err := parseSVDInt(blocks[0].Offset)
+			if err != nil {
+				return nil, fmt.Errorf("address block: %v", err)
+			}
+			size, err := parseSVDInt(blocks[0].Size)
+			if err != nil {
+				return nil, fmt.Errorf("address block: %v", err)
+			}
+			def.AddressBlock.BaseAddress += offset
+			def.AddressBlock.Size = size
+			if blocks[0].Usage == "buffer" {
+				def.AddressBlock.Usage = "buffer"
+			}
+		}
+		return def, nil
+	}
+	for _, r := range registers.Register {
+		regs, err := readSVDRegister(r, defaults)
+		if err != nil {
+			return nil, fmt.Errorf("register %s: %v", r.Name, err)
+		}
+		for _, reg := range regs {
+			def.Register[reg.Name] = reg
+			last := reg.AddressOffset
+			if reg.Dim != 0 {
+				last += (reg.Dim - 1) * reg.DimIncrement
+			}
+			if last > def.AddressBlock.Size {
+				def.AddressBlock.Size = last
+			}
+		}
+	}
+	return def, nil
+}
+
+// mergeSVDProperties is p with the things that q sets replaced
+func mergeSVDProperties(p, q svdRegisterProperties) svdRegisterProperties {
+	if q.Size != "" {
+		p.Size = q.Size
+	}
+	if q.Access != "" {
+		p.Access = q.Access
+	}
+	if q.ResetValue != "" {
+		p.ResetValue = q.ResetValue
+	}
+	if q.ResetMask != "" {
+		p.ResetMask = q.ResetMask
+	}
+	return p
+}
+
+// readSVDRegister returns one register, or several if r is a list (a dim
+// without [%s] in the name) since the generator only understands arrays
+func readSVDRegister(r *svdRegister, defaults svdRegisterProperties) ([]*RegisterDef, error) {
+	props := mergeSVDProperties(defaults, r.svdRegisterProperties)
+	fields := []*svdField{}
+	if r.Fields != nil {
+		fields = r.Fields.Field
+	}
+	offset, err := parseSVDInt(r.AddressOffset)
+	if err != nil {
+		return nil, fmt.Errorf("address offset: %v", err)
+	}
+	reg := &RegisterDef{
+		Name:          r.Name,
+		Description:   strings.TrimSpace(r.Description),
+		AddressOffset: offset,
+		Size:          32,
+		Field:         map[string]*FieldDef{},
+	}
+	if props.Size != "" {
+		if reg.Size, err = parseSVDInt(props.Size); err != nil {
+			return nil, fmt.Errorf("size: %v", err)
+		}
+	}
+	if props.Access == "" {
+		//svd's default, unless the fields all say
+		props.Access = "read-write"
+		for _, f := range fields {
+			props.Access = ""
+			if f.Access == "" {
+				props.Access = "read-write"
+				break
+			}
+		}
+	}
+	if reg.Access, err = svdAccess(props.Access); err != nil {
+		return nil, err
+	}
+	if props.ResetValue != "" {
+		if reg.ResetValue, err = parseSVDInt(props.ResetValue); err != nil {
+			return nil, fmt.Errorf("reset value: %v", err)
+		}
+	}
+	if props.ResetMask != "" {
+		if reg.ResetMask, err = parseSVDInt(props.ResetMask); err != nil {
+			return nil, fmt.Errorf("reset mask: %v", err)
+		}
+	}
+	for _, f := range fields {
+		field, err := readSVDField(f)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", f.Name, err)
+		}
+		reg.Field[f.Name] = field
+	}
+	if r.Dim == "" {
+		return []*RegisterDef{reg}, nil
+	}
+	if reg.Dim, err = parseSVDInt(r.Dim); err != nil {
+		return nil, fmt.Errorf("dim: %v", err)
+	}
+	if reg.DimIncrement, err = parseSVDInt(r.DimIncrement); err != nil {
+		return nil, fmt.Errorf("dim increment: %v", err)
+	}
+	indices, err := svdDimIndex(r.DimIndex, reg.Dim)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(r.Name, "[%s]") {
+		//index names that aren't numbers become constants
+		for i, index := range indices {
+			if _, err := strconv.Atoi(index); err != nil {
+				if reg.DimIndices == nil {
+					reg.DimIndices = map[string]int{}
+				}
+				reg.DimIndices[index] = i
+			}
+		}
+		return []*RegisterDef{reg}, nil
+	}
+	result := []*RegisterDef{}
+	for i, index := range indices {
+		copied := copyRegister(reg)
+		copied.Name = strings.Replace(r.Name, "%s", index, 1)
+		copied.AddressOffset += i * reg.DimIncrement
+		copied.Dim, copied.DimIncrement = 0, 0
+		result = append(result, copied)
+	}
+	return result, nil
+}
+
+// svdDimIndex is the names of the elements of an array, dimIndex is a
+// range (0-3, A-D) or a list (A,B,C), numbers from 0 when it isn't given
+func svdDimIndex(s string, dim int) ([]string, error) {
+	result := []string{}
+	switch {
+	case s == "":
+		for i := 0; i < dim; i++ {
+			result = append(result, strconv.Itoa(i))
+		}
+	case strings.Contains(s, "-"):
+		parts := strings.SplitN(s, "-", 2)
+		first, err1 := strconv.Atoi(parts[0])
+		last, err2 := strconv.Atoi(parts[1])
+		if err1 == nil && err2 == nil {
+			for i := first; i <= last; i++ {
+				result = append(result, strconv.Itoa(i))
+			}
+		} else if len(parts[0]) == 1 && len(parts[1]) == 1 {
+			for c := parts[0][0]; c <= parts[1][0]; c++ {
+				result = append(result, string(c))
+			}
+		}
+	default:
+		for _, index := range strings.Split(s, ",") {
+			result = append(result, strings.TrimSpace(index))
+		}
+	}
+	if len(result) != dim {
+		return nil, fmt.Errorf("dim index '%s' does not have %d elements", s, dim)
+	}
+	return result, nil
+}
+
+func readSVDField(f *svdField) (*FieldDef, error) {
+	var msb, lsb int
+	var err error
+	switch {
+	case f.BitRange != "":
+		if _, err = fmt.Sscanf(f.BitRange, "[%d:%d]", &msb, &lsb); err != nil {
+			return nil, fmt.Errorf("bit range '%s': %v", f.BitRange, err)
+		}
+	case f.Lsb != "":
+		if lsb, err = parseSVDInt(f.Lsb); err != nil {
+			return nil, fmt.Errorf("lsb: %v", err)
+		}
+		if msb, err = parseSVDInt(f.Msb); err != nil {
+			return nil, fmt.Errorf("msb: %v", err)
+		}
+	default:
+		if lsb, err = parseSVDInt(f.BitOffset); err != nil {
+			return nil, fmt.Errorf("bit offset: %v", err)
+		}
+		width := 1
+		if f.BitWidth != "" {
+			if width, err = parseSVDInt(f.BitWidth); err != nil {
+				return nil, fmt.Errorf("bit width: %v", err)
+			}
+		}
+		msb = lsb + width - 1
+	}
+	if msb > 63 || lsb < 0 || msb < lsb {
+		return nil, fmt.Errorf("bad bit range [%d:%d]", msb, lsb)
+	}
+	field := &FieldDef{
+		Name:        f.Name,
+		Description: strings.TrimSpace(f.Description),
+		BitRange:    BitRange(msb, lsb),
+	}
+	if field.Access, err = svdAccess(f.Access); err != nil {
+		return nil, err
+	}
+	//we don't distinguish between values for reading and writing
+	for _, values := range f.EnumeratedValues {
+		for _, v := range values.EnumeratedValue {
+			if v.IsDefault {
+				continue
+			}
+			n, err := parseSVDInt(v.Value)
+			if err != nil {
+				return nil, fmt.Errorf("enumerated value %s: %v", v.Name, err)
+			}
+			if field.EnumeratedValue == nil {
+				field.EnumeratedValue = map[string]*EnumeratedValueDef{}
+			}
+			field.EnumeratedValue[v.Name] = &EnumeratedValueDef{
+				Name:        v.Name,
+				Description: strings.TrimSpace(v.Description),
+				Value:       n,
+			}
+		}
+	}
+	return field, nil
+}
+
+// svdAccess converts the svd names to ours, write once is just write
+func svdAccess(s string) (AccessDef, error) {
+	switch s {
+	case "":
+		return Access(""), nil
+	case "read-only":
+		return Access("r"), nil
+	case "write-only", "writeOnce":
+		return Access("w"), nil
+	case "read-write", "read-writeOnce":
+		return Access("rw"), nil
+	}
+	return AccessDef{}, fmt.Errorf("unknown access '%s'", s)
+}
+
+// parseSVDInt understands svd's scaledNonNegativeInteger: decimal, 0x hex,
+// 0b or # binary, with an optional k, M, G or T
+func parseSVDInt(s string) (int, error) {
+	s = strings.TrimPrefix(strings.TrimSpace(s), "+")
+	if s == "" {
+		return 0, fmt.Errorf("missing number")
+	}
+	scale := uint64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		scale = 1 << 10
+	case 'm', 'M':
+		scale = 1 << 20
+	case 'g', 'G':
+		scale = 1 << 30
+	case 't', 'T':
+		scale = 1 << 40
+	}
+	if scale != 1 && !strings.HasPrefix(strings.ToLower(s), "0x") {
+		s = s[:len(s)-1]
+	}
+	base := 10
+	lower := strings.ToLower(s)
+	switch {
+	case strings.HasPrefix(lower, "0x"):
+		base, s = 16, s[2:]
+	case strings.HasPrefix(lower, "0b"):
+		base, s = 2, s[2:]
+	case strings.HasPrefix(s, "#"):
+		base, s = 2, s[1:]
+	}
+	n, err := strconv.ParseUint(s, base, 64)
+	if err != nil {
+		return 0, fmt.Errorf("bad number '%s'", s)
+	}
+	return int(n * scale), nil
+}
+
+// WriteSVD writes device as CMSIS-SVD.  Like the generator, peripherals
+// without an MMIOBinding are left out.
+func WriteSVD(device DeviceDef, w io.Writer) error {
+	d := svdDevice{
+		SchemaVersion:   "1.3",
+		Vendor:          device.Vendor,
+		VendorID:        device.VendorID,
+		Name:            device.Name,
+		Series:          device.Series,
+		Version:         strconv.Itoa(device.Version),
+		Description:     strings.TrimSpace(device.Description),
+		LicenseText:     strings.TrimSpace(device.LicenseText),
+		AddressUnitBits: "8",
+		Width:           "32",
+		svdRegisterProperties: svdRegisterProperties{
+			Size:       "32",
+			ResetValue: "0x0",
+			ResetMask:  "0xffffffff",
+		},
+		CPU: &svdCPU{
+			Name:          device.Cpu.Name,
+			Revision:      device.Cpu.Revision,
+			Endian:        "big",
+			FPUPresent:    device.Cpu.FPUPresent,
+			DSPPresent:    device.Cpu.DSPPresent,
+			ICachePresent: device.Cpu.ICachePresent,
+			DCachePresent: device.Cpu.DCachePresent,
+			NVICPrioBits:  "0",
+		},
+	}
+	if device.Cpu.LittleEndian {
+		d.CPU.Endian = "little"
+	}
+	if device.Cpu.DeviceNumInterrupts != 0 {
+		d.CPU.DeviceNumInterrupts = strconv.Itoa(device.Cpu.DeviceNumInterrupts)
+	}
+	names := []string{}
+	for name := range device.Peripheral {
+		if _, ok := device.MMIOBindings[name]; ok {
+			names = append(names, name)
+		}
+	}
+	base := func(name string) int {
+		return device.MMIOBindings[name] + device.Peripheral[name].AddressBlock.BaseAddress
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return base(names[i]) < base(names[j])
+	})
+	for _, name := range names {
+		d.Peripherals = append(d.Peripherals, writeSVDPeripheral(name, base(name), device.Peripheral[name]))
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+func writeSVDPeripheral(name string, base int, p *PeripheralDef) *svdPeripheral {
+	result := &svdPeripheral{
+		Name:             name,
+		Description:      strings.TrimSpace(p.Description),
+		GroupName:        p.GroupName,
+		PrependToName:    p.PrependToName,
+		AppendToName:     p.AppendToName,
+		HeaderStructName: p.HeaderStructName,
+		BaseAddress:      fmt.Sprintf("0x%08x", base),
+	}
+	if p.Version != 0 {
+		result.Version = strconv.Itoa(p.Version)
+	}
+	if p.Interrupt.Name != "" {
+		result.Interrupt = []svdInterrupt{{Name: p.Interrupt.Name,
+			Description: p.Interrupt.Description, Value: strconv.Itoa(p.Interrupt.Value)}}
+	}
+	block := svdAddressBlock{Offset: "0x0", Size: fmt.Sprintf("0x%x", p.AddressBlock.Size), Usage: "registers"}
+	if p.AddressBlock.Usage == "buffer" || p.AddressBlock.Usage == "memory" {
+		block.Usage = "buffer" //svd has nothing for normal memory
+	}
+	if len(p.Register) == 0 {
+		result.AddressBlock = []svdAddressBlock{block}
+		return result
+	}
+	names := []string{}
+	for name := range p.Register {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := p.Register[names[i]], p.Register[names[j]]
+		if a.AddressOffset == b.AddressOffset {
+			return names[i] < names[j] //not right, but the same every time
+		}
+		return a.AddressOffset < b.AddressOffset
+	})
+	end := 0
+	result.Registers = &svdRegisters{}
+	for _, name := range names {
+		r := p.Register[name]
+		result.Registers.Register = append(result.Registers.Register, writeSVDRegister(name, r))
+		last := r.AddressOffset + 4
+		if r.Dim != 0 {
+			last += (r.Dim - 1) * r.DimIncrement
+		}
+		if last > end {
+			end = last
+		}
+	}
+	block.Size = fmt.Sprintf("0x%x", end)
+	result.AddressBlock = []svdAddressBlock{block}
+	return result
+}
+
+func writeSVDRegister(name string, r *RegisterDef) *svdRegister {
+	result := &svdRegister{
+		Name:          name,
+		Description:   strings.TrimSpace(r.Description),
+		AddressOffset: fmt.Sprintf("0x%x", r.AddressOffset),
+		svdRegisterProperties: svdRegisterProperties{
+			Access: svdAccessName(r.Access),
+		},
+	}
+	if len(r.Field) == 0 && !r.Access.IsSet() {
+		result.Access = "read-write" //what the generator does
+	}
+	//no size, the generator makes every register 32 bits whatever Size says
+	if r.ResetValue != 0 {
+		result.ResetValue = fmt.Sprintf("0x%x", r.ResetValue)
+	}
+	if r.ResetMask != 0 && r.ResetMask != 0xffffffff {
+		result.ResetMask = fmt.Sprintf("0x%x", r.ResetMask)
+	}
+	if r.Dim != 0 {
+		//we don't need the [%s] to make an array, svd does
+		if !strings.Contains(name, "%s") {
+			result.Name = name + "[%s]"
+		}
+		result.Dim = strconv.Itoa(r.Dim)
+		result.DimIncrement = fmt.Sprintf("0x%x", r.DimIncrement)
+		if len(r.DimIndices) == r.Dim {
+			indices := make([]string, r.Dim)
+			for index, i := range r.DimIndices {
+				indices[i] = index
+			}
+			result.DimIndex = strings.Join(indices, ",")
+		}
+	}
+	names := []string{}
+	for name := range r.Field {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := r.Field[names[i]], r.Field[names[j]]
+		if a.BitRange.Lsb == b.BitRange.Lsb {
+			return names[i] < names[j]
+		}
+		return a.BitRange.Lsb < b.BitRange.Lsb
+	})
+	for _, name := range names {
+		f := r.Field[name]
+		field := &svdField{
+			Name:        name,
+			Description: strings.TrimSpace(f.Description),
+			BitRange:    f.BitRange.String(),
+			Access:      svdAccessName(f.Access),
+		}
+		if len(f.EnumeratedValue) > 0 {
+			values := svdEnumeratedValues{}
+			for ename, e := range f.EnumeratedValue {
+				values.EnumeratedValue = append(values.EnumeratedValue, svdEnumeratedValue{
+					Name:        ename,
+					Description: strings.TrimSpace(e.Description),
+					Value:       fmt.Sprintf("0x%x", e.Value),
+				})
+			}
+			sort.Slice(values.EnumeratedValue, func(i, j int) bool {
+				a, b := values.EnumeratedValue[i], values.EnumeratedValue[j]
+				if f.EnumeratedValue[a.Name].Value == f.EnumeratedValue[b.Name].Value {
+					return a.Name < b.Name
+				}
+				return f.EnumeratedValue[a.Name].Value < f.EnumeratedValue[b.Name].Value
+			})
+			field.EnumeratedValues = []svdEnumeratedValues{values}
+		}
+		if result.Fields == nil {
+			result.Fields = &svdFields{}
+		}
+		result.Fields.Field = append(result.Fields.Field, field)
+	}
+	return result
+}
+
+// svdAccessName is the svd name for a, empty if it is not set
+func svdAccessName(a AccessDef) string {
+	switch {
+	case !a.IsSet():
+		return ""
+	case a.CanRead() && a.CanWrite():
+		return "read-write"
+	case a.CanWrite():
+		return "write-only"
+	}
+	return "read-only"
+}
@@ -0,0 +1,163 @@
+package sysdec_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"tools/sysdec"
+)
+
+// TestReadVendorSVD reads an svd that uses the things a vendor's file does
+// and ours don't: derivedFrom, properties inherited from the device and
+// peripheral, the other ways to give a field's bits, lists, dimIndex and
+// svd's numbers
+func TestReadVendorSVD(t *testing.T) {
+	f, err := os.Open("testdata/vendor.svd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	device, err := sysdec.ReadSVD(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if device.Name != "EX32" || device.Version != 0 || device.Cpu.DeviceNumInterrupts != 32 ||
+		!device.Cpu.LittleEndian || !device.Cpu.FPUPresent {
+		t.Errorf("unexpected device %s, version %d, cpu %+v", device.Name, device.Version, device.Cpu)
+	}
+	if len(device.Peripheral) != 3 {
+		t.Fatalf("expected 3 peripherals but got %d", len(device.Peripheral))
+	}
+
+	timer0, timer1 := device.Peripheral["TIMER0"], device.Peripheral["TIMER1"]
+	if timer0.AddressBlock.BaseAddress != 0x4001_0000 || timer1.AddressBlock.BaseAddress != 0x4001_1000 ||
+		device.MMIOBindings["TIMER1"] != 0 {
+		t.Errorf("unexpected timers at 0x%x and 0x%x", timer0.AddressBlock.BaseAddress,
+			timer1.AddressBlock.BaseAddress)
+	}
+	//the last register is IN2
+	if timer0.AddressBlock.Size != 0x3c || timer1.AddressBlock.Size != 0x3c {
+		t.Errorf("unexpected sizes 0x%x and 0x%x", timer0.AddressBlock.Size, timer1.AddressBlock.Size)
+	}
+	//derived, with its own interrupt (TIMER0's second is dropped)
+	if timer1.Description != "General purpose timer" || timer1.GroupName != "TIMER" || timer1.Version != 2 {
+		t.Errorf("TIMER1 didn't get TIMER0's description, group and version: %+v", timer1)
+	}
+	if timer0.Interrupt.Value != 5 || timer0.Interrupt.Name != "TIMER0" ||
+		timer1.Interrupt.Value != 7 || timer1.Interrupt.Name != "TIMER1" {
+		t.Errorf("unexpected interrupts %+v and %+v", timer0.Interrupt, timer1.Interrupt)
+	}
+
+	//both timers have every register, so they are renamed
+	for _, test := range []struct {
+		name                string
+		offset, size        int
+		read, write         bool
+		reset, mask         int
+		dim, dimIncrement   int
+		dimIndices          map[string]int
+		peripheral, renamed string
+	}{
+		{name: "CTRL", offset: 0x0, size: 32, read: true, write: true, reset: 5, mask: 0xffffffff},
+		{name: "STATUS", offset: 0x4, size: 32, read: true, reset: 0x10, mask: 0xffffffff},
+		{name: "KEY", offset: 0x8, size: 16, write: true, reset: 0x10, mask: 0xffffffff},
+		{name: "CC[%s]", offset: 0x10, size: 32, read: true, write: true, reset: 0x10, mask: 0xffffffff,
+			dim: 4, dimIncrement: 4},
+		{name: "CHA", offset: 0x20, size: 32, read: true, write: true, reset: 0x10, mask: 0xffffffff},
+		{name: "CHB", offset: 0x24, size: 32, read: true, write: true, reset: 0x10, mask: 0xffffffff},
+		{name: "CHC", offset: 0x28, size: 32, read: true, write: true, reset: 0x10, mask: 0xffffffff},
+		{name: "OUT[%s]", offset: 0x30, size: 32, read: true, write: true, reset: 0x10, mask: 0xffffffff,
+			dim: 2, dimIncrement: 4, dimIndices: map[string]int{"A": 0, "B": 1}},
+		{name: "IN1", offset: 0x38, size: 32, read: true, write: true, reset: 0x10, mask: 0xffffffff},
+		{name: "IN2", offset: 0x3c, size: 32, read: true, write: true, reset: 0x10, mask: 0xffffffff},
+		//TIMER1 is read only, except where the register says
+		{peripheral: "TIMER1", name: "CTRL", offset: 0x0, size: 32, read: true, reset: 5, mask: 0xffffffff},
+		{peripheral: "TIMER1", name: "KEY", offset: 0x8, size: 16, write: true, reset: 0x10, mask: 0xffffffff},
+		{peripheral: "TIMER1", name: "CHB", offset: 0x24, size: 32, read: true, reset: 0x10, mask: 0xffffffff},
+	} {
+		if test.peripheral == "" {
+			test.peripheral = "TIMER0"
+		}
+		name := test.peripheral + test.name
+		r, ok := device.Peripheral[test.peripheral].Register[name]
+		if !ok {
+			t.Errorf("%s: missing", name)
+			continue
+		}
+		if r.Name != name || r.AddressOffset != test.offset || r.Size != test.size ||
+			r.Access.CanRead() != test.read || r.Access.CanWrite() != test.write ||
+			r.ResetValue != test.reset || r.ResetMask != test.mask ||
+			r.Dim != test.dim || r.DimIncrement != test.dimIncrement {
+			t.Errorf("%s: unexpected %+v", name, r)
+		}
+		if len(r.DimIndices) != len(test.dimIndices) {
+			t.Errorf("%s: expected dim indices %v but got %v", name, test.dimIndices, r.DimIndices)
+		}
+		for index, i := range test.dimIndices {
+			if r.DimIndices[index] != i {
+				t.Errorf("%s: expected dim indices %v but got %v", name, test.dimIndices, r.DimIndices)
+			}
+		}
+	}
+
+	for _, ctrl := range []*sysdec.RegisterDef{timer0.Register["TIMER0CTRL"], timer1.Register["TIMER1CTRL"]} {
+		for name, bits := range map[string]sysdec.BitRangeDef{
+			"EN":       sysdec.BitRange(0, 0), //bitOffset without a bitWidth
+			"MODE":     sysdec.BitRange(2, 1), //bitOffset and bitWidth
+			"PRESCALE": sysdec.BitRange(7, 4), //lsb and msb
+			"IRQEN":    sysdec.BitRange(8, 8), //bitRange
+		} {
+			f, ok := ctrl.Field[name]
+			if !ok || f.BitRange != bits {
+				t.Errorf("%s.%s: expected %+v but got %+v", ctrl.Name, name, bits, f)
+			}
+		}
+		mode := ctrl.Field["MODE"].EnumeratedValue
+		if len(mode) != 3 { //not the default
+			t.Errorf("%s.MODE: expected 3 values but got %d", ctrl.Name, len(mode))
+		}
+		for name, value := range map[string]int{"ONESHOT": 0, "PERIODIC": 1, "CONTINUOUS": 2} {
+			if v, ok := mode[name]; !ok || v.Value != value {
+				t.Errorf("%s.MODE: expected %s to be %d but got %+v", ctrl.Name, name, value, v)
+			}
+		}
+	}
+
+	//no registers, so it is just memory, 4k from its own base plus the offset
+	sram := device.Peripheral["SRAM"]
+	if sram.AddressBlock != (sysdec.AddressBlockDef{BaseAddress: 0x2000_0100, Size: 0x1000, Usage: "buffer"}) {
+		t.Errorf("unexpected SRAM %+v", sram.AddressBlock)
+	}
+
+	//and it makes a machine package that passes the checks
+	for _, p := range sysdec.Check(*device) {
+		t.Errorf("%v", p)
+	}
+	var out bytes.Buffer
+	opts := options("vendor.svd")
+	opts.OutTags = ""
+	if err := sysdec.GenerateDeviceDecls(*device, opts, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, part := range []string{"[4]TIMER0CCDef", "[2]TIMER1OUTDef", "const A = 0"} {
+		if !strings.Contains(out.String(), part) {
+			t.Errorf("expected %q in the output", part)
+		}
+	}
+}
+
+func TestReadSVDCluster(t *testing.T) {
+	svd := `<device><name>C</name><peripherals><peripheral>
+		<name>P</name><baseAddress>0x1000</baseAddress>
+		<registers>
+			<register><name>R</name><addressOffset>0</addressOffset></register>
+			<cluster><name>C</name><addressOffset>4</addressOffset></cluster>
+		</registers>
+	</peripheral></peripherals></device>`
+	_, err := sysdec.ReadSVD(strings.NewReader(svd))
+	if err == nil || !strings.Contains(err.Error(), "clusters are not supported") {
+		t.Errorf("expected clusters to be refused but got %v", err)
+	}
+}
@@ -42,6 +42,8 @@ operations are available.
 
 Currently, the two SPI masters are not described in this document.`,
 	AddressBlock: sysdec.AddressBlockDef{BaseAddress: 0x21_5000, Size: 0x68},
+	Interrupt: sysdec.InterruptDef{Name: "Aux",
+		Description: "the mini uart and both spis, see Aux.IRQ for which", Value: 29},
 	Register: map[string]*sysdec.RegisterDef{
 		"IRQ": {
 			Description: `The IRQ register is used to check any pending
@@ -231,7 +233,7 @@ actually wrong on this one.  Used the known to work values.`,
 					Access:   sysdec.Access("rw"),
 					EnumeratedValue: map[string]*sysdec.EnumeratedValueDef{
 						"SevenBit": {Value: 0b00},
-						"EightBit": {Value: 0b00},
+						"EightBit": {Value: 0b11},
 					},
 				},
 			},
@@ -302,11 +304,12 @@ UART1_CTS [sic?] pin is high`,
 			},
 		},
 		"AuxMUScratch": {
-			Description:   ``,
-			AddressOffset: 0x58,
-			Size:          6,
+			Description: `The AUX_MU_SCRATCH register is a byte of storage.
+ Aux, MU=MinuUART.`,
+			AddressOffset: 0x5C,
+			Size:          8,
 			Field: map[string]*sysdec.FieldDef{
-				"CTS": {
+				"Scratch": {
 					Description: `AUX_MU_SCRATCH is a single byte storage.`,
 					BitRange:    sysdec.BitRange(7, 0),
 					Access:      sysdec.Access("rw"),
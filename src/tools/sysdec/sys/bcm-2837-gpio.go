@@ -15,6 +15,8 @@ Register and the associated clocks. GPIOSetup allows you to choose the
 function for a particular pin and it handles these operations for you.
 `,
 	AddressBlock: sysdec.AddressBlockDef{BaseAddress: 0x20_0000, Size: 0x9C},
+	Interrupt: sysdec.InterruptDef{Name: "GPIO0",
+		Description: "pin events in bank 0, the other banks are 50-52", Value: 49},
 	Register: map[string]*sysdec.RegisterDef{
 		"FSel[%s]": {
 			Description: `The function select registers are used to define 
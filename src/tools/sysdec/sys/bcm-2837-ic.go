@@ -2,6 +2,17 @@ package sys
 
 import "tools/sysdec"
 
+// ICBanks are the interrupts of IC, for a DeviceDef's InterruptBank.  The
+// GPU's are 0-63, and the ARM's (the ones in the Basic registers) are 64-71.
+var ICBanks = []sysdec.InterruptBankDef{
+	{Peripheral: "IC", First: 0, Count: 32, Enable: "Enable1", Disable: "Disable1", Pending: "Pending1"},
+	{Peripheral: "IC", First: 32, Count: 32, Enable: "Enable2", Disable: "Disable2", Pending: "Pending2"},
+	{Peripheral: "IC", First: 64, Count: 8, Enable: "EnableBasic", Disable: "DisableBasic", Pending: "BasicPending"},
+}
+
+// RPI3Banks are the IC's interrupts and then core 0's in QA7 (QA7Banks)
+var RPI3Banks = append(append([]sysdec.InterruptBankDef{}, ICBanks...), QA7Banks...)
+
 var IC = &sysdec.PeripheralDef{
 	Version: 1,
 	Description: `Interrupt Controller: Broadcom implementation of the ARM GIC.
@@ -137,11 +148,11 @@ register to be set. That is all bits except . register bits 21..25, 30
 				},
 				"PCM": {
 					Description: ``,
-					BitRange:    sysdec.BitRange(22, 22),
+					BitRange:    sysdec.BitRange(23, 23),
 				},
 				"UART": {
 					Description: `This is not the mini UART, it's UART0.'`,
-					BitRange:    sysdec.BitRange(24, 24),
+					BitRange:    sysdec.BitRange(25, 25),
 				},
 			},
 		},
@@ -235,12 +246,12 @@ here to see if there are interrupts which are pending but not enabled.`,
 				},
 				"PCM": {
 					Description: ``,
-					BitRange:    sysdec.BitRange(22, 22),
+					BitRange:    sysdec.BitRange(23, 23),
 					Access:      sysdec.Access("r"),
 				},
 				"UART": {
 					Description: `This is not the mini UART, it's UART0.'`,
-					BitRange:    sysdec.BitRange(24, 24),
+					BitRange:    sysdec.BitRange(25, 25),
 					Access:      sysdec.Access("r"),
 				},
 			},
@@ -291,14 +302,6 @@ register 1 is set)`,
 					Description: ``,
 					BitRange:    sysdec.BitRange(7, 7),
 				},
-				"MoreBitsSetInPending1": {
-					Description: ``,
-					BitRange:    sysdec.BitRange(8, 8),
-				},
-				"MoreBitsSetInPending2": {
-					Description: ``,
-					BitRange:    sysdec.BitRange(9, 9),
-				},
 			},
 		},
 		"Disable1": {
@@ -356,12 +359,12 @@ All other IRQ enable bits are unaffected.`,
 				},
 				"PCM": {
 					Description: ``,
-					BitRange:    sysdec.BitRange(22, 22),
+					BitRange:    sysdec.BitRange(23, 23),
 					Access:      sysdec.Access("r"),
 				},
 				"UART": {
 					Description: `This is not the mini UART, it's UART0.'`,
-					BitRange:    sysdec.BitRange(24, 24),
+					BitRange:    sysdec.BitRange(25, 25),
 					Access:      sysdec.Access("r"),
 				},
 			},
@@ -409,14 +412,6 @@ register 1 is set)`,
 					Description: ``,
 					BitRange:    sysdec.BitRange(7, 7),
 				},
-				"MoreBitsSetInPending1": {
-					Description: ``,
-					BitRange:    sysdec.BitRange(8, 8),
-				},
-				"MoreBitsSetInPending2": {
-					Description: ``,
-					BitRange:    sysdec.BitRange(9, 9),
-				},
 			},
 		},
 	},
@@ -0,0 +1,68 @@
+package sys
+
+import "tools/sysdec"
+
+var PM = &sysdec.PeripheralDef{
+	Version: 1,
+	Description: `Power Management: The power manager is not documented in
+the BCM2835 ARM peripherals manual, but the firmware and linux use two of its
+registers as a watchdog.  Once WDOG is loaded with a timeout, it counts down
+and when it reaches zero the chip is reset in the way RSTC says.  Loading
+WDOG again before it gets to zero is how you keep the board alive.
+
+Every write to these registers must have the password (0x5a) in the top
+byte or the write is ignored.  Because of this, the whole register has to be
+written at once (with Set) rather than a field at a time.
+
+The timeout counts ticks of about 16 microseconds, so the most it can be
+is a bit more than 16 seconds.`,
+	AddressBlock: sysdec.AddressBlockDef{BaseAddress: 0x10_0000, Size: 0x24},
+	Register: map[string]*sysdec.RegisterDef{
+		"RSTC": {
+			Description: `Reset control.  The WRCFG field says what happens
+when the watchdog runs out.`,
+			AddressOffset: 0x1c,
+			Size:          32,
+			Access:        sysdec.Access("rw"),
+			Field: map[string]*sysdec.FieldDef{
+				"Passwd": {
+					Description: `Must be 0x5a on every write.`,
+					BitRange:    sysdec.BitRange(31, 24),
+					Access:      sysdec.Access("w"),
+				},
+				"WRCFG": {
+					Description: `What to do when the watchdog gets to zero.
+Keep the other bits of the register as they are when you change this.`,
+					BitRange: sysdec.BitRange(5, 4),
+					Access:   sysdec.Access("rw"),
+					EnumeratedValue: map[string]*sysdec.EnumeratedValueDef{
+						"FullReset": {
+							Description: `Reset the whole chip, as if the
+power had been cycled (but memory is not cleared).`,
+							Value: 2,
+						},
+					},
+				},
+			},
+		},
+		"WDOG": {
+			Description: `Watchdog timer.  Writing a timeout (with the password)
+starts the countdown, reading gives the ticks left.`,
+			AddressOffset: 0x24,
+			Size:          32,
+			Access:        sysdec.Access("rw"),
+			Field: map[string]*sysdec.FieldDef{
+				"Passwd": {
+					Description: `Must be 0x5a on every write.`,
+					BitRange:    sysdec.BitRange(31, 24),
+					Access:      sysdec.Access("w"),
+				},
+				"Timeout": {
+					Description: `Ticks (about 16us each) until the reset.`,
+					BitRange:    sysdec.BitRange(19, 0),
+					Access:      sysdec.Access("rw"),
+				},
+			},
+		},
+	},
+}
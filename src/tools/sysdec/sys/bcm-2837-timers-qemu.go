@@ -19,11 +19,13 @@ and the ARM local timer.`,
 			Description:   `System Timer counter Lower 32 bits`,
 			AddressOffset: 0x4,
 			Size:          32,
+			Access:        sysdec.Access("r"),
 		},
 		"SystemTimerUpper32": {
 			Description:   `System Timer counter Upper 32 bits`,
 			AddressOffset: 0x8,
 			Size:          32,
+			Access:        sysdec.Access("r"),
 		},
 	},
 }
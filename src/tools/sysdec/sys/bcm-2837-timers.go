@@ -23,6 +23,8 @@ service routine then reads the output compare register and adds the appropriate
 offset for the next timer tick. The free running counter is driven by the 
 timer clock and stopped whenever the processor is stopped in debug mode.`,
 	AddressBlock: sysdec.AddressBlockDef{BaseAddress: 0x3000, Size: 0x1C},
+	Interrupt: sysdec.InterruptDef{Name: "SystemTimer1",
+		Description: "Match1, Match3 is 3", Value: 1},
 	Register: map[string]*sysdec.RegisterDef{
 		"CS": {
 			Description: `System Timer Control/Status.  This register is 
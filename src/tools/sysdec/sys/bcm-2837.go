@@ -2,9 +2,13 @@ package sys
 
 import "tools/sysdec"
 
-//
-// This is the parent of the main peripherals, but he doesn't have
-// anything that is directly addressable.
-//
-
-var BCM2837 = &sysdec.PeripheralDef{}
+var BCM2837 = &sysdec.PeripheralDef{
+	Version: 1,
+	Description: `
+This is the parent of the main peripherals, but he doesn't have anything
+that is directly addressable.  His AddressBlock is the whole peripheral
+window, so the memory map has the devices we don't describe (EMMC, USB,
+etc) too.
+`,
+	AddressBlock: sysdec.AddressBlockDef{BaseAddress: 0, Size: 0x100_0000},
+}
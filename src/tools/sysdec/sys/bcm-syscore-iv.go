@@ -11,6 +11,8 @@ the ARM around.
 https://github.com/raspberrypi/firmware/wiki/Mailbox-property-interface
 `,
 	AddressBlock: sysdec.AddressBlockDef{BaseAddress: 0xB880, Size: 0x20},
+	Interrupt: sysdec.InterruptDef{Name: "Mailbox",
+		Description: "the ARM's mailbox, in the basic registers", Value: 65},
 	Register: map[string]*sysdec.RegisterDef{
 		"Receive": {
 			Description:   ``,
@@ -60,3 +62,14 @@ https://github.com/raspberrypi/firmware/wiki/Mailbox-property-interface
 		},
 	},
 }
+
+var VCMemory = &sysdec.PeripheralDef{
+	Version: 1,
+	Description: `
+The top of the ram, below the peripherals, belongs to the VideoCore.  The
+framebuffer it gives us is in here.  Where it really starts depends on gpu_mem
+in config.txt, this is what we assume.  It has no registers, so it only shows
+up in the memory map.
+`,
+	AddressBlock: sysdec.AddressBlockDef{BaseAddress: 0x3c00_0000, Size: 0x300_0000, Usage: "buffer"},
+}
@@ -0,0 +1,30 @@
+package sys
+
+import "tools/sysdec"
+
+//
+// Devices is every system declaration here, by the name you give sysdec.
+// A new board goes in this map, and its declaration can use any of the
+// peripherals in this package.
+//
+
+var Devices = map[string]*sysdec.DeviceDef{
+	"rpi3":      &RPI3,
+	"rpi3_qemu": &RPI3Qemu5,
+}
+
+// Peripherals is every peripheral declared here, by the name of its var,
+// so that sysdec can find the ones in a file (to diff two of them).
+var Peripherals = map[string]*sysdec.PeripheralDef{
+	"Aux":             Aux,
+	"BCM2837":         BCM2837,
+	"EMCC":            EMCC,
+	"GPIO":            GPIO,
+	"GPUMailbox":      GPUMailbox,
+	"IC":              IC,
+	"PM":              PM,
+	"QA7":             QA7,
+	"SystemTimer":     SystemTimer,
+	"SystemTimerQEMU": SystemTimerQEMU,
+	"VCMemory":        VCMemory,
+}
@@ -2,6 +2,15 @@ package sys
 
 import "tools/sysdec"
 
+// QA7Banks are core 0's interrupts in QA7, for a DeviceDef's InterruptBank
+// after the IC's, so bit 0 of IRQSource is 72.  They are turned on where
+// they come from (the local timer in LocalTimerControl) and sent to core 0
+// by LocalInterrupt and GPUInterruptRouting, so there is no Enable or
+// Disable.  The GPU's bit (80) is every interrupt of the IC.
+var QA7Banks = []sysdec.InterruptBankDef{
+	{Peripheral: "QA7", First: 72, Count: 12, Pending: "IRQSource[0]"},
+}
+
 var QA7 = &sysdec.PeripheralDef{
 	Version: 1,
 	Description: `
@@ -11,6 +20,8 @@ core with this peripheral or no interrupts will arrive at your core.
 
 https://www.raspberrypi.org/documentation/hardware/raspberrypi/bcm2836/QA7_rev3.4.pdf`,
 	AddressBlock: sysdec.AddressBlockDef{BaseAddress: 0x0, Size: 0x100},
+	Interrupt: sysdec.InterruptDef{Name: "LocalTimer",
+		Description: "core 0's, see QA7Banks", Value: 83},
 	Register: map[string]*sysdec.RegisterDef{
 		"Control": {
 			Description: `The control register is currently only used to 
@@ -72,6 +83,7 @@ error of 8.9E-9 which is much lower than any ordinary crystal oscillator
 produces. Do not use timer values >2^31 (2147483648)`,
 			AddressOffset: 0x08,
 			Size:          32,
+			Access:        sysdec.Access("rw"),
 		},
 		"GPUInterruptRouting": {
 			Description: `This is how to connect the interrupt controller
@@ -96,7 +108,7 @@ possible GPU-IRQ/GPU-FIQ interrupt outstanding bit. `,
 					},
 				},
 				"GPUIRQRouting": {
-					BitRange: sysdec.BitRange(2, 1),
+					BitRange: sysdec.BitRange(1, 0),
 					EnumeratedValue: map[string]*sysdec.EnumeratedValueDef{
 						"IRQToCore0": {Value: 0b00},
 						"IRQToCore1": {Value: 0b01},
@@ -1,5 +1,3 @@
-// +build feelings_rpi3
-
 package sys
 
 import "tools/sysdec"
@@ -47,21 +45,27 @@ var RPI3 = sysdec.DeviceDef{
 		DeviceNumInterrupts: 2 /*FIQ+IRQ*/ * (64 /*GPU*/ + 16 /*ARM Chip*/),
 	},
 	Peripheral: map[string]*sysdec.PeripheralDef{
-		"SOC":         BCM2837, //just for completeness
+		"SOC":         BCM2837, //all of the peripheral window
 		"IC":          IC,
 		"Aux":         Aux,
 		"QA7":         QA7,
 		"GPUMailbox":  GPUMailbox,
+		"VCMemory":    VCMemory,
+		"PM":          PM,
 		"GPIO":        GPIO,
 		"SystemTimer": SystemTimer,
 	},
-	NumCores: 4,
+	InterruptBank: RPI3Banks,
+	NumCores:      4,
 	MMIOBindings: map[string]int{
+		"SOC":         0x3f00_0000,
 		"IC":          0x3f00_0000,
 		"Aux":         0x3f00_0000,
 		"SystemTimer": 0x3f00_0000,
 		"QA7":         0x4000_0000,
 		"GPUMailbox":  0x3f00_0000,
+		"VCMemory":    0,
+		"PM":          0x3f00_0000,
 		"GPIO":        0x3f00_0000,
 	},
 }
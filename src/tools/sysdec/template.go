@@ -9,14 +9,14 @@ xxxblankxxx
 //
 // DO NOT EDIT THIS FILE!  YOUR CHANGES WILL BE OVERWRITTEN!
 // 
-// This file was machine generated from the system description file
+// This file was machine generated from the system description
 // '{{.SourceFilename}}'.  You can obtain the latest version of sysdec
 // and the system description files at 
 // github.com/iansmith/feelings/src/tools/sysdec
 //
 
 package {{.Package}} 
-import "{{.Import}}"
+import volatile "{{.Import}}"
 import "unsafe"
 `
 
@@ -39,6 +39,20 @@ type {{printf "%sDef" $rdef.Name}} volatile.Register32
 		(*volatile.Register32)(a).SetBits(u)
 	}
 	{{end}} {{/*end of can write test*/}}
+	{{if .Field}}
+	// {{printf "%sValue" $rdef.Name}} is a copy of {{$rdef.Name}}, its field methods change
+	// the copy rather than the register
+	type {{printf "%sValue" $rdef.Name}} uint32
+	{{if and .CanRead .CanWrite}}
+	// Modify reads {{$rdef.Name}}, lets f change the fields and writes it back:
+	// one read and one write for all of them
+	func (a *{{printf "%sDef" $rdef.Name}}) Modify(f func(*{{printf "%sValue" $rdef.Name}})) {
+		v := {{printf "%sValue" $rdef.Name}}((*volatile.Register32)(a).Get())
+		f(&v)
+		(*volatile.Register32)(a).Set(uint32(v))
+	}
+	{{end}} {{/*end of read and write test*/}}
+	{{end}} {{/*end of has fields*/}}
 
 {{end}} {{/*closes registers*/}}
 {{end}} {{/*closes peripherals*/}}
@@ -49,9 +63,14 @@ var deviceTemplateText = `
 //                             PERIPHERALS
 {{/* Emit the struct for each peripheral */}}
 {{range $pname,$pdef := .Peripheral}}
+{{if $pdef.Register}}
 ///////////////////////////////////////////////////////////////////////
 {{$pdef.Description}}
+{{if $.Mock}}
+var {{$pdef.Name}} *{{printf "%sDef" $pdef.Name}} = (*{{printf "%sDef" $pdef.Name}})(volatile.Map("{{$pdef.Name}}", {{printf "0x%x" .MMIOBase}} + {{printf "0x%x" .AddressBlock.BaseAddress}}, unsafe.Sizeof({{printf "%sDef" $pdef.Name}}{})))
+{{else}}
 var {{$pdef.Name}} *{{printf "%sDef" $pdef.Name}} = (*{{printf "%sDef" $pdef.Name}})(unsafe.Pointer(uintptr({{printf "0x%x" .MMIOBase}} + {{printf "0x%x" .AddressBlock.BaseAddress}})))
+{{end}}
 
 type {{printf "%sDef" $pdef.Name}} struct {
 	{{- range $rindex, $rdef := $pdef.RegistersWithReserved}}
@@ -66,54 +85,92 @@ type {{printf "%sDef" $pdef.Name}} struct {
 		{{end}} {{/*closes if statement for IsReserved */}}
 	{{end}} {{/* closes registers with reserved */}} 
 } {{/* closes struct of peripheral */}}
+{{end}} {{/* closes if it has registers */}}
 {{end}} {{/* end of peripherals */}}
 ///////////////////////////////////////////////////////////////////////
 
 `
 
 var bitFieldDeclTemplateText = `
+{{$mask := printf "0x%x" .BitRange.Mask}}
+{{$type := printf "%s%s" .RegName .Name}}
+{{/* the values, and a type for them */}}
+{{if .EnumeratedValue}}
+// {{$type}} is the values of the {{.Name}} field of {{.RegName}}
+type {{$type}} uint32
+
+const (
+{{- range .EnumeratedValue}}
+	{{$type}}{{.Name}} {{$type}} = {{.Value}}
+{{- end}}
+)
+{{end}} {{/*end of the enum type*/}}
+
 {{if .CanRead}}
 {{if eq .BitRange.Width 1}}
 func (a *{{printf "%sDef" .RegName}}) {{printf "%sIsSet" .Name}}() bool {
-	b:=volatile.BitField{ Msb:{{ .BitRange.Msb}}, Lsb:{{ .BitRange.Lsb}}, Ptr:(*volatile.Register32)(a)}
-	return b.HasBits()
+	return (*volatile.Register32)(a).HasBits(1 << {{.BitRange.Lsb}})
 }
-{{else}}
-func (a *{{printf "%sDef" .RegName}}) {{.Name}} () uint32 {
-	b:=volatile.BitField{ Msb:{{ .BitRange.Msb}}, Lsb:{{ .BitRange.Lsb }} ,Ptr:(*volatile.Register32)(a)}
-	return b.Get()
+func (v *{{printf "%sValue" .RegName}}) {{printf "%sIsSet" .Name}}() bool {
+	return uint32(*v)&(1 << {{.BitRange.Lsb}}) != 0
 }
 {{end}} {{/*end of the bit width is 1*/}}
+{{if .EnumeratedValue}}
+func (a *{{printf "%sDef" .RegName}}) {{.Name}}() {{$type}} {
+	return {{$type}}(((*volatile.Register32)(a).Get() >> {{.BitRange.Lsb}}) & {{$mask}})
+}
+func (v *{{printf "%sValue" .RegName}}) {{.Name}}() {{$type}} {
+	return {{$type}}((uint32(*v) >> {{.BitRange.Lsb}}) & {{$mask}})
+}
+{{else if gt .BitRange.Width 1}}
+func (a *{{printf "%sDef" .RegName}}) {{.Name}}() uint32 {
+	return ((*volatile.Register32)(a).Get() >> {{.BitRange.Lsb}}) & {{$mask}}
+}
+func (v *{{printf "%sValue" .RegName}}) {{.Name}}() uint32 {
+	return (uint32(*v) >> {{.BitRange.Lsb}}) & {{$mask}}
+}
+{{end}} {{/*end of the getter for the value*/}}
+{{range .EnumeratedValue}}
+func (a *{{printf "%sDef" .Field.RegName}}) {{.Name}}() bool {
+	return a.{{.Field.Name}}() == {{$type}}{{.Name}}
+}
+func (v *{{printf "%sValue" .Field.RegName}}) {{.Name}}() bool {
+	return v.{{.Field.Name}}() == {{$type}}{{.Name}}
+}
+{{end}} {{/*closes enumerated values*/}}
 {{end}} {{/*end of can read */}}
 
 {{if .CanWrite}}
-{{if eq .BitRange.Width 1}} 
+{{if eq .BitRange.Width 1}}
 func (a *{{printf "%sDef" .RegName}}) {{printf "Set%s" .Name}}() {
-	b:=volatile.BitField{ Msb:{{ .BitRange.Msb}}, Lsb:{{ .BitRange.Lsb}},Ptr:(*volatile.Register32)(a)}
-	b.Set()
+	(*volatile.Register32)(a).SetBits(1 << {{.BitRange.Lsb}})
 }
 func (a *{{printf "%sDef" .RegName}}) {{printf "Clear%s" .Name}}() {
-	b:=volatile.BitField{ Msb:{{ .BitRange.Msb}}, Lsb:{{ .BitRange.Lsb}},Ptr: (*volatile.Register32)(a)}
-	b.Clear()
+	(*volatile.Register32)(a).ClearBits(1 << {{.BitRange.Lsb}})
+}
+func (v *{{printf "%sValue" .RegName}}) {{printf "Set%s" .Name}}() {
+	*v |= 1 << {{.BitRange.Lsb}}
+}
+func (v *{{printf "%sValue" .RegName}}) {{printf "Clear%s" .Name}}() {
+	*v &^= 1 << {{.BitRange.Lsb}}
 }
 {{else}}
-func (a *{{printf "%sDef" .RegName}}) {{printf "Set%s" .Name}}(v uint32) {
-	b:=volatile.BitField{ Msb:{{ .BitRange.Msb}}, Lsb:{{ .BitRange.Lsb}}, Ptr:(*volatile.Register32)(a)}
-	b.SetBits(v)
+{{$arg := "uint32"}}{{if .EnumeratedValue}}{{$arg = $type}}{{end}}
+func (a *{{printf "%sDef" .RegName}}) {{printf "Set%s" .Name}}(x {{$arg}}) {
+	(*volatile.Register32)(a).ReplaceBits(uint32(x)&{{$mask}}, {{$mask}}, {{.BitRange.Lsb}})
+}
+func (v *{{printf "%sValue" .RegName}}) {{printf "Set%s" .Name}}(x {{$arg}}) {
+	*v = *v&^({{$mask}} << {{.BitRange.Lsb}}) | {{printf "%sValue" .RegName}}((uint32(x)&{{$mask}}) << {{.BitRange.Lsb}})
 }
 {{end}} {{/*closes if */}}
 
 {{range .EnumeratedValue}}
-{{if .Field.CanRead}}
-func (a *{{printf "%sDef" .Field.RegName}}) {{.Name}}() bool {
-	return (*volatile.Register32)(a).Get()=={{ .Value }}
+func (a *{{printf "%sDef" .Field.RegName}}) {{printf "Set%s" .Name}}() {
+	(*volatile.Register32)(a).ReplaceBits(uint32({{$type}}{{.Name}}), {{$mask}}, {{.Field.BitRange.Lsb}})
 }
-{{end}} {{/* closes if */}}
-{{if .Field.CanWrite}}
-func (a *{{printf "%sDef" .Field.RegName }}) {{ printf "Set%s" .Name }}()  {
-	(*volatile.Register32)(a).SetBits({{ .Value }} << {{.Field.BitRange.Lsb}})
+func (v *{{printf "%sValue" .Field.RegName}}) {{printf "Set%s" .Name}}() {
+	*v = *v&^({{$mask}} << {{.Field.BitRange.Lsb}}) | {{printf "%sValue" .Field.RegName}}(uint32({{$type}}{{.Name}}) << {{.Field.BitRange.Lsb}})
 }
-{{end}} {{/* closes if */}}
 {{end}} {{/*closes enumerated values*/}}
 {{end}} {{/*closes Can write */}}
 `
@@ -124,26 +181,285 @@ const {{$name}} = {{$val}}
 {{end}} {{/*end of constants */}}
 `
 
-var intermediatTemplateText = `// +build {{.InTags}}
-package {{.Pkg}}
-
-import (
-	"flag"
-	"tools/sysdec"
-	"tools/sysdec/sys"
-	{{if .Dump}}
-	"os"
- 	"github.com/davecgh/go-spew/spew"
-	{{end}}
+var memoryMapTemplateText = `
+///////////////////////////////////////////////////////////////////////
+//                             MEMORY MAP
+
+// MemoryAttr is how a region of the memory map should be mapped by the MMU
+type MemoryAttr int
+
+const (
+	MemoryDevice  MemoryAttr = 0 //registers, no gathering, reordering or early write ack
+	MemoryNoCache MemoryAttr = 1 //shared with something that isn't a cpu
+	MemoryNormal  MemoryAttr = 2
 )
-func main() {
-	flag.Parse()
 
-	//generate these based on the input
-	root:=sys.{{.Root}}
-	{{if .Dump}}
-	spew.Fdump(os.Stdout,root)
-	{{end}}
-	sysdec.OutputPeripherals(root,"{{.OutTags}}","{{.Package}}","{{.Import}}","{{.SourceFile}}")
+// MemoryRegionDef is the physical memory used by one peripheral
+type MemoryRegionDef struct {
+	Name string
+	Base uintptr
+	Size uintptr
+	Attr MemoryAttr
+}
+
+// MemoryMapDef is a list of regions, lib/mmu's AddDevices takes one
+type MemoryMapDef []MemoryRegionDef
+
+// MemoryMap is every peripheral of the {{.Name}}, in address order
+var MemoryMap = MemoryMapDef{
+{{- range .MemoryMap}}
+	{Name: "{{.Name}}", Base: {{printf "0x%x" .Base}}, Size: {{printf "0x%x" .Size}}, Attr: {{.Attr}}},
+{{- end}}
+}
+
+// Len is the number of regions
+func (m MemoryMapDef) Len() int {
+	return len(m)
 }
+
+// Region is the i'th region, with its Attr as an int
+func (m MemoryMapDef) Region(i int) (string, uint64, uint64, int) {
+	return m[i].Name, uint64(m[i].Base), uint64(m[i].Size), int(m[i].Attr)
+}
+`
+
+var interruptTemplateText = `
+{{if .Interrupts}}
+///////////////////////////////////////////////////////////////////////
+//                             INTERRUPTS
+
+// IRQ is the number of an interrupt of the {{.Name}}
+type IRQ int
+
+const (
+{{- range .Interrupts}}
+	IRQ{{.Name}} IRQ = {{.Value}} {{if .Description}}//{{.Description}}{{end}}
+{{- end}}
+)
+
+// NumIRQ is one more than the biggest IRQ, the size of an IRQTable
+const NumIRQ = {{.NumInterrupts}}
+
+// IRQNamed is the IRQ called name, IRQAux is "Aux"
+func IRQNamed(name string) (IRQ, bool) {
+	switch name {
+	{{- range .Interrupts}}
+	case "{{.Name}}":
+		return IRQ{{.Name}}, true
+	{{- end}}
+	}
+	return 0, false
+}
+
+// IRQHandler is called with the interrupt that happened
+type IRQHandler func(IRQ)
+
+// IRQTable is the handler for each interrupt, by IRQ
+type IRQTable [NumIRQ]IRQHandler
+
+// Register sets the handler for the interrupt called name, it is false if
+// there is no such interrupt
+func (t *IRQTable) Register(name string, handler IRQHandler) bool {
+	i, ok := IRQNamed(name)
+	if !ok {
+		return false
+	}
+	t[i] = handler
+	return true
+}
+{{if .InterruptBank}}
+// Enable turns on i in the interrupt controller, if its bank has an
+// Enable register
+func (i IRQ) Enable() {
+	switch {
+	{{- range .InterruptBank}}{{if .Enable}}
+	case i >= {{.First}} && i < {{.First}}+{{.Count}}:
+		{{.Peripheral}}.{{.Enable}}.Set(1 << uint(i-{{.First}}))
+	{{- end}}{{end}}
+	}
+}
+
+// Disable turns off i in the interrupt controller, if its bank has a
+// Disable register
+func (i IRQ) Disable() {
+	switch {
+	{{- range .InterruptBank}}{{if .Disable}}
+	case i >= {{.First}} && i < {{.First}}+{{.Count}}:
+		{{.Peripheral}}.{{.Disable}}.Set(1 << uint(i-{{.First}}))
+	{{- end}}{{end}}
+	}
+}
+
+// IsPending is true if i is happening (and is enabled)
+func (i IRQ) IsPending() bool {
+	switch {
+	{{- range .InterruptBank}}
+	case i >= {{.First}} && i < {{.First}}+{{.Count}}:
+		return {{.Peripheral}}.{{.Pending}}.Get()&(1<<uint(i-{{.First}})) != 0
+	{{- end}}
+	}
+	return false
+}
+
+// Dispatch calls the handler of each interrupt that is pending and has
+// one, it returns how many it called
+func (t *IRQTable) Dispatch() int {
+	n := 0
+	{{- range .InterruptBank}}
+	n += t.dispatch({{.Peripheral}}.{{.Pending}}.Get(), {{.First}}, {{.Count}})
+	{{- end}}
+	return n
+}
+
+func (t *IRQTable) dispatch(pending uint32, first IRQ, count int) int {
+	n := 0
+	for bit := 0; bit < count; bit++ {
+		i := first + IRQ(bit)
+		if pending&(1<<uint(bit)) != 0 && t[i] != nil {
+			t[i](i)
+			n++
+		}
+	}
+	return n
+}
+{{end}} {{/*end of banks*/}}
+{{end}} {{/*end of interrupts*/}}
+`
+
+var markdownDocTemplateText = `# {{.Name}} registers
+{{with .Description}}
+{{md .}}
+{{end}}
+| Peripheral | Address | Interrupt |
+|---|---|---|
+{{- range .Peripherals}}
+| [{{.Name}}](#{{lower .Name}}) | {{if .Address}}` + "`{{.Address}}`" + `{{end}} | {{.Interrupt}} |
+{{- end}}
+{{range $p := .Peripherals}}
+## {{.Name}}
+{{if .Address}}
+At ` + "`{{.Address}}`" + `{{if .Interrupt}}, interrupt {{.Interrupt}}{{end}}.
+{{end}}
+{{- with .Description}}
+{{md .}}
+{{end}}
+{{- range .Registers}}
+### {{$p.Name}}.{{.Name}}
+
+Offset ` + "`{{.Offset}}`" + `{{if .Address}}, address ` + "`{{.Address}}`" + `{{end}}, {{.Access}}
+{{- if .Reset}}, reset ` + "`{{.Reset}}`" + `{{end}}.
+{{with .Description}}
+{{md .}}
+{{end}}
+{{- if .Fields}}
+|{{range .Layout}} {{.Bits}} |{{end}}
+|{{range .Layout}}:-:|{{end}}
+|{{range .Layout}} {{.Name}} |{{end}}
+
+{{range .Fields -}}
+* **{{.Name}}** ` + "`{{.Bits}}`" + ` {{.Access}}{{with .Description}}: {{md .}}{{end}}
+{{- range .Enums}}
+  * ` + "`{{.Value}}`" + ` {{.Name}}{{with .Description}}: {{md .}}{{end}}
+{{- end}}
+{{end}}
+{{- end}}
+{{- end}}
+{{- end}}
+`
+
+var htmlDocTemplateText = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}} registers</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: auto; }
+.description { white-space: pre-line; }
+table.bits { border-collapse: collapse; width: 100%; table-layout: fixed; font-size: small; }
+table.bits td { border: 1px solid #888; text-align: center; overflow: hidden; }
+table.bits tr.numbers td { border: none; color: #888; }
+table.bits td.reserved { background: #eee; }
+code { background: #f4f4f4; }
+</style>
+</head>
+<body>
+<h1>{{.Name}} registers</h1>
+{{with .Description}}<p class="description">{{.}}</p>{{end}}
+<table>
+<tr><th>Peripheral</th><th>Address</th><th>Interrupt</th></tr>
+{{- range .Peripherals}}
+<tr><td><a href="#{{.Name}}">{{.Name}}</a></td><td><code>{{.Address}}</code></td><td>{{.Interrupt}}</td></tr>
+{{- end}}
+</table>
+{{range $p := .Peripherals}}
+<h2 id="{{.Name}}">{{.Name}}</h2>
+{{if .Address}}<p>At <code>{{.Address}}</code>{{if .Interrupt}}, interrupt {{.Interrupt}}{{end}}.</p>{{end}}
+{{with .Description}}<p class="description">{{.}}</p>{{end}}
+{{- range .Registers}}
+<h3 id="{{$p.Name}}.{{.Name}}">{{$p.Name}}.{{.Name}}</h3>
+<p>Offset <code>{{.Offset}}</code>{{if .Address}}, address <code>{{.Address}}</code>{{end}}, {{.Access}}
+{{- if .Reset}}, reset <code>{{.Reset}}</code>{{end}}.</p>
+{{with .Description}}<p class="description">{{.}}</p>{{end}}
+{{- if .Fields}}
+<table class="bits">
+<tr class="numbers">{{range .Layout}}<td colspan="{{.Span}}">{{.Bits}}</td>{{end}}</tr>
+<tr>{{range .Layout}}{{if .Name}}<td colspan="{{.Span}}">{{.Name}}</td>{{else}}<td colspan="{{.Span}}" class="reserved"></td>{{end}}{{end}}</tr>
+</table>
+<dl>
+{{- range .Fields}}
+<dt><b>{{.Name}}</b> <code>{{.Bits}}</code> {{.Access}}</dt>
+<dd>{{.Description}}
+{{- if .Enums}}
+<ul>
+{{- range .Enums}}
+<li><code>{{.Value}}</code> {{.Name}}{{with .Description}}: {{.}}{{end}}</li>
+{{- end}}
+</ul>
+{{- end}}
+</dd>
+{{- end}}
+</dl>
+{{- end}}
+{{- end}}
+{{- end}}
+</body>
+</html>
+`
+
+var markdownDiffTemplateText = `# {{.Old}} to {{.New}}
+{{if not .Differences}}
+No differences.
+{{end}}
+{{- range .Differences}}
+* **{{.Where}}** {{.What}}:
+{{- if not .Old}} added, {{md .New}}
+{{- else if not .New}} removed, {{md .Old}}
+{{- else}} {{md .Old}} is now {{md .New}}{{end}}
+{{- end}}
+`
+
+var htmlDiffTemplateText = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Old}} to {{.New}}</title>
+<style>
+body { font-family: sans-serif; max-width: 60em; margin: auto; }
+.old { color: #a00; }
+.new { color: #070; }
+</style>
+</head>
+<body>
+<h1>{{.Old}} to {{.New}}</h1>
+{{if not .Differences}}<p>No differences.</p>{{end}}
+<ul>
+{{- range .Differences}}
+<li><b>{{.Where}}</b> {{.What}}:
+{{- if not .Old}} added, <span class="new">{{.New}}</span>
+{{- else if not .New}} removed, <span class="old">{{.Old}}</span>
+{{- else}} <span class="old">{{.Old}}</span> is now <span class="new">{{.New}}</span>{{end}}</li>
+{{- end}}
+</ul>
+</body>
+</html>
 `
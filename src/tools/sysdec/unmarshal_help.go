@@ -64,6 +64,11 @@ func (b *BitRangeDef) String() string {
 func (b *BitRangeDef) Width() int {
 	return (b.Msb - b.Lsb) + 1
 }
+
+// Mask is the bits of the field, before it is shifted to Lsb
+func (b *BitRangeDef) Mask() uint64 {
+	return 1<<uint(b.Width()) - 1
+}
 func BitRange(Msb int, Lsb int) BitRangeDef {
 	if Msb > 63 || Lsb > 63 || Msb < 0 || Lsb < 0 {
 		panic("BitRange value for Msb/Lsb out of range")
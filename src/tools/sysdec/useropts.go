@@ -5,8 +5,10 @@ type UserOptions struct {
 	Dump          bool
 	Pkg           string
 	InputFilename string
-	InTags        string
 	OutTags       string
 	Import        string
-	Leave         bool
+	SVD           bool       //write CMSIS-SVD instead of go
+	Mock          bool       //registers in a regfile.File, for tests on the host
+	Doc           string     //md or html, write a register reference instead of go
+	Diff          *DeviceDef //with Doc, write the differences from this one instead
 }